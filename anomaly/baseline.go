@@ -0,0 +1,44 @@
+// Package anomaly flags hours whose spend, CTR, CPA or conversions stray from
+// a rolling per campaign/platform baseline.
+package anomaly
+
+import "math"
+
+// Baseline is an EWMA level with additive hour-of-day seasonality and an EWMA
+// of the squared residual, i.e. Holt-Winters without trend.
+type Baseline struct {
+	Level  float64     `json:"level"`
+	Season [24]float64 `json:"season"`
+	Var    float64     `json:"var"`
+	N      int         `json:"n"` // observations so far
+}
+
+// Expected returns the forecast for an hour of day
+func (b *Baseline) Expected(hour int) float64 {
+	return b.Level + b.Season[hour]
+}
+
+// StdDev returns the residual standard deviation, floored at minRel of the
+// expected value so a flat history does not turn every wiggle into an anomaly
+func (b *Baseline) StdDev(hour int, minRel float64) float64 {
+	sd := math.Sqrt(b.Var)
+	if floor := math.Abs(b.Expected(hour)) * minRel; sd < floor {
+		sd = floor
+	}
+	return math.Max(sd, 1e-9)
+}
+
+// Update folds an observation in, alpha smoothing the level and residual
+// variance and gamma the seasonal component
+func (b *Baseline) Update(hour int, obs, alpha, gamma float64) {
+	if b.N == 0 {
+		b.Level = obs
+		b.N = 1
+		return
+	}
+	resid := obs - b.Expected(hour)
+	b.Var = (1 - alpha) * (b.Var + alpha*resid*resid)
+	b.Level = alpha*(obs-b.Season[hour]) + (1-alpha)*b.Level
+	b.Season[hour] = gamma*(obs-b.Level) + (1-gamma)*b.Season[hour]
+	b.N++
+}
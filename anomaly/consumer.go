@@ -0,0 +1,118 @@
+package anomaly
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"campaign-analytics/codec"
+	"campaign-analytics/sink"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// MessageReader is the part of *kafka.Reader the consumer needs
+type MessageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Consumer feeds campaign-data messages to a Detector, storing and emitting
+// the anomalies it raises. Offsets are committed every TickInterval, after the
+// anomalies raised so far and the detector's state are stored; a redelivered
+// hour raises anomalies with the same IDs, which the store ignores. A crash
+// between the state save and the commit counts the redelivered records of the
+// open hours twice.
+//
+// Without States the detector's state is only held in memory: its baselines
+// restart cold, so a partial hour after a restart only feeds the warmup and
+// is never scored.
+type Consumer struct {
+	Reader       MessageReader
+	Detector     *Detector
+	Store        Store
+	States       StateStore     // optional
+	Emit         sink.EventSink // optional
+	TickInterval time.Duration
+}
+
+// Run consumes until ctx is done or storing anomalies or state fails
+func (c *Consumer) Run(ctx context.Context) error {
+	if c.States != nil {
+		states, err := c.States.Load(ctx)
+		if err != nil {
+			return errors.Wrap(err, "load detector state")
+		}
+		c.Detector.Restore(states)
+	}
+	var uncommitted []kafka.Message
+	deadline := time.Now().Add(c.TickInterval)
+	for {
+		fctx, cancel := context.WithDeadline(ctx, deadline)
+		msg, err := c.Reader.FetchMessage(fctx)
+		cancel()
+		switch {
+		case err == nil:
+			uncommitted = append(uncommitted, msg)
+			data, err := codec.DecodeCampaignData(msg)
+			if err != nil {
+				log.Printf("anomaly: skipping invalid message at %s/%d/%d: %v", msg.Topic, msg.Partition, msg.Offset, err)
+				break
+			}
+			if err := c.publish(ctx, c.Detector.Observe(data)); err != nil {
+				return err
+			}
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, context.DeadlineExceeded):
+		default:
+			return errors.Wrap(err, "fetch message")
+		}
+
+		if time.Now().Before(deadline) {
+			continue
+		}
+		if err := c.publish(ctx, c.Detector.Tick()); err != nil {
+			return err
+		}
+		if c.States != nil {
+			if err := c.States.Save(ctx, c.Detector.State()); err != nil {
+				return errors.Wrap(err, "save detector state")
+			}
+		}
+		if len(uncommitted) > 0 {
+			if err := c.Reader.CommitMessages(ctx, uncommitted...); err != nil {
+				return errors.Wrap(err, "commit offsets")
+			}
+			uncommitted = uncommitted[:0]
+		}
+		deadline = time.Now().Add(c.TickInterval)
+	}
+}
+
+func (c *Consumer) publish(ctx context.Context, anomalies []Anomaly) error {
+	if len(anomalies) == 0 {
+		return nil
+	}
+	if err := c.Store.Save(ctx, anomalies); err != nil {
+		return errors.Wrap(err, "save anomalies")
+	}
+	if c.Emit == nil {
+		return nil
+	}
+	msgs := make([]kafka.Message, 0, len(anomalies))
+	for _, a := range anomalies {
+		v, err := json.Marshal(a)
+		if err != nil {
+			return errors.Wrap(err, "encode anomaly")
+		}
+		msgs = append(msgs, kafka.Message{
+			Key:     []byte(a.CampaignID),
+			Value:   v,
+			Headers: []kafka.Header{{Key: "severity", Value: []byte(a.Severity)}},
+		})
+	}
+	return errors.Wrap(c.Emit.Write(ctx, msgs...), "emit anomalies")
+}
@@ -0,0 +1,230 @@
+package anomaly
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"campaign-analytics/rollup"
+	"campaign-analytics/schema"
+)
+
+// Metric is a monitored metric
+type Metric string
+
+const (
+	Spend       Metric = "spend"
+	CTR         Metric = "ctr"
+	CPA         Metric = "cpa"
+	Conversions Metric = "conversions"
+)
+
+// Metrics lists the monitored metrics
+var Metrics = []Metric{Spend, CTR, CPA, Conversions}
+
+// Severity ranks anomalies
+type Severity string
+
+const (
+	Warning  Severity = "warning"
+	Critical Severity = "critical"
+)
+
+// Rank orders severities, 0 for unknown
+func (s Severity) Rank() int {
+	switch s {
+	case Warning:
+		return 1
+	case Critical:
+		return 2
+	}
+	return 0
+}
+
+// Anomaly is an hour whose metric deviates from its baseline
+type Anomaly struct {
+	ID         string    `json:"id"` // stable per campaign, platform, metric and hour
+	CampaignID string    `json:"campaign_id"`
+	Platform   string    `json:"platform"`
+	Metric     Metric    `json:"metric"`
+	Hour       time.Time `json:"hour"`
+	Observed   float64   `json:"observed"`
+	Expected   float64   `json:"expected"`
+	ZScore     float64   `json:"z_score"`
+	Severity   Severity  `json:"severity"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// Config tunes the detector
+type Config struct {
+	Alpha        float64 // level and variance smoothing
+	Gamma        float64 // seasonal smoothing
+	WarmupHours  int     // hours observed before a series can raise anomalies
+	WarningZ     float64
+	CriticalZ    float64
+	MinRelStdDev float64 // see Baseline.StdDev
+	// Grace is how long after its end an hour stays open for late records
+	Grace time.Duration
+}
+
+// DefaultConfig warms up over two days and flags 3 and 5 sigma deviations
+var DefaultConfig = Config{
+	Alpha:        0.1,
+	Gamma:        0.2,
+	WarmupHours:  48,
+	WarningZ:     3,
+	CriticalZ:    5,
+	MinRelStdDev: 0.05,
+	Grace:        10 * time.Minute,
+}
+
+type seriesKey struct{ campaignID, platform string }
+
+type series struct {
+	open       map[time.Time]rollup.Metrics // totals of the hours still open
+	lastClosed time.Time                    // last hour closed, zero before the first close
+	watermark  time.Time                    // latest record time
+	baselines  map[Metric]*Baseline
+	changed    bool // since the last State
+}
+
+func newSeries() *series {
+	return &series{open: make(map[time.Time]rollup.Metrics), baselines: make(map[Metric]*Baseline)}
+}
+
+// Detector aggregates records into hourly totals per campaign and platform
+// and scores each hour against its baseline once the hour closes, Grace after
+// its end. Records for an hour that already closed are dropped. State and
+// Restore carry the series over a restart.
+type Detector struct {
+	cfg     Config
+	series  map[seriesKey]*series
+	Dropped int // late records ignored
+	Skipped int // day totals ignored
+	now     func() time.Time
+}
+
+func NewDetector(cfg Config) *Detector {
+	return &Detector{cfg: cfg, series: make(map[seriesKey]*series), now: time.Now}
+}
+
+// Observe adds a record, returning the anomalies of the hours it closed if
+// any: the hours that ended more than Grace before the latest record of the
+// series. Day totals are skipped: a restated day is not spend of the hour it
+// was fetched.
+func (d *Detector) Observe(data schema.CampaignData) []Anomaly {
+	if data.IsDayTotal() {
+		d.Skipped++
+		return nil
+	}
+	k := seriesKey{data.CampaignID, data.Platform}
+	s := d.series[k]
+	if s == nil {
+		s = newSeries()
+		d.series[k] = s
+	}
+	at := time.Unix(data.Timestamp, 0).UTC()
+	hour := rollup.Hourly.Truncate(at)
+	// An hour past its grace is closed, or would be scored on this record alone
+	if !hour.After(s.lastClosed) || !hour.Add(time.Hour+d.cfg.Grace).After(s.watermark) {
+		d.Dropped++
+		return nil
+	}
+	s.open[hour] = s.open[hour].Add(rollup.MetricsOf(data))
+	s.changed = true
+	if at.After(s.watermark) {
+		s.watermark = at
+	}
+	return d.closeUntil(k, s, s.watermark.Add(-d.cfg.Grace))
+}
+
+// Tick closes the open hours that ended more than Grace ago
+func (d *Detector) Tick() []Anomaly {
+	cutoff := d.now().Add(-d.cfg.Grace)
+	var out []Anomaly
+	for k, s := range d.series {
+		out = append(out, d.closeUntil(k, s, cutoff)...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// closeUntil closes the open hours of s that ended by cutoff, oldest first
+func (d *Detector) closeUntil(k seriesKey, s *series, cutoff time.Time) []Anomaly {
+	var hours []time.Time
+	for h := range s.open {
+		if !h.Add(time.Hour).After(cutoff) {
+			hours = append(hours, h)
+		}
+	}
+	sort.Slice(hours, func(i, j int) bool { return hours[i].Before(hours[j]) })
+	var out []Anomaly
+	for _, h := range hours {
+		out = append(out, d.closeHour(k, s, h)...)
+	}
+	return out
+}
+
+// closeHour scores an open hour of s and folds it into the baselines
+func (d *Detector) closeHour(k seriesKey, s *series, hour time.Time) []Anomaly {
+	var out []Anomaly
+	h := hour.Hour()
+	for m, obs := range observe(s.open[hour]) {
+		b := s.baselines[m]
+		if b == nil {
+			b = &Baseline{}
+			s.baselines[m] = b
+		}
+		if b.N >= d.cfg.WarmupHours {
+			expected := b.Expected(h)
+			z := (obs - expected) / b.StdDev(h, d.cfg.MinRelStdDev)
+			if sev := d.severity(z); sev != "" {
+				out = append(out, Anomaly{
+					ID:         fmt.Sprintf("%s/%s/%s/%d", k.campaignID, k.platform, m, hour.Unix()),
+					CampaignID: k.campaignID,
+					Platform:   k.platform,
+					Metric:     m,
+					Hour:       hour,
+					Observed:   obs,
+					Expected:   expected,
+					ZScore:     z,
+					Severity:   sev,
+					DetectedAt: d.now().UTC(),
+				})
+			}
+		}
+		b.Update(h, obs, d.cfg.Alpha, d.cfg.Gamma)
+	}
+	delete(s.open, hour)
+	s.lastClosed = hour
+	s.changed = true
+	sort.Slice(out, func(i, j int) bool { return out[i].Metric < out[j].Metric })
+	return out
+}
+
+func (d *Detector) severity(z float64) Severity {
+	switch az := math.Abs(z); {
+	case az >= d.cfg.CriticalZ:
+		return Critical
+	case az >= d.cfg.WarningZ:
+		return Warning
+	}
+	return ""
+}
+
+// observe returns the hour's metrics. Ratios are left out when undefined
+// rather than counted as zero.
+func observe(t rollup.Metrics) map[Metric]float64 {
+	obs := map[Metric]float64{
+		Spend:       t.Cost,
+		Conversions: float64(t.Conversions),
+	}
+	if t.Impressions > 0 {
+		obs[CTR] = float64(t.Clicks) / float64(t.Impressions)
+	}
+	if t.Conversions > 0 {
+		obs[CPA] = t.Cost / float64(t.Conversions)
+	}
+	return obs
+}
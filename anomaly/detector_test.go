@@ -0,0 +1,157 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"campaign-analytics/migrate/migratetest"
+	"campaign-analytics/schema"
+)
+
+var start = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+func record(at time.Time, cost float64) schema.CampaignData {
+	return schema.CampaignData{CampaignID: "c1", Platform: "meta", Timestamp: at.Unix(), Impressions: 1000, Clicks: 20, Cost: cost}
+}
+
+// warm feeds hours of spend 100 from start, a record at the half of each, and
+// returns the anomalies raised
+func warm(d *Detector, hours int) []Anomaly {
+	var out []Anomaly
+	for i := 0; i < hours; i++ {
+		out = append(out, d.Observe(record(start.Add(time.Duration(i)*time.Hour+30*time.Minute), 100))...)
+	}
+	return out
+}
+
+func spendAnomalies(as []Anomaly) []Anomaly {
+	var out []Anomaly
+	for _, a := range as {
+		if a.Metric == Spend {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func TestDetectorSpike(t *testing.T) {
+	d := NewDetector(DefaultConfig)
+	if got := warm(d, 60); len(got) != 0 {
+		t.Fatalf("steady hours raised %+v", got)
+	}
+	// Hour 60 spends 10 times as much, scored once hour 61 is past its grace
+	spike := start.Add(60 * time.Hour)
+	d.Observe(record(spike.Add(time.Minute), 1000))
+	if got := d.Observe(record(spike.Add(time.Hour+time.Minute), 100)); len(got) != 0 {
+		t.Fatalf("hour closed within its grace: %+v", got)
+	}
+	got := spendAnomalies(d.Observe(record(spike.Add(time.Hour+DefaultConfig.Grace+time.Minute), 100)))
+	if len(got) != 1 || got[0].Severity != Critical || got[0].Observed != 1000 || !got[0].Hour.Equal(spike) {
+		t.Fatalf("got %+v, want a critical spend anomaly of 1000 at %v", got, spike)
+	}
+	if want := fmt.Sprintf("c1/meta/spend/%d", spike.Unix()); got[0].ID != want {
+		t.Fatalf("ID %q, want %q", got[0].ID, want)
+	}
+}
+
+// Records of the previous hour arriving within Grace still count
+func TestDetectorGrace(t *testing.T) {
+	d := NewDetector(DefaultConfig)
+	warm(d, 60)
+	hour := start.Add(60 * time.Hour)
+	d.Observe(record(hour.Add(50*time.Minute), 500))
+	// The next hour starts, then the rest of the spike arrives late
+	d.Observe(record(hour.Add(time.Hour+time.Minute), 100))
+	d.Observe(record(hour.Add(59*time.Minute), 500))
+	got := spendAnomalies(d.Observe(record(hour.Add(time.Hour+DefaultConfig.Grace), 0)))
+	if len(got) != 1 || got[0].Observed != 1000 {
+		t.Fatalf("got %+v, want the hour's spend of 1000", got)
+	}
+	if d.Dropped != 0 {
+		t.Fatalf("dropped %d records within grace", d.Dropped)
+	}
+
+	// Past its grace, the hour is closed
+	d.Observe(record(hour.Add(30*time.Minute), 100))
+	// An hour without records until past its grace is not scored on a
+	// straggler alone
+	d.Observe(record(hour.Add(3*time.Hour+DefaultConfig.Grace), 100))
+	d.Observe(record(hour.Add(2*time.Hour+time.Minute), 100))
+	if d.Dropped != 2 {
+		t.Fatalf("dropped %d records, want 2", d.Dropped)
+	}
+}
+
+func TestDetectorTick(t *testing.T) {
+	d := NewDetector(DefaultConfig)
+	warm(d, 60)
+	hour := start.Add(60 * time.Hour)
+	d.Observe(record(hour, 1000))
+
+	d.now = func() time.Time { return hour.Add(time.Hour + DefaultConfig.Grace - time.Second) }
+	if got := d.Tick(); len(got) != 0 {
+		t.Fatalf("tick within grace raised %+v", got)
+	}
+	d.now = func() time.Time { return hour.Add(time.Hour + DefaultConfig.Grace) }
+	if got := spendAnomalies(d.Tick()); len(got) != 1 {
+		t.Fatalf("got %+v, want the spike", got)
+	}
+}
+
+func TestDetectorSkipsDayTotals(t *testing.T) {
+	d := NewDetector(DefaultConfig)
+	r := record(start, 100)
+	r.ReportDate, r.Level = start.Format(schema.DateLayout), schema.LevelCampaign
+	if got := d.Observe(r); got != nil || d.Skipped != 1 {
+		t.Fatalf("day total observed: %+v, skipped %d", got, d.Skipped)
+	}
+}
+
+// A detector restored from the state of another goes on like it
+func testRestore(t *testing.T, store StateStore) {
+	ctx := context.Background()
+	d := NewDetector(DefaultConfig)
+	warm(d, 60)
+	hour := start.Add(60 * time.Hour)
+	d.Observe(record(hour.Add(10*time.Minute), 600))
+	if err := store.Save(ctx, d.State()); err != nil {
+		t.Fatal(err)
+	}
+	if st := d.State(); len(st) != 0 {
+		t.Fatalf("unchanged series in state: %+v", st)
+	}
+	states, err := store.Load(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewDetector(DefaultConfig)
+	restored.Restore(states)
+
+	// The closed hours are kept closed
+	restored.Observe(record(hour.Add(-time.Hour), 100))
+	if restored.Dropped != 1 {
+		t.Fatal("restored detector took a record of a closed hour")
+	}
+	var got [2][]Anomaly
+	for i, d := range []*Detector{d, restored} {
+		d.Observe(record(hour.Add(20*time.Minute), 400))
+		got[i] = d.Observe(record(hour.Add(time.Hour+DefaultConfig.Grace), 100))
+		for j := range got[i] {
+			got[i][j].DetectedAt = time.Time{}
+		}
+	}
+	if len(spendAnomalies(got[0])) != 1 || !reflect.DeepEqual(got[0], got[1]) {
+		t.Fatalf("restored detector raised %+v, want %+v", got[1], got[0])
+	}
+}
+
+func TestMemoryStateStore(t *testing.T) {
+	testRestore(t, NewMemoryStateStore())
+}
+
+func TestPostgresStateStore(t *testing.T) {
+	testRestore(t, NewPostgresStateStore(migratetest.DB(t)))
+}
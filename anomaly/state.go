@@ -0,0 +1,191 @@
+package anomaly
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"campaign-analytics/rollup"
+
+	"github.com/pkg/errors"
+)
+
+// SeriesState is what a Detector knows of a campaign and platform: its
+// baselines, the hours still open and the last one closed
+type SeriesState struct {
+	CampaignID string               `json:"campaign_id"`
+	Platform   string               `json:"platform"`
+	LastClosed time.Time            `json:"last_closed"`
+	Watermark  time.Time            `json:"watermark"`
+	Open       []OpenHour           `json:"open,omitempty"`
+	Baselines  map[Metric]*Baseline `json:"baselines"`
+}
+
+// OpenHour holds the totals of an hour not closed yet
+type OpenHour struct {
+	Hour   time.Time      `json:"hour"`
+	Totals rollup.Metrics `json:"totals"`
+}
+
+// State returns the state of the series changed since the last call
+func (d *Detector) State() []SeriesState {
+	var out []SeriesState
+	for k, s := range d.series {
+		if !s.changed {
+			continue
+		}
+		st := SeriesState{
+			CampaignID: k.campaignID,
+			Platform:   k.platform,
+			LastClosed: s.lastClosed,
+			Watermark:  s.watermark,
+			Baselines:  make(map[Metric]*Baseline, len(s.baselines)),
+		}
+		for h, t := range s.open {
+			st.Open = append(st.Open, OpenHour{Hour: h, Totals: t})
+		}
+		sort.Slice(st.Open, func(i, j int) bool { return st.Open[i].Hour.Before(st.Open[j].Hour) })
+		for m, b := range s.baselines {
+			c := *b
+			st.Baselines[m] = &c
+		}
+		out = append(out, st)
+		s.changed = false
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].CampaignID != out[j].CampaignID {
+			return out[i].CampaignID < out[j].CampaignID
+		}
+		return out[i].Platform < out[j].Platform
+	})
+	return out
+}
+
+// Restore replaces the series of states, as saved from State
+func (d *Detector) Restore(states []SeriesState) {
+	for _, st := range states {
+		s := newSeries()
+		s.lastClosed, s.watermark = st.LastClosed.UTC(), st.Watermark.UTC()
+		for _, o := range st.Open {
+			s.open[o.Hour.UTC()] = o.Totals
+		}
+		for m, b := range st.Baselines {
+			c := *b
+			s.baselines[m] = &c
+		}
+		d.series[seriesKey{st.CampaignID, st.Platform}] = s
+	}
+}
+
+// StateStore keeps the series state of a Detector across restarts
+type StateStore interface {
+	Load(ctx context.Context) ([]SeriesState, error)
+	// Save upserts states by campaign and platform
+	Save(ctx context.Context, states []SeriesState) error
+}
+
+// PostgresStateStore keeps series states in the anomaly_series table:
+//
+//	CREATE TABLE anomaly_series (
+//	    campaign_id VARCHAR(255) NOT NULL,
+//	    platform    VARCHAR(50)  NOT NULL,
+//	    state       JSONB        NOT NULL, -- SeriesState
+//	    updated_at  TIMESTAMP    NOT NULL,
+//	    PRIMARY KEY (campaign_id, platform)
+//	);
+type PostgresStateStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStateStore(db *sql.DB) *PostgresStateStore {
+	return &PostgresStateStore{db: db}
+}
+
+func (s *PostgresStateStore) Load(ctx context.Context) ([]SeriesState, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT state FROM anomaly_series ORDER BY campaign_id, platform")
+	if err != nil {
+		return nil, errors.Wrap(err, "query series states")
+	}
+	defer rows.Close()
+	var out []SeriesState
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, errors.Wrap(err, "scan series state")
+		}
+		var st SeriesState
+		if err := json.Unmarshal(b, &st); err != nil {
+			return nil, errors.Wrap(err, "decode series state")
+		}
+		out = append(out, st)
+	}
+	return out, errors.Wrap(rows.Err(), "iterate series states")
+}
+
+func (s *PostgresStateStore) Save(ctx context.Context, states []SeriesState) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `
+INSERT INTO anomaly_series (campaign_id, platform, state, updated_at) VALUES ($1, $2, $3, $4)
+ON CONFLICT (campaign_id, platform) DO UPDATE SET state = EXCLUDED.state, updated_at = EXCLUDED.updated_at`)
+	if err != nil {
+		return errors.Wrap(err, "prepare upsert")
+	}
+	defer stmt.Close()
+	now := time.Now().UTC()
+	for _, st := range states {
+		b, err := json.Marshal(st)
+		if err != nil {
+			return errors.Wrap(err, "encode series state")
+		}
+		if _, err := stmt.ExecContext(ctx, st.CampaignID, st.Platform, b, now); err != nil {
+			return errors.Wrap(err, "upsert series state")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "commit transaction")
+}
+
+// MemoryStateStore keeps series states in memory, for tests and local development
+type MemoryStateStore struct {
+	mu     sync.Mutex
+	states map[seriesKey][]byte
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{states: make(map[seriesKey][]byte)}
+}
+
+func (s *MemoryStateStore) Load(_ context.Context) ([]SeriesState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]SeriesState, 0, len(s.states))
+	for _, b := range s.states {
+		var st SeriesState
+		if err := json.Unmarshal(b, &st); err != nil {
+			return nil, err
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+// Save stores states encoded, like PostgresStateStore, so they share nothing
+// with the Detector
+func (s *MemoryStateStore) Save(_ context.Context, states []SeriesState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range states {
+		b, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		s.states[seriesKey{st.CampaignID, st.Platform}] = b
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package anomaly
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Filter selects stored anomalies. Zero fields match everything.
+type Filter struct {
+	CampaignID  string
+	Platform    string
+	Metric      Metric
+	MinSeverity Severity
+	From, To    time.Time // Hour in [From, To)
+}
+
+func (f Filter) match(a Anomaly) bool {
+	return (f.CampaignID == "" || a.CampaignID == f.CampaignID) &&
+		(f.Platform == "" || a.Platform == f.Platform) &&
+		(f.Metric == "" || a.Metric == f.Metric) &&
+		a.Severity.Rank() >= f.MinSeverity.Rank() &&
+		(f.From.IsZero() || !a.Hour.Before(f.From)) &&
+		(f.To.IsZero() || a.Hour.Before(f.To))
+}
+
+// Store keeps detected anomalies
+type Store interface {
+	// Save stores anomalies, ignoring IDs already stored
+	Save(ctx context.Context, anomalies []Anomaly) error
+	// Query returns the anomalies matching f ordered by hour
+	Query(ctx context.Context, f Filter) ([]Anomaly, error)
+}
+
+// PostgresStore keeps anomalies in the campaign_anomalies table:
+//
+//	CREATE TABLE campaign_anomalies (
+//	    id          VARCHAR(400) PRIMARY KEY,
+//	    campaign_id VARCHAR(255) NOT NULL,
+//	    platform    VARCHAR(50)  NOT NULL,
+//	    metric      VARCHAR(20)  NOT NULL,
+//	    hour        TIMESTAMP    NOT NULL,
+//	    observed    DOUBLE PRECISION NOT NULL,
+//	    expected    DOUBLE PRECISION NOT NULL,
+//	    z_score     DOUBLE PRECISION NOT NULL,
+//	    severity    VARCHAR(10)  NOT NULL,
+//	    detected_at TIMESTAMP    NOT NULL
+//	);
+//	CREATE INDEX campaign_anomalies_campaign_hour ON campaign_anomalies (campaign_id, hour);
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Save(ctx context.Context, anomalies []Anomaly) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `
+INSERT INTO campaign_anomalies
+    (id, campaign_id, platform, metric, hour, observed, expected, z_score, severity, detected_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+ON CONFLICT (id) DO NOTHING`)
+	if err != nil {
+		return errors.Wrap(err, "prepare insert")
+	}
+	defer stmt.Close()
+	for _, a := range anomalies {
+		_, err := stmt.ExecContext(ctx, a.ID, a.CampaignID, a.Platform, string(a.Metric), a.Hour,
+			a.Observed, a.Expected, a.ZScore, string(a.Severity), a.DetectedAt)
+		if err != nil {
+			return errors.Wrap(err, "insert anomaly")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "commit transaction")
+}
+
+func (s *PostgresStore) Query(ctx context.Context, f Filter) ([]Anomaly, error) {
+	severities := []string{string(Warning), string(Critical)}
+	if f.MinSeverity == Critical {
+		severities = severities[1:]
+	}
+	to := f.To
+	if to.IsZero() {
+		to = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	rows, err := s.db.QueryContext(ctx, `
+SELECT id, campaign_id, platform, metric, hour, observed, expected, z_score, severity, detected_at
+FROM campaign_anomalies
+WHERE ($1 = '' OR campaign_id = $1) AND ($2 = '' OR platform = $2) AND ($3 = '' OR metric = $3)
+  AND severity IN ($4, $5) AND hour >= $6 AND hour < $7
+ORDER BY hour, campaign_id, platform, metric`,
+		f.CampaignID, f.Platform, string(f.Metric), severities[0], severities[len(severities)-1], f.From, to)
+	if err != nil {
+		return nil, errors.Wrap(err, "query anomalies")
+	}
+	defer rows.Close()
+
+	var out []Anomaly
+	for rows.Next() {
+		var a Anomaly
+		var metric, severity string
+		err := rows.Scan(&a.ID, &a.CampaignID, &a.Platform, &metric, &a.Hour, &a.Observed, &a.Expected,
+			&a.ZScore, &severity, &a.DetectedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan anomaly")
+		}
+		a.Metric, a.Severity = Metric(metric), Severity(severity)
+		a.Hour = a.Hour.UTC()
+		out = append(out, a)
+	}
+	return out, errors.Wrap(rows.Err(), "iterate anomalies")
+}
+
+// MemoryStore keeps anomalies in memory, for tests and local development
+type MemoryStore struct {
+	mu        sync.RWMutex
+	anomalies map[string]Anomaly
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{anomalies: make(map[string]Anomaly)}
+}
+
+func (s *MemoryStore) Save(_ context.Context, anomalies []Anomaly) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range anomalies {
+		if _, ok := s.anomalies[a.ID]; !ok {
+			s.anomalies[a.ID] = a
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Query(_ context.Context, f Filter) ([]Anomaly, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []Anomaly
+	for _, a := range s.anomalies {
+		if f.match(a) {
+			out = append(out, a)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Hour.Equal(out[j].Hour) {
+			return out[i].Hour.Before(out[j].Hour)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
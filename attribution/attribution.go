@@ -0,0 +1,227 @@
+// Package attribution splits the credit of each conversion over the
+// impressions and clicks that led to it.
+package attribution
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"campaign-analytics/events"
+)
+
+// Model is an attribution model
+type Model string
+
+const (
+	FirstTouch    Model = "first_touch"
+	LastTouch     Model = "last_touch"
+	Linear        Model = "linear"
+	TimeDecay     Model = "time_decay"
+	PositionBased Model = "position_based"
+)
+
+// ParseModel validates a model name, defaulting to LastTouch when empty
+func ParseModel(s string) (Model, error) {
+	switch m := Model(s); m {
+	case "":
+		return LastTouch, nil
+	case FirstTouch, LastTouch, Linear, TimeDecay, PositionBased:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown attribution model %q", s)
+	}
+}
+
+// Config tunes an attribution run
+type Config struct {
+	Model    Model
+	Lookback time.Duration // touches older than this before a conversion are ignored
+	// HalfLife is the age at which a touch gets half the weight of one at the
+	// time of conversion (TimeDecay)
+	HalfLife time.Duration
+	// EndsWeight is the share of the first and of the last touch, the rest being
+	// split evenly over the touches in between (PositionBased)
+	EndsWeight float64
+}
+
+// DefaultConfig is a 30 day lookback, 7 day half-life and 40/20/40 position split
+var DefaultConfig = Config{
+	Model:      LastTouch,
+	Lookback:   30 * 24 * time.Hour,
+	HalfLife:   7 * 24 * time.Hour,
+	EndsWeight: 0.4,
+}
+
+// Credit is the attributed share of conversions and revenue of a campaign channel
+type Credit struct {
+	CampaignID  int64   `json:"campaign_id"`
+	ChannelID   int64   `json:"channel_id"`
+	Conversions float64 `json:"conversions"`
+	Revenue     float64 `json:"revenue"`
+}
+
+// Report is the outcome of an attribution run over conversions in [From, To)
+type Report struct {
+	Model               Model     `json:"model"`
+	LookbackDays        float64   `json:"lookback_days"`
+	From                time.Time `json:"from"`
+	To                  time.Time `json:"to"`
+	Conversions         int       `json:"conversions"`
+	Revenue             float64   `json:"revenue"`
+	Unattributed        int       `json:"unattributed"` // conversions without a touch in the lookback window
+	UnattributedRevenue float64   `json:"unattributed_revenue"`
+	Credits             []Credit  `json:"credits"`
+}
+
+type channelKey struct{ campaignID, channelID int64 }
+
+// Attributor credits conversions one user journey at a time, so the
+// journeys need not be held at once
+type Attributor struct {
+	cfg     Config
+	from    time.Time
+	to      time.Time
+	rep     Report
+	credits map[channelKey]*Credit
+}
+
+func NewAttributor(from, to time.Time, cfg Config) *Attributor {
+	return &Attributor{
+		cfg:     cfg,
+		from:    from,
+		to:      to,
+		rep:     Report{Model: cfg.Model, LookbackDays: cfg.Lookback.Hours() / 24, From: from, To: to},
+		credits: make(map[channelKey]*Credit),
+	}
+}
+
+// Add credits the conversions in [from, to) of one user's events, ordered by time
+func (a *Attributor) Add(journey []events.Event) {
+	for i, conv := range journey {
+		ct := conv.Time()
+		if conv.EventType != events.Conversion || ct.Before(a.from) || !ct.Before(a.to) {
+			continue
+		}
+		a.rep.Conversions++
+		a.rep.Revenue += conv.Revenue
+
+		touches := touchesBefore(journey[:i], ct, a.cfg.Lookback)
+		if len(touches) == 0 {
+			a.rep.Unattributed++
+			a.rep.UnattributedRevenue += conv.Revenue
+			continue
+		}
+		for j, w := range Weights(touches, ct, a.cfg) {
+			if w == 0 {
+				continue
+			}
+			k := channelKey{touches[j].CampaignID, touches[j].ChannelID}
+			c := a.credits[k]
+			if c == nil {
+				c = &Credit{CampaignID: k.campaignID, ChannelID: k.channelID}
+				a.credits[k] = c
+			}
+			c.Conversions += w
+			c.Revenue += w * conv.Revenue
+		}
+	}
+}
+
+// Report returns the credits of the journeys added so far
+func (a *Attributor) Report() Report {
+	rep := a.rep
+	rep.Credits = make([]Credit, 0, len(a.credits))
+	for _, c := range a.credits {
+		rep.Credits = append(rep.Credits, *c)
+	}
+	sort.Slice(rep.Credits, func(i, j int) bool {
+		x, y := rep.Credits[i], rep.Credits[j]
+		if x.CampaignID != y.CampaignID {
+			return x.CampaignID < y.CampaignID
+		}
+		return x.ChannelID < y.ChannelID
+	})
+	return rep
+}
+
+// Attribute credits every conversion in [from, to) of evs, which must be
+// ordered by user then time as returned by events.Store.IterateJourneys
+func Attribute(evs []events.Event, from, to time.Time, cfg Config) Report {
+	a := NewAttributor(from, to, cfg)
+	for start := 0; start < len(evs); {
+		end := start + 1
+		for end < len(evs) && evs[end].UserID == evs[start].UserID {
+			end++
+		}
+		a.Add(evs[start:end])
+		start = end
+	}
+	return a.Report()
+}
+
+// touchesBefore returns the impressions and clicks of prior within lookback of at
+func touchesBefore(prior []events.Event, at time.Time, lookback time.Duration) []events.Event {
+	var out []events.Event
+	cutoff := at.Add(-lookback)
+	for _, ev := range prior {
+		if ev.EventType == events.Conversion || ev.Time().Before(cutoff) {
+			continue
+		}
+		out = append(out, ev)
+	}
+	return out
+}
+
+// Weights returns the share of a conversion at conv given to each touch,
+// ordered oldest first. The shares sum to 1.
+func Weights(touches []events.Event, conv time.Time, cfg Config) []float64 {
+	n := len(touches)
+	w := make([]float64, n)
+	if n == 0 {
+		return w
+	}
+	switch cfg.Model {
+	case FirstTouch:
+		w[0] = 1
+	case Linear:
+		for i := range w {
+			w[i] = 1 / float64(n)
+		}
+	case TimeDecay:
+		halfLife := cfg.HalfLife
+		if halfLife <= 0 {
+			halfLife = DefaultConfig.HalfLife
+		}
+		// Ages count from the newest touch rather than the conversion: the
+		// shares are the same, but the newest weighs 1 so a half-life short
+		// next to the ages cannot underflow every weight to 0
+		newest := touches[n-1].Time()
+		var sum float64
+		for i, t := range touches {
+			age := newest.Sub(t.Time())
+			w[i] = math.Exp2(-age.Hours() / halfLife.Hours())
+			sum += w[i]
+		}
+		for i := range w {
+			w[i] /= sum
+		}
+	case PositionBased:
+		switch n {
+		case 1:
+			w[0] = 1
+		case 2:
+			w[0], w[1] = 0.5, 0.5
+		default:
+			w[0], w[n-1] = cfg.EndsWeight, cfg.EndsWeight
+			middle := (1 - 2*cfg.EndsWeight) / float64(n-2)
+			for i := 1; i < n-1; i++ {
+				w[i] = middle
+			}
+		}
+	default: // LastTouch
+		w[n-1] = 1
+	}
+	return w
+}
@@ -0,0 +1,124 @@
+package attribution
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"campaign-analytics/events"
+)
+
+var t0 = time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+
+const day = 24 * time.Hour
+
+func ev(user string, channelID int64, eventType string, at time.Duration, revenue float64) events.Event {
+	return events.Event{CampaignID: 1, ChannelID: channelID, EventType: eventType, EventTimestamp: t0.Add(at).Unix(), UserID: user, Revenue: revenue}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func nearAll(got, want []float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if !near(got[i], want[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func config(m Model) Config {
+	cfg := DefaultConfig
+	cfg.Model, cfg.HalfLife = m, day
+	return cfg
+}
+
+func TestWeights(t *testing.T) {
+	// Touches a day apart, the conversion a day after the last
+	touches := []events.Event{
+		ev("u1", 1, events.Impression, 0, 0),
+		ev("u1", 2, events.Click, day, 0),
+		ev("u1", 3, events.Impression, 2*day, 0),
+	}
+	conv := t0.Add(3 * day)
+	short := config(TimeDecay)
+	short.HalfLife = time.Second
+	for _, tc := range []struct {
+		name    string
+		touches []events.Event
+		cfg     Config
+		want    []float64
+	}{
+		{"first touch", touches, config(FirstTouch), []float64{1, 0, 0}},
+		{"last touch", touches, config(LastTouch), []float64{0, 0, 1}},
+		{"linear", touches, config(Linear), []float64{1.0 / 3, 1.0 / 3, 1.0 / 3}},
+		{"time decay", touches, config(TimeDecay), []float64{1.0 / 7, 2.0 / 7, 4.0 / 7}},
+		// Weights of a day old touches would underflow at a second's half-life
+		{"time decay short half-life", touches, short, []float64{0, 0, 1}},
+		{"time decay same time", []events.Event{touches[0], touches[0]}, short, []float64{0.5, 0.5}},
+		{"position based", touches, config(PositionBased), []float64{0.4, 0.2, 0.4}},
+		{"position based pair", touches[:2], config(PositionBased), []float64{0.5, 0.5}},
+		{"position based single", touches[:1], config(PositionBased), []float64{1}},
+		{"no touch", nil, config(Linear), []float64{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Weights(tc.touches, conv, tc.cfg); !nearAll(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAttribute(t *testing.T) {
+	evs := []events.Event{
+		// Three touches over channels 1 to 3, then a conversion of 70
+		ev("u1", 1, events.Impression, 0, 0),
+		ev("u1", 2, events.Click, day, 0),
+		ev("u1", 3, events.Impression, 2*day, 0),
+		ev("u1", 1, events.Conversion, 3*day, 70),
+		// A touch past the lookback of the conversion
+		ev("u2", 1, events.Click, 0, 0),
+		ev("u2", 1, events.Conversion, 31*day, 10),
+		// A conversion before the range, then one credited to channel 2 alone
+		ev("u3", 2, events.Impression, -2*day, 0),
+		ev("u3", 2, events.Conversion, -time.Hour, 5),
+		ev("u3", 2, events.Conversion, time.Hour, 20),
+	}
+	for _, tc := range []struct {
+		model Model
+		want  []Credit
+	}{
+		{FirstTouch, []Credit{{1, 1, 1, 70}, {1, 2, 1, 20}}},
+		{LastTouch, []Credit{{1, 2, 1, 20}, {1, 3, 1, 70}}},
+		{Linear, []Credit{{1, 1, 1.0 / 3, 70.0 / 3}, {1, 2, 4.0 / 3, 70.0/3 + 20}, {1, 3, 1.0 / 3, 70.0 / 3}}},
+		{TimeDecay, []Credit{{1, 1, 1.0 / 7, 10}, {1, 2, 9.0 / 7, 40}, {1, 3, 4.0 / 7, 40}}},
+		{PositionBased, []Credit{{1, 1, 0.4, 28}, {1, 2, 1.2, 34}, {1, 3, 0.4, 28}}},
+	} {
+		t.Run(string(tc.model), func(t *testing.T) {
+			rep := Attribute(evs, t0, t0.Add(40*day), config(tc.model))
+			if rep.Model != tc.model || rep.Conversions != 3 || rep.Revenue != 100 || rep.Unattributed != 1 || rep.UnattributedRevenue != 10 {
+				t.Fatalf("report %+v, want 3 conversions of 100 with 1 of 10 unattributed", rep)
+			}
+			if len(rep.Credits) != len(tc.want) {
+				t.Fatalf("credits %+v, want %+v", rep.Credits, tc.want)
+			}
+			var conversions float64
+			for i, c := range rep.Credits {
+				w := tc.want[i]
+				if c.CampaignID != w.CampaignID || c.ChannelID != w.ChannelID || !near(c.Conversions, w.Conversions) || !near(c.Revenue, w.Revenue) {
+					t.Fatalf("credits %+v, want %+v", rep.Credits, tc.want)
+				}
+				conversions += c.Conversions
+			}
+			// The attributed conversions are credited in full
+			if !near(conversions, 2) {
+				t.Fatalf("credited %v conversions, want 2", conversions)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+// Command anomaly consumes the campaign-data topic and flags hours whose
+// spend, CTR, CPA or conversions deviate from their baseline.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"campaign-analytics/anomaly"
+	"campaign-analytics/sink"
+
+	_ "github.com/lib/pq"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	appName        = "campaign-anomaly"
+	inputTopic     = "campaign-data"
+	anomaliesTopic = "campaign-anomalies"
+	tickInterval   = 30 * time.Second
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	brokers := strings.Split(getenv("KAFKA_BROKERS", "localhost:9092"), ",")
+
+	var (
+		store  anomaly.Store = anomaly.NewMemoryStore()
+		states anomaly.StateStore
+	)
+	if dsn := os.Getenv("DATABASE_URL"); dsn != "" {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			log.Fatalf("open database: %v", err)
+		}
+		defer db.Close()
+		store = anomaly.NewPostgresStore(db)
+		states = anomaly.NewPostgresStateStore(db)
+	} else {
+		log.Println("DATABASE_URL not set, keeping anomalies and baselines in memory")
+	}
+
+	emit := sink.NewKafkaSink(brokers, anomaliesTopic)
+	defer emit.Close()
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: brokers,
+		GroupID: appName,
+		Topic:   inputTopic,
+		ErrorLogger: kafka.LoggerFunc(func(format string, args ...interface{}) {
+			log.Printf("Kafka reader error: "+format, args...)
+		}),
+	})
+	defer reader.Close()
+
+	consumer := &anomaly.Consumer{
+		Reader:       reader,
+		Detector:     anomaly.NewDetector(anomaly.DefaultConfig),
+		Store:        store,
+		States:       states,
+		Emit:         emit,
+		TickInterval: tickInterval,
+	}
+	log.Printf("Consuming %s", inputTopic)
+	if err := consumer.Run(ctx); err != nil && ctx.Err() == nil {
+		log.Fatalf("anomaly consumer: %v", err)
+	}
+}
+
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
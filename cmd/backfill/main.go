@@ -0,0 +1,212 @@
+// Command backfill recomputes the rollups from the campaign-data topic into a
+// versioned table, to be compared with and then promoted over the live ones.
+//
+//	backfill run     -version V [-since T | -offsets P:O,...] [-campaigns ID,...] [-restart]
+//	backfill diff    -version V
+//	backfill promote -version V
+//
+// -since is truncated to UTC midnight so the first daily buckets are complete.
+// Promote only replaces buckets from -since on; runs starting mid-topic through
+// -offsets or a trimmed topic only replace those after their first message day.
+// Brokers come from KAFKA_BROKERS and the database from DATABASE_URL.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"campaign-analytics/fx"
+	"campaign-analytics/rollup"
+
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	inputTopic       = "campaign-data"
+	groupPrefix      = "campaign-rollup-backfill-"
+	defaultFlushSize = 5000
+)
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		log.Fatal("usage: backfill run|diff|promote -version V [flags]")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		log.Fatal("DATABASE_URL is required")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+
+	switch os.Args[1] {
+	case "run":
+		err = runBackfill(ctx, db, os.Args[2:])
+	case "diff":
+		err = runDiff(ctx, db, os.Args[2:])
+	case "promote":
+		err = runPromote(ctx, db, os.Args[2:])
+	default:
+		err = fmt.Errorf("unknown command %q", os.Args[1])
+	}
+	if err != nil {
+		log.Fatalf("backfill %s: %v", os.Args[1], err)
+	}
+}
+
+func runBackfill(ctx context.Context, db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	version := fs.String("version", "", "name of the output version, [a-z0-9_]")
+	since := fs.String("since", "", "start at this time (RFC 3339 or YYYY-MM-DD)")
+	offsets := fs.String("offsets", "", "start offsets as partition:offset,...")
+	campaigns := fs.String("campaigns", "", "comma separated campaign IDs to recompute, all when empty")
+	restart := fs.Bool("restart", false, "ignore the progress of an earlier run of this version")
+	flushSize := fs.Int("flush-size", defaultFlushSize, "messages per rollup write")
+	fs.Parse(args)
+	if *version == "" {
+		return errors.New("-version is required")
+	}
+	if *flushSize <= 0 {
+		return errors.New("-flush-size must be positive")
+	}
+
+	b := &rollup.Backfill{
+		Brokers:   strings.Split(getenv("KAFKA_BROKERS", "localhost:9092"), ","),
+		Topic:     inputTopic,
+		GroupID:   groupPrefix + *version,
+		FlushSize: *flushSize,
+		Restart:   *restart,
+	}
+	b.Client = &kafka.Client{Addr: kafka.TCP(b.Brokers...)}
+
+	v := rollup.Version{Name: *version}
+	if *since != "" {
+		t, err := parseTime(*since)
+		if err != nil {
+			return errors.Wrap(err, "-since")
+		}
+		b.Since = rollup.Daily.Truncate(t)
+		v.Since = &b.Since
+	}
+	if *offsets != "" {
+		b.Offsets = make(map[int]int64)
+		for _, pos := range strings.Split(*offsets, ",") {
+			ps, offset, ok := strings.Cut(strings.TrimSpace(pos), ":")
+			p, perr := strconv.Atoi(ps)
+			o, oerr := strconv.ParseInt(offset, 10, 64)
+			if !ok || perr != nil || oerr != nil {
+				return fmt.Errorf("invalid offset %q, want partition:offset", pos)
+			}
+			b.Offsets[p] = o
+		}
+	}
+	if *campaigns != "" {
+		b.CampaignIDs = make(map[string]bool)
+		for _, id := range strings.Split(*campaigns, ",") {
+			id = strings.TrimSpace(id)
+			b.CampaignIDs[id] = true
+			v.CampaignIDs = append(v.CampaignIDs, id)
+		}
+	}
+
+	if err := rollup.CreateVersion(ctx, db, v); err != nil {
+		return err
+	}
+	repo, err := rollup.NewVersionRepository(db, *version)
+	if err != nil {
+		return err
+	}
+	// Versioned buckets are not emitted; consumers see them once promoted
+	rates, currency, err := loadRates()
+	if err != nil {
+		return errors.Wrap(err, "load FX rates")
+	}
+	b.Aggregator = rollup.NewAggregator(repo, nil, rates, currency)
+	// Runs starting mid-topic only promote the buckets they fully read
+	b.OnLowerBound = func(ctx context.Context, bound time.Time) error {
+		return rollup.RaiseVersionSince(ctx, db, *version, bound)
+	}
+
+	// Messages published after this point may be past the end offsets
+	until := time.Now()
+	if err := b.Run(ctx); err != nil {
+		return err
+	}
+	if err := rollup.CompleteVersion(ctx, db, *version, until); err != nil {
+		return err
+	}
+	log.Printf("version %s is ready, compare it with: backfill diff -version %s", *version, *version)
+	return nil
+}
+
+// runDiff prints live and version totals per campaign and platform as JSON lines
+func runDiff(ctx context.Context, db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	version := fs.String("version", "", "version to compare")
+	fs.Parse(args)
+	diffs, err := rollup.DiffVersion(ctx, db, *version)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, d := range diffs {
+		enc.Encode(d)
+	}
+	return nil
+}
+
+func runPromote(ctx context.Context, db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	version := fs.String("version", "", "version to promote")
+	fs.Parse(args)
+	n, err := rollup.PromoteVersion(ctx, db, *version)
+	if err != nil {
+		return err
+	}
+	log.Printf("promoted %s: %d buckets replaced", *version, n)
+	return nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// loadRates returns the FX rates of FX_RATES_FILE, nil when unset, and the
+// REPORTING_CURRENCY rollups are summed in, USD by default
+func loadRates() (*fx.Store, string, error) {
+	currency := getenv("REPORTING_CURRENCY", "USD")
+	path := os.Getenv("FX_RATES_FILE")
+	if path == "" {
+		return nil, currency, nil
+	}
+	rates, err := fx.LoadFile(path)
+	return rates, currency, err
+}
+
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -3,8 +3,7 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"log"
-	"os"
+	"io"
 
 	"github.com/DTSL/golang-libraries/kafkautils"
 	"github.com/DTSL/golang-libraries/timeutils"
@@ -17,6 +16,8 @@ import (
 type campaignExporter struct {
 	campaignsCSVGenerator interface {
 		GenerateCSV(ctx context.Context, args *kafkaevents.SmsExportMessage, fileName string, camp *campaign, emailDB *mongo.Database, config *config) error
+		// WriteCSV writes the rows of GenerateCSV to w one page at a time
+		WriteCSV(ctx context.Context, args *kafkaevents.SmsExportMessage, w io.Writer, camp *campaign, emailDB *mongo.Database, config *config) error
 	}
 	campaignsEventsCSVGenerator interface {
 		GenerateEventsCSV(ctx context.Context, args *kafkaevents.SmsExportMessage, fileName string, camp *campaign, config *config, emailDB *mongo.Database) error
@@ -27,6 +28,7 @@ type campaignExporter struct {
 	fileUploader interface {
 		UploadFile(ctx context.Context, fileName string) (string, error)
 		UploadFileToAWS(ctx context.Context, fileName string) (string, error)
+		StreamFileToAWS(ctx context.Context, fileName string, write func(w io.Writer) error) (string, error)
 	}
 	notificationHandler interface {
 		SendNotification(ctx context.Context, fileURL string, args *kafkaevents.SmsExportMessage, camp *campaign, processId int64, config *config) error
@@ -79,7 +81,7 @@ func (s *campaignExporter) process(ctx context.Context, expMsg *kafkaevents.SmsE
 		err = kafkautils.ConsumerErrorWithHandler(err, kafkautils.ConsumerDiscard)
 		return err
 	}
-	fileName, fileURL, err := s.generateAndUploadCSVToAWS(ctx, args, camp, emailDB, config)
+	fileURL, err := s.streamCampaignCSVToAWS(ctx, args, camp, emailDB, config)
 	if err != nil {
 		return err
 	}
@@ -92,10 +94,14 @@ func (s *campaignExporter) process(ctx context.Context, expMsg *kafkaevents.SmsE
 	if err != nil {
 		return err
 	}
-
-	err = os.Remove(fileName)
-	if err != nil {
-		log.Println("error in removing file", err)
-	}
 	return nil
 }
+
+// streamCampaignCSVToAWS writes the campaign CSV straight into the upload,
+// so neither memory nor local disk grow with the campaign
+func (s *campaignExporter) streamCampaignCSVToAWS(ctx context.Context, args *kafkaevents.SmsExportMessage, camp *campaign, emailDB *mongo.Database, config *config) (string, error) {
+	fileName := fmt.Sprintf("campaign_%d_%d.csv", args.CampaignID, timeutils.Now().UTC().Unix())
+	return s.fileUploader.StreamFileToAWS(ctx, fileName, func(w io.Writer) error {
+		return s.campaignsCSVGenerator.WriteCSV(ctx, args, w, camp, emailDB, config)
+	})
+}
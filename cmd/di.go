@@ -1,13 +1,23 @@
 package cmd
 
 import (
+	"database/sql"
+	"log"
+	"os"
+
+	"campaign-analytics/ledger"
+	"campaign-analytics/retention"
+
 	"github.com/DTSL/golang-libraries/closeutils"
+	"github.com/DTSL/golang-libraries/envutils"
 	"github.com/DTSL/golang-libraries/kafkautils"
+	_ "github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
 type diContainer struct {
 	kafka *kafkaevents.DIContainer
+	db    *sql.DB
 }
 
 func (d *diContainer) kafkaProducer() (*kafkautils.SimpleProducer, error) {
@@ -18,6 +28,60 @@ func (d *diContainer) kafkaProducer() (*kafkautils.SimpleProducer, error) {
 	return producer, nil
 }
 
+// processedLedger returns the ledger of exported message IDs, kept in
+// Postgres. Without DATABASE_URL, production fails to start and other
+// environments fall back to memory, forgetting the IDs on restart.
+func (d *diContainer) processedLedger() (ledger.Ledger, error) {
+	db, err := d.database()
+	if err != nil {
+		return nil, err
+	}
+	if db == nil {
+		if d.flags.environment == envutils.Production {
+			return nil, errors.New("DATABASE_URL is not set, exported message IDs need a persistent ledger")
+		}
+		log.Println("WARNING: DATABASE_URL is not set, exported message IDs are kept in memory and redeliveries after a restart are exported again")
+		return ledger.NewMemory(), nil
+	}
+	return ledger.NewSQL(db, appName), nil
+}
+
+// database returns the Postgres database of DATABASE_URL, nil when unset
+func (d *diContainer) database() (*sql.DB, error) {
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		return nil, nil
+	}
+	if d.db == nil {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, errors.Wrap(err, "open database")
+		}
+		d.db = db
+	}
+	return d.db, nil
+}
+
+// retentionRunner returns the runner of the organizations' retention
+// policies, archiving to the file uploader's bucket and path like the
+// retention command; nil without DATABASE_URL
+func (d *diContainer) retentionRunner() (*retention.Runner, error) {
+	db, err := d.database()
+	if err != nil || db == nil {
+		return nil, err
+	}
+	gcsClient, err := d.gcloud.StorageClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "gcs client")
+	}
+	uploader := retention.GCSUploader{
+		Client: gcsClient,
+		Bucket: campaignCSVBucket[d.flags.environment],
+		Prefix: uploadPath,
+	}
+	return retention.NewRunner(db, retention.NewPostgresPolicyStore(db), uploader), nil
+}
+
 func newDIContainer(flg *flags) (*diContainer, closeutils.WithOnErr) {
 	dic := &diContainer{
 		flags: flg,
@@ -27,5 +91,8 @@ func newDIContainer(flg *flags) (*diContainer, closeutils.WithOnErr) {
 		if dic.kafka != nil {
 			dic.kafka.Close()
 		}
+		if dic.db != nil {
+			dic.db.Close()
+		}
 	}
 }
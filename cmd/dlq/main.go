@@ -0,0 +1,229 @@
+// Command dlq lists the dead-lettered export messages and replays chosen ones
+// to the main topic.
+//
+//	dlq list   [-org ID] [-campaign ID] [-since T] [-until T] [-limit N]
+//	dlq replay (-select P:O,... | -all) [filters] [-payload FILE] [-actor NAME] [-note TEXT] [-dry-run]
+//
+// Times are RFC 3339 or YYYY-MM-DD. Brokers come from KAFKA_BROKERS and every
+// replay is appended to the audit log (-audit, default DLQ_AUDIT_LOG or
+// dlq-audit.ndjson), once as started before the write and once as completed
+// or failed after it.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"campaign-analytics/dlq"
+	"campaign-analytics/sink"
+
+	"github.com/DTSL/sms-marketing-events/kafkaevents"
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// errDone stops a scan once the list limit is reached
+var errDone = errors.New("done")
+
+type commonFlags struct {
+	deadTopic string
+	filter    dlq.Filter
+	since     string
+	until     string
+}
+
+func (c *commonFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.deadTopic, "dead-topic", kafkaevents.SmsReportIngestDeadTopic, "dead letter topic")
+	fs.Int64Var(&c.filter.OrganizationID, "org", 0, "only messages of this organization ID")
+	fs.Int64Var(&c.filter.CampaignID, "campaign", 0, "only messages of this campaign ID")
+	fs.StringVar(&c.since, "since", "", "only messages dead-lettered at or after this time")
+	fs.StringVar(&c.until, "until", "", "only messages dead-lettered before this time")
+}
+
+func (c *commonFlags) parse() (err error) {
+	if c.filter.Since, err = parseTime(c.since); err != nil {
+		return errors.Wrap(err, "-since")
+	}
+	if c.filter.Until, err = parseTime(c.until); err != nil {
+		return errors.Wrap(err, "-until")
+	}
+	return nil
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		log.Fatal("usage: dlq list|replay [flags]")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	brokers := strings.Split(getenv("KAFKA_BROKERS", "localhost:9092"), ",")
+	var err error
+	switch os.Args[1] {
+	case "list":
+		err = runList(ctx, brokers, os.Args[2:])
+	case "replay":
+		err = runReplay(ctx, brokers, os.Args[2:])
+	default:
+		err = fmt.Errorf("unknown command %q", os.Args[1])
+	}
+	if err != nil {
+		log.Fatalf("dlq %s: %v", os.Args[1], err)
+	}
+}
+
+// runList prints matching entries as JSON lines
+func runList(ctx context.Context, brokers []string, args []string) error {
+	var c commonFlags
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	c.register(fs)
+	limit := fs.Int("limit", 100, "maximum number of messages to list, 0 for all")
+	fs.Parse(args)
+	if err := c.parse(); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	n := 0
+	err := dlq.Scan(ctx, brokers, c.deadTopic, c.filter.Since, func(msg kafka.Message) error {
+		e := dlq.Describe(msg)
+		if !c.filter.Match(e) {
+			return nil
+		}
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+		if n++; *limit > 0 && n >= *limit {
+			return errDone
+		}
+		return nil
+	})
+	if err == errDone {
+		return nil
+	}
+	return err
+}
+
+func runReplay(ctx context.Context, brokers []string, args []string) error {
+	var c commonFlags
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	c.register(fs)
+	topic := fs.String("topic", kafkaevents.SmsReportIngestTopic, "topic to replay to")
+	selection := fs.String("select", "", "comma separated partition:offset of the messages to replay")
+	all := fs.Bool("all", false, "replay every message matching the filters")
+	payloadFile := fs.String("payload", "", "JSON file replacing the payload of the single selected message")
+	actor := fs.String("actor", os.Getenv("USER"), "who is replaying, for the audit log")
+	note := fs.String("note", "", "reason for the replay, for the audit log")
+	auditPath := fs.String("audit", getenv("DLQ_AUDIT_LOG", "dlq-audit.ndjson"), "audit log file")
+	dryRun := fs.Bool("dry-run", false, "print the messages that would be replayed")
+	fs.Parse(args)
+	if err := c.parse(); err != nil {
+		return err
+	}
+	if (*selection == "") == !*all {
+		return errors.New("exactly one of -select and -all is required")
+	}
+	if *actor == "" {
+		return errors.New("-actor is required")
+	}
+
+	var msgs []kafka.Message
+	if *selection != "" {
+		for _, pos := range strings.Split(*selection, ",") {
+			p, o, err := parsePosition(pos)
+			if err != nil {
+				return err
+			}
+			msg, err := dlq.Fetch(ctx, brokers, c.deadTopic, p, o)
+			if err != nil {
+				return errors.Wrapf(err, "fetch %s", pos)
+			}
+			if c.filter.Match(dlq.Describe(msg)) {
+				msgs = append(msgs, msg)
+			}
+		}
+	} else {
+		err := dlq.Scan(ctx, brokers, c.deadTopic, c.filter.Since, func(msg kafka.Message) error {
+			if c.filter.Match(dlq.Describe(msg)) {
+				msgs = append(msgs, msg)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var payload []byte
+	if *payloadFile != "" {
+		if len(msgs) != 1 {
+			return fmt.Errorf("-payload needs exactly one selected message, got %d", len(msgs))
+		}
+		var err error
+		if payload, err = os.ReadFile(*payloadFile); err != nil {
+			return errors.Wrap(err, "read payload")
+		}
+	}
+
+	if *dryRun {
+		enc := json.NewEncoder(os.Stdout)
+		for _, msg := range msgs {
+			enc.Encode(dlq.Describe(msg))
+		}
+		return nil
+	}
+
+	dest := sink.NewKafkaSink(brokers, *topic)
+	defer dest.Close()
+	r := &dlq.Replayer{
+		Dest:      dest,
+		DestTopic: *topic,
+		Audit:     dlq.NewFileAuditLog(*auditPath),
+		Actor:     *actor,
+		Note:      *note,
+	}
+	for _, msg := range msgs {
+		if err := r.Replay(ctx, msg, payload); err != nil {
+			return errors.Wrapf(err, "replay %d:%d", msg.Partition, msg.Offset)
+		}
+		log.Printf("replayed %d:%d", msg.Partition, msg.Offset)
+	}
+	log.Printf("replayed %d messages to %s", len(msgs), *topic)
+	return nil
+}
+
+func parsePosition(s string) (int, int64, error) {
+	ps, offset, ok := strings.Cut(strings.TrimSpace(s), ":")
+	p, perr := strconv.Atoi(ps)
+	o, oerr := strconv.ParseInt(offset, 10, 64)
+	if !ok || perr != nil || oerr != nil {
+		return 0, 0, fmt.Errorf("invalid position %q, want partition:offset", s)
+	}
+	return p, o, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,71 @@
+// Command events consumes the campaign-events topic into the events table,
+// which attribution, funnels, exports and retention read.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"campaign-analytics/events"
+
+	_ "github.com/lib/pq"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	appName       = "campaign-events-writer"
+	inputTopic    = "campaign-events"
+	flushSize     = 5000
+	flushInterval = 5 * time.Second
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	brokers := strings.Split(getenv("KAFKA_BROKERS", "localhost:9092"), ",")
+
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		log.Fatal("DATABASE_URL is required")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: brokers,
+		GroupID: appName,
+		Topic:   inputTopic,
+		ErrorLogger: kafka.LoggerFunc(func(format string, args ...interface{}) {
+			log.Printf("Kafka reader error: "+format, args...)
+		}),
+	})
+	defer reader.Close()
+
+	consumer := &events.Consumer{
+		Reader:        reader,
+		Store:         events.NewPostgresStore(db),
+		FlushSize:     flushSize,
+		FlushInterval: flushInterval,
+	}
+	log.Printf("Consuming %s", inputTopic)
+	if err := consumer.Run(ctx); err != nil && ctx.Err() == nil {
+		log.Fatalf("events consumer: %v", err)
+	}
+}
+
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
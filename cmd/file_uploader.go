@@ -16,6 +16,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/pkg/errors"
 )
 
@@ -117,8 +118,7 @@ func (f *fileUploader) UploadFile(ctx context.Context, fileName string) (string,
 	return fileURL, nil
 }
 
-func (f *fileUploader) UploadFileToAWS(ctx context.Context, fileName string) (string, error) {
-	log.Println("creds===>", secretAccessKey, accessKeyID)
+func newAWSSession() (*session.Session, error) {
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String("eu-west-1"),
 		Credentials: credentials.NewStaticCredentials(
@@ -127,8 +127,14 @@ func (f *fileUploader) UploadFileToAWS(ctx context.Context, fileName string) (st
 			"",
 		),
 	})
+	return sess, errors.Wrap(err, "creating AWS session")
+}
+
+func (f *fileUploader) UploadFileToAWS(ctx context.Context, fileName string) (string, error) {
+	log.Println("creds===>", secretAccessKey, accessKeyID)
+	sess, err := newAWSSession()
 	if err != nil {
-		return "", errors.Wrap(err, "creating AWS session")
+		return "", err
 	}
 	upFile, err := os.Open(fileName)
 	if err != nil {
@@ -150,3 +156,32 @@ func (f *fileUploader) UploadFileToAWS(ctx context.Context, fileName string) (st
 
 	return fileURL, nil
 }
+
+// StreamFileToAWS uploads what write produces as fileName without going
+// through local disk. The body is sent in multipart chunks as it is written,
+// so memory stays bounded whatever its size; a write error aborts the upload.
+func (f *fileUploader) StreamFileToAWS(ctx context.Context, fileName string, write func(w io.Writer) error) (string, error) {
+	sess, err := newAWSSession()
+	if err != nil {
+		return "", err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(write(pw))
+	}()
+
+	_, err = s3manager.NewUploader(sess).UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:      aws.String(f.bucketS3),
+		Key:         aws.String(uploadPath + fileName),
+		Body:        pr,
+		ContentType: aws.String("text/csv"),
+	})
+	if err != nil {
+		// Unblocks write if the upload gave up first
+		pr.CloseWithError(err)
+		return "", errors.Wrap(err, "failed to stream file to AWS")
+	}
+
+	fileURL := fmt.Sprintf("%s%s/%s%s", f.schemeAWS, f.bucketS3, uploadPath, fileName)
+	return fileURL, nil
+}
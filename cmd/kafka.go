@@ -3,10 +3,16 @@ package main
 import (
 	"context"
 	"log"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"campaign-analytics/codec"
+	"campaign-analytics/ledger"
+	"campaign-analytics/retention"
+	"campaign-analytics/retry"
+	"campaign-analytics/sink"
+
 	"github.com/DTSL/golang-libraries/errorhandle"
 	"github.com/DTSL/golang-libraries/errors"
 	"github.com/DTSL/golang-libraries/jsontracing"
@@ -16,7 +22,14 @@ import (
 )
 
 const (
-	maxRetryCnt = 3
+	// retrySchedulerRestartDelay is the pause before restarting a failed retry scheduler
+	retrySchedulerRestartDelay = 10 * time.Second
+	// retentionInterval is the pause between two runs of the retention policies
+	retentionInterval = 24 * time.Hour
+	// ledgerRetention is how long exported message IDs are remembered, well
+	// past any redelivery or retry of a message
+	ledgerRetention     = 7 * 24 * time.Hour
+	ledgerPruneInterval = time.Hour
 )
 
 func runKafka(ctx context.Context, dic *diContainer) error {
@@ -42,11 +55,89 @@ func runKafka(ctx context.Context, dic *diContainer) error {
 		},
 		GroupName: appName,
 	}
+	for _, tier := range retry.Tiers(kafkaevents.SmsReportIngestTopic) {
+		go runRetryScheduler(ctx, readerCfg, tier)
+	}
+	runner, err := dic.retentionRunner()
+	if err != nil {
+		return errors.Wrap(err, "get retention runner")
+	}
+	if runner != nil {
+		go runRetention(ctx, runner)
+	}
+	if l, ok := pr.ledger.(*ledger.SQL); ok {
+		go runLedgerPrune(ctx, l)
+	}
 	kafkautils.RunConsumers(ctx, readerCfg, pr.process, dic.flags.consumers, retryProducer.Produce, smsExportDeadProducer.Produce, errorhandle.HandleDefault)
 
+	// The consumers are done scheduling retries, flush and close the tier writers
+	if err := pr.retrier.Close(); err != nil {
+		log.Println("retrier close err", err)
+	}
 	return nil
 }
 
+// runRetryScheduler moves due messages from a retry tier back to the main
+// topic. Each tier has its own consumer group, e.g. <app>-retry-1m, so that a
+// tier waiting for its messages to be due never holds back another's offsets
+// or rebalances.
+func runRetryScheduler(ctx context.Context, readerCfg kafka.ReaderConfig, tier retry.Tier) {
+	topic := tier.Topic
+	readerCfg.Topic = topic
+	readerCfg.GroupID = appName + "-" + strings.TrimPrefix(topic, kafkaevents.SmsReportIngestTopic+".")
+	dest := sink.NewKafkaSink(readerCfg.Brokers, kafkaevents.SmsReportIngestTopic)
+	defer dest.Close()
+	for ctx.Err() == nil {
+		reader := kafka.NewReader(readerCfg)
+		err := (&retry.Scheduler{Reader: reader, Dest: dest}).Run(ctx)
+		reader.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("retry scheduler", topic, "err", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(retrySchedulerRestartDelay):
+		}
+	}
+}
+
+// runRetention compacts, archives and deletes expired raw events once a day
+func runRetention(ctx context.Context, runner *retention.Runner) {
+	for {
+		results, err := runner.Run(ctx, time.Now())
+		for _, res := range results {
+			log.Println("retention compacted organization", res.OrganizationID, res.Day.Format("2006-01-02"), res.Events, "events", res.URL)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Println("retention err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retentionInterval):
+		}
+	}
+}
+
+// runLedgerPrune forgets exported message IDs older than ledgerRetention, so
+// processed_messages does not grow without bound
+func runLedgerPrune(ctx context.Context, l *ledger.SQL) {
+	for {
+		n, err := l.Prune(ctx, time.Now().UTC().Add(-ledgerRetention))
+		if err != nil && ctx.Err() == nil {
+			log.Println("ledger prune err", err)
+		} else if n > 0 {
+			log.Println("ledger pruned", n, "message IDs")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ledgerPruneInterval):
+		}
+	}
+}
+
 func getKafkaReaderConfig(dic *diContainer) (kafka.ReaderConfig, error) {
 	cfg, err := kafkaevents.GetConfig(dic.flags.environment)
 	if err != nil {
@@ -66,6 +157,8 @@ type kafkaProcessor struct {
 	processor         func(ctx context.Context, expMsg *kafkaevents.SmsExportMessage) error
 	kafkaProducer     *kafkautils.SimpleProducer
 	kafkaWaitProducer *kafkautils.WaitProducer
+	ledger            ledger.Ledger // message IDs already exported
+	retrier           *retry.Retrier
 }
 
 func newKafkaProcessor(dic *diContainer) (*kafkaProcessor, error) {
@@ -84,10 +177,25 @@ func newKafkaProcessor(dic *diContainer) (*kafkaProcessor, error) {
 		return nil, errors.Wrap(err, "newWaitProducerSingle")
 	}
 
+	ldg, err := dic.processedLedger()
+	if err != nil {
+		return nil, errors.Wrap(err, "processedLedger")
+	}
+
+	readerCfg, err := getKafkaReaderConfig(dic)
+	if err != nil {
+		return nil, errors.Wrap(err, "get reader config")
+	}
+	retrier := retry.NewRetrier(retry.LoadPolicy(), retry.Tiers(kafkaevents.SmsReportIngestTopic), func(topic string) sink.EventSink {
+		return sink.NewKafkaSink(readerCfg.Brokers, topic)
+	})
+
 	return &kafkaProcessor{
 		processor:         exPro.process,
 		kafkaProducer:     kafkaProducer,
 		kafkaWaitProducer: kafkaWaitProducer,
+		ledger:            ldg,
+		retrier:           retrier,
 	}, nil
 }
 
@@ -111,42 +219,62 @@ func (p *kafkaProcessor) process(ctx context.Context, kmsgs kafka.Message) error
 		err = kafkautils.ConsumerErrorWithHandler(err, kafkautils.ConsumerDiscard)
 		return err
 	}
-	err = p.processor(ctx, msgs)
-	if err != nil {
-		err = errors.Wrap(err, "processor")
-		if !retriesWithDelays(kmsgs) {
-			log.Println("in retriesWithDelays code block.....")
-			err = kafkautils.ConsumerErrorWithHandler(err, kafkautils.ConsumerDiscard)
-		}
+
+	// The export runs under a claim of the message ID, so a message
+	// redelivered after a crash before the offset commit, produced twice
+	// upstream or delivered to two consumers at once is exported only once
+	id := ledger.MessageID(kmsgs)
+	var perr error
+	claimed, err := p.ledger.Claim(ctx, id, func(ctx context.Context) error {
+		perr = p.processor(ctx, msgs)
+		return perr
+	})
+	switch {
+	case perr != nil:
+		err = errors.Wrap(perr, "processor")
 		log.Println("processor err", err)
-		return err
+		// Hand the message to a retry tier rather than blocking the partition
+		serr := p.retrier.Schedule(ctx, kmsgs, err)
+		switch {
+		case serr == nil:
+			return nil
+		case serr == retry.ErrExhausted:
+			return kafkautils.ConsumerErrorWithHandler(err, kafkautils.ConsumerDiscard)
+		default:
+			// Retry topics unavailable, fall back to the consumer's retry producer
+			log.Println("retry schedule err", serr)
+			return err
+		}
+	case err != nil:
+		// An unrecorded export would run again on a redelivery unnoticed, so
+		// the message fails and is retried rather than reported done
+		return errors.Wrap(err, "ledger")
+	case !claimed:
+		log.Println("skipping already processed message", id)
 	}
-
 	return nil
 }
 
-func retriesWithDelays(kmsgs kafka.Message) bool {
-	// put message in the dead queue after 3 retries(prevent infinite retries)
-	retryCountB, _ := kafkautils.GetHeader(kmsgs.Headers, "discard_retry_count")
-	retryCount, _ := strconv.ParseInt(string(retryCountB), 10, 64)
-	log.Println("retryCount...", retryCount)
-	if retryCount >= maxRetryCnt {
-		return false
-	}
-	log.Println("in retry count...", retryCount)
-	initialDelay := 5 * time.Second
-	delay := time.Duration(float64(initialDelay) * (float64(retryCount) + 1))
-	log.Println("delay time...", delay)
-	time.Sleep(delay)
-	return true
-}
-
 func (p *kafkaProcessor) decodeMessage(ctx context.Context, kmsg kafka.Message) (*kafkaevents.SmsExportMessage, error) {
 	msg := &kafkaevents.SmsExportMessage{}
 
-	err := jsontracing.Unmarshal(ctx, kmsg.Value, &msg)
+	enc, err := codec.EncodingOf(kmsg.Headers)
 	if err != nil {
-		return nil, errors.Wrap(err, "JSON unmarshal")
+		return nil, errors.Wrap(err, "encoding header")
+	}
+	switch enc {
+	case codec.Protobuf:
+		pm, err := codec.DecodeExportMessage(kmsg.Value)
+		if err != nil {
+			return nil, err
+		}
+		msg.OrganizationID = pm.OrganizationID
+		msg.CampaignID = pm.CampaignID
+	default:
+		err = jsontracing.Unmarshal(ctx, kmsg.Value, &msg)
+		if err != nil {
+			return nil, errors.Wrap(err, "JSON unmarshal")
+		}
 	}
 	if msg == nil {
 		return nil, errors.Wrap(err, "no data")
@@ -0,0 +1,129 @@
+// Command migrate applies or reverts the schema migrations of package migrate.
+//
+//	migrate up     [-to N]   apply pending migrations, up to the latest by default
+//	migrate down   [-to N]   revert migrations above N, the last applied one by default
+//	migrate status           list migrations and when they were applied
+//
+// The database comes from DATABASE_URL.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"campaign-analytics/migrate"
+
+	_ "github.com/lib/pq"
+)
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		log.Fatal("usage: migrate up|down|status [-to N]")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		log.Fatal("DATABASE_URL is required")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+
+	migrations, err := migrate.Embedded()
+	if err != nil {
+		log.Fatalf("load migrations: %v", err)
+	}
+	m := migrate.New(db, migrations)
+
+	switch os.Args[1] {
+	case "up":
+		err = runUp(ctx, m, os.Args[2:])
+	case "down":
+		err = runDown(ctx, m, os.Args[2:])
+	case "status":
+		err = runStatus(ctx, m)
+	default:
+		err = fmt.Errorf("unknown command %q", os.Args[1])
+	}
+	if err != nil {
+		log.Fatalf("migrate %s: %v", os.Args[1], err)
+	}
+}
+
+func runUp(ctx context.Context, m *migrate.Migrator, args []string) error {
+	fs := flag.NewFlagSet("up", flag.ExitOnError)
+	to := fs.Int("to", m.Latest(), "version to migrate up to")
+	fs.Parse(args)
+
+	done, err := m.Up(ctx, *to)
+	for _, mig := range done {
+		log.Printf("applied %04d_%s", mig.Version, mig.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(done) == 0 {
+		log.Print("schema is up to date")
+	}
+	return nil
+}
+
+func runDown(ctx context.Context, m *migrate.Migrator, args []string) error {
+	fs := flag.NewFlagSet("down", flag.ExitOnError)
+	to := fs.Int("to", -1, "version to migrate down to, one step when unset")
+	fs.Parse(args)
+
+	if *to < 0 {
+		current, err := m.Current(ctx)
+		if err != nil {
+			return err
+		}
+		if current == 0 {
+			log.Print("no migration applied")
+			return nil
+		}
+		// The step below is the newest applied version lower than current
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		*to = 0
+		for _, s := range statuses {
+			if s.AppliedAt != nil && s.Version < current {
+				*to = s.Version
+			}
+		}
+	}
+
+	done, err := m.Down(ctx, *to)
+	for _, mig := range done {
+		log.Printf("reverted %04d_%s", mig.Version, mig.Name)
+	}
+	return err
+}
+
+func runStatus(ctx context.Context, m *migrate.Migrator) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		applied := "pending"
+		if s.AppliedAt != nil {
+			applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%04d  %-40s %s\n", s.Version, s.Name, applied)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Command protocheck fails when the .proto files under codec/proto contain a
+// breaking change compared to the committed schema lock. Run it in CI before
+// deploying producers or consumers; pass -update to accept compatible changes.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"campaign-analytics/codec"
+)
+
+func main() {
+	dir := flag.String("dir", "codec/proto", "directory holding the .proto files")
+	lockPath := flag.String("lock", "codec/proto/schema.lock.json", "schema lock file")
+	update := flag.Bool("update", false, "rewrite the lock file after a compatible change")
+	flag.Parse()
+
+	files, err := filepath.Glob(filepath.Join(*dir, "*.proto"))
+	if err != nil {
+		log.Fatalf("list proto files: %v", err)
+	}
+	current := make(map[string]codec.Message)
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("open %s: %v", path, err)
+		}
+		msgs, err := codec.ParseProto(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("parse %s: %v", path, err)
+		}
+		for name, msg := range msgs {
+			current[name] = msg
+		}
+	}
+
+	locked := make(map[string]codec.Message)
+	if b, err := os.ReadFile(*lockPath); err == nil {
+		if err := json.Unmarshal(b, &locked); err != nil {
+			log.Fatalf("decode lock: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("read lock: %v", err)
+	}
+
+	if problems := codec.CheckCompatible(locked, current); len(problems) > 0 {
+		for _, p := range problems {
+			log.Printf("breaking change: %s", p)
+		}
+		os.Exit(1)
+	}
+
+	if *update {
+		b, err := json.MarshalIndent(current, "", "  ")
+		if err != nil {
+			log.Fatalf("encode lock: %v", err)
+		}
+		if err := os.WriteFile(*lockPath, append(b, '\n'), 0o644); err != nil {
+			log.Fatalf("write lock: %v", err)
+		}
+	}
+	log.Println("proto schema is compatible")
+}
@@ -0,0 +1,74 @@
+// Command reach consumes the campaign-events topic and maintains daily
+// HyperLogLog reach sketches per campaign and channel.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"campaign-analytics/reach"
+
+	_ "github.com/lib/pq"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	appName       = "campaign-reach"
+	inputTopic    = "campaign-events"
+	flushSize     = 10000
+	flushInterval = 10 * time.Second
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	brokers := strings.Split(getenv("KAFKA_BROKERS", "localhost:9092"), ",")
+
+	var store reach.Store = reach.NewMemoryStore()
+	if dsn := os.Getenv("DATABASE_URL"); dsn != "" {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			log.Fatalf("open database: %v", err)
+		}
+		defer db.Close()
+		store = reach.NewPostgresStore(db)
+	} else {
+		log.Println("DATABASE_URL not set, keeping sketches in memory")
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: brokers,
+		GroupID: appName,
+		Topic:   inputTopic,
+		ErrorLogger: kafka.LoggerFunc(func(format string, args ...interface{}) {
+			log.Printf("Kafka reader error: "+format, args...)
+		}),
+	})
+	defer reader.Close()
+
+	consumer := &reach.Consumer{
+		Reader:        reader,
+		Store:         store,
+		Precision:     reach.DefaultPrecision,
+		FlushSize:     flushSize,
+		FlushInterval: flushInterval,
+	}
+	log.Printf("Consuming %s", inputTopic)
+	if err := consumer.Run(ctx); err != nil && ctx.Err() == nil {
+		log.Fatalf("reach consumer: %v", err)
+	}
+}
+
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,192 @@
+// Command retention manages the retention of raw events, see package retention.
+//
+//	retention policy   -org ID -raw-days N [-archive=false]   set an organization's policy
+//	retention policies                                      list the policies
+//	retention run      [-org ID] [-now T]                   apply the policies
+//	retention restore  -org ID -from D -to D                rehydrate archived days for reprocessing
+//
+// Archives go to the GCS bucket ARCHIVE_BUCKET under ARCHIVE_PREFIX (upload/
+// by default), which must be the export service's bucket as it applies the
+// policies daily too. Without ARCHIVE_BUCKET they are files under ARCHIVE_DIR,
+// for local runs. The database comes from DATABASE_URL.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"campaign-analytics/retention"
+
+	"cloud.google.com/go/storage"
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		log.Fatal("usage: retention policy|policies|run|restore [flags]")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		log.Fatal("DATABASE_URL is required")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		log.Fatalf("open database: %v", err)
+	}
+	defer db.Close()
+
+	var uploader retention.Uploader = retention.LocalUploader{Dir: getenv("ARCHIVE_DIR", "archive")}
+	if bucket := os.Getenv("ARCHIVE_BUCKET"); bucket != "" {
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			log.Fatalf("gcs client: %v", err)
+		}
+		defer client.Close()
+		uploader = retention.GCSUploader{Client: client, Bucket: bucket, Prefix: getenv("ARCHIVE_PREFIX", "upload/")}
+	}
+	policies := retention.NewPostgresPolicyStore(db)
+	runner := retention.NewRunner(db, policies, uploader)
+
+	switch os.Args[1] {
+	case "policy":
+		err = runPolicy(ctx, policies, os.Args[2:])
+	case "policies":
+		err = runPolicies(ctx, policies)
+	case "run":
+		err = runRetention(ctx, runner, policies, os.Args[2:])
+	case "restore":
+		err = runRestore(ctx, runner, os.Args[2:])
+	default:
+		err = fmt.Errorf("unknown command %q", os.Args[1])
+	}
+	if err != nil {
+		log.Fatalf("retention %s: %v", os.Args[1], err)
+	}
+}
+
+func runPolicy(ctx context.Context, policies retention.PolicyStore, args []string) error {
+	fs := flag.NewFlagSet("policy", flag.ExitOnError)
+	org := fs.Int64("org", 0, "organization ID")
+	rawDays := fs.Int("raw-days", 0, "days of raw events to keep, today included")
+	archive := fs.Bool("archive", true, "archive raw events before deleting them")
+	fs.Parse(args)
+
+	p := retention.Policy{OrganizationID: *org, RawDays: *rawDays, Archive: *archive, UpdatedAt: time.Now().UTC()}
+	if err := policies.Put(ctx, p); err != nil {
+		return err
+	}
+	log.Printf("organization %d keeps %d days of raw events", p.OrganizationID, p.RawDays)
+	return nil
+}
+
+func runPolicies(ctx context.Context, policies retention.PolicyStore) error {
+	list, err := policies.List(ctx)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, p := range list {
+		enc.Encode(p)
+	}
+	return nil
+}
+
+// runRetention prints the compacted days as JSON lines
+func runRetention(ctx context.Context, runner *retention.Runner, policies retention.PolicyStore, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	org := fs.Int64("org", 0, "apply only this organization's policy")
+	now := fs.String("now", "", "apply the policies as of this time (RFC 3339 or YYYY-MM-DD), now when empty")
+	fs.Parse(args)
+
+	at := time.Now()
+	if *now != "" {
+		t, err := parseTime(*now)
+		if err != nil {
+			return errors.Wrap(err, "-now")
+		}
+		at = t
+	}
+
+	var results []retention.Result
+	var err error
+	if *org != 0 {
+		p, ok, perr := policies.Get(ctx, *org)
+		if perr != nil {
+			return perr
+		}
+		if !ok {
+			return fmt.Errorf("organization %d has no retention policy", *org)
+		}
+		results, err = runner.Apply(ctx, p, at)
+	} else {
+		results, err = runner.Run(ctx, at)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, res := range results {
+		enc.Encode(res)
+	}
+	return err
+}
+
+// runRestore prints the restored archives as JSON lines
+func runRestore(ctx context.Context, runner *retention.Runner, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	org := fs.Int64("org", 0, "organization ID")
+	from := fs.String("from", "", "first day to restore, YYYY-MM-DD")
+	to := fs.String("to", "", "last day to restore, YYYY-MM-DD, -from when empty")
+	fs.Parse(args)
+	if *org <= 0 || *from == "" {
+		return errors.New("-org and -from are required")
+	}
+	if *to == "" {
+		*to = *from
+	}
+	start, err := time.Parse("2006-01-02", *from)
+	if err != nil {
+		return errors.Wrap(err, "-from")
+	}
+	end, err := time.Parse("2006-01-02", *to)
+	if err != nil {
+		return errors.Wrap(err, "-to")
+	}
+	if end.Before(start) {
+		return errors.New("-to is before -from")
+	}
+
+	results, err := runner.Restore(ctx, *org, start, end)
+	enc := json.NewEncoder(os.Stdout)
+	for _, res := range results {
+		enc.Encode(res)
+	}
+	if err == nil && len(results) == 0 {
+		log.Print("no archive to restore in this range")
+	}
+	return err
+}
+
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,122 @@
+// Command rollup consumes the campaign-data topic and maintains hourly and
+// daily rollups per campaign and platform. Cost and revenue are summed in
+// REPORTING_CURRENCY, converting other currencies with FX_RATES_FILE.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"campaign-analytics/fx"
+	"campaign-analytics/rollup"
+	"campaign-analytics/sink"
+
+	_ "github.com/lib/pq"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	appName       = "campaign-rollup"
+	inputTopic    = "campaign-data"
+	rollupsTopic  = "campaign-rollups"
+	flushSize     = 1000
+	flushInterval = 5 * time.Second
+
+	// ledgerRetention is how long applied message IDs are remembered, well
+	// past any redelivery or retry of a message
+	ledgerRetention = 7 * 24 * time.Hour
+	pruneInterval   = time.Hour
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	brokers := strings.Split(getenv("KAFKA_BROKERS", "localhost:9092"), ",")
+
+	var repo rollup.Repository = rollup.NewMemoryRepository()
+	if dsn := os.Getenv("DATABASE_URL"); dsn != "" {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			log.Fatalf("open database: %v", err)
+		}
+		defer db.Close()
+		pg := rollup.NewPostgresRepository(db)
+		go pruneLedger(ctx, pg)
+		repo = pg
+	} else {
+		log.Println("DATABASE_URL not set, keeping rollups in memory")
+	}
+
+	rates, currency, err := loadRates()
+	if err != nil {
+		log.Fatalf("load FX rates: %v", err)
+	}
+
+	emit := sink.NewKafkaSink(brokers, rollupsTopic)
+	defer emit.Close()
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: brokers,
+		GroupID: appName,
+		Topic:   inputTopic,
+		ErrorLogger: kafka.LoggerFunc(func(format string, args ...interface{}) {
+			log.Printf("Kafka reader error: "+format, args...)
+		}),
+	})
+	defer reader.Close()
+
+	consumer := &rollup.Consumer{
+		Reader:        reader,
+		Aggregator:    rollup.NewAggregator(repo, emit, rates, currency),
+		FlushSize:     flushSize,
+		FlushInterval: flushInterval,
+	}
+	log.Printf("Consuming %s", inputTopic)
+	if err := consumer.Run(ctx); err != nil && ctx.Err() == nil {
+		log.Fatalf("rollup consumer: %v", err)
+	}
+}
+
+// pruneLedger forgets applied message IDs older than ledgerRetention every
+// pruneInterval, so processed_messages does not grow without bound
+func pruneLedger(ctx context.Context, repo *rollup.PostgresRepository) {
+	for {
+		n, err := repo.PruneLedger(ctx, time.Now().UTC().Add(-ledgerRetention))
+		if err != nil && ctx.Err() == nil {
+			log.Printf("prune ledger: %v", err)
+		} else if n > 0 {
+			log.Printf("pruned %d applied message IDs", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pruneInterval):
+		}
+	}
+}
+
+// loadRates returns the FX rates of FX_RATES_FILE, nil when unset, and the
+// REPORTING_CURRENCY rollups are summed in, USD by default
+func loadRates() (*fx.Store, string, error) {
+	currency := getenv("REPORTING_CURRENCY", "USD")
+	path := os.Getenv("FX_RATES_FILE")
+	if path == "" {
+		return nil, currency, nil
+	}
+	rates, err := fx.LoadFile(path)
+	return rates, currency, err
+}
+
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,105 @@
+package codec
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Field is a protobuf field as recorded in the schema lock
+type Field struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Message is a protobuf message as recorded in the schema lock
+type Message struct {
+	Fields   map[int]Field `json:"fields"`
+	Reserved []int         `json:"reserved,omitempty"`
+}
+
+var (
+	messageRe  = regexp.MustCompile(`^message\s+(\w+)\s*\{`)
+	fieldRe    = regexp.MustCompile(`^(?:repeated\s+|optional\s+)?([\w.]+)\s+(\w+)\s*=\s*(\d+)`)
+	reservedRe = regexp.MustCompile(`^reserved\s+(.+);`)
+)
+
+// ParseProto extracts messages, fields and reserved numbers from a .proto
+// file. It only understands the flat messages used in this repo.
+func ParseProto(r io.Reader) (map[string]Message, error) {
+	msgs := make(map[string]Message)
+	var current string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(text, "//"); i >= 0 {
+			text = strings.TrimSpace(text[:i])
+		}
+		switch {
+		case text == "":
+		case messageRe.MatchString(text):
+			current = messageRe.FindStringSubmatch(text)[1]
+			msgs[current] = Message{Fields: make(map[int]Field)}
+		case text == "}":
+			current = ""
+		case current == "":
+		case reservedRe.MatchString(text):
+			msg := msgs[current]
+			for _, part := range strings.Split(reservedRe.FindStringSubmatch(text)[1], ",") {
+				n, err := strconv.Atoi(strings.TrimSpace(part))
+				if err != nil {
+					continue // reserved names
+				}
+				msg.Reserved = append(msg.Reserved, n)
+			}
+			msgs[current] = msg
+		case fieldRe.MatchString(text):
+			m := fieldRe.FindStringSubmatch(text)
+			num, _ := strconv.Atoi(m[3])
+			if _, dup := msgs[current].Fields[num]; dup {
+				return nil, fmt.Errorf("line %d: field number %d used twice in %s", line, num, current)
+			}
+			msgs[current].Fields[num] = Field{Name: m[2], Type: m[1]}
+		}
+	}
+	return msgs, errors.Wrap(scanner.Err(), "scan proto")
+}
+
+// CheckCompatible lists the changes from old to new that would break
+// consumers still reading the old schema
+func CheckCompatible(old, new map[string]Message) []string {
+	var problems []string
+	for name, om := range old {
+		nm, ok := new[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("message %s was removed", name))
+			continue
+		}
+		reserved := make(map[int]bool)
+		for _, n := range nm.Reserved {
+			reserved[n] = true
+		}
+		for num, of := range om.Fields {
+			nf, ok := nm.Fields[num]
+			switch {
+			case !ok && !reserved[num]:
+				problems = append(problems, fmt.Sprintf("%s.%s (%d) was removed without reserving its number", name, of.Name, num))
+			case ok && nf.Type != of.Type:
+				problems = append(problems, fmt.Sprintf("%s.%s (%d) changed type from %s to %s", name, of.Name, num, of.Type, nf.Type))
+			}
+		}
+		for _, num := range om.Reserved {
+			if f, ok := nm.Fields[num]; ok {
+				problems = append(problems, fmt.Sprintf("%s.%s reuses reserved number %d", name, f.Name, num))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
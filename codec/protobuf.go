@@ -0,0 +1,174 @@
+package codec
+
+import (
+	"math"
+
+	"campaign-analytics/schema"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers, kept in sync with proto/*.proto (checked by protobuf_test.go)
+const (
+	cdSchemaVersion protowire.Number = 1
+	cdCampaignID    protowire.Number = 2
+	cdPlatform      protowire.Number = 3
+	cdTimestamp     protowire.Number = 4
+	cdImpressions   protowire.Number = 5
+	cdClicks        protowire.Number = 6
+	cdConversions   protowire.Number = 7
+	cdCost          protowire.Number = 8
+	cdRevenue       protowire.Number = 9
+	cdCurrency      protowire.Number = 10
+	cdEventID       protowire.Number = 11
+	cdReportDate    protowire.Number = 12
+	cdLevel         protowire.Number = 13
+
+	exOrganizationID protowire.Number = 1
+	exCampaignID     protowire.Number = 2
+)
+
+func marshalCampaignData(d schema.CampaignData) []byte {
+	var b []byte
+	b = appendVarint(b, cdSchemaVersion, uint64(int64(d.SchemaVersion)))
+	b = appendString(b, cdCampaignID, d.CampaignID)
+	b = appendString(b, cdPlatform, d.Platform)
+	b = appendVarint(b, cdTimestamp, uint64(d.Timestamp))
+	b = appendVarint(b, cdImpressions, uint64(int64(d.Impressions)))
+	b = appendVarint(b, cdClicks, uint64(int64(d.Clicks)))
+	b = appendVarint(b, cdConversions, uint64(int64(d.Conversions)))
+	b = appendDouble(b, cdCost, d.Cost)
+	b = appendDouble(b, cdRevenue, d.Revenue)
+	b = appendString(b, cdCurrency, d.Currency)
+	b = appendString(b, cdEventID, d.EventID)
+	b = appendString(b, cdReportDate, d.ReportDate)
+	b = appendString(b, cdLevel, d.Level)
+	return b
+}
+
+func unmarshalCampaignData(b []byte) (schema.CampaignData, error) {
+	var d schema.CampaignData
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool) {
+		switch {
+		case num == cdCampaignID && typ == protowire.BytesType:
+			return consumeString(b, &d.CampaignID)
+		case num == cdPlatform && typ == protowire.BytesType:
+			return consumeString(b, &d.Platform)
+		case num == cdCurrency && typ == protowire.BytesType:
+			return consumeString(b, &d.Currency)
+		case num == cdEventID && typ == protowire.BytesType:
+			return consumeString(b, &d.EventID)
+		case num == cdReportDate && typ == protowire.BytesType:
+			return consumeString(b, &d.ReportDate)
+		case num == cdLevel && typ == protowire.BytesType:
+			return consumeString(b, &d.Level)
+		case num == cdCost && typ == protowire.Fixed64Type:
+			return consumeDouble(b, &d.Cost)
+		case num == cdRevenue && typ == protowire.Fixed64Type:
+			return consumeDouble(b, &d.Revenue)
+		case typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			switch num {
+			case cdSchemaVersion:
+				d.SchemaVersion = int(int32(v))
+			case cdTimestamp:
+				d.Timestamp = int64(v)
+			case cdImpressions:
+				d.Impressions = int(int64(v))
+			case cdClicks:
+				d.Clicks = int(int64(v))
+			case cdConversions:
+				d.Conversions = int(int64(v))
+			}
+			return n, true
+		}
+		return 0, false
+	})
+	return d, err
+}
+
+func marshalExportMessage(m ExportMessage) []byte {
+	var b []byte
+	b = appendVarint(b, exOrganizationID, uint64(m.OrganizationID))
+	b = appendVarint(b, exCampaignID, uint64(m.CampaignID))
+	return b
+}
+
+func unmarshalExportMessage(b []byte) (ExportMessage, error) {
+	var m ExportMessage
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, bool) {
+		if typ != protowire.VarintType {
+			return 0, false
+		}
+		v, n := protowire.ConsumeVarint(b)
+		switch num {
+		case exOrganizationID:
+			m.OrganizationID = int64(v)
+		case exCampaignID:
+			m.CampaignID = int64(v)
+		}
+		return n, true
+	})
+	return m, err
+}
+
+// consumeFields walks the fields of a message. field returns the number of
+// bytes it consumed and false for unknown fields, which are skipped so that
+// older consumers accept messages from newer producers.
+func consumeFields(b []byte, field func(protowire.Number, protowire.Type, []byte) (int, bool)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, known := field(num, typ, b)
+		if !known {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return errors.Wrapf(protowire.ParseError(n), "field %d", num)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// Zero values are omitted, as proto3 does for scalar fields
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendDouble(b []byte, num protowire.Number, f float64) []byte {
+	if f == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(f))
+}
+
+func consumeString(b []byte, dst *string) (int, bool) {
+	s, n := protowire.ConsumeString(b)
+	*dst = s
+	return n, true
+}
+
+func consumeDouble(b []byte, dst *float64) (int, bool) {
+	v, n := protowire.ConsumeFixed64(b)
+	*dst = math.Float64frombits(v)
+	return n, true
+}
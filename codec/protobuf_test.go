@@ -0,0 +1,159 @@
+package codec
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"campaign-analytics/schema"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var protoTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"int32":  descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"double": descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+}
+
+// descriptor builds the descriptor of a message of proto/*.proto, so the hand
+// written codec can be checked against the protobuf runtime
+func descriptor(t *testing.T, name string) protoreflect.MessageDescriptor {
+	t.Helper()
+	paths, err := filepath.Glob("proto/*.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("campaign_analytics.proto"),
+		Package: proto.String("campaignanalytics.v1"),
+		Syntax:  proto.String("proto3"),
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := ParseProto(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		for msgName, msg := range msgs {
+			md := &descriptorpb.DescriptorProto{Name: proto.String(msgName)}
+			for num, field := range msg.Fields {
+				typ, ok := protoTypes[field.Type]
+				if !ok {
+					t.Fatalf("%s.%s: unsupported type %s", msgName, field.Name, field.Type)
+				}
+				md.Field = append(md.Field, &descriptorpb.FieldDescriptorProto{
+					Name:     proto.String(field.Name),
+					JsonName: proto.String(field.Name),
+					Number:   proto.Int32(int32(num)),
+					Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					Type:     typ.Enum(),
+				})
+			}
+			fd.MessageType = append(fd.MessageType, md)
+		}
+	}
+	file, err := protodesc.NewFile(fd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := file.Messages().ByName(protoreflect.Name(name))
+	if desc == nil {
+		t.Fatalf("message %s not found in proto/", name)
+	}
+	return desc
+}
+
+// checkProto decodes b with the protobuf runtime, checks it holds exactly the
+// fields of want, by proto name, and returns it encoded by the runtime
+func checkProto(t *testing.T, desc protoreflect.MessageDescriptor, b []byte, want map[string]interface{}) []byte {
+	t.Helper()
+	if len(want) != desc.Fields().Len() {
+		t.Fatalf("%d fields tested, %s has %d", len(want), desc.Name(), desc.Fields().Len())
+	}
+	msg := dynamicpb.NewMessage(desc)
+	if err := proto.Unmarshal(b, msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.GetUnknown()) > 0 {
+		t.Fatal("fields encoded with numbers missing from the .proto")
+	}
+	for name, v := range want {
+		fd := desc.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			t.Fatalf("field %s missing from %s", name, desc.Name())
+		}
+		if got := msg.Get(fd).Interface(); got != v {
+			t.Errorf("%s: got %v (%T), want %v (%T)", name, got, got, v, v)
+		}
+	}
+	out, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCampaignDataProto(t *testing.T) {
+	d := schema.CampaignData{
+		SchemaVersion: 1,
+		CampaignID:    "c1",
+		Platform:      "meta",
+		Timestamp:     1700000000,
+		Impressions:   1000,
+		Clicks:        20,
+		Conversions:   3,
+		Cost:          12.5,
+		Revenue:       99.9,
+		Currency:      "EUR",
+		EventID:       "e1",
+		ReportDate:    "2023-11-14",
+		Level:         schema.LevelCampaign,
+	}
+	b := checkProto(t, descriptor(t, "CampaignData"), marshalCampaignData(d), map[string]interface{}{
+		"schema_version": int32(1),
+		"campaign_id":    "c1",
+		"platform":       "meta",
+		"timestamp":      int64(1700000000),
+		"impressions":    int64(1000),
+		"clicks":         int64(20),
+		"conversions":    int64(3),
+		"cost":           12.5,
+		"revenue":        99.9,
+		"currency":       "EUR",
+		"event_id":       "e1",
+		"report_date":    "2023-11-14",
+		"level":          schema.LevelCampaign,
+	})
+	got, err := unmarshalCampaignData(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != d {
+		t.Fatalf("round trip %+v, want %+v", got, d)
+	}
+}
+
+func TestExportMessageProto(t *testing.T) {
+	m := ExportMessage{OrganizationID: 7, CampaignID: 42}
+	b := checkProto(t, descriptor(t, "ExportMessage"), marshalExportMessage(m), map[string]interface{}{
+		"organization_id": int64(7),
+		"campaign_id":     int64(42),
+	})
+	got, err := unmarshalExportMessage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != m {
+		t.Fatalf("round trip %+v, want %+v", got, m)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDedupWindow     = 24 * time.Hour
+	defaultDedupMaxEntries = 100000
+)
+
+// ErrDedupInFlight is returned when a request with the same key is still being processed
+var ErrDedupInFlight = errors.New("request with the same idempotency key is in progress")
+
+// DedupResult is the response recorded for an idempotency key so that retries
+// can be answered with the original outcome
+type DedupResult struct {
+	StatusCode int
+	Body       []byte
+}
+
+// DedupStore tracks idempotency keys seen within a time window. A persistent
+// implementation (Redis, Postgres...) only needs to satisfy this interface.
+type DedupStore interface {
+	// Begin reserves key. If the key already completed within the window the
+	// original result is returned; if it is still reserved ErrDedupInFlight is returned.
+	Begin(ctx context.Context, key string) (*DedupResult, error)
+	// Complete stores the result for a key reserved by Begin
+	Complete(ctx context.Context, key string, res DedupResult) error
+	// Abort releases a reservation so the key can be retried
+	Abort(ctx context.Context, key string) error
+}
+
+// newDedupStore builds the store used by the ingest handlers, with the
+// window taken from INGEST_DEDUP_WINDOW
+func newDedupStore() DedupStore {
+	window := defaultDedupWindow
+	if v := os.Getenv("INGEST_DEDUP_WINDOW"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			window = d
+		}
+	}
+	return NewMemoryDedupStore(window, defaultDedupMaxEntries)
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+	result  *DedupResult // nil while in flight
+}
+
+// MemoryDedupStore is a bounded in-memory DedupStore. Entries expire after the
+// window and the oldest entries are evicted once maxEntries is reached.
+type MemoryDedupStore struct {
+	mu         sync.Mutex
+	window     time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List // oldest first
+	now        func() time.Time
+}
+
+func NewMemoryDedupStore(window time.Duration, maxEntries int) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		window:     window,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		now:        time.Now,
+	}
+}
+
+func (s *MemoryDedupStore) Begin(_ context.Context, key string) (*DedupResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.evictExpired(now)
+
+	if el, ok := s.entries[key]; ok {
+		e := el.Value.(*dedupEntry)
+		if e.result == nil {
+			return nil, ErrDedupInFlight
+		}
+		return e.result, nil
+	}
+
+	for s.maxEntries > 0 && s.order.Len() >= s.maxEntries {
+		s.remove(s.order.Front())
+	}
+	s.entries[key] = s.order.PushBack(&dedupEntry{key: key, expires: now.Add(s.window)})
+	return nil, nil
+}
+
+func (s *MemoryDedupStore) Complete(_ context.Context, key string, res DedupResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*dedupEntry)
+	e.result = &res
+	e.expires = s.now().Add(s.window)
+	s.order.MoveToBack(el)
+	return nil
+}
+
+func (s *MemoryDedupStore) Abort(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.entries[key]; ok && el.Value.(*dedupEntry).result == nil {
+		s.remove(el)
+	}
+	return nil
+}
+
+// evictExpired drops entries from the front of the list until an unexpired one is found
+func (s *MemoryDedupStore) evictExpired(now time.Time) {
+	for el := s.order.Front(); el != nil; el = s.order.Front() {
+		if el.Value.(*dedupEntry).expires.After(now) {
+			return
+		}
+		s.remove(el)
+	}
+}
+
+func (s *MemoryDedupStore) remove(el *list.Element) {
+	s.order.Remove(el)
+	delete(s.entries, el.Value.(*dedupEntry).key)
+}
@@ -0,0 +1,189 @@
+// Package dlq inspects dead-lettered export messages and replays them to the
+// main topic, keeping an audit record of every replay.
+package dlq
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"campaign-analytics/codec"
+	"campaign-analytics/retry"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// Headers set on replayed messages
+const (
+	HeaderReplayedFrom = "dlq_replayed_from" // topic/partition/offset of the dead message
+	HeaderReplayedAt   = "dlq_replayed_at"   // RFC 3339 replay time
+)
+
+// reasonHeaders are the headers that may carry the failure reason, most specific first
+var reasonHeaders = []string{retry.HeaderError, "discard_error", "error"}
+
+// Entry describes a dead-lettered message
+type Entry struct {
+	Partition      int               `json:"partition"`
+	Offset         int64             `json:"offset"`
+	Time           time.Time         `json:"time"`
+	Key            string            `json:"key,omitempty"`
+	Reason         string            `json:"reason,omitempty"`
+	RetryCount     int               `json:"retry_count"`
+	OrganizationID int64             `json:"organization_id,omitempty"`
+	CampaignID     int64             `json:"campaign_id,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Payload        json.RawMessage   `json:"payload,omitempty"` // JSON payloads only
+	DecodeError    string            `json:"decode_error,omitempty"`
+}
+
+// Describe extracts the failure details and export IDs of a dead message
+func Describe(msg kafka.Message) Entry {
+	e := Entry{
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Time:      msg.Time.UTC(),
+		Key:       string(msg.Key),
+		Headers:   make(map[string]string, len(msg.Headers)),
+	}
+	for _, h := range msg.Headers {
+		e.Headers[h.Key] = string(h.Value)
+	}
+	for _, k := range reasonHeaders {
+		if v := e.Headers[k]; v != "" {
+			e.Reason = v
+			break
+		}
+	}
+	e.RetryCount = retry.Attempt(msg)
+	if n, err := strconv.Atoi(e.Headers["discard_retry_count"]); err == nil && n > e.RetryCount {
+		e.RetryCount = n
+	}
+
+	exp, err := decodeExport(msg)
+	if err != nil {
+		e.DecodeError = err.Error()
+	}
+	e.OrganizationID, e.CampaignID = exp.OrganizationID, exp.CampaignID
+	if json.Valid(msg.Value) {
+		e.Payload = msg.Value
+	}
+	return e
+}
+
+func decodeExport(msg kafka.Message) (codec.ExportMessage, error) {
+	enc, err := codec.EncodingOf(msg.Headers)
+	if err != nil {
+		return codec.ExportMessage{}, err
+	}
+	if enc == codec.Protobuf {
+		return codec.DecodeExportMessage(msg.Value)
+	}
+	var exp codec.ExportMessage
+	err = json.Unmarshal(msg.Value, &exp)
+	return exp, errors.Wrap(err, "JSON unmarshal")
+}
+
+// Filter selects entries. Zero fields match everything.
+type Filter struct {
+	OrganizationID int64
+	CampaignID     int64
+	Since, Until   time.Time
+}
+
+// Match reports whether e passes the filter
+func (f Filter) Match(e Entry) bool {
+	if f.OrganizationID != 0 && e.OrganizationID != f.OrganizationID {
+		return false
+	}
+	if f.CampaignID != 0 && e.CampaignID != f.CampaignID {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Scan calls fn for every message of topic published at or after since (the
+// whole topic when zero), up to the end offsets observed when the scan starts
+func Scan(ctx context.Context, brokers []string, topic string, since time.Time, fn func(kafka.Message) error) error {
+	conn, err := kafka.DialContext(ctx, "tcp", brokers[0])
+	if err != nil {
+		return errors.Wrap(err, "dial")
+	}
+	partitions, err := conn.ReadPartitions(topic)
+	conn.Close()
+	if err != nil {
+		return errors.Wrap(err, "read partitions")
+	}
+	for _, p := range partitions {
+		if err := scanPartition(ctx, brokers, topic, p.ID, since, fn); err != nil {
+			return errors.Wrapf(err, "partition %d", p.ID)
+		}
+	}
+	return nil
+}
+
+func scanPartition(ctx context.Context, brokers []string, topic string, partition int, since time.Time, fn func(kafka.Message) error) error {
+	leader, err := kafka.DialLeader(ctx, "tcp", brokers[0], topic, partition)
+	if err != nil {
+		return errors.Wrap(err, "dial leader")
+	}
+	first, last, err := leader.ReadOffsets()
+	leader.Close()
+	if err != nil {
+		return errors.Wrap(err, "read offsets")
+	}
+	if last <= first {
+		return nil
+	}
+
+	r := kafka.NewReader(kafka.ReaderConfig{Brokers: brokers, Topic: topic, Partition: partition})
+	defer r.Close()
+	if since.IsZero() {
+		err = r.SetOffset(kafka.FirstOffset)
+	} else {
+		err = r.SetOffsetAt(ctx, since)
+	}
+	if err != nil {
+		return errors.Wrap(err, "seek")
+	}
+	if r.Offset() >= last {
+		return nil
+	}
+	for {
+		msg, err := r.ReadMessage(ctx)
+		if err != nil {
+			return errors.Wrap(err, "read message")
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+		if msg.Offset+1 >= last {
+			return nil
+		}
+	}
+}
+
+// Fetch reads the message at partition/offset of topic
+func Fetch(ctx context.Context, brokers []string, topic string, partition int, offset int64) (kafka.Message, error) {
+	r := kafka.NewReader(kafka.ReaderConfig{Brokers: brokers, Topic: topic, Partition: partition})
+	defer r.Close()
+	if err := r.SetOffset(offset); err != nil {
+		return kafka.Message{}, errors.Wrap(err, "seek")
+	}
+	msg, err := r.ReadMessage(ctx)
+	if err != nil {
+		return kafka.Message{}, errors.Wrap(err, "read message")
+	}
+	if msg.Offset != offset {
+		return kafka.Message{}, errors.Errorf("offset %d no longer available, next is %d", offset, msg.Offset)
+	}
+	return msg, nil
+}
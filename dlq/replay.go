@@ -0,0 +1,163 @@
+package dlq
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"campaign-analytics/codec"
+	"campaign-analytics/retry"
+	"campaign-analytics/sink"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// Audit record statuses. A replay is recorded as started before the message
+// is written and as completed or failed after, so a started record without
+// an outcome tells that the message may have been written.
+const (
+	AuditStarted   = "started"
+	AuditCompleted = "completed"
+	AuditFailed    = "failed"
+)
+
+// AuditRecord is kept for every replayed message
+type AuditRecord struct {
+	Status        string    `json:"status"`
+	Error         string    `json:"error,omitempty"` // write error of a failed replay
+	ReplayedAt    time.Time `json:"replayed_at"`
+	Actor         string    `json:"actor"`
+	Note          string    `json:"note,omitempty"`
+	SourceTopic   string    `json:"source_topic"`
+	Partition     int       `json:"partition"`
+	Offset        int64     `json:"offset"`
+	DestTopic     string    `json:"dest_topic"`
+	Reason        string    `json:"reason,omitempty"` // failure reason of the dead message
+	Edited        bool      `json:"edited"`
+	OriginalHash  string    `json:"original_sha256"`
+	PayloadHash   string    `json:"payload_sha256"`
+	OriginalValue []byte    `json:"original_value,omitempty"` // kept when the payload was edited
+}
+
+// AuditLog stores audit records
+type AuditLog interface {
+	Record(ctx context.Context, rec AuditRecord) error
+}
+
+// FileAuditLog appends audit records as JSON lines
+type FileAuditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileAuditLog(path string) *FileAuditLog {
+	return &FileAuditLog{path: path}
+}
+
+func (l *FileAuditLog) Record(_ context.Context, rec AuditRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "encode audit record")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "open audit log")
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return errors.Wrap(err, "write audit log")
+	}
+	return errors.Wrap(f.Close(), "close audit log")
+}
+
+// Replayer puts dead messages back on the main topic
+type Replayer struct {
+	Dest      sink.EventSink
+	DestTopic string
+	Audit     AuditLog
+	Actor     string
+	Note      string
+}
+
+// Replay writes msg to the main topic, with payload replacing its value when
+// not nil, and records the replay. An edited payload is JSON encoded. Retry
+// headers are dropped so the message gets a fresh set of attempts. Nothing is
+// written when the started record cannot be stored.
+func (r *Replayer) Replay(ctx context.Context, msg kafka.Message, payload []byte) error {
+	out := kafka.Message{Key: msg.Key, Value: msg.Value}
+	edited := payload != nil
+	if edited {
+		if !json.Valid(payload) {
+			return errors.New("edited payload is not valid JSON")
+		}
+		out.Value = payload
+	}
+	for _, h := range msg.Headers {
+		switch h.Key {
+		case retry.HeaderNotBefore, retry.HeaderAttempt, retry.HeaderOriginTopic, retry.HeaderError,
+			"discard_retry_count", HeaderReplayedFrom, HeaderReplayedAt:
+		case codec.HeaderEncoding:
+			if !edited {
+				out.Headers = append(out.Headers, h)
+			}
+		default:
+			out.Headers = append(out.Headers, h)
+		}
+	}
+	now := time.Now().UTC()
+	out.Headers = append(out.Headers,
+		kafka.Header{Key: HeaderReplayedFrom, Value: []byte(fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset))},
+		kafka.Header{Key: HeaderReplayedAt, Value: []byte(now.Format(time.RFC3339))},
+	)
+	if edited {
+		out.Headers = append(out.Headers, codec.Header(codec.JSON))
+	}
+
+	rec := AuditRecord{
+		Status:       AuditStarted,
+		ReplayedAt:   now,
+		Actor:        r.Actor,
+		Note:         r.Note,
+		SourceTopic:  msg.Topic,
+		Partition:    msg.Partition,
+		Offset:       msg.Offset,
+		DestTopic:    r.DestTopic,
+		Reason:       Describe(msg).Reason,
+		Edited:       edited,
+		OriginalHash: hash(msg.Value),
+		PayloadHash:  hash(out.Value),
+	}
+	if edited {
+		rec.OriginalValue = msg.Value
+	}
+	if err := r.Audit.Record(ctx, rec); err != nil {
+		return errors.Wrap(err, "audit replay start")
+	}
+
+	werr := r.Dest.Write(ctx, out)
+	rec.Status, rec.OriginalValue = AuditCompleted, nil
+	if werr != nil {
+		rec.Status, rec.Error = AuditFailed, werr.Error()
+	}
+	// The outcome is recorded even when the write was cancelled
+	if err := r.Audit.Record(context.WithoutCancel(ctx), rec); err != nil {
+		if werr != nil {
+			return errors.Wrapf(werr, "write to main topic (audit replay outcome: %v)", err)
+		}
+		return errors.Wrap(err, "audit replay outcome")
+	}
+	return errors.Wrap(werr, "write to main topic")
+}
+
+func hash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
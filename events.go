@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"campaign-analytics/events"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const campaignEventsTopic = "campaign-events"
+
+// newEventMessage serializes an event into a Kafka message. Events are keyed
+// by user so that a user's journey stays ordered within one partition.
+func newEventMessage(ev events.Event) (kafka.Message, error) {
+	msgBytes, err := json.Marshal(ev)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	msg := kafka.Message{
+		Key:   []byte(ev.UserID),
+		Value: msgBytes,
+		Headers: []kafka.Header{
+			{Key: "campaign_id", Value: []byte(strconv.FormatInt(ev.CampaignID, 10))},
+			{Key: "event_type", Value: []byte(ev.EventType)},
+		},
+	}
+	if ev.EventID != "" {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: "event_id", Value: []byte(ev.EventID)})
+	}
+	return msg, nil
+}
+
+func parseEventLine(raw json.RawMessage) (batchRecord, error) {
+	var ev events.Event
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		return batchRecord{}, errors.New("Invalid JSON: " + err.Error())
+	}
+	if err := events.Validate(ev); err != nil {
+		return batchRecord{}, err
+	}
+	msg, err := newEventMessage(ev)
+	if err != nil {
+		return batchRecord{}, errors.New("Internal Server Error")
+	}
+	rec := batchRecord{msg: msg}
+	if ev.EventID != "" {
+		// Namespaced so event IDs cannot collide with campaign-data IDs
+		rec.dedupKey = "event:" + ev.EventID
+	}
+	return rec, nil
+}
+
+// eventsHandler ingests raw events, one per NDJSON line or as a JSON array,
+// into the campaign-events topic.
+func (s *ingestServer) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	s.serveBatch(w, r, s.events, parseEventLine)
+}
@@ -0,0 +1,89 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// MessageReader is the part of *kafka.Reader the consumer needs
+type MessageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Saver stores events, skipping IDs already stored
+type Saver interface {
+	Save(ctx context.Context, evs []Event) (int, error)
+}
+
+// Consumer writes the campaign-events topic into the events table, saving
+// every FlushSize events or FlushInterval before committing their offsets.
+// Events without an ID get one from their topic position, so a redelivered
+// message is stored once.
+type Consumer struct {
+	Reader        MessageReader
+	Store         Saver
+	FlushSize     int
+	FlushInterval time.Duration
+}
+
+// Run consumes until ctx is done or a save fails
+func (c *Consumer) Run(ctx context.Context) error {
+	var pending []Event
+	var uncommitted []kafka.Message
+	deadline := time.Now().Add(c.FlushInterval)
+	for {
+		fctx, cancel := context.WithDeadline(ctx, deadline)
+		msg, err := c.Reader.FetchMessage(fctx)
+		cancel()
+		switch {
+		case err == nil:
+			uncommitted = append(uncommitted, msg)
+			var ev Event
+			if err := json.Unmarshal(msg.Value, &ev); err != nil {
+				log.Printf("events: skipping invalid message at %s/%d/%d: %v", msg.Topic, msg.Partition, msg.Offset, err)
+				break
+			}
+			if err := Validate(ev); err != nil {
+				log.Printf("events: skipping invalid event at %s/%d/%d: %v", msg.Topic, msg.Partition, msg.Offset, err)
+				break
+			}
+			if ev.EventID == "" {
+				ev.EventID = fmt.Sprintf("kafka:%s:%d:%d", msg.Topic, msg.Partition, msg.Offset)
+			}
+			pending = append(pending, ev)
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, context.DeadlineExceeded):
+		default:
+			return errors.Wrap(err, "fetch message")
+		}
+
+		if len(uncommitted) < c.FlushSize && time.Now().Before(deadline) {
+			continue
+		}
+		if len(pending) > 0 {
+			stored, err := c.Store.Save(ctx, pending)
+			if err != nil {
+				return errors.Wrap(err, "save events")
+			}
+			if skipped := len(pending) - stored; skipped > 0 {
+				log.Printf("events: %d events already stored or of unknown campaign, channel or audience", skipped)
+			}
+			pending = pending[:0]
+		}
+		if len(uncommitted) > 0 {
+			if err := c.Reader.CommitMessages(ctx, uncommitted...); err != nil {
+				return errors.Wrap(err, "commit offsets")
+			}
+			uncommitted = uncommitted[:0]
+		}
+		deadline = time.Now().Add(c.FlushInterval)
+	}
+}
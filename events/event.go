@@ -0,0 +1,52 @@
+// Package events holds raw impression/click/conversion events, the rows of
+// the events table, and the stores reading them.
+package events
+
+import (
+	"errors"
+	"time"
+)
+
+// Event types matching the CHECK constraint on the events table
+const (
+	Impression = "impression"
+	Click      = "click"
+	Conversion = "conversion"
+)
+
+// Event is a single raw impression/click/conversion, mirroring a row of the events table
+type Event struct {
+	EventID        string  `json:"event_id,omitempty"`
+	CampaignID     int64   `json:"campaign_id"`
+	ChannelID      int64   `json:"channel_id"` // 0 for stored events without a channel
+	AudienceID     int64   `json:"audience_id,omitempty"`
+	EventType      string  `json:"event_type"`
+	EventTimestamp int64   `json:"event_timestamp"` // unix seconds
+	UserID         string  `json:"user_id"`
+	Revenue        float64 `json:"revenue,omitempty"` // conversion value, conversions only
+}
+
+// Time returns the event timestamp
+func (e Event) Time() time.Time {
+	return time.Unix(e.EventTimestamp, 0).UTC()
+}
+
+// Validate checks the fields required by the events table
+func Validate(ev Event) error {
+	if ev.CampaignID <= 0 || ev.ChannelID <= 0 || ev.EventTimestamp == 0 || ev.UserID == "" {
+		return errors.New("Missing required fields")
+	}
+	switch ev.EventType {
+	case Impression, Click:
+		if ev.Revenue != 0 {
+			return errors.New("revenue is only allowed on conversion events")
+		}
+	case Conversion:
+	default:
+		return errors.New("event_type must be one of impression, click, conversion")
+	}
+	if ev.AudienceID < 0 || ev.Revenue < 0 {
+		return errors.New("audience_id and revenue must not be negative")
+	}
+	return nil
+}
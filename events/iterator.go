@@ -0,0 +1,143 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBatchSize is the page size used when an iterator is given none
+const DefaultBatchSize = 1000
+
+// Iterator pages through events with constant memory. Next returns io.EOF
+// once every event has been returned.
+type Iterator interface {
+	Next(ctx context.Context) ([]Event, error)
+}
+
+// cursor is the keyset position of the last returned event
+type cursor struct {
+	userID string
+	ts     time.Time
+	id     string
+}
+
+// pgIterator pages with a keyset on (key, event_timestamp, event_id) so that
+// every page is an index range scan whatever its depth. The query is
+// formatted with the cursor conditions on key alone and on the keyset, then
+// the page size.
+type pgIterator struct {
+	db    *sql.DB
+	query string
+	key   string // user expression of the keyset
+	args  []interface{}
+	size  int
+	// short is set when a page may hold fewer than size events before the
+	// last one, which then is the first empty page
+	short bool
+	last  *cursor
+	done  bool
+}
+
+func (it *pgIterator) Next(ctx context.Context) ([]Event, error) {
+	if it.done {
+		return nil, io.EOF
+	}
+	if it.size <= 0 {
+		it.size = DefaultBatchSize
+	}
+	userCond, cond, args := "", "", it.args
+	if it.last != nil {
+		n := len(args)
+		userCond = fmt.Sprintf(" AND %s >= $%d", it.key, n+1)
+		cond = fmt.Sprintf("\n  AND (%s, event_timestamp, event_id) > ($%d, $%d, $%d)", it.key, n+1, n+2, n+3)
+		args = append(args[:n:n], it.last.userID, it.last.ts, it.last.id)
+	}
+	rows, err := it.db.QueryContext(ctx, fmt.Sprintf(it.query, userCond, cond, it.size), args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query events page")
+	}
+	defer rows.Close()
+	evs, lastTS, err := scanEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(evs) < it.size && !it.short {
+		it.done = true
+	}
+	if len(evs) == 0 {
+		return nil, io.EOF
+	}
+	last := evs[len(evs)-1]
+	it.last = &cursor{userID: last.UserID, ts: lastTS, id: last.EventID}
+	return evs, nil
+}
+
+// sliceIterator pages through events already in memory
+type sliceIterator struct {
+	evs  []Event
+	size int
+}
+
+func (it *sliceIterator) Next(context.Context) ([]Event, error) {
+	if len(it.evs) == 0 {
+		return nil, io.EOF
+	}
+	if it.size <= 0 {
+		it.size = DefaultBatchSize
+	}
+	n := it.size
+	if n > len(it.evs) {
+		n = len(it.evs)
+	}
+	page := it.evs[:n:n]
+	it.evs = it.evs[n:]
+	return page, nil
+}
+
+// UserIterator regroups the pages of an Iterator ordered by user into the
+// events of one user at a time, carrying a user split across pages over
+type UserIterator struct {
+	it      Iterator
+	pending []Event
+	eof     bool
+}
+
+func ByUser(it Iterator) *UserIterator {
+	return &UserIterator{it: it}
+}
+
+// Next returns every event of the next user, io.EOF after the last one
+func (u *UserIterator) Next(ctx context.Context) ([]Event, error) {
+	for {
+		// The first user of pending is complete once a later user shows up
+		for i := 1; i < len(u.pending); i++ {
+			if u.pending[i].UserID != u.pending[0].UserID {
+				user := u.pending[:i:i]
+				u.pending = u.pending[i:]
+				return user, nil
+			}
+		}
+		if u.eof {
+			if len(u.pending) == 0 {
+				return nil, io.EOF
+			}
+			user := u.pending
+			u.pending = nil
+			return user, nil
+		}
+		page, err := u.it.Next(ctx)
+		if err == io.EOF {
+			u.eof = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		u.pending = append(u.pending[:len(u.pending):len(u.pending)], page...)
+	}
+}
@@ -0,0 +1,84 @@
+package events
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func eventRows(ids ...string) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"event_id", "campaign_id", "channel_id", "audience_id", "event_type", "event_timestamp", "user_id", "revenue"})
+	for _, id := range ids {
+		// The user is the first letter of the ID
+		rows.AddRow(id, 1, 1, nil, Conversion, time.Unix(1700000000, 0), id[:1], 1.0)
+	}
+	return rows
+}
+
+func collectIDs(t *testing.T, it Iterator) []string {
+	t.Helper()
+	var ids []string
+	for {
+		page, err := it.Next(context.Background())
+		if err == io.EOF {
+			return ids
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ev := range page {
+			ids = append(ids, ev.EventID)
+		}
+	}
+}
+
+// Users a (2 events), b and c by pages of 2. The page after a starts from a,
+// which has no events left, so it holds b alone while c remains.
+func TestJourneysShortPage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	limit := regexp.QuoteMeta("LIMIT 2 + 1")
+	mock.ExpectQuery(limit).WillReturnRows(eventRows("a1", "a2"))
+	mock.ExpectQuery(limit).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "a", sqlmock.AnyArg(), "a2").
+		WillReturnRows(eventRows("b1"))
+	mock.ExpectQuery(limit).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), "b", sqlmock.AnyArg(), "b1").
+		WillReturnRows(eventRows("c1"))
+	mock.ExpectQuery(limit).WillReturnRows(eventRows())
+
+	from := time.Unix(1700000000, 0)
+	got := collectIDs(t, NewPostgresStore(db).IterateJourneys(from, from.Add(time.Hour), time.Hour, 2))
+	if want := []string{"a1", "a2", "b1", "c1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A short page of campaign events is the last one
+func TestCampaignEventsShortPage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mock.ExpectQuery("LIMIT 2").WillReturnRows(eventRows("a1", "a2"))
+	mock.ExpectQuery("LIMIT 2").WillReturnRows(eventRows("b1"))
+
+	from := time.Unix(1700000000, 0)
+	got := collectIDs(t, NewPostgresStore(db).IterateCampaignEvents(1, from, from.Add(time.Hour), 2))
+	if want := []string{"a1", "a2", "b1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
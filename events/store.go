@@ -0,0 +1,277 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Store reads raw events, batchSize at a time (DefaultBatchSize when 0)
+type Store interface {
+	// IterateJourneys pages, ordered by user then time, through the events
+	// between from-lookback and to of every user with a conversion in [from, to)
+	IterateJourneys(from, to time.Time, lookback time.Duration, batchSize int) Iterator
+	// IterateCampaignEvents pages, ordered by user then time, through the
+	// events of a campaign in [from, to). Events without a user are left out,
+	// as they cannot be followed from one step to the next.
+	IterateCampaignEvents(campaignID int64, from, to time.Time, batchSize int) Iterator
+	// CountImpressions counts the impressions of the campaigns on the days in
+	// [from, to), of channelID unless 0. The keys are those of the reach
+	// sketches, so impressions over reach is the frequency.
+	CountImpressions(ctx context.Context, campaignIDs []int64, channelID int64, from, to time.Time) (int64, error)
+}
+
+// PostgresStore reads the events table. Pages are ordered like
+// events_campaign_user and events_user (see migrations) so each one is an
+// index range scan.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+const eventColumns = "event_id, campaign_id, channel_id, audience_id, event_type, event_timestamp, user_id, revenue"
+
+// IterateJourneys reads, for each page, the events of the next batchSize+1
+// converting users from the cursor's user on. Each has its conversion in
+// range, so a page is only empty once every user is read, but the cursor's
+// user may have no events left and a page may be short before the last one.
+// Users without user_id have no journey.
+func (s *PostgresStore) IterateJourneys(from, to time.Time, lookback time.Duration, batchSize int) Iterator {
+	return &pgIterator{
+		db:  s.db,
+		key: "user_id",
+		query: `
+WITH users AS (
+    SELECT DISTINCT user_id FROM events
+    WHERE event_type = 'conversion' AND event_timestamp >= $1 AND event_timestamp < $2%[1]s
+    ORDER BY user_id
+    LIMIT %[3]d + 1
+)
+SELECT ` + eventColumns + `
+FROM events
+JOIN users USING (user_id)
+WHERE event_timestamp >= $3 AND event_timestamp < $2%[2]s
+ORDER BY user_id, event_timestamp, event_id
+LIMIT %[3]d`,
+		args:  []interface{}{from, to, from.Add(-lookback)},
+		size:  batchSize,
+		short: true,
+	}
+}
+
+func (s *PostgresStore) IterateCampaignEvents(campaignID int64, from, to time.Time, batchSize int) Iterator {
+	return &pgIterator{
+		db:  s.db,
+		key: "COALESCE(user_id, '')",
+		query: `
+SELECT ` + eventColumns + `
+FROM events
+WHERE campaign_id = $1 AND event_timestamp >= $2 AND event_timestamp < $3
+  AND COALESCE(user_id, '') <> ''%[2]s
+ORDER BY COALESCE(user_id, ''), event_timestamp, event_id
+LIMIT %[3]d`,
+		args: []interface{}{campaignID, from, to},
+		size: batchSize,
+	}
+}
+
+// CountImpressions also counts the impressions retention compacted into
+// event_daily_rollups
+func (s *PostgresStore) CountImpressions(ctx context.Context, campaignIDs []int64, channelID int64, from, to time.Time) (int64, error) {
+	var n int64
+	err := s.db.QueryRowContext(ctx, `
+SELECT
+    (SELECT COUNT(*) FROM events
+     WHERE event_type = 'impression' AND user_id IS NOT NULL AND campaign_id = ANY($1)
+       AND ($2 = 0 OR channel_id = $2) AND event_timestamp >= $3 AND event_timestamp < $4)
+  + (SELECT COALESCE(SUM(events), 0) FROM event_daily_rollups
+     WHERE event_type = 'impression' AND campaign_id = ANY($1)
+       AND ($2 = 0 OR channel_id = $2) AND day >= $3 AND day < $4)`,
+		pq.Array(campaignIDs), channelID, from, to).Scan(&n)
+	return n, errors.Wrap(err, "count impressions")
+}
+
+// Save stores events, skipping IDs already stored and events whose campaign,
+// channel or audience is unknown. It returns the number of events stored.
+func (s *PostgresStore) Save(ctx context.Context, evs []Event) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `
+INSERT INTO events (`+eventColumns+`)
+SELECT $1, $2, $3, $4, $5, $6, $7, $8
+WHERE EXISTS (SELECT 1 FROM campaigns WHERE campaign_id = $2)
+  AND EXISTS (SELECT 1 FROM channels WHERE channel_id = $3)
+  AND ($4::INT IS NULL OR EXISTS (SELECT 1 FROM audiences WHERE audience_id = $4))
+ON CONFLICT (event_id) DO NOTHING`)
+	if err != nil {
+		return 0, errors.Wrap(err, "prepare insert")
+	}
+	defer stmt.Close()
+	stored := 0
+	for _, ev := range evs {
+		var (
+			audience sql.NullInt64
+			userID   sql.NullString
+			revenue  sql.NullFloat64
+		)
+		if ev.AudienceID != 0 {
+			audience = sql.NullInt64{Int64: ev.AudienceID, Valid: true}
+		}
+		if ev.UserID != "" {
+			userID = sql.NullString{String: ev.UserID, Valid: true}
+		}
+		if ev.EventType == Conversion {
+			revenue = sql.NullFloat64{Float64: ev.Revenue, Valid: true}
+		}
+		res, err := stmt.ExecContext(ctx, ev.EventID, ev.CampaignID, ev.ChannelID, audience, ev.EventType, ev.Time(), userID, revenue)
+		if err != nil {
+			return 0, errors.Wrapf(err, "insert event %s", ev.EventID)
+		}
+		n, _ := res.RowsAffected()
+		stored += int(n)
+	}
+	return stored, errors.Wrap(tx.Commit(), "commit transaction")
+}
+
+// scanEvents also returns the timestamp of the last event, which
+// EventTimestamp truncates to the second
+func scanEvents(rows *sql.Rows) ([]Event, time.Time, error) {
+	var (
+		out  []Event
+		last time.Time
+	)
+	for rows.Next() {
+		var (
+			ev       Event
+			channel  sql.NullInt64
+			audience sql.NullInt64
+			userID   sql.NullString
+			revenue  sql.NullFloat64
+			ts       time.Time
+		)
+		err := rows.Scan(&ev.EventID, &ev.CampaignID, &channel, &audience, &ev.EventType, &ts, &userID, &revenue)
+		if err != nil {
+			return nil, time.Time{}, errors.Wrap(err, "scan event")
+		}
+		ev.ChannelID = channel.Int64
+		ev.AudienceID = audience.Int64
+		ev.UserID = userID.String
+		ev.Revenue = revenue.Float64
+		ev.EventTimestamp = ts.Unix()
+		out = append(out, ev)
+		last = ts
+	}
+	return out, last, errors.Wrap(rows.Err(), "iterate events")
+}
+
+// MemoryStore keeps events in memory, for tests and local development
+type MemoryStore struct {
+	mu     sync.RWMutex
+	events []Event
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Add stores events
+func (s *MemoryStore) Add(evs ...Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, evs...)
+}
+
+// Save stores events, skipping IDs already stored
+func (s *MemoryStore) Save(_ context.Context, evs []Event) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := 0
+	for _, ev := range evs {
+		dup := false
+		for _, old := range s.events {
+			if old.EventID == ev.EventID {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			s.events = append(s.events, ev)
+			stored++
+		}
+	}
+	return stored, nil
+}
+
+func (s *MemoryStore) IterateJourneys(from, to time.Time, lookback time.Duration, batchSize int) Iterator {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	converted := make(map[string]bool)
+	for _, ev := range s.events {
+		if ev.EventType == Conversion && ev.UserID != "" && inRange(ev.Time(), from, to) {
+			converted[ev.UserID] = true
+		}
+	}
+	var out []Event
+	for _, ev := range s.events {
+		if converted[ev.UserID] && inRange(ev.Time(), from.Add(-lookback), to) {
+			out = append(out, ev)
+		}
+	}
+	SortByUser(out)
+	return &sliceIterator{evs: out, size: batchSize}
+}
+
+func (s *MemoryStore) IterateCampaignEvents(campaignID int64, from, to time.Time, batchSize int) Iterator {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []Event
+	for _, ev := range s.events {
+		if ev.CampaignID == campaignID && ev.UserID != "" && inRange(ev.Time(), from, to) {
+			out = append(out, ev)
+		}
+	}
+	SortByUser(out)
+	return &sliceIterator{evs: out, size: batchSize}
+}
+
+func (s *MemoryStore) CountImpressions(_ context.Context, campaignIDs []int64, channelID int64, from, to time.Time) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	campaigns := make(map[int64]bool, len(campaignIDs))
+	for _, id := range campaignIDs {
+		campaigns[id] = true
+	}
+	var n int64
+	for _, ev := range s.events {
+		if ev.EventType == Impression && ev.UserID != "" && campaigns[ev.CampaignID] &&
+			(channelID == 0 || ev.ChannelID == channelID) && inRange(ev.Time(), from, to) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// SortByUser orders events by user then time, keeping insertion order for ties
+func SortByUser(evs []Event) {
+	sort.SliceStable(evs, func(i, j int) bool {
+		if evs[i].UserID != evs[j].UserID {
+			return evs[i].UserID < evs[j].UserID
+		}
+		return evs[i].EventTimestamp < evs[j].EventTimestamp
+	})
+}
+
+func inRange(t, from, to time.Time) bool {
+	return !t.Before(from) && t.Before(to)
+}
@@ -19,6 +19,7 @@ type CampaignData struct {
 	Conversions int
 	Cost        float64
 	Revenue     float64
+	Currency    string // ISO 4217 code of Cost and Revenue
 }
 
 /* Implementing Polymorphism */
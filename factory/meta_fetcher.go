@@ -6,6 +6,7 @@ type CampaignData struct {
 	Conversions int
 	Cost        float64
 	Revenue     float64
+	Currency    string // ISO 4217 code of Cost and Revenue
 }
 
 type MetaFetcher struct{}
@@ -18,5 +19,6 @@ func (m *MetaFetcher) FetchData(campaignID, startDate, endDate string) (Campaign
 		Conversions: 10,
 		Cost:        500,
 		Revenue:     1500,
+		Currency:    "USD",
 	}, nil
 }
@@ -0,0 +1,204 @@
+// Package funnel follows users of a campaign through impression, click and
+// conversion, so conversion rates only count users who went through the
+// previous step on the same campaign.
+package funnel
+
+import (
+	"sort"
+	"time"
+
+	"campaign-analytics/events"
+)
+
+// Steps of the funnel, in order
+var Steps = []string{events.Impression, events.Click, events.Conversion}
+
+// Config bounds the time allowed between steps
+type Config struct {
+	ClickWindow      time.Duration // impression to click
+	ConversionWindow time.Duration // click to conversion
+}
+
+// DefaultConfig allows a day to click and a week to convert
+var DefaultConfig = Config{
+	ClickWindow:      24 * time.Hour,
+	ConversionWindow: 7 * 24 * time.Hour,
+}
+
+// Step reports the users that reached a step
+type Step struct {
+	Name  string `json:"name"`
+	Users int    `json:"users"`
+	// DropOff is the share of the previous step's users that did not reach
+	// this one, ConversionRate the share that did
+	DropOff        float64 `json:"drop_off"`
+	ConversionRate float64 `json:"conversion_rate"`
+	// MedianSeconds is the median time from the previous step
+	MedianSeconds float64 `json:"median_seconds"`
+}
+
+// Segment is the funnel of the users entering through one channel or audience
+type Segment struct {
+	ID    int64  `json:"id"`
+	Steps []Step `json:"steps"`
+}
+
+// Report is the funnel of a campaign
+type Report struct {
+	CampaignID int64     `json:"campaign_id"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Steps      []Step    `json:"steps"`
+	ByChannel  []Segment `json:"by_channel"`
+	ByAudience []Segment `json:"by_audience"`
+}
+
+// journey is how far one user went
+type journey struct {
+	channelID, audienceID int64
+	reached               int              // number of steps reached, 1 to 3
+	gaps                  [2]time.Duration // time to click, time from click to conversion
+}
+
+// counter accumulates journeys
+type counter struct {
+	users [3]int
+	gaps  [2][]time.Duration
+}
+
+func (c *counter) add(j journey) {
+	for i := 0; i < j.reached; i++ {
+		c.users[i]++
+		if i > 0 {
+			c.gaps[i-1] = append(c.gaps[i-1], j.gaps[i-1])
+		}
+	}
+}
+
+func (c *counter) steps() []Step {
+	out := make([]Step, len(Steps))
+	for i, name := range Steps {
+		out[i] = Step{Name: name, Users: c.users[i]}
+		if i == 0 {
+			continue
+		}
+		if prev := c.users[i-1]; prev > 0 {
+			out[i].ConversionRate = float64(c.users[i]) / float64(prev)
+			out[i].DropOff = 1 - out[i].ConversionRate
+		}
+		out[i].MedianSeconds = median(c.gaps[i-1]).Seconds()
+	}
+	return out
+}
+
+// Builder accumulates a funnel one user at a time, so a campaign's events
+// need not be held at once
+type Builder struct {
+	cfg        Config
+	total      counter
+	byChannel  map[int64]*counter
+	byAudience map[int64]*counter
+}
+
+func NewBuilder(cfg Config) *Builder {
+	return &Builder{cfg: cfg, byChannel: make(map[int64]*counter), byAudience: make(map[int64]*counter)}
+}
+
+// Add walks the events of one user, ordered by time. The user enters at
+// their first impression and is attributed to its channel and audience; the
+// click must follow within ClickWindow of an impression and the conversion
+// follow a click within ConversionWindow.
+// Clicks and conversions without a preceding impression are not counted.
+func (b *Builder) Add(evs []events.Event) {
+	j, ok := follow(evs, b.cfg)
+	if !ok {
+		return
+	}
+	b.total.add(j)
+	segment(b.byChannel, j.channelID).add(j)
+	segment(b.byAudience, j.audienceID).add(j)
+}
+
+// Report returns the funnel of the users added so far
+func (b *Builder) Report(campaignID int64, from, to time.Time) Report {
+	return Report{
+		CampaignID: campaignID,
+		From:       from,
+		To:         to,
+		Steps:      b.total.steps(),
+		ByChannel:  segments(b.byChannel),
+		ByAudience: segments(b.byAudience),
+	}
+}
+
+// Build computes the funnel from a campaign's events ordered by user then
+// time, see Builder.Add
+func Build(campaignID int64, evs []events.Event, from, to time.Time, cfg Config) Report {
+	b := NewBuilder(cfg)
+	for start := 0; start < len(evs); {
+		end := start + 1
+		for end < len(evs) && evs[end].UserID == evs[start].UserID {
+			end++
+		}
+		b.Add(evs[start:end])
+		start = end
+	}
+	return b.Report(campaignID, from, to)
+}
+
+// follow walks one user's events
+func follow(evs []events.Event, cfg Config) (journey, bool) {
+	var j journey
+	var last time.Time
+	for _, ev := range evs {
+		t := ev.Time()
+		switch {
+		case j.reached == 0 && ev.EventType == events.Impression:
+			j = journey{channelID: ev.ChannelID, audienceID: ev.AudienceID, reached: 1}
+		case j.reached == 1 && ev.EventType == events.Impression,
+			j.reached == 2 && ev.EventType == events.Click:
+			// Windows run from the latest event of the previous step
+		case j.reached == 1 && ev.EventType == events.Click && t.Sub(last) <= cfg.ClickWindow:
+			j.gaps[0] = t.Sub(last)
+			j.reached = 2
+		case j.reached == 2 && ev.EventType == events.Conversion && t.Sub(last) <= cfg.ConversionWindow:
+			j.gaps[1] = t.Sub(last)
+			j.reached = 3
+			return j, true
+		default:
+			continue
+		}
+		last = t
+	}
+	return j, j.reached > 0
+}
+
+func segment(m map[int64]*counter, id int64) *counter {
+	c := m[id]
+	if c == nil {
+		c = &counter{}
+		m[id] = c
+	}
+	return c
+}
+
+func segments(m map[int64]*counter) []Segment {
+	out := make([]Segment, 0, len(m))
+	for id, c := range m {
+		out = append(out, Segment{ID: id, Steps: c.steps()})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func median(ds []time.Duration) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	n := len(ds)
+	if n%2 == 1 {
+		return ds[n/2]
+	}
+	return (ds[n/2-1] + ds[n/2]) / 2
+}
@@ -0,0 +1,79 @@
+package funnel
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"campaign-analytics/events"
+)
+
+var t0 = time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+
+func ev(user string, channelID int64, eventType string, at time.Duration) events.Event {
+	return events.Event{CampaignID: 1, ChannelID: channelID, EventType: eventType, EventTimestamp: t0.Add(at).Unix(), UserID: user}
+}
+
+func users(steps []Step) []int {
+	out := make([]int, len(steps))
+	for i, s := range steps {
+		out[i] = s.Users
+	}
+	return out
+}
+
+func TestBuild(t *testing.T) {
+	h := time.Hour
+	evs := []events.Event{
+		// Converts an hour after clicking an hour after the impression
+		ev("u1", 1, events.Impression, 0), ev("u1", 1, events.Click, h), ev("u1", 1, events.Conversion, 2*h),
+		// Clicks past the click window
+		ev("u2", 2, events.Impression, 0), ev("u2", 2, events.Click, 30*h),
+		// A click before any impression does not count
+		ev("u3", 2, events.Click, 0), ev("u3", 2, events.Impression, h), ev("u3", 2, events.Click, 2*h),
+		// The click window runs from the latest impression, the conversion
+		// comes past the conversion window
+		ev("u4", 1, events.Impression, 0), ev("u4", 1, events.Impression, 10*h), ev("u4", 1, events.Click, 20*h),
+		ev("u4", 1, events.Conversion, 20*h+8*24*h),
+		// Never saw an impression
+		ev("u5", 1, events.Click, 0), ev("u5", 1, events.Conversion, h),
+	}
+	rep := Build(1, evs, t0, t0.Add(24*h), DefaultConfig)
+
+	third := 1.0 / 3
+	want := []Step{
+		{Name: events.Impression, Users: 4},
+		{Name: events.Click, Users: 3, ConversionRate: 0.75, DropOff: 0.25, MedianSeconds: 3600},
+		{Name: events.Conversion, Users: 1, ConversionRate: third, DropOff: 1 - third, MedianSeconds: 3600},
+	}
+	if !reflect.DeepEqual(rep.Steps, want) {
+		t.Fatalf("steps %+v, want %+v", rep.Steps, want)
+	}
+	if len(rep.ByChannel) != 2 || rep.ByChannel[0].ID != 1 || rep.ByChannel[1].ID != 2 {
+		t.Fatalf("channels %+v, want 1 and 2", rep.ByChannel)
+	}
+	if got := users(rep.ByChannel[0].Steps); !reflect.DeepEqual(got, []int{2, 2, 1}) {
+		t.Errorf("channel 1 users %v, want [2 2 1]", got)
+	}
+	if got := users(rep.ByChannel[1].Steps); !reflect.DeepEqual(got, []int{2, 1, 0}) {
+		t.Errorf("channel 2 users %v, want [2 1 0]", got)
+	}
+	if len(rep.ByAudience) != 1 || !reflect.DeepEqual(users(rep.ByAudience[0].Steps), []int{4, 3, 1}) {
+		t.Errorf("audiences %+v, want everyone in audience 0", rep.ByAudience)
+	}
+}
+
+func TestMedian(t *testing.T) {
+	for _, tc := range []struct {
+		in   []time.Duration
+		want time.Duration
+	}{
+		{nil, 0},
+		{[]time.Duration{3, 1, 2}, 2},
+		{[]time.Duration{4, 1, 3, 2}, 2},
+	} {
+		if got := median(tc.in); got != tc.want {
+			t.Errorf("median(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Package fx converts amounts between currencies using historical daily rates
+// loaded from a local CSV or JSON file.
+package fx
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	dateLayout = "2006-01-02"
+	// maxStaleDays is how far back a missing day falls back to (weekends, holidays)
+	maxStaleDays = 7
+)
+
+// Rate is one day's rate: 1 Base = Rate Quote
+type Rate struct {
+	Date  string  `json:"date"`
+	Base  string  `json:"base"`
+	Quote string  `json:"quote"`
+	Rate  float64 `json:"rate"`
+}
+
+// Store holds daily rates keyed by day and currency pair
+type Store struct {
+	mu    sync.RWMutex
+	rates map[string]map[string]float64 // date => "BASE/QUOTE" => rate
+}
+
+func NewStore() *Store {
+	return &Store{rates: make(map[string]map[string]float64)}
+}
+
+// LoadFile loads rates from a .csv (date,base,quote,rate) or .json ([]Rate) file
+func LoadFile(path string) (*Store, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open rates file")
+	}
+	defer f.Close()
+
+	var rates []Rate
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		if err := json.NewDecoder(f).Decode(&rates); err != nil {
+			return nil, errors.Wrap(err, "decode rates JSON")
+		}
+	case ".csv":
+		rates, err = readCSV(f)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported rates file %q", path)
+	}
+
+	s := NewStore()
+	for _, r := range rates {
+		if err := s.Add(r); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func readCSV(r io.Reader) ([]Rate, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "read rates CSV")
+	}
+	var rates []Rate
+	for i, row := range rows {
+		if len(row) != 4 {
+			return nil, fmt.Errorf("rates CSV line %d: expected 4 columns", i+1)
+		}
+		if i == 0 && strings.EqualFold(row[0], "date") {
+			continue // header
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(row[3]), 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "rates CSV line %d", i+1)
+		}
+		rates = append(rates, Rate{Date: strings.TrimSpace(row[0]), Base: row[1], Quote: row[2], Rate: v})
+	}
+	return rates, nil
+}
+
+// Add stores a rate, validating its date and currencies
+func (s *Store) Add(r Rate) error {
+	if _, err := time.Parse(dateLayout, r.Date); err != nil {
+		return errors.Wrapf(err, "rate date %q", r.Date)
+	}
+	base, quote := normalize(r.Base), normalize(r.Quote)
+	if len(base) != 3 || len(quote) != 3 || r.Rate <= 0 {
+		return fmt.Errorf("invalid rate %+v", r)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	day, ok := s.rates[r.Date]
+	if !ok {
+		day = make(map[string]float64)
+		s.rates[r.Date] = day
+	}
+	day[base+"/"+quote] = r.Rate
+	return nil
+}
+
+// Rate returns how many units of to one unit of from is worth on date. Days
+// without rates fall back to the most recent earlier day, up to maxStaleDays.
+func (s *Store) Rate(date time.Time, from, to string) (float64, error) {
+	from, to = normalize(from), normalize(to)
+	if from == to {
+		return 1, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := 0; i <= maxStaleDays; i++ {
+		day := s.rates[date.AddDate(0, 0, -i).Format(dateLayout)]
+		if rate, ok := lookup(day, from, to); ok {
+			return rate, nil
+		}
+	}
+	return 0, fmt.Errorf("no %s/%s rate for %s", from, to, date.Format(dateLayout))
+}
+
+// Latest returns the from/to rate of the most recent day having one, and that
+// day, for amounts without a date of their own such as running totals
+func (s *Store) Latest(from, to string) (float64, time.Time, error) {
+	from, to = normalize(from), normalize(to)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dates := make([]string, 0, len(s.rates))
+	for date := range s.rates {
+		dates = append(dates, date)
+	}
+	// The layout sorts like the dates
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+	for _, date := range dates {
+		if rate, ok := lookup(s.rates[date], from, to); ok {
+			day, _ := time.Parse(dateLayout, date)
+			return rate, day, nil
+		}
+	}
+	return 0, time.Time{}, fmt.Errorf("no %s/%s rate", from, to)
+}
+
+// Convert converts amount from one currency to another at the rate of date
+func (s *Store) Convert(amount float64, from, to string, date time.Time) (float64, error) {
+	rate, err := s.Rate(date, from, to)
+	if err != nil {
+		return 0, err
+	}
+	return amount * rate, nil
+}
+
+// lookup finds a direct, inverse or single-hop cross rate within one day
+func lookup(day map[string]float64, from, to string) (float64, bool) {
+	if day == nil {
+		return 0, false
+	}
+	if r, ok := day[from+"/"+to]; ok {
+		return r, true
+	}
+	if r, ok := day[to+"/"+from]; ok {
+		return 1 / r, true
+	}
+	for pair, r := range day {
+		base, quote := pair[:3], pair[4:]
+		// from -> pivot -> to, where the pivot is quoted against both currencies
+		var toPivot float64
+		switch {
+		case base == from:
+			toPivot = r
+		case quote == from:
+			toPivot = 1 / r
+		default:
+			continue
+		}
+		pivot := quote
+		if quote == from {
+			pivot = base
+		}
+		if r2, ok := day[pivot+"/"+to]; ok {
+			return toPivot * r2, true
+		}
+		if r2, ok := day[to+"/"+pivot]; ok {
+			return toPivot / r2, true
+		}
+	}
+	return 0, false
+}
+
+func normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
@@ -0,0 +1,36 @@
+package fx
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLatest(t *testing.T) {
+	s := NewStore()
+	for _, r := range []Rate{
+		{Date: "2024-01-02", Base: "EUR", Quote: "USD", Rate: 1.1},
+		{Date: "2024-01-03", Base: "EUR", Quote: "USD", Rate: 1.2},
+		{Date: "2024-01-04", Base: "GBP", Quote: "USD", Rate: 1.3},
+	} {
+		if err := s.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Months after the file's last day, which Rate no longer falls back to
+	if _, err := s.Rate(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), "EUR", "USD"); err == nil {
+		t.Fatal("Rate fell back more than maxStaleDays")
+	}
+	rate, day, err := s.Latest("eur", "usd")
+	if err != nil || rate != 1.2 || day != time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC) {
+		t.Fatalf("got %v on %v (%v), want 1.2 on 2024-01-03", rate, day, err)
+	}
+	// An inverse rate counts on its day too
+	if rate, day, err := s.Latest("USD", "GBP"); err != nil || math.Abs(rate-1/1.3) > 1e-12 || day.Day() != 4 {
+		t.Fatalf("got %v on %v (%v), want the inverse GBP/USD of 2024-01-04", rate, day, err)
+	}
+	if _, _, err := s.Latest("EUR", "JPY"); err == nil {
+		t.Fatal("got a rate for a pair without any")
+	}
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"campaign-analytics/anomaly"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Anomalies is the store of detected anomalies, set at startup
+var Anomalies anomaly.Store
+
+// GetCampaignAnomalies lists the anomalies of a campaign. Query: start_date,
+// end_date (YYYY-MM-DD, inclusive), optional platform, metric (spend, ctr,
+// cpa, conversions) and severity (warning or critical, the minimum shown).
+func GetCampaignAnomalies(c *gin.Context) {
+	from, err := time.Parse(dateLayout, c.Query("start_date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start_date"})
+		return
+	}
+	to, err := time.Parse(dateLayout, c.Query("end_date"))
+	if err != nil || to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end_date"})
+		return
+	}
+	f := anomaly.Filter{
+		CampaignID:  c.Param("id"),
+		Platform:    c.Query("platform"),
+		Metric:      anomaly.Metric(c.Query("metric")),
+		MinSeverity: anomaly.Severity(c.Query("severity")),
+		From:        from,
+		To:          to.AddDate(0, 0, 1),
+	}
+	if f.Metric != "" && !validMetric(f.Metric) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "metric must be one of spend, ctr, cpa, conversions"})
+		return
+	}
+	if f.MinSeverity != "" && f.MinSeverity.Rank() == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "severity must be warning or critical"})
+		return
+	}
+
+	anomalies, err := Anomalies.Query(c.Request.Context(), f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch anomalies"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"anomalies": anomalies})
+}
+
+func validMetric(m anomaly.Metric) bool {
+	for _, v := range anomaly.Metrics {
+		if v == m {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"campaign-analytics/attribution"
+	"campaign-analytics/events"
+	"campaign-analytics/services"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxLookbackDays bounds the lookback window a request can ask for
+const maxLookbackDays = 90
+
+// Events is the store raw events are read from, set at startup
+var Events events.Store
+
+// GetAttribution serves attributed conversions and revenue per campaign and
+// channel. Query: start_date, end_date (YYYY-MM-DD, inclusive) bounding the
+// conversions, model (first_touch, last_touch, linear, time_decay,
+// position_based; default last_touch) and lookback_days (default 30).
+func GetAttribution(c *gin.Context) {
+	serveAttribution(c, 0)
+}
+
+// GetCampaignAttribution is GetAttribution restricted to the campaign's channels
+func GetCampaignAttribution(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid campaign id"})
+		return
+	}
+	serveAttribution(c, id)
+}
+
+func serveAttribution(c *gin.Context, campaignID int64) {
+	from, err := time.Parse(dateLayout, c.Query("start_date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start_date"})
+		return
+	}
+	to, err := time.Parse(dateLayout, c.Query("end_date"))
+	if err != nil || to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end_date"})
+		return
+	}
+
+	cfg := attribution.DefaultConfig
+	if cfg.Model, err = attribution.ParseModel(c.Query("model")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if v := c.Query("lookback_days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days <= 0 || days > maxLookbackDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "lookback_days must be between 1 and 90"})
+			return
+		}
+		cfg.Lookback = time.Duration(days) * 24 * time.Hour
+	}
+
+	rep, err := services.FetchAttribution(c.Request.Context(), Events, campaignID, from, to.AddDate(0, 0, 1), cfg)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute attribution"})
+		return
+	}
+	c.JSON(http.StatusOK, rep)
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"campaign-analytics/funnel"
+	"campaign-analytics/services"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetCampaignFunnel serves the impression, click, conversion funnel of a
+// campaign with breakdowns by channel and audience. Query: start_date,
+// end_date (YYYY-MM-DD, inclusive) bounding when users enter, optional
+// click_window_hours (default 24) and conversion_window_hours (default 168).
+func GetCampaignFunnel(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid campaign id"})
+		return
+	}
+	from, err := time.Parse(dateLayout, c.Query("start_date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start_date"})
+		return
+	}
+	to, err := time.Parse(dateLayout, c.Query("end_date"))
+	if err != nil || to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end_date"})
+		return
+	}
+
+	cfg := funnel.DefaultConfig
+	for param, window := range map[string]*time.Duration{
+		"click_window_hours":      &cfg.ClickWindow,
+		"conversion_window_hours": &cfg.ConversionWindow,
+	} {
+		v := c.Query(param)
+		if v == "" {
+			continue
+		}
+		hours, err := strconv.Atoi(v)
+		if err != nil || hours <= 0 || hours > 24*maxLookbackDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+			return
+		}
+		*window = time.Duration(hours) * time.Hour
+	}
+
+	rep, err := services.FetchFunnel(c.Request.Context(), Events, id, from, to.AddDate(0, 0, 1), cfg)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute funnel"})
+		return
+	}
+	c.JSON(http.StatusOK, rep)
+}
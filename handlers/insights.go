@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"campaign-analytics/reach"
+	"campaign-analytics/rollup"
+	"campaign-analytics/services"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const dateLayout = "2006-01-02"
+
+// Rollups is the store campaign insights are read from, set at startup
+var Rollups rollup.Repository
+
+// Reach is the store of reach sketches, set at startup
+var Reach reach.Store
+
+// GetCampaignInsights serves pre-aggregated insights for a campaign.
+// Query: start_date, end_date (YYYY-MM-DD, inclusive), optional platform and
+// granularity (hour or day, default day).
+func GetCampaignInsights(c *gin.Context) {
+	from, err := time.Parse(dateLayout, c.Query("start_date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start_date"})
+		return
+	}
+	to, err := time.Parse(dateLayout, c.Query("end_date"))
+	if err != nil || to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end_date"})
+		return
+	}
+	g := rollup.Granularity(c.DefaultQuery("granularity", string(rollup.Daily)))
+	if g != rollup.Hourly && g != rollup.Daily {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "granularity must be hour or day"})
+		return
+	}
+
+	// Buckets are written as they are read so that long ranges are never held
+	stream := &bucketStream{w: c.Writer}
+	insights, err := services.FetchRollupInsights(c.Request.Context(), Rollups,
+		c.Param("id"), c.Query("platform"), g, from, to.AddDate(0, 0, 1), stream.write)
+	if err == nil {
+		err = stream.finish(insights)
+	}
+	if err != nil && stream.started {
+		// The status is sent, cut the body short so the client sees invalid JSON
+		log.Printf("insights campaign %s: %v", c.Param("id"), err)
+		c.Abort()
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch insights"})
+		return
+	}
+}
+
+// bucketStream writes {"buckets":[...], followed by the other fields of the
+// response. The status is sent with the first bucket so that a failure before
+// it is still reported.
+type bucketStream struct {
+	w       gin.ResponseWriter
+	started bool
+}
+
+func (s *bucketStream) start(open string) {
+	s.started = true
+	s.w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	s.w.WriteHeader(http.StatusOK)
+	s.w.WriteString(open)
+}
+
+func (s *bucketStream) write(b rollup.Bucket) error {
+	v, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	if s.started {
+		s.w.WriteString(",")
+	} else {
+		s.start(`{"buckets":[`)
+	}
+	_, err = s.w.Write(v)
+	return err
+}
+
+// finish closes the bucket array and writes the fields of v, a JSON object
+func (s *bucketStream) finish(v interface{}) error {
+	rest, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if s.started {
+		s.w.WriteString("],")
+	} else {
+		s.start(`{"buckets":[],`)
+	}
+	_, err = s.w.Write(rest[1:])
+	return err
+}
+
+// GetCampaignMetrics serves the metrics platforms reported for a campaign,
+// read from the configured campaign backend. Query: start_date, end_date
+// (YYYY-MM-DD, inclusive), optional platform and currency to convert to.
+func GetCampaignMetrics(c *gin.Context) {
+	from, err := time.Parse(dateLayout, c.Query("start_date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start_date"})
+		return
+	}
+	to, err := time.Parse(dateLayout, c.Query("end_date"))
+	if err != nil || to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end_date"})
+		return
+	}
+	start, end := from.Format(dateLayout), to.Format(dateLayout)
+
+	var metrics map[string]float64
+	currency := strings.ToUpper(c.Query("currency"))
+	if currency != "" {
+		metrics, err = services.FetchInsightsIn(c.Request.Context(), c.Param("id"), c.Query("platform"), start, end, currency, services.Rates)
+	} else {
+		metrics, currency, err = services.FetchInsights(c.Request.Context(), c.Param("id"), c.Query("platform"), start, end)
+	}
+	if errors.Is(err, services.ErrNoImpressions) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No metrics for campaign"})
+		return
+	}
+	if err != nil {
+		log.Printf("metrics campaign %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch metrics"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"metrics": metrics, "currency": currency})
+}
+
+// GetCampaignRestatements serves the changes platforms made to the reported
+// day totals of a campaign. Query: start_date, end_date (YYYY-MM-DD,
+// inclusive) of the restated days and optional platform.
+func GetCampaignRestatements(c *gin.Context) {
+	from, err := time.Parse(dateLayout, c.Query("start_date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start_date"})
+		return
+	}
+	to, err := time.Parse(dateLayout, c.Query("end_date"))
+	if err != nil || to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end_date"})
+		return
+	}
+
+	history, err := services.FetchRestatements(c.Request.Context(), Rollups,
+		c.Param("id"), c.Query("platform"), from, to.AddDate(0, 0, 1))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch restatements"})
+		return
+	}
+	c.JSON(http.StatusOK, history)
+}
+
+// GetReach serves the approximate unique users of a group of campaigns and
+// their Frequency.
+// Query: campaign_ids (comma separated), start_date, end_date (YYYY-MM-DD,
+// inclusive) and optional channel_id.
+func GetReach(c *gin.Context) {
+	var q reach.Query
+	for _, v := range strings.Split(c.Query("campaign_ids"), ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid campaign_ids"})
+			return
+		}
+		q.CampaignIDs = append(q.CampaignIDs, id)
+	}
+	if v := c.Query("channel_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid channel_id"})
+			return
+		}
+		q.ChannelID = id
+	}
+	from, err := time.Parse(dateLayout, c.Query("start_date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start_date"})
+		return
+	}
+	to, err := time.Parse(dateLayout, c.Query("end_date"))
+	if err != nil || to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end_date"})
+		return
+	}
+	q.From, q.To = from, to.AddDate(0, 0, 1)
+
+	res, err := services.FetchReach(c.Request.Context(), Reach, Events, q)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch reach"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"campaign_ids": q.CampaignIDs,
+		"channel_id":   q.ChannelID,
+		"reach":        res.Reach,
+		"impressions":  res.Impressions,
+		"metrics":      res.Metrics,
+	})
+}
@@ -2,86 +2,235 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"campaign-analytics/codec"
+	"campaign-analytics/schema"
+	"campaign-analytics/sink"
+	"campaign-analytics/spool"
+
 	"github.com/segmentio/kafka-go"
 )
 
-// CampaignData represents the structure of the incoming campaign data
-type CampaignData struct {
-	CampaignID  string  `json:"campaign_id"`
-	Platform    string  `json:"platform"`
-	Timestamp   int64   `json:"timestamp"`
-	Impressions int     `json:"impressions"`
-	Clicks      int     `json:"clicks"`
-	Conversions int     `json:"conversions"`
-	Cost        float64 `json:"cost"`
-	Revenue     float64 `json:"revenue"`
+const campaignDataTopic = "campaign-data"
+
+// ingestServer serves the ingest endpoints on top of EventSinks
+type ingestServer struct {
+	sink     sink.EventSink // campaign-data
+	events   sink.EventSink // campaign-events
+	dedup    DedupStore
+	encoding codec.Encoding // payload encoding of campaign-data messages
+}
+
+// newIngestHandler builds the ingest HTTP handler writing aggregated campaign
+// data to data, encoded with enc, and raw events to events. A webhook endpoint
+// is registered for every platform in hooks.
+func newIngestHandler(data, events sink.EventSink, dedup DedupStore, enc codec.Encoding, hooks map[string]webhookSecret) http.Handler {
+	srv := &ingestServer{sink: data, events: events, dedup: dedup, encoding: enc}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ingest", srv.ingestHandler)
+	mux.HandleFunc("/ingest/batch", srv.ingestBatchHandler)
+	mux.HandleFunc("/ingest/csv", srv.ingestCSVHandler)
+	mux.HandleFunc("/events", srv.eventsHandler)
+	for name, secret := range hooks {
+		mux.HandleFunc("/webhooks/"+name, srv.webhookHandler(name, secret))
+	}
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
 }
 
-// KafkaWriter is a global Kafka writer instance
-var KafkaWriter *kafka.Writer
+// newEventSink picks the sink for topic from INGEST_SINK: kafka (default), file or memory
+func newEventSink(topic string) (sink.EventSink, error) {
+	switch kind := os.Getenv("INGEST_SINK"); kind {
+	case "", "kafka":
+		brokers := os.Getenv("KAFKA_BROKERS")
+		if brokers == "" {
+			brokers = "localhost:9092"
+		}
+		return sink.NewKafkaSink(strings.Split(brokers, ","), topic), nil
+	case "file":
+		dir := os.Getenv("INGEST_SINK_DIR")
+		if dir == "" {
+			dir = "."
+		}
+		return sink.NewFileSink(filepath.Join(dir, topic+".ndjson"))
+	case "memory":
+		ch := sink.NewChannelSink(1024)
+		go func() {
+			for msg := range ch.C() {
+				log.Printf("ingested topic=%s key=%s value=%s", topic, msg.Key, msg.Value)
+			}
+		}()
+		return ch, nil
+	default:
+		return nil, fmt.Errorf("unknown INGEST_SINK %q", kind)
+	}
+}
+
+// writeValidationError replies 400 with the offending fields as JSON
+func writeValidationError(w http.ResponseWriter, verr *schema.ValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		*schema.ValidationError
+	}{Error: "validation failed", ValidationError: verr})
+}
 
-func initKafkaWriter() {
-	KafkaWriter = &kafka.Writer{
-		Addr:     kafka.TCP("localhost:9092"),
-		Topic:    "campaign-data",
-		Balancer: &kafka.LeastBytes{},
+// newCampaignMessage serializes a record into a Kafka message keyed by campaign
+func newCampaignMessage(data schema.CampaignData, enc codec.Encoding) (kafka.Message, error) {
+	msgBytes, err := codec.EncodeCampaignData(data, enc)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	msg := kafka.Message{
+		Key:   []byte(data.CampaignID),
+		Value: msgBytes,
+		Headers: []kafka.Header{
+			codec.Header(enc),
+			{Key: "schema_version", Value: []byte(strconv.Itoa(data.SchemaVersion))},
+		},
 	}
+	if data.EventID != "" {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: "event_id", Value: []byte(data.EventID)})
+	}
+	return msg, nil
 }
 
-func ingestHandler(w http.ResponseWriter, r *http.Request) {
+func (s *ingestServer) ingestHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var data CampaignData
+	var data schema.CampaignData
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&data); err != nil {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
 
-	// Basic validation
-	if data.CampaignID == "" || data.Platform == "" || data.Timestamp == 0 {
-		http.Error(w, "Missing required fields", http.StatusBadRequest)
+	if err := schema.Validate(&data); err != nil {
+		var verr *schema.ValidationError
+		if errors.As(err, &verr) {
+			writeValidationError(w, verr)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Serialize data to JSON
-	msgBytes, err := json.Marshal(data)
+	// The Idempotency-Key header takes precedence over the event_id in the body
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = data.EventID
+	} else if data.EventID == "" {
+		data.EventID = key
+	}
+	if key != "" {
+		prev, err := s.dedup.Begin(r.Context(), key)
+		if errors.Is(err, ErrDedupInFlight) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if prev != nil {
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(prev.StatusCode)
+			w.Write(prev.Body)
+			return
+		}
+	}
+
+	abort := func(msg string, code int) {
+		if key != "" {
+			s.dedup.Abort(r.Context(), key)
+		}
+		http.Error(w, msg, code)
+	}
+
+	msg, err := newCampaignMessage(data, s.encoding)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		abort("Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	// Produce message to Kafka
-	err = KafkaWriter.WriteMessages(r.Context(),
-		kafka.Message{
-			Key:   []byte(data.CampaignID),
-			Value: msgBytes,
-		},
-	)
+	err = s.sink.Write(r.Context(), msg)
+	if errors.Is(err, spool.ErrFull) {
+		abort("Service Unavailable: ingest spool is full", http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to write to Kafka", http.StatusInternalServerError)
+		abort("Failed to write to sink", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusAccepted)
-	w.Write([]byte("Data ingested successfully"))
+	res := DedupResult{StatusCode: http.StatusAccepted, Body: []byte("Data ingested successfully")}
+	if key != "" {
+		if err := s.dedup.Complete(r.Context(), key, res); err != nil {
+			log.Printf("dedup complete %q: %v", key, err)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	w.Write(res.Body)
+}
+
+// openSink opens the sink for topic, wrapped in a disk spool when
+// INGEST_SPOOL_DIR is set. The returned func releases everything.
+func openSink(topic string) (sink.EventSink, func(), error) {
+	primary, err := newEventSink(topic)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir := os.Getenv("INGEST_SPOOL_DIR")
+	if dir == "" {
+		return primary, func() { primary.Close() }, nil
+	}
+	spooled, stop, err := newSpooledSink(primary, filepath.Join(dir, topic), topic)
+	if err != nil {
+		primary.Close()
+		return nil, nil, err
+	}
+	return spooled, func() {
+		stop()
+		spooled.Close()
+		primary.Close()
+	}, nil
 }
 
 func main() {
-	initKafkaWriter()
-	defer KafkaWriter.Close()
+	dataSink, closeData, err := openSink(campaignDataTopic)
+	if err != nil {
+		log.Fatalf("Sink init failed: %v", err)
+	}
+	defer closeData()
 
-	http.HandleFunc("/ingest", ingestHandler)
+	eventsSink, closeEvents, err := openSink(campaignEventsTopic)
+	if err != nil {
+		log.Fatalf("Sink init failed: %v", err)
+	}
+	defer closeEvents()
+
+	enc, err := codec.ParseEncoding(os.Getenv("INGEST_ENCODING"))
+	if err != nil {
+		log.Fatalf("Invalid INGEST_ENCODING: %v", err)
+	}
 
 	srv := &http.Server{
 		Addr:         ":8080",
+		Handler:      newIngestHandler(dataSink, eventsSink, newDedupStore(), enc, loadWebhookSecrets()),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 	}
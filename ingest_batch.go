@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"campaign-analytics/schema"
+	"campaign-analytics/sink"
+	"campaign-analytics/spool"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	maxBatchBodyBytes = 32 << 20 // 32 MB per batch request
+	maxBatchLineBytes = 1 << 20  // 1 MB per NDJSON line
+	batchWriteSize    = 500      // messages per sink write
+)
+
+// BatchResult reports the outcome of a single line/element of a batch request
+type BatchResult struct {
+	Line      int                 `json:"line"`
+	Accepted  bool                `json:"accepted"`
+	Duplicate bool                `json:"duplicate,omitempty"`
+	Error     string              `json:"error,omitempty"`
+	Fields    []schema.FieldError `json:"fields,omitempty"`
+}
+
+// BatchResponse is the body returned by the batch ingest endpoint
+type BatchResponse struct {
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Results  []BatchResult `json:"results"`
+}
+
+// batchRecord is a decoded and validated line ready to be written
+type batchRecord struct {
+	msg      kafka.Message
+	dedupKey string // empty when the record carries no event ID
+}
+
+// batchParser decodes and validates one raw line, returning the rejection reason on error
+type batchParser func(raw json.RawMessage) (batchRecord, error)
+
+// ingestBatchHandler accepts either NDJSON (one CampaignData per line) or a
+// JSON array of CampaignData, validates each record on its own and writes the
+// valid ones to the sink in batches.
+func (s *ingestServer) ingestBatchHandler(w http.ResponseWriter, r *http.Request) {
+	s.serveBatch(w, r, s.sink, s.parseCampaignLine)
+}
+
+func (s *ingestServer) parseCampaignLine(raw json.RawMessage) (batchRecord, error) {
+	var data schema.CampaignData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return batchRecord{}, errors.New("Invalid JSON: " + err.Error())
+	}
+	if err := schema.Validate(&data); err != nil {
+		return batchRecord{}, err
+	}
+	msg, err := newCampaignMessage(data, s.encoding)
+	if err != nil {
+		return batchRecord{}, errors.New("Internal Server Error")
+	}
+	return batchRecord{msg: msg, dedupKey: data.EventID}, nil
+}
+
+// serveBatch reads an NDJSON or JSON array body, parses each line with parse
+// and writes the accepted records to dst, answering with a per-line result.
+func (s *ingestServer) serveBatch(w http.ResponseWriter, r *http.Request, dst sink.EventSink, parse batchParser) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := bufio.NewReader(http.MaxBytesReader(w, r.Body, maxBatchBodyBytes))
+	var (
+		raws []json.RawMessage
+		err  error
+	)
+	if isJSONArray(body) {
+		raws, err = readJSONArray(body)
+	} else {
+		raws, err = readNDJSON(body)
+	}
+	if err != nil {
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := BatchResponse{Results: make([]BatchResult, len(raws))}
+	var (
+		pending []kafka.Message
+		lines   []int
+		keys    []string
+		seen    = make(map[string]int) // event_id => first line index in this batch
+		dupOf   = make(map[int]int)    // duplicate line index => first line index
+
+		spoolFull bool
+	)
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		err := dst.Write(r.Context(), pending...)
+		// A partial failure tells which messages were written
+		var werrs kafka.WriteErrors
+		partial := errors.As(err, &werrs) && len(werrs) == len(pending)
+		for n, i := range lines {
+			lineErr := err
+			if partial {
+				lineErr = werrs[n]
+			}
+			if lineErr != nil {
+				resp.Results[i].Accepted = false
+				resp.Results[i].Error = "Failed to write to sink"
+				if errors.Is(lineErr, spool.ErrFull) {
+					spoolFull = true
+					resp.Results[i].Error = "Service Unavailable: ingest spool is full"
+				}
+			}
+			if keys[n] == "" {
+				continue
+			}
+			if lineErr != nil {
+				s.dedup.Abort(r.Context(), keys[n])
+			} else {
+				s.dedup.Complete(r.Context(), keys[n], DedupResult{
+					StatusCode: http.StatusAccepted,
+					Body:       []byte("Data ingested successfully"),
+				})
+			}
+		}
+		pending, lines, keys = pending[:0], lines[:0], keys[:0]
+	}
+
+	for i, raw := range raws {
+		resp.Results[i] = BatchResult{Line: i + 1}
+
+		if len(raw) == 0 {
+			resp.Results[i].Error = "Empty line"
+			continue
+		}
+		rec, err := parse(raw)
+		if err != nil {
+			var verr *schema.ValidationError
+			if errors.As(err, &verr) {
+				resp.Results[i].Error = "validation failed"
+				resp.Results[i].Fields = verr.Fields
+				continue
+			}
+			resp.Results[i].Error = err.Error()
+			continue
+		}
+		if key := rec.dedupKey; key != "" {
+			if first, ok := seen[key]; ok {
+				resp.Results[i].Duplicate = true
+				dupOf[i] = first
+				continue
+			}
+			prev, err := s.dedup.Begin(r.Context(), key)
+			if err != nil {
+				resp.Results[i].Error = err.Error()
+				continue
+			}
+			if prev != nil {
+				resp.Results[i].Accepted = prev.StatusCode == http.StatusAccepted
+				resp.Results[i].Duplicate = true
+				continue
+			}
+			seen[key] = i
+		}
+
+		resp.Results[i].Accepted = true
+		pending = append(pending, rec.msg)
+		lines = append(lines, i)
+		keys = append(keys, rec.dedupKey)
+		if len(pending) >= batchWriteSize {
+			flush()
+		}
+	}
+	flush()
+
+	// In-batch duplicates share the outcome of the first occurrence
+	for i, first := range dupOf {
+		resp.Results[i].Accepted = resp.Results[first].Accepted
+		resp.Results[i].Error = resp.Results[first].Error
+	}
+
+	for _, res := range resp.Results {
+		if res.Accepted {
+			resp.Accepted++
+		} else {
+			resp.Rejected++
+		}
+	}
+
+	status := http.StatusAccepted
+	if resp.Accepted == 0 && spoolFull {
+		status = http.StatusServiceUnavailable
+	} else if resp.Accepted == 0 && resp.Rejected > 0 {
+		status = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// isJSONArray reports whether the body starts with a JSON array
+func isJSONArray(r *bufio.Reader) bool {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return false
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+		default:
+			return b[0] == '['
+		}
+	}
+}
+
+// readJSONArray splits a JSON array into its raw elements. A syntax error
+// anywhere in the array fails the whole request since element boundaries are lost.
+func readJSONArray(r io.Reader) ([]json.RawMessage, error) {
+	var raws []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raws); err != nil {
+		return nil, err
+	}
+	return raws, nil
+}
+
+// readNDJSON returns one raw message per line, keeping blank lines so that
+// result line numbers match the request body.
+func readNDJSON(r io.Reader) ([]json.RawMessage, error) {
+	var raws []json.RawMessage
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBatchLineBytes)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		raws = append(raws, json.RawMessage(append([]byte(nil), line...)))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// Drop trailing blank lines left by a final newline
+	for len(raws) > 0 && len(raws[len(raws)-1]) == 0 {
+		raws = raws[:len(raws)-1]
+	}
+	return raws, nil
+}
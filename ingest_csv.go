@@ -0,0 +1,445 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"campaign-analytics/schema"
+	"campaign-analytics/spool"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	maxCSVBodyBytes  = 64 << 20 // 64 MB per upload
+	csvPreviewRows   = 20
+	csvUploadTimeout = 5 * time.Minute
+)
+
+// csvFields are the CampaignData fields a CSV column can be mapped to
+var csvFields = map[string]func(d *schema.CampaignData, v string) error{
+	"campaign_id": func(d *schema.CampaignData, v string) error { d.CampaignID = v; return nil },
+	"platform":    func(d *schema.CampaignData, v string) error { d.Platform = strings.ToLower(v); return nil },
+	"currency":    func(d *schema.CampaignData, v string) error { d.Currency = strings.ToUpper(v); return nil },
+	"event_id":    func(d *schema.CampaignData, v string) error { d.EventID = v; return nil },
+	"level":       func(d *schema.CampaignData, v string) error { d.Level = strings.ToLower(v); return nil },
+	"report_date": func(d *schema.CampaignData, v string) error {
+		ts, err := parseCSVTime(v)
+		d.ReportDate = time.Unix(ts, 0).UTC().Format(schema.DateLayout)
+		return err
+	},
+	"timestamp": func(d *schema.CampaignData, v string) (err error) {
+		d.Timestamp, err = parseCSVTime(v)
+		return err
+	},
+	"impressions": func(d *schema.CampaignData, v string) (err error) { d.Impressions, err = parseCSVInt(v); return err },
+	"clicks":      func(d *schema.CampaignData, v string) (err error) { d.Clicks, err = parseCSVInt(v); return err },
+	"conversions": func(d *schema.CampaignData, v string) (err error) { d.Conversions, err = parseCSVInt(v); return err },
+	"cost":        func(d *schema.CampaignData, v string) (err error) { d.Cost, err = parseCSVFloat(v); return err },
+	"revenue":     func(d *schema.CampaignData, v string) (err error) { d.Revenue, err = parseCSVFloat(v); return err },
+}
+
+// CSVResponse is the body returned by the CSV upload endpoint
+type CSVResponse struct {
+	DryRun   bool `json:"dry_run"`
+	Rows     int  `json:"rows"`
+	Accepted int  `json:"accepted"`
+	Rejected int  `json:"rejected"`
+	// Duplicates counts rows already ingested, by an earlier upload or an
+	// earlier row of this one with the same event_id, and not written again
+	Duplicates int                   `json:"duplicates"`
+	Errors     []BatchResult         `json:"errors,omitempty"`
+	Preview    []schema.CampaignData `json:"preview,omitempty"`
+}
+
+// ingestCSVHandler ingests spreadsheets for channels without an API. The
+// multipart body carries, in order:
+//
+//	mapping  JSON object of CSV header => CampaignData field (optional, headers
+//	         named after fields map to themselves)
+//	defaults JSON object of CampaignData field => value used when a row has no
+//	         value, e.g. {"platform":"print","currency":"EUR"} (optional)
+//	file     the CSV, first row being the header
+//
+// With ?dry_run=true rows are only parsed and validated, and the response
+// previews the first rows. Otherwise rows are streamed to the campaign-data
+// sink; on a sink failure rows written before it stay ingested. Rows go
+// through the dedup store keyed by their event_id, derived from the file and
+// the row's line when the CSV has none, so uploading the file again after a
+// partial failure only writes the rows that were not ingested. Identical rows
+// of one file are distinct records, e.g. two insertions of the same ad.
+func (s *ingestServer) ingestCSVHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Uploads outlive the server-wide read/write timeouts
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(csvUploadTimeout))
+	rc.SetWriteDeadline(time.Now().Add(csvUploadTimeout))
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxCSVBodyBytes)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Bad Request: expected multipart/form-data", http.StatusBadRequest)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	var (
+		mapping  map[string]string
+		defaults map[string]string
+		file     *multipart.Part
+	)
+	for file == nil {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch part.FormName() {
+		case "mapping":
+			err = json.NewDecoder(part).Decode(&mapping)
+		case "defaults":
+			err = json.NewDecoder(part).Decode(&defaults)
+		case "file":
+			file = part
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Bad Request: invalid %s: %v", part.FormName(), err), http.StatusBadRequest)
+			return
+		}
+	}
+	if file == nil {
+		http.Error(w, "Bad Request: missing file part", http.StatusBadRequest)
+		return
+	}
+	for field := range defaults {
+		if csvFields[field] == nil {
+			http.Error(w, fmt.Sprintf("Bad Request: unknown default field %q", field), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The file is hashed to derive event IDs before its first row is written
+	tmp, err := os.CreateTemp("", "ingest-*.csv")
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), file); err != nil {
+		http.Error(w, "Bad Request: cannot read file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	fileSum := hash.Sum(nil)
+
+	reader := csv.NewReader(tmp)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		http.Error(w, "Bad Request: cannot read CSV header: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	columns, err := mapCSVColumns(header, mapping)
+	if err != nil {
+		http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := CSVResponse{DryRun: dryRun}
+	var (
+		pending []kafka.Message
+		keys    []string
+		seen    = make(map[string]bool)
+	)
+	// release frees the keys of the rows not written, so a retry can write them
+	release := func() {
+		for _, key := range keys {
+			s.dedup.Abort(r.Context(), key)
+		}
+	}
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if err := s.sink.Write(r.Context(), pending...); err != nil {
+			release()
+			return err
+		}
+		for _, key := range keys {
+			s.dedup.Complete(r.Context(), key, DedupResult{
+				StatusCode: http.StatusAccepted,
+				Body:       []byte("Data ingested successfully"),
+			})
+		}
+		resp.Accepted += len(pending)
+		pending, keys = pending[:0], keys[:0]
+		return nil
+	}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if !errors.As(err, &perr) {
+				http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			resp.Rows++
+			resp.Errors = append(resp.Errors, BatchResult{Line: perr.StartLine, Error: perr.Err.Error()})
+			continue
+		}
+		resp.Rows++
+		line, _ := reader.FieldPos(0)
+
+		data, fields, err := parseCSVRow(row, columns, defaults)
+		if err == nil {
+			err = schema.Validate(&data)
+		}
+		if err != nil {
+			res := BatchResult{Line: line, Error: err.Error(), Fields: fields}
+			var verr *schema.ValidationError
+			if errors.As(err, &verr) {
+				res.Error, res.Fields = "validation failed", verr.Fields
+			}
+			resp.Errors = append(resp.Errors, res)
+			continue
+		}
+
+		if data.EventID == "" {
+			data.EventID = csvEventID(fileSum, line)
+		}
+		if seen[data.EventID] {
+			resp.Duplicates++
+			continue
+		}
+		seen[data.EventID] = true
+
+		if dryRun {
+			resp.Accepted++
+			if len(resp.Preview) < csvPreviewRows {
+				resp.Preview = append(resp.Preview, data)
+			}
+			continue
+		}
+		prev, err := s.dedup.Begin(r.Context(), data.EventID)
+		if err != nil {
+			resp.Errors = append(resp.Errors, BatchResult{Line: line, Error: err.Error()})
+			continue
+		}
+		if prev != nil {
+			resp.Duplicates++
+			continue
+		}
+		msg, err := newCampaignMessage(data, s.encoding)
+		if err != nil {
+			s.dedup.Abort(r.Context(), data.EventID)
+			release()
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		pending = append(pending, msg)
+		keys = append(keys, data.EventID)
+		if len(pending) >= batchWriteSize {
+			if err := flush(); err != nil {
+				s.writeCSVFailure(w, resp, err)
+				return
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		s.writeCSVFailure(w, resp, err)
+		return
+	}
+	resp.Rejected = len(resp.Errors)
+
+	status := http.StatusOK
+	if !dryRun {
+		status = http.StatusAccepted
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeCSVFailure reports a sink failure together with what was committed so far
+func (s *ingestServer) writeCSVFailure(w http.ResponseWriter, resp CSVResponse, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, spool.ErrFull) {
+		status = http.StatusServiceUnavailable
+	}
+	resp.Rejected = len(resp.Errors)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		CSVResponse
+	}{Error: "Failed to write to sink, rows after the accepted count were not ingested", CSVResponse: resp})
+}
+
+// csvEventID identifies a row without an event_id by the SHA-256 of its file
+// and its line, so that the same file uploaded twice is ingested once
+func csvEventID(fileSum []byte, line int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%x:%d", fileSum, line)))
+	return "csv:" + hex.EncodeToString(sum[:16])
+}
+
+// mapCSVColumns resolves, for each CSV column, the CampaignData field it fills ("" to ignore)
+func mapCSVColumns(header []string, mapping map[string]string) ([]string, error) {
+	columns := make([]string, len(header))
+	found := make(map[string]bool)
+	for i, h := range header {
+		h = strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")) // Excel BOM
+		field, ok := mapping[h]
+		if !ok && mapping == nil {
+			field = strings.ToLower(h)
+		}
+		if field == "" {
+			continue
+		}
+		if csvFields[field] == nil {
+			if ok {
+				return nil, fmt.Errorf("column %q maps to unknown field %q", h, field)
+			}
+			continue
+		}
+		columns[i] = field
+		found[field] = true
+	}
+	for h := range mapping {
+		if !containsHeader(header, h) {
+			return nil, fmt.Errorf("mapped column %q not found in CSV header", h)
+		}
+	}
+	if len(found) == 0 {
+		return nil, errors.New("no CSV column maps to a campaign data field")
+	}
+	return columns, nil
+}
+
+func containsHeader(header []string, name string) bool {
+	for _, h := range header {
+		if strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCSVRow builds a record from a row. Unparseable cells are reported per field.
+func parseCSVRow(row, columns []string, defaults map[string]string) (schema.CampaignData, []schema.FieldError, error) {
+	var data schema.CampaignData
+	var fields []schema.FieldError
+	set := make(map[string]bool)
+	for i, field := range columns {
+		if field == "" || i >= len(row) || strings.TrimSpace(row[i]) == "" {
+			continue
+		}
+		if err := csvFields[field](&data, strings.TrimSpace(row[i])); err != nil {
+			fields = append(fields, schema.FieldError{Field: field, Message: err.Error()})
+		}
+		set[field] = true
+	}
+	for field, v := range defaults {
+		if !set[field] {
+			if err := csvFields[field](&data, v); err != nil {
+				fields = append(fields, schema.FieldError{Field: field, Message: "default: " + err.Error()})
+			}
+		}
+	}
+	if len(fields) > 0 {
+		return data, fields, errors.New("invalid values")
+	}
+	return data, nil, nil
+}
+
+// parseCSVTime accepts unix seconds, YYYY-MM-DD or RFC 3339
+func parseCSVTime(v string) (int64, error) {
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return n, nil
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot parse %q as a date", v)
+}
+
+// parseCSVInt accepts thousands separators as spreadsheets export them
+func parseCSVInt(v string) (int, error) {
+	digits, err := stripThousands(v, false)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q as a number", v)
+	}
+	return n, nil
+}
+
+func parseCSVFloat(v string) (float64, error) {
+	digits, err := stripThousands(v, true)
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(digits, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q as a number", v)
+	}
+	return f, nil
+}
+
+// stripThousands removes commas used as thousands separators. Commas must
+// group the integer part by three digits, so that a decimal comma such as
+// "12,50" is rejected instead of read as 1250. For decimals, a single comma
+// as in "1,250" could be either and needs the decimal point: "1,250.00".
+func stripThousands(v string, decimal bool) (string, error) {
+	if !strings.Contains(v, ",") {
+		return v, nil
+	}
+	whole, frac, hasPoint := strings.Cut(v, ".")
+	if strings.Contains(frac, ",") {
+		return "", fmt.Errorf("cannot parse %q as a number: comma after the decimal point", v)
+	}
+	groups := strings.Split(strings.TrimPrefix(whole, "-"), ",")
+	if len(groups[0]) == 0 || len(groups[0]) > 3 {
+		return "", fmt.Errorf("cannot parse %q as a number: ambiguous separator", v)
+	}
+	for _, g := range groups[1:] {
+		if len(g) != 3 {
+			return "", fmt.Errorf("cannot parse %q as a number: ambiguous separator", v)
+		}
+	}
+	if decimal && !hasPoint && len(groups) == 2 {
+		return "", fmt.Errorf("cannot parse %q as a number: ambiguous separator, write %s or %s.00",
+			v, strings.ReplaceAll(v, ",", ""), v)
+	}
+	return strings.ReplaceAll(v, ",", ""), nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"campaign-analytics/codec"
+	"campaign-analytics/schema"
+)
+
+func TestMapCSVColumns(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		header  []string
+		mapping map[string]string
+		want    []string
+		ok      bool
+	}{
+		{"field names", []string{"\ufeffCampaign_ID", " Cost ", "notes"}, nil, []string{"campaign_id", "cost", ""}, true},
+		{"mapping", []string{"Campaign", "Spend", "Notes", "cost"},
+			map[string]string{"Campaign": "campaign_id", "Spend": "cost", "Notes": ""}, []string{"campaign_id", "cost", "", ""}, true},
+		{"unknown field", []string{"Campaign"}, map[string]string{"Campaign": "budget"}, nil, false},
+		{"missing column", []string{"Campaign"}, map[string]string{"Campaign": "campaign_id", "Spend": "cost"}, nil, false},
+		{"no field", []string{"notes"}, nil, nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := mapCSVColumns(tc.header, tc.mapping)
+			if (err == nil) != tc.ok || !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %q (%v), want %q", got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestStripThousands(t *testing.T) {
+	for _, tc := range []struct {
+		v       string
+		decimal bool
+		want    string // "" when rejected
+	}{
+		{"1250", false, "1250"},
+		{"1,250", false, "1250"},
+		{"-12,345,678", false, "-12345678"},
+		{"1,250.00", true, "1250.00"},
+		{"1,250,000", true, "1250000"},
+		{"12.50", true, "12.50"},
+		{"1,250", true, ""},
+		{"12,50", true, ""},
+		{"1,2500", false, ""},
+		{",250", false, ""},
+		{"1250,000", false, ""},
+		{"1.250,5", true, ""},
+	} {
+		got, err := stripThousands(tc.v, tc.decimal)
+		if got != tc.want || (err == nil) != (tc.want != "") {
+			t.Errorf("%q (decimal %v): got %q (%v), want %q", tc.v, tc.decimal, got, err, tc.want)
+		}
+	}
+}
+
+// postCSV posts a CSV with its mapping and defaults to h, leaving out empty parts
+func postCSV(h http.Handler, query, mapping, defaults, file string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range [][2]string{{"mapping", mapping}, {"defaults", defaults}, {"file", file}} {
+		if part[1] != "" {
+			mw.WriteField(part[0], part[1])
+		}
+	}
+	mw.Close()
+	r := httptest.NewRequest(http.MethodPost, "/ingest/csv"+query, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func upload(t *testing.T, h http.Handler, query, mapping, defaults, file string) (int, CSVResponse) {
+	t.Helper()
+	w := postCSV(h, query, mapping, defaults, file)
+	var resp CSVResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("status %d, body %q: %v", w.Code, w.Body.String(), err)
+	}
+	return w.Code, resp
+}
+
+const (
+	csvMapping  = `{"Campaign":"campaign_id","Date":"timestamp","Spend":"cost","Impressions":"impressions","Clicks":"clicks","Notes":""}`
+	csvDefaults = `{"platform":"print","currency":"eur"}`
+	// Two identical insertions of an ad, then an ambiguous spend and a bad date
+	csvFile = `Campaign,Date,Spend,Impressions,Clicks,Notes
+c1,2024-03-01,"1,250.00","12,000",100,back cover
+c1,2024-03-01,"1,250.00","12,000",100,back cover
+c2,2024-03-01,"12,50",10,1,
+c3,01/03/2024,1,1,1,
+`
+)
+
+func csvLines(errs []BatchResult) map[int]string {
+	out := make(map[int]string)
+	for _, e := range errs {
+		for _, f := range e.Fields {
+			out[e.Line] = f.Field
+		}
+	}
+	return out
+}
+
+func TestCSVUpload(t *testing.T) {
+	data := &testSink{}
+	h := newIngestHandler(data, &testSink{}, NewMemoryDedupStore(time.Hour, 100), codec.JSON, nil)
+	wantErrors := map[int]string{4: "cost", 5: "timestamp"}
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).Unix()
+	row := schema.CampaignData{CampaignID: "c1", Platform: "print", Timestamp: day, Impressions: 12000, Clicks: 100, Cost: 1250, Currency: "EUR", SchemaVersion: schema.CurrentVersion}
+
+	code, resp := upload(t, h, "?dry_run=true", csvMapping, csvDefaults, csvFile)
+	if code != http.StatusOK || resp.Rows != 4 || resp.Accepted != 2 || resp.Rejected != 2 || resp.Duplicates != 0 {
+		t.Fatalf("dry run: status %d, %+v", code, resp)
+	}
+	if got := csvLines(resp.Errors); !reflect.DeepEqual(got, wantErrors) {
+		t.Fatalf("dry run errors %v, want %v", got, wantErrors)
+	}
+	if len(resp.Preview) != 2 || resp.Preview[0].EventID == resp.Preview[1].EventID {
+		t.Fatalf("preview %+v, want both rows", resp.Preview)
+	}
+	for _, p := range resp.Preview {
+		p.EventID = ""
+		if !reflect.DeepEqual(p, row) {
+			t.Fatalf("previewed %+v, want %+v", p, row)
+		}
+	}
+	if len(data.msgs) != 0 {
+		t.Fatalf("dry run wrote %d messages", len(data.msgs))
+	}
+
+	code, resp = upload(t, h, "", csvMapping, csvDefaults, csvFile)
+	if code != http.StatusAccepted || resp.Accepted != 2 || resp.Rejected != 2 || len(resp.Preview) != 0 {
+		t.Fatalf("commit: status %d, %+v", code, resp)
+	}
+	if recs := data.records(t); len(recs) != 2 || recs[0].EventID == recs[1].EventID {
+		t.Fatalf("ingested %+v, want both rows", recs)
+	}
+
+	// The same file uploaded again is ingested once
+	code, resp = upload(t, h, "", csvMapping, csvDefaults, csvFile)
+	if code != http.StatusAccepted || resp.Accepted != 0 || resp.Duplicates != 2 || len(data.msgs) != 2 {
+		t.Fatalf("re-upload: status %d, %+v, %d messages", code, resp, len(data.msgs))
+	}
+}
+
+func TestCSVUploadEventIDs(t *testing.T) {
+	data := &testSink{}
+	h := newIngestHandler(data, &testSink{}, NewMemoryDedupStore(time.Hour, 100), codec.JSON, nil)
+	code, resp := upload(t, h, "", "", csvDefaults, `campaign_id,timestamp,event_id
+c1,2024-03-01,e1
+c1,2024-03-02,e1
+c1,2024-03-03,e2
+`)
+	if code != http.StatusAccepted || resp.Accepted != 2 || resp.Duplicates != 1 || len(data.msgs) != 2 {
+		t.Fatalf("status %d, %+v, %d messages", code, resp, len(data.msgs))
+	}
+}
+
+// After a sink failure, uploading the file again ingests the rows left out
+func TestCSVUploadRetry(t *testing.T) {
+	data := &testSink{err: errors.New("broker unavailable")}
+	h := newIngestHandler(data, &testSink{}, NewMemoryDedupStore(time.Hour, 100), codec.JSON, nil)
+	if code, resp := upload(t, h, "", csvMapping, csvDefaults, csvFile); code != http.StatusInternalServerError || resp.Accepted != 0 {
+		t.Fatalf("failed upload: status %d, %+v", code, resp)
+	}
+	data.err = nil
+	if code, resp := upload(t, h, "", csvMapping, csvDefaults, csvFile); code != http.StatusAccepted || resp.Accepted != 2 {
+		t.Fatalf("retry: status %d, %+v", code, resp)
+	}
+}
+
+func TestCSVUploadMalformed(t *testing.T) {
+	h := newIngestHandler(&testSink{}, &testSink{}, NewMemoryDedupStore(time.Hour, 100), codec.JSON, nil)
+	for name, tc := range map[string][3]string{
+		"missing file":          {csvMapping, "", ""},
+		"unknown default":       {"", `{"budget":"1"}`, csvFile},
+		"invalid mapping":       {`{"Campaign":`, "", csvFile},
+		"mapped column missing": {`{"Budget":"cost"}`, "", csvFile},
+	} {
+		w := postCSV(h, "", tc[0], tc[1], tc[2])
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, w.Code)
+		}
+	}
+}
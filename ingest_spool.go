@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"os"
+	"strconv"
+	"time"
+
+	"campaign-analytics/sink"
+	"campaign-analytics/spool"
+)
+
+const (
+	defaultSpoolMaxBytes = 1 << 30 // 1 GB
+	spoolPrimaryTimeout  = 2 * time.Second
+)
+
+// newSpooledSink wraps primary with a disk spool in dir and starts the
+// forwarder draining it back to primary. Messages primary keeps rejecting are
+// moved to spool.DeadLetterFile in dir. The returned func stops the forwarder.
+func newSpooledSink(primary sink.EventSink, dir, name string) (sink.EventSink, func(), error) {
+	maxBytes := int64(defaultSpoolMaxBytes)
+	if v := os.Getenv("INGEST_SPOOL_MAX_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			maxBytes = n
+		}
+	}
+	sp, err := spool.Open(dir, maxBytes, spool.DefaultSegmentBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Spool depth and age are exposed on /debug/vars
+	expvar.Publish("ingest_spool_"+name, expvar.Func(func() interface{} { return sp.Stats() }))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sp.Forward(ctx, primary)
+	}()
+	return spool.NewSink(primary, sp, spoolPrimaryTimeout), func() {
+		cancel()
+		<-done
+	}, nil
+}
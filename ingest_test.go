@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"campaign-analytics/codec"
+	"campaign-analytics/schema"
+	"campaign-analytics/sink"
+	"campaign-analytics/spool"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func testRecord(eventID string) string {
+	rec := `{"campaign_id":"c1","platform":"meta","timestamp":1700000000,"impressions":100,"clicks":10`
+	if eventID != "" {
+		rec += `,"event_id":"` + eventID + `"`
+	}
+	return rec + "}"
+}
+
+func post(h http.Handler, path, body string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestIngestHandler(t *testing.T) {
+	newHandler := func(data *testSink, dedup DedupStore) http.Handler {
+		return newIngestHandler(data, &testSink{}, dedup, codec.JSON, nil)
+	}
+
+	t.Run("accepted", func(t *testing.T) {
+		data := &testSink{}
+		h := newHandler(data, NewMemoryDedupStore(time.Hour, 100))
+		if w := post(h, "/ingest", testRecord(""), nil); w.Code != http.StatusAccepted {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		recs := data.records(t)
+		if len(recs) != 1 || recs[0].CampaignID != "c1" || recs[0].Clicks != 10 {
+			t.Fatalf("ingested %+v", recs)
+		}
+		if enc, err := codec.EncodingOf(data.msgs[0].Headers); err != nil || enc != codec.JSON {
+			t.Fatalf("encoding %q (%v), want JSON", enc, err)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		data := &testSink{}
+		h := newHandler(data, NewMemoryDedupStore(time.Hour, 100))
+		r := httptest.NewRequest(http.MethodGet, "/ingest", nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("GET: status %d", w.Code)
+		}
+		if w := post(h, "/ingest", `{"campaign_id":`, nil); w.Code != http.StatusBadRequest {
+			t.Fatalf("malformed JSON: status %d", w.Code)
+		}
+		w = post(h, "/ingest", `{"campaign_id":"c1","platform":"myspace","timestamp":1700000000}`, nil)
+		var body struct {
+			Error  string
+			Fields []struct{ Field string }
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if w.Code != http.StatusBadRequest || body.Error != "validation failed" || len(body.Fields) != 1 || body.Fields[0].Field != "platform" {
+			t.Fatalf("invalid platform: status %d, %s", w.Code, w.Body)
+		}
+		if len(data.msgs) != 0 {
+			t.Fatalf("rejected records written: %d", len(data.msgs))
+		}
+	})
+
+	t.Run("idempotency key", func(t *testing.T) {
+		data := &testSink{}
+		h := newHandler(data, NewMemoryDedupStore(time.Hour, 100))
+		header := http.Header{"Idempotency-Key": {"k1"}}
+		if w := post(h, "/ingest", testRecord(""), header); w.Code != http.StatusAccepted || w.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("first: status %d, headers %v", w.Code, w.Header())
+		}
+		if w := post(h, "/ingest", testRecord(""), header); w.Code != http.StatusAccepted || w.Header().Get("Idempotent-Replayed") != "true" {
+			t.Fatalf("replay: status %d, headers %v", w.Code, w.Header())
+		}
+		// The event_id in the body is a key too
+		post(h, "/ingest", testRecord("e1"), nil)
+		post(h, "/ingest", testRecord("e1"), nil)
+		recs := data.records(t)
+		if len(recs) != 2 || recs[0].EventID != "k1" || recs[1].EventID != "e1" {
+			t.Fatalf("ingested %+v, want k1 and e1 once", recs)
+		}
+	})
+
+	t.Run("in flight", func(t *testing.T) {
+		dedup := NewMemoryDedupStore(time.Hour, 100)
+		dedup.Begin(context.Background(), "e1")
+		if w := post(newHandler(&testSink{}, dedup), "/ingest", testRecord("e1"), nil); w.Code != http.StatusConflict {
+			t.Fatalf("status %d, want 409", w.Code)
+		}
+	})
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"sink down", errors.New("broker unavailable"), http.StatusInternalServerError},
+		{"spool full", spool.ErrFull, http.StatusServiceUnavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := &testSink{err: tc.err}
+			h := newHandler(data, NewMemoryDedupStore(time.Hour, 100))
+			if w := post(h, "/ingest", testRecord("e1"), nil); w.Code != tc.code {
+				t.Fatalf("status %d, want %d", w.Code, tc.code)
+			}
+			// The key was released for the retry
+			data.err = nil
+			if w := post(h, "/ingest", testRecord("e1"), nil); w.Code != http.StatusAccepted || len(data.msgs) != 1 {
+				t.Fatalf("retry: status %d, %d messages", w.Code, len(data.msgs))
+			}
+		})
+	}
+}
+
+func decodeBatch(t *testing.T, w *httptest.ResponseRecorder) BatchResponse {
+	t.Helper()
+	var resp BatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("status %d, body %q: %v", w.Code, w.Body, err)
+	}
+	return resp
+}
+
+func TestIngestBatch(t *testing.T) {
+	ndjson := strings.Join([]string{
+		testRecord("e1"),
+		`{"campaign_id":"c1","platform":"meta","timestamp":1700000000,"impressions":1,"clicks":2}`,
+		"",
+		`{"campaign_id":`,
+		testRecord("e1"),
+		testRecord(""),
+	}, "\n") + "\n"
+	want := []BatchResult{
+		{Line: 1, Accepted: true},
+		{Line: 2, Error: "validation failed", Fields: []schema.FieldError{{Field: "clicks", Message: "must not exceed impressions"}}},
+		{Line: 3, Error: "Empty line"},
+		{Line: 4, Error: "Invalid JSON: unexpected end of JSON input"},
+		{Line: 5, Accepted: true, Duplicate: true},
+		{Line: 6, Accepted: true},
+	}
+
+	data := &testSink{}
+	h := newIngestHandler(data, &testSink{}, NewMemoryDedupStore(time.Hour, 100), codec.JSON, nil)
+	w := post(h, "/ingest/batch", ndjson, nil)
+	resp := decodeBatch(t, w)
+	if w.Code != http.StatusAccepted || resp.Accepted != 3 || resp.Rejected != 3 || !reflect.DeepEqual(resp.Results, want) {
+		t.Fatalf("status %d, %+v, want results %+v", w.Code, resp, want)
+	}
+	if len(data.msgs) != 2 {
+		t.Fatalf("%d messages written, want 2", len(data.msgs))
+	}
+
+	// The batch again as an array: e1 was ingested, the record without event
+	// ID is written again
+	w = post(h, "/ingest/batch", "[\n"+testRecord("e1")+",\n"+testRecord("")+"]", nil)
+	resp = decodeBatch(t, w)
+	want = []BatchResult{{Line: 1, Accepted: true, Duplicate: true}, {Line: 2, Accepted: true}}
+	if w.Code != http.StatusAccepted || !reflect.DeepEqual(resp.Results, want) || len(data.msgs) != 3 {
+		t.Fatalf("status %d, %+v, %d messages", w.Code, resp, len(data.msgs))
+	}
+
+	if w := post(h, "/ingest/batch", `{"campaign_id":`, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("all rejected: status %d", w.Code)
+	}
+	if w := post(h, "/ingest/batch", `[{"campaign_id":`, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("malformed array: status %d", w.Code)
+	}
+}
+
+func TestIngestBatchSinkFailure(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		code int
+		msg  string
+	}{
+		{"sink down", errors.New("broker unavailable"), http.StatusBadRequest, "Failed to write to sink"},
+		{"spool full", spool.ErrFull, http.StatusServiceUnavailable, "Service Unavailable: ingest spool is full"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := &testSink{err: tc.err}
+			h := newIngestHandler(data, &testSink{}, NewMemoryDedupStore(time.Hour, 100), codec.JSON, nil)
+			body := testRecord("e1") + "\n" + testRecord("e2")
+			w := post(h, "/ingest/batch", body, nil)
+			resp := decodeBatch(t, w)
+			if w.Code != tc.code || resp.Accepted != 0 || resp.Results[0].Error != tc.msg || resp.Results[1].Error != tc.msg {
+				t.Fatalf("status %d, %+v", w.Code, resp)
+			}
+			// The keys were released for the retry
+			data.err = nil
+			if w := post(h, "/ingest/batch", body, nil); w.Code != http.StatusAccepted || decodeBatch(t, w).Accepted != 2 || len(data.msgs) != 2 {
+				t.Fatalf("retry: status %d, %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+// partialSink fails the messages whose event_id is in fail, as Kafka reports
+// a partially written batch
+type partialSink struct {
+	testSink
+	fail map[string]bool
+}
+
+func (s *partialSink) Write(ctx context.Context, msgs ...kafka.Message) error {
+	var written []kafka.Message
+	errs := make(kafka.WriteErrors, len(msgs))
+	failed := false
+	for i, msg := range msgs {
+		for _, h := range msg.Headers {
+			if h.Key == "event_id" && s.fail[string(h.Value)] {
+				errs[i], failed = kafka.LeaderNotAvailable, true
+			}
+		}
+		if errs[i] == nil {
+			written = append(written, msg)
+		}
+	}
+	s.testSink.Write(ctx, written...)
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+// Lines written in a partially failed write are accepted, the others rejected
+func TestIngestBatchPartialFailure(t *testing.T) {
+	data := &partialSink{fail: map[string]bool{"e2": true}}
+	h := newIngestHandler(data, &testSink{}, NewMemoryDedupStore(time.Hour, 100), codec.JSON, nil)
+	body := strings.Join([]string{testRecord("e1"), testRecord("e2"), testRecord("e3"), testRecord("e2")}, "\n")
+	w := post(h, "/ingest/batch", body, nil)
+	resp := decodeBatch(t, w)
+	want := []BatchResult{
+		{Line: 1, Accepted: true},
+		{Line: 2, Error: "Failed to write to sink"},
+		{Line: 3, Accepted: true},
+		{Line: 4, Duplicate: true, Error: "Failed to write to sink"},
+	}
+	if w.Code != http.StatusAccepted || resp.Accepted != 2 || !reflect.DeepEqual(resp.Results, want) {
+		t.Fatalf("status %d, %+v, want results %+v", w.Code, resp, want)
+	}
+	if len(data.msgs) != 2 {
+		t.Fatalf("%d messages written, want 2", len(data.msgs))
+	}
+
+	// The retry only writes the failed line
+	data.fail = nil
+	w = post(h, "/ingest/batch", body, nil)
+	if resp := decodeBatch(t, w); resp.Accepted != 4 || len(data.msgs) != 3 {
+		t.Fatalf("retry: %+v, %d messages", resp, len(data.msgs))
+	}
+	var ids []string
+	for _, rec := range data.records(t) {
+		ids = append(ids, rec.EventID)
+	}
+	if !reflect.DeepEqual(ids, []string{"e1", "e3", "e2"}) {
+		t.Fatalf("written %v, want e1 e3 e2", ids)
+	}
+}
+
+// fileRecords reads the values written by a sink.FileSink
+func fileRecords(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec sink.FileRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, string(rec.Value))
+	}
+	return out
+}
+
+func TestOpenSink(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	t.Setenv("INGEST_SINK", "file")
+	t.Setenv("INGEST_SINK_DIR", dir)
+
+	for _, spoolDir := range []string{"", filepath.Join(dir, "spool")} {
+		t.Setenv("INGEST_SPOOL_DIR", spoolDir)
+		topic := "direct"
+		if spoolDir != "" {
+			topic = "spooled"
+		}
+		s, closeSink, err := openSink(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, spooled := s.(*spool.Sink); spooled != (spoolDir != "") {
+			t.Fatalf("%s: sink %T", topic, s)
+		}
+		if err := s.Write(ctx, kafka.Message{Value: []byte("a")}); err != nil {
+			t.Fatal(err)
+		}
+		closeSink()
+		if got := fileRecords(t, filepath.Join(dir, topic+".ndjson")); !reflect.DeepEqual(got, []string{"a"}) {
+			t.Fatalf("%s: file holds %v", topic, got)
+		}
+	}
+
+	t.Setenv("INGEST_SINK", "memory")
+	if s, err := newEventSink("memory"); err != nil {
+		t.Fatal(err)
+	} else if _, ok := s.(*sink.ChannelSink); !ok {
+		t.Fatalf("memory sink %T", s)
+	} else {
+		s.Close()
+	}
+	t.Setenv("INGEST_SINK", "carrier-pigeon")
+	if _, err := newEventSink("t"); err == nil {
+		t.Fatal("unknown sink opened")
+	}
+}
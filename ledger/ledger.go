@@ -0,0 +1,200 @@
+// Package ledger records the IDs of processed Kafka messages so that
+// redelivered or re-produced messages are not applied twice.
+package ledger
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// MessageIDHeader is the header carrying a producer-assigned message ID
+const MessageIDHeader = "event_id"
+
+// maxIDLength is the size of processed_messages.message_id
+const maxIDLength = 255
+
+// MessageID identifies a message: the producer-assigned event_id header when
+// present, which survives retries through a re-produce, else its topic
+// position. The event_id comes from clients, so it is scoped to the topic and
+// message key (the campaign) lest two campaigns' IDs collide.
+func MessageID(msg kafka.Message) string {
+	for _, h := range msg.Headers {
+		if h.Key == MessageIDHeader && len(h.Value) > 0 {
+			id := fmt.Sprintf("%s/%s/%s", msg.Topic, msg.Key, h.Value)
+			if len(id) > maxIDLength {
+				sum := sha256.Sum256(h.Value)
+				id = fmt.Sprintf("%s/%s/sha256:%s", msg.Topic, msg.Key, hex.EncodeToString(sum[:]))
+			}
+			return id
+		}
+	}
+	return fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
+}
+
+// Ledger tracks processed message IDs
+type Ledger interface {
+	// Seen reports whether id was already processed
+	Seen(ctx context.Context, id string) (bool, error)
+	// Mark records id as processed
+	Mark(ctx context.Context, id string) error
+	// Claim runs process unless id was processed, and records id as
+	// processed only if process succeeds. A concurrent claim of the same id
+	// waits for the first to finish. It reports whether process ran; an
+	// error of process is returned as is.
+	Claim(ctx context.Context, id string, process func(ctx context.Context) error) (bool, error)
+}
+
+// SQL is a Ledger backed by the processed_messages table:
+//
+//	CREATE TABLE processed_messages (
+//	    ledger       VARCHAR(100) NOT NULL,
+//	    message_id   VARCHAR(255) NOT NULL,
+//	    processed_at TIMESTAMP    NOT NULL,
+//	    PRIMARY KEY (ledger, message_id)
+//	);
+//
+// MarkTx lets callers record IDs in the same transaction as their own writes.
+type SQL struct {
+	db   *sql.DB
+	name string // namespace, usually the consumer group
+}
+
+func NewSQL(db *sql.DB, name string) *SQL {
+	return &SQL{db: db, name: name}
+}
+
+func (l *SQL) Seen(ctx context.Context, id string) (bool, error) {
+	var n int
+	err := l.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM processed_messages WHERE ledger = $1 AND message_id = $2", l.name, id).Scan(&n)
+	if err != nil {
+		return false, errors.Wrap(err, "query ledger")
+	}
+	return n > 0, nil
+}
+
+func (l *SQL) Mark(ctx context.Context, id string) error {
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+	if _, err := l.MarkTx(ctx, tx, []string{id}); err != nil {
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "commit transaction")
+}
+
+// Claim records id in a transaction held open while process runs, so that
+// the record commits with process' success and a concurrent claim blocks on
+// it. Only a failed commit after process succeeded lets it run again.
+func (l *SQL) Claim(ctx context.Context, id string, process func(ctx context.Context) error) (bool, error) {
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+	fresh, err := l.MarkTx(ctx, tx, []string{id})
+	if err != nil || !fresh[id] {
+		return false, err
+	}
+	if err := process(ctx); err != nil {
+		return true, err
+	}
+	return true, errors.Wrap(tx.Commit(), "commit transaction")
+}
+
+// MarkTx records ids within tx and returns those that were not processed
+// before. IDs repeated within ids are only returned once.
+func (l *SQL) MarkTx(ctx context.Context, tx *sql.Tx, ids []string) (map[string]bool, error) {
+	stmt, err := tx.PrepareContext(ctx, `
+INSERT INTO processed_messages (ledger, message_id, processed_at) VALUES ($1, $2, $3)
+ON CONFLICT (ledger, message_id) DO NOTHING`)
+	if err != nil {
+		return nil, errors.Wrap(err, "prepare ledger insert")
+	}
+	defer stmt.Close()
+
+	now := time.Now().UTC()
+	fresh := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		res, err := stmt.ExecContext(ctx, l.name, id, now)
+		if err != nil {
+			return nil, errors.Wrap(err, "insert ledger")
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			fresh[id] = true
+		}
+	}
+	return fresh, nil
+}
+
+// Prune forgets IDs processed before cutoff. Keep the retention longer than
+// any redelivery or retry delay.
+func (l *SQL) Prune(ctx context.Context, cutoff time.Time) (int64, error) {
+	res, err := l.db.ExecContext(ctx,
+		"DELETE FROM processed_messages WHERE ledger = $1 AND processed_at < $2", l.name, cutoff)
+	if err != nil {
+		return 0, errors.Wrap(err, "prune ledger")
+	}
+	return res.RowsAffected()
+}
+
+// Memory is an in-process Ledger for tests and local development
+type Memory struct {
+	mu     sync.Mutex
+	ids    map[string]bool
+	claims sync.Mutex // held by Claim, which runs one process at a time
+}
+
+func NewMemory() *Memory {
+	return &Memory{ids: make(map[string]bool)}
+}
+
+func (l *Memory) Seen(_ context.Context, id string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ids[id], nil
+}
+
+func (l *Memory) Mark(_ context.Context, id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ids[id] = true
+	return nil
+}
+
+func (l *Memory) Claim(ctx context.Context, id string, process func(ctx context.Context) error) (bool, error) {
+	l.claims.Lock()
+	defer l.claims.Unlock()
+	if seen, _ := l.Seen(ctx, id); seen {
+		return false, nil
+	}
+	if err := process(ctx); err != nil {
+		return true, err
+	}
+	return true, l.Mark(ctx, id)
+}
+
+// MarkNew records ids and returns those that were not processed before. The
+// caller must hold its own lock if this has to be atomic with other writes.
+func (l *Memory) MarkNew(ids []string) map[string]bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fresh := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if !l.ids[id] {
+			l.ids[id] = true
+			fresh[id] = true
+		}
+	}
+	return fresh
+}
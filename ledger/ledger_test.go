@@ -0,0 +1,152 @@
+package ledger
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"campaign-analytics/migrate/migratetest"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/segmentio/kafka-go"
+)
+
+func TestMessageID(t *testing.T) {
+	header := func(v string) []kafka.Header { return []kafka.Header{{Key: MessageIDHeader, Value: []byte(v)}} }
+	long := strings.Repeat("x", 300)
+	sum := sha256.Sum256([]byte(long))
+	for _, tc := range []struct {
+		name string
+		msg  kafka.Message
+		want string
+	}{
+		{"position", kafka.Message{Topic: "t", Partition: 2, Offset: 7}, "t/2/7"},
+		{"empty header", kafka.Message{Topic: "t", Offset: 7, Headers: header("")}, "t/0/7"},
+		{"event_id", kafka.Message{Topic: "t", Key: []byte("c1"), Offset: 7, Headers: header("e1")}, "t/c1/e1"},
+		{"other campaign", kafka.Message{Topic: "t", Key: []byte("c2"), Headers: header("e1")}, "t/c2/e1"},
+		{"other topic", kafka.Message{Topic: "u", Key: []byte("c1"), Headers: header("e1")}, "u/c1/e1"},
+		{"long event_id", kafka.Message{Topic: "t", Key: []byte("c1"), Headers: header(long)}, "t/c1/sha256:" + hex.EncodeToString(sum[:])},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := MessageID(tc.msg); got != tc.want {
+				t.Fatalf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+var errExport = errors.New("export failed")
+
+// testClaim claims an ID through an export failing once, then succeeding,
+// then redelivered, with concurrent deliveries of another ID exported once
+func testClaim(t *testing.T, l Ledger) {
+	ctx := context.Background()
+	var runs int
+	export := func(err error) func(context.Context) error {
+		return func(context.Context) error {
+			runs++
+			return err
+		}
+	}
+
+	claimed, err := l.Claim(ctx, "m1", export(errExport))
+	if !claimed || err != errExport {
+		t.Fatalf("failed export: claimed %v, err %v", claimed, err)
+	}
+	if seen, err := l.Seen(ctx, "m1"); seen || err != nil {
+		t.Fatalf("failed export recorded (%v)", err)
+	}
+	if claimed, err := l.Claim(ctx, "m1", export(nil)); !claimed || err != nil {
+		t.Fatalf("retried export: claimed %v, err %v", claimed, err)
+	}
+	if claimed, err := l.Claim(ctx, "m1", export(nil)); claimed || err != nil {
+		t.Fatalf("redelivered export: claimed %v, err %v", claimed, err)
+	}
+	if runs != 2 {
+		t.Fatalf("export ran %d times, want 2", runs)
+	}
+
+	var exports int32
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := l.Claim(ctx, "m2", func(context.Context) error {
+				atomic.AddInt32(&exports, 1)
+				time.Sleep(10 * time.Millisecond)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if exports != 1 {
+		t.Fatalf("concurrent deliveries exported %d times, want 1", exports)
+	}
+}
+
+func TestMemoryClaim(t *testing.T) {
+	testClaim(t, NewMemory())
+}
+
+func TestSQLClaim(t *testing.T) {
+	testClaim(t, NewSQL(migratetest.DB(t), "exports"))
+}
+
+const markSQL = "INSERT INTO processed_messages"
+
+// The claim and the export share one transaction: committed on success,
+// rolled back on failure or when the ID was processed already
+func TestSQLClaimTransaction(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		inserted  int64
+		exportErr error
+		commit    bool
+	}{
+		{"fresh", 1, nil, true},
+		{"export failed", 1, errExport, false},
+		{"processed", 0, nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			mock.ExpectBegin()
+			mock.ExpectPrepare(markSQL).ExpectExec().
+				WithArgs("exports", "m1", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, tc.inserted))
+			if tc.commit {
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			ran := false
+			claimed, err := NewSQL(db, "exports").Claim(context.Background(), "m1", func(context.Context) error {
+				ran = true
+				return tc.exportErr
+			})
+			if err != tc.exportErr {
+				t.Fatalf("got %v, want %v", err, tc.exportErr)
+			}
+			if claimed != (tc.inserted == 1) || ran != claimed {
+				t.Fatalf("claimed %v, ran %v", claimed, ran)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -3,23 +3,81 @@
 package main
 
 import (
+	"campaign-analytics/anomaly"
+	"campaign-analytics/events"
+	"campaign-analytics/fx"
 	"campaign-analytics/handlers"
 	"campaign-analytics/middleware"
+	"campaign-analytics/models"
+	"campaign-analytics/reach"
+	"campaign-analytics/rollup"
+	"campaign-analytics/services"
+	"database/sql"
+	"log"
+	"os"
 
 	"github.com/gin-gonic/gin"
+	_ "github.com/lib/pq"
 )
 
 func main() {
+	// Insights are served from the rollups maintained by cmd/rollup
+	handlers.Rollups = rollup.NewMemoryRepository()
+	handlers.Events = events.NewMemoryStore()
+	handlers.Reach = reach.NewMemoryStore()
+	handlers.Anomalies = anomaly.NewMemoryStore()
+	if dsn := os.Getenv("DATABASE_URL"); dsn != "" {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			log.Fatalf("open database: %v", err)
+		}
+		defer db.Close()
+		handlers.Rollups = rollup.NewPostgresRepository(db)
+		handlers.Events = events.NewPostgresStore(db)
+		handlers.Reach = reach.NewPostgresStore(db)
+		handlers.Anomalies = anomaly.NewPostgresStore(db)
+		services.Campaigns = models.NewPostgresCampaignRepository(db)
+	}
+	// Platform metrics are read from ClickHouse when configured
+	if url := os.Getenv("CLICKHOUSE_URL"); url != "" {
+		services.Campaigns = models.NewClickHouseCampaignRepository(models.ClickHouseConfig{
+			URL:      url,
+			Database: os.Getenv("CLICKHOUSE_DATABASE"),
+			User:     os.Getenv("CLICKHOUSE_USER"),
+			Password: os.Getenv("CLICKHOUSE_PASSWORD"),
+		}, nil)
+	}
+
+	// Campaigns spending in several currencies are reported in one
+	if path := os.Getenv("FX_RATES_FILE"); path != "" {
+		rates, err := fx.LoadFile(path)
+		if err != nil {
+			log.Fatalf("load FX rates: %v", err)
+		}
+		services.Rates = rates
+	}
+	services.ReportingCurrency = os.Getenv("REPORTING_CURRENCY")
+	if services.ReportingCurrency == "" {
+		services.ReportingCurrency = "USD"
+	}
+
 	router := gin.Default()
 
 	// Apply authentication middleware
 	router.Use(middleware.AuthMiddleware())
 
 	// Define routes
-	router.Group("/campaign")
+	campaign := router.Group("/campaign")
 	{
-		router.GET("/:id/insights", handlers.GetCampaignInsights)
+		campaign.GET("/:id/insights", handlers.GetCampaignInsights)
+		campaign.GET("/:id/metrics", handlers.GetCampaignMetrics)
+		campaign.GET("/:id/restatements", handlers.GetCampaignRestatements)
+		campaign.GET("/:id/attribution", handlers.GetCampaignAttribution)
+		campaign.GET("/:id/anomalies", handlers.GetCampaignAnomalies)
+		campaign.GET("/:id/funnel", handlers.GetCampaignFunnel)
 	}
+	router.GET("/attribution", handlers.GetAttribution)
+	router.GET("/reach", handlers.GetReach)
 	// Start the server
 	router.Run(":8080")
 }
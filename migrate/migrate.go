@@ -0,0 +1,271 @@
+// Package migrate applies the versioned SQL migrations embedded from sql/ and
+// records the applied ones in the schema_version table:
+//
+//	CREATE TABLE schema_version (
+//	    version    INT          PRIMARY KEY,
+//	    name       VARCHAR(255) NOT NULL,
+//	    applied_at TIMESTAMP    NOT NULL
+//	);
+//
+// Migrations are named NNNN_name.up.sql and NNNN_name.down.sql. Each step runs
+// in its own transaction together with its schema_version change.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//go:embed sql/*.sql
+var embedded embed.FS
+
+// lockKey serializes migrators across processes through pg_advisory_lock
+const lockKey int64 = 7264823190
+
+// Migration is a pair of up and down steps
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status tells whether a migration has been applied
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Embedded returns the migrations shipped with the binary
+func Embedded() ([]Migration, error) {
+	sub, err := fs.Sub(embedded, "sql")
+	if err != nil {
+		return nil, errors.Wrap(err, "open embedded migrations")
+	}
+	return Load(sub)
+}
+
+// Load reads the migrations of fsys, ordered by version. Every version needs
+// both steps and versions must not repeat.
+func Load(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, errors.Wrap(err, "list migrations")
+	}
+	byVersion := make(map[int]*Migration)
+	for _, file := range names {
+		base := strings.TrimSuffix(path.Base(file), ".sql")
+		dir := path.Ext(base)
+		num, name, ok := strings.Cut(strings.TrimSuffix(base, dir), "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || version <= 0 || (dir != ".up" && dir != ".down") {
+			return nil, errors.Errorf("invalid migration file name %q, want NNNN_name.up.sql or .down.sql", file)
+		}
+		b, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %s", file)
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		} else if m.Name != name {
+			return nil, errors.Errorf("migration %d is named both %q and %q", version, m.Name, name)
+		}
+		if dir == ".up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+
+	out := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, errors.Errorf("migration %04d_%s needs both an up and a down step", m.Version, m.Name)
+		}
+		out = append(out, *m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// Migrator applies migrations to a Postgres database
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+func New(db *sql.DB, migrations []Migration) *Migrator {
+	return &Migrator{db: db, migrations: migrations}
+}
+
+// Latest returns the version of the last known migration, 0 when none
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Status lists every known migration and when it was applied
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var out []Status
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			s := Status{Migration: mig}
+			if t, ok := applied[mig.Version]; ok {
+				s.AppliedAt = &t
+			}
+			out = append(out, s)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// Up applies the pending migrations up to and including version target. It
+// returns the applied migrations, stopping at the first failing one.
+func (m *Migrator) Up(ctx context.Context, target int) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if mig.Version > target {
+				break
+			}
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+			err := step(ctx, conn, mig.Up,
+				"INSERT INTO schema_version (version, name, applied_at) VALUES ($1, $2, $3)",
+				mig.Version, mig.Name, time.Now().UTC())
+			if err != nil {
+				return errors.Wrapf(err, "apply %04d_%s", mig.Version, mig.Name)
+			}
+			done = append(done, mig)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the applied migrations above version target, newest first. It
+// returns the reverted migrations, stopping at the first failing one.
+func (m *Migrator) Down(ctx context.Context, target int) ([]Migration, error) {
+	var done []Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if mig.Version <= target {
+				break
+			}
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			err := step(ctx, conn, mig.Down, "DELETE FROM schema_version WHERE version = $1", mig.Version)
+			if err != nil {
+				return errors.Wrapf(err, "revert %04d_%s", mig.Version, mig.Name)
+			}
+			done = append(done, mig)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Current returns the highest applied version, 0 when none
+func (m *Migrator) Current(ctx context.Context) (int, error) {
+	var current int
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedVersions(ctx, conn)
+		for v := range applied {
+			if v > current {
+				current = v
+			}
+		}
+		return err
+	})
+	return current, err
+}
+
+// locked runs fn on a single connection holding the migration lock, creating
+// the schema_version table first
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get connection")
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", lockKey); err != nil {
+		return errors.Wrap(err, "acquire migration lock")
+	}
+	// Unlock on a fresh context so a cancelled run still releases the lock
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", lockKey)
+
+	_, err = conn.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS schema_version (
+    version    INT          PRIMARY KEY,
+    name       VARCHAR(255) NOT NULL,
+    applied_at TIMESTAMP    NOT NULL
+)`)
+	if err != nil {
+		return errors.Wrap(err, "create schema_version")
+	}
+	return fn(conn)
+}
+
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, errors.Wrap(err, "query schema_version")
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var v int
+		var t time.Time
+		if err := rows.Scan(&v, &t); err != nil {
+			return nil, errors.Wrap(err, "scan schema_version")
+		}
+		applied[v] = t.UTC()
+	}
+	return applied, errors.Wrap(rows.Err(), "iterate schema_version")
+}
+
+// step runs a migration script and its schema_version change in one transaction
+func step(ctx context.Context, conn *sql.Conn, script, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return errors.Wrap(err, "record schema version")
+	}
+	return errors.Wrap(tx.Commit(), "commit transaction")
+}
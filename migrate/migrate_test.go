@@ -0,0 +1,257 @@
+package migrate_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"campaign-analytics/events"
+	"campaign-analytics/migrate"
+	"campaign-analytics/migrate/migratetest"
+	"campaign-analytics/models"
+	"campaign-analytics/spend"
+
+	_ "github.com/lib/pq"
+)
+
+func TestEmbedded(t *testing.T) {
+	migrations, err := migrate.Embedded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("migration %04d_%s follows version %d", m.Version, m.Name, i)
+		}
+	}
+}
+
+// relations lists the tables, indexes and sequences of the current schema
+func relations(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.Query(`
+SELECT c.relname FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE n.nspname = current_schema() AND c.relkind IN ('r', 'i', 'S')
+ORDER BY c.relname`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, name)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestUpDownUp(t *testing.T) {
+	db := migratetest.Schema(t)
+	ctx := context.Background()
+	migrations, err := migrate.Embedded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := migrate.New(db, migrations)
+
+	if _, err := m.Up(ctx, m.Latest()); err != nil {
+		t.Fatal(err)
+	}
+	migrated := relations(t, db)
+
+	reverted, err := m.Down(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != len(migrations) {
+		t.Fatalf("reverted %d migrations, want %d", len(reverted), len(migrations))
+	}
+	// Only schema_version, created on first use, remains
+	if got, want := relations(t, db), []string{"schema_version", "schema_version_pkey"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("relations left after down %v, want %v", got, want)
+	}
+
+	applied, err := m.Up(ctx, m.Latest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("reapplied %d migrations, want %d", len(applied), len(migrations))
+	}
+	if current, err := m.Current(ctx); err != nil || current != m.Latest() {
+		t.Fatalf("current version %d (%v), want %d", current, err, m.Latest())
+	}
+	if got := relations(t, db); !reflect.DeepEqual(got, migrated) {
+		t.Fatalf("relations after up, down, up %v, want %v", got, migrated)
+	}
+	checkQueries(t, db)
+}
+
+// checkQueries runs the queries of the services on a few rows of the
+// migrated schema
+func checkQueries(t *testing.T, db *sql.DB) {
+	t.Helper()
+	ctx := context.Background()
+	var campaignID, channelID int64
+	err := db.QueryRow(`
+INSERT INTO campaigns (name, start_date, budget, currency, status)
+VALUES ('spring', '2024-03-01', 500, 'EUR', 'active')
+RETURNING campaign_id`).Scan(&campaignID)
+	if err != nil {
+		t.Fatalf("insert campaign: %v", err)
+	}
+	if err := db.QueryRow("INSERT INTO channels (name) VALUES ('meta') RETURNING channel_id").Scan(&channelID); err != nil {
+		t.Fatalf("insert channel: %v", err)
+	}
+
+	t.Run("p2", func(t *testing.T) {
+		// The campaign queries of the budget service (p2.go)
+		var currency string
+		if err := db.QueryRowContext(ctx, "SELECT currency FROM campaigns WHERE campaign_id = $1", campaignID).Scan(&currency); err != nil {
+			t.Fatal(err)
+		}
+		var budget float64
+		err := db.QueryRowContext(ctx, "SELECT COALESCE(budget, 0), currency FROM campaigns WHERE campaign_id = $1", campaignID).Scan(&budget, &currency)
+		if err != nil || budget != 500 || currency != "EUR" {
+			t.Fatalf("budget %v %s (%v), want 500 EUR", budget, currency, err)
+		}
+
+		// Its spend ledger, snapshotting every other entry
+		ledger := spend.NewPostgresLedger(db, 2)
+		for i, amount := range []float64{10.5, 20, -5.25} {
+			_, dup, err := ledger.Append(ctx, spend.Entry{
+				CampaignID:     campaignID,
+				Amount:         amount,
+				Source:         "manual",
+				IdempotencyKey: fmt.Sprintf("key-%d", i),
+				Actor:          "test",
+			})
+			if err != nil || dup {
+				t.Fatalf("append %v: duplicate %v, %v", amount, dup, err)
+			}
+		}
+		// A retried entry is not appended twice
+		if _, dup, err := ledger.Append(ctx, spend.Entry{CampaignID: campaignID, Amount: 20, Source: "manual", IdempotencyKey: "key-1", Actor: "test"}); err != nil || dup {
+			t.Fatalf("retried append: duplicate %v, %v", dup, err)
+		}
+		if _, _, err := ledger.Append(ctx, spend.Entry{CampaignID: campaignID + 1000, Amount: 1, Source: "manual", IdempotencyKey: "k", Actor: "test"}); err != spend.ErrCampaignNotFound {
+			t.Fatalf("append to unknown campaign: %v, want %v", err, spend.ErrCampaignNotFound)
+		}
+		if total, err := ledger.Total(ctx, campaignID); err != nil || total != 25.25 {
+			t.Fatalf("total %v (%v), want 25.25", total, err)
+		}
+		entries, err := ledger.History(ctx, campaignID, 0, 2)
+		if err != nil || len(entries) != 2 {
+			t.Fatalf("history %v (%v), want 2 entries", entries, err)
+		}
+		if _, err := db.Exec("DELETE FROM spend_ledger WHERE campaign_id = $1", campaignID); err == nil {
+			t.Fatal("spend_ledger entries were deleted")
+		}
+	})
+
+	t.Run("events", func(t *testing.T) {
+		store := events.NewPostgresStore(db)
+		day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+		evs := []events.Event{
+			{EventID: "e1", CampaignID: campaignID, ChannelID: channelID, EventType: events.Impression, EventTimestamp: day.Unix(), UserID: "u1"},
+			{EventID: "e2", CampaignID: campaignID, ChannelID: channelID, EventType: events.Conversion, EventTimestamp: day.Add(time.Hour).Unix(), UserID: "u1", Revenue: 12.5},
+			{EventID: "e3", CampaignID: campaignID, ChannelID: channelID, EventType: events.Impression, EventTimestamp: day.Add(2 * time.Hour).Unix(), UserID: "u2"},
+			{EventID: "e4", CampaignID: campaignID, ChannelID: channelID, EventType: events.Impression, EventTimestamp: day.Add(3 * time.Hour).Unix()},
+			// Unknown audience
+			{EventID: "e5", CampaignID: campaignID, ChannelID: channelID, AudienceID: 42, EventType: events.Impression, EventTimestamp: day.Unix(), UserID: "u3"},
+		}
+		stored, err := store.Save(ctx, evs)
+		if err != nil || stored != 4 {
+			t.Fatalf("stored %d (%v), want 4", stored, err)
+		}
+		if stored, err := store.Save(ctx, evs[:1]); err != nil || stored != 0 {
+			t.Fatalf("stored %d again (%v), want 0", stored, err)
+		}
+
+		// The impression without a user is not in the campaign's funnel
+		got := collect(t, store.IterateCampaignEvents(campaignID, day, day.AddDate(0, 0, 1), 2))
+		if want := []string{"e1", "e2", "e3"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("campaign events %v, want %v", got, want)
+		}
+		// Impressions without a user are not in the reach sketches
+		if n, err := store.CountImpressions(ctx, []int64{campaignID}, 0, day, day.AddDate(0, 0, 1)); err != nil || n != 2 {
+			t.Fatalf("impressions %d (%v), want 2", n, err)
+		}
+		got = collect(t, store.IterateJourneys(day, day.AddDate(0, 0, 1), 24*time.Hour, 1))
+		if want := []string{"e1", "e2"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("journeys %v, want %v", got, want)
+		}
+
+		// Journeys of several converting users the next day, whatever the
+		// page size; pages may end within a user
+		next := day.AddDate(0, 0, 1)
+		journeys := []events.Event{
+			{EventID: "j1", CampaignID: campaignID, ChannelID: channelID, EventType: events.Click, EventTimestamp: next.Unix(), UserID: "ua"},
+			{EventID: "j2", CampaignID: campaignID, ChannelID: channelID, EventType: events.Conversion, EventTimestamp: next.Add(time.Hour).Unix(), UserID: "ua"},
+			{EventID: "j3", CampaignID: campaignID, ChannelID: channelID, EventType: events.Conversion, EventTimestamp: next.Unix(), UserID: "ub"},
+			{EventID: "j4", CampaignID: campaignID, ChannelID: channelID, EventType: events.Conversion, EventTimestamp: next.Unix(), UserID: "uc"},
+			{EventID: "j5", CampaignID: campaignID, ChannelID: channelID, EventType: events.Impression, EventTimestamp: next.Unix(), UserID: "ud"},
+			{EventID: "j6", CampaignID: campaignID, ChannelID: channelID, EventType: events.Impression, EventTimestamp: next.Unix(), UserID: "ue"},
+			{EventID: "j7", CampaignID: campaignID, ChannelID: channelID, EventType: events.Conversion, EventTimestamp: next.Add(time.Hour).Unix(), UserID: "ue"},
+			{EventID: "j8", CampaignID: campaignID, ChannelID: channelID, EventType: events.Impression, EventTimestamp: next.Add(2 * time.Hour).Unix(), UserID: "ue"},
+		}
+		if stored, err := store.Save(ctx, journeys); err != nil || stored != len(journeys) {
+			t.Fatalf("stored %d (%v), want %d", stored, err, len(journeys))
+		}
+		mem := events.NewMemoryStore()
+		mem.Add(journeys...)
+		want := collect(t, mem.IterateJourneys(next, next.AddDate(0, 0, 1), time.Hour, 0))
+		for size := 1; size <= len(journeys)+1; size++ {
+			got := collect(t, store.IterateJourneys(next, next.AddDate(0, 0, 1), time.Hour, size))
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("journeys by %d %v, want %v", size, got, want)
+			}
+		}
+	})
+
+	t.Run("campaign metrics", func(t *testing.T) {
+		_, err := db.Exec(`
+INSERT INTO campaign_metrics (campaign_id, platform, date, impressions, clicks, conversions, cost, revenue, currency)
+VALUES ('c1', 'meta', '2024-03-01', 100, 10, 1, 5, 20, 'USD'),
+       ('c1', 'google', '2024-03-02', 50, 5, 0, 3, 0, 'EUR')`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		totals, err := models.NewPostgresCampaignRepository(db).GetCampaignData(ctx, "c1", "", "2024-03-01", "2024-03-31")
+		if err != nil || len(totals) != 2 {
+			t.Fatalf("totals %+v (%v), want one per currency", totals, err)
+		}
+	})
+}
+
+// collect returns the IDs of every event of it
+func collect(t *testing.T, it events.Iterator) []string {
+	t.Helper()
+	var ids []string
+	for {
+		page, err := it.Next(context.Background())
+		if err == io.EOF {
+			return ids
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ev := range page {
+			ids = append(ids, ev.EventID)
+		}
+	}
+}
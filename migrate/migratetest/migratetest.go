@@ -0,0 +1,73 @@
+// Package migratetest provides Postgres schemas to the tests of packages
+// reading and writing the migrated tables. Tests using it are skipped unless
+// TEST_DATABASE_URL is set.
+package migratetest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"campaign-analytics/migrate"
+
+	_ "github.com/lib/pq"
+)
+
+// Schema connects to TEST_DATABASE_URL with an empty schema of its own as
+// search_path, dropped when the test ends
+func Schema(t testing.TB) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Errorf("drop schema: %v", err)
+		}
+	})
+
+	// lib/pq passes unknown settings on as run-time parameters
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		dsn = u.String()
+	} else {
+		dsn += " search_path=" + schema
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// DB is Schema migrated to the latest embedded version
+func DB(t testing.TB) *sql.DB {
+	t.Helper()
+	db := Schema(t)
+	migrations, err := migrate.Embedded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := migrate.New(db, migrations)
+	if _, err := m.Up(context.Background(), m.Latest()); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,5 @@
+DROP TABLE events;
+DROP TABLE campaign_channels;
+DROP TABLE audiences;
+DROP TABLE channels;
+DROP TABLE campaigns;
@@ -0,0 +1,42 @@
+CREATE TABLE campaigns (
+    campaign_id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    description TEXT,
+    start_date DATE NOT NULL,
+    end_date DATE,
+    budget DECIMAL(12, 2),
+    currency CHAR(3) NOT NULL DEFAULT 'USD', -- ISO 4217 code of budget and spend
+    status VARCHAR(50) CHECK (status IN ('planned', 'active', 'paused', 'completed'))
+);
+
+CREATE TABLE channels (
+    channel_id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL UNIQUE
+);
+
+CREATE TABLE audiences (
+    audience_id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    description TEXT
+);
+
+CREATE TABLE campaign_channels (
+    campaign_channel_id SERIAL PRIMARY KEY,
+    campaign_id INT REFERENCES campaigns(campaign_id),
+    channel_id INT REFERENCES channels(channel_id)
+);
+
+CREATE TABLE events (
+    event_id SERIAL PRIMARY KEY,
+    campaign_id INT REFERENCES campaigns(campaign_id),
+    channel_id INT REFERENCES channels(channel_id),
+    audience_id INT REFERENCES audiences(audience_id),
+    event_type VARCHAR(50) CHECK (event_type IN ('impression', 'click', 'conversion')),
+    event_timestamp TIMESTAMP NOT NULL,
+    user_id VARCHAR(255),
+    revenue DECIMAL(12, 2) -- conversion value, conversions only
+);
+
+-- events.Store reads a campaign's events by time and users' journeys by user
+CREATE INDEX events_campaign_timestamp ON events (campaign_id, event_timestamp);
+CREATE INDEX events_user_timestamp ON events (user_id, event_timestamp);
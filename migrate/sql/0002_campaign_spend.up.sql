@@ -0,0 +1,2 @@
+-- Spend accumulated by the budget service, in the campaign currency
+ALTER TABLE campaigns ADD COLUMN spend DECIMAL(12, 2) NOT NULL DEFAULT 0;
@@ -0,0 +1,9 @@
+CREATE TABLE processed_messages (
+    ledger       VARCHAR(100) NOT NULL,
+    message_id   VARCHAR(255) NOT NULL,
+    processed_at TIMESTAMP    NOT NULL,
+    PRIMARY KEY (ledger, message_id)
+);
+
+-- ledger.SQL.Prune deletes by age
+CREATE INDEX processed_messages_processed_at ON processed_messages (processed_at);
@@ -0,0 +1,5 @@
+-- Version tables created by backfills (campaign_rollups_<name>) are left to drop by hand
+DROP TABLE rollup_versions;
+DROP TABLE campaign_restatements;
+DROP TABLE campaign_day_totals;
+DROP TABLE campaign_rollups;
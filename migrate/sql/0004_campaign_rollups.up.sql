@@ -0,0 +1,59 @@
+CREATE TABLE campaign_rollups (
+    campaign_id  VARCHAR(255) NOT NULL,
+    platform     VARCHAR(50)  NOT NULL,
+    granularity  VARCHAR(10)  NOT NULL,
+    bucket_start TIMESTAMP    NOT NULL,
+    impressions  BIGINT NOT NULL DEFAULT 0,
+    clicks       BIGINT NOT NULL DEFAULT 0,
+    conversions  BIGINT NOT NULL DEFAULT 0,
+    cost         DOUBLE PRECISION NOT NULL DEFAULT 0,
+    revenue      DOUBLE PRECISION NOT NULL DEFAULT 0,
+    revision     BIGINT NOT NULL DEFAULT 0,
+    updated_at   TIMESTAMP NOT NULL,
+    PRIMARY KEY (campaign_id, platform, granularity, bucket_start)
+);
+
+CREATE TABLE campaign_day_totals (
+    campaign_id VARCHAR(255) NOT NULL,
+    platform    VARCHAR(50)  NOT NULL,
+    report_date DATE         NOT NULL,
+    level       VARCHAR(20)  NOT NULL,
+    impressions BIGINT NOT NULL,
+    clicks      BIGINT NOT NULL,
+    conversions BIGINT NOT NULL,
+    cost        DOUBLE PRECISION NOT NULL,
+    revenue     DOUBLE PRECISION NOT NULL,
+    fetched_at  TIMESTAMP NOT NULL,
+    PRIMARY KEY (campaign_id, platform, report_date, level)
+);
+
+CREATE TABLE campaign_restatements (
+    id                   BIGSERIAL PRIMARY KEY,
+    campaign_id          VARCHAR(255) NOT NULL,
+    platform             VARCHAR(50)  NOT NULL,
+    report_date          DATE         NOT NULL,
+    level                VARCHAR(20)  NOT NULL,
+    prev_impressions     BIGINT NOT NULL,
+    prev_clicks          BIGINT NOT NULL,
+    prev_conversions     BIGINT NOT NULL,
+    prev_cost            DOUBLE PRECISION NOT NULL,
+    prev_revenue         DOUBLE PRECISION NOT NULL,
+    impressions          BIGINT NOT NULL,
+    clicks               BIGINT NOT NULL,
+    conversions          BIGINT NOT NULL,
+    cost                 DOUBLE PRECISION NOT NULL,
+    revenue              DOUBLE PRECISION NOT NULL,
+    previous_fetched_at  TIMESTAMP NOT NULL,
+    fetched_at           TIMESTAMP NOT NULL
+);
+CREATE INDEX campaign_restatements_campaign_date ON campaign_restatements (campaign_id, report_date);
+
+CREATE TABLE rollup_versions (
+    name         VARCHAR(40) PRIMARY KEY,
+    created_at   TIMESTAMP   NOT NULL,
+    source_since TIMESTAMP,
+    source_until TIMESTAMP,
+    campaign_ids TEXT[]      NOT NULL DEFAULT '{}',
+    status       VARCHAR(20) NOT NULL,
+    promoted_at  TIMESTAMP
+);
@@ -0,0 +1 @@
+DROP TABLE reach_sketches;
@@ -0,0 +1,7 @@
+CREATE TABLE reach_sketches (
+    campaign_id INT   NOT NULL,
+    channel_id  INT   NOT NULL,
+    day         DATE  NOT NULL,
+    sketch      BYTEA NOT NULL,
+    PRIMARY KEY (campaign_id, channel_id, day)
+);
@@ -0,0 +1,13 @@
+CREATE TABLE campaign_anomalies (
+    id          VARCHAR(400) PRIMARY KEY,
+    campaign_id VARCHAR(255) NOT NULL,
+    platform    VARCHAR(50)  NOT NULL,
+    metric      VARCHAR(20)  NOT NULL,
+    hour        TIMESTAMP    NOT NULL,
+    observed    DOUBLE PRECISION NOT NULL,
+    expected    DOUBLE PRECISION NOT NULL,
+    z_score     DOUBLE PRECISION NOT NULL,
+    severity    VARCHAR(10)  NOT NULL,
+    detected_at TIMESTAMP    NOT NULL
+);
+CREATE INDEX campaign_anomalies_campaign_hour ON campaign_anomalies (campaign_id, hour);
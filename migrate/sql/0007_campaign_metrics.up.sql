@@ -0,0 +1,12 @@
+CREATE TABLE campaign_metrics (
+    campaign_id VARCHAR(255) NOT NULL,
+    platform    VARCHAR(50)  NOT NULL,
+    date        DATE         NOT NULL,
+    impressions BIGINT NOT NULL DEFAULT 0,
+    clicks      BIGINT NOT NULL DEFAULT 0,
+    conversions BIGINT NOT NULL DEFAULT 0,
+    cost        DECIMAL(12, 2) NOT NULL DEFAULT 0,
+    revenue     DECIMAL(12, 2) NOT NULL DEFAULT 0,
+    currency    CHAR(3),
+    PRIMARY KEY (campaign_id, platform, date)
+);
@@ -0,0 +1 @@
+DROP INDEX events_campaign_user;
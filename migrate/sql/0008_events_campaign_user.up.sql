@@ -0,0 +1,2 @@
+-- Keyset pages of a campaign's events, ordered by user then time (see events.Store)
+CREATE INDEX events_campaign_user ON events (campaign_id, (COALESCE(user_id, '')), event_timestamp, event_id);
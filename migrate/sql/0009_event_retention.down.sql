@@ -0,0 +1,5 @@
+DROP TABLE event_archives;
+DROP TABLE event_daily_rollups;
+DROP TABLE retention_policies;
+DROP INDEX campaigns_organization;
+ALTER TABLE campaigns DROP COLUMN organization_id;
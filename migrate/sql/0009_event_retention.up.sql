@@ -0,0 +1,35 @@
+-- Retention policies are per organization, the owner of its campaigns
+ALTER TABLE campaigns ADD COLUMN organization_id INT;
+CREATE INDEX campaigns_organization ON campaigns (organization_id);
+
+CREATE TABLE retention_policies (
+    organization_id INT       PRIMARY KEY,
+    raw_days        INT       NOT NULL CHECK (raw_days > 0),
+    archive         BOOLEAN   NOT NULL DEFAULT TRUE,
+    updated_at      TIMESTAMP NOT NULL
+);
+
+-- Daily counts of the raw events compacted by retention.Runner
+CREATE TABLE event_daily_rollups (
+    campaign_id INT         NOT NULL,
+    channel_id  INT         NOT NULL,
+    audience_id INT         NOT NULL DEFAULT 0, -- 0 when the events had none
+    day         DATE        NOT NULL,
+    event_type  VARCHAR(50) NOT NULL,
+    events      BIGINT      NOT NULL,
+    revenue     DECIMAL(14, 2) NOT NULL DEFAULT 0,
+    PRIMARY KEY (campaign_id, day, channel_id, audience_id, event_type)
+);
+
+-- Compressed files of archived raw events, one or more per organization and day
+CREATE TABLE event_archives (
+    archive_id      SERIAL       PRIMARY KEY,
+    organization_id INT          NOT NULL,
+    day             DATE         NOT NULL,
+    file_name       VARCHAR(512) NOT NULL,
+    url             TEXT         NOT NULL,
+    events          INT          NOT NULL,
+    created_at      TIMESTAMP    NOT NULL,
+    restored_at     TIMESTAMP
+);
+CREATE INDEX event_archives_organization_day ON event_archives (organization_id, day);
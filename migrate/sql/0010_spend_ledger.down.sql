@@ -0,0 +1,9 @@
+ALTER TABLE campaigns ADD COLUMN spend DECIMAL(12, 2) NOT NULL DEFAULT 0;
+UPDATE campaigns c
+SET spend = l.total
+FROM (SELECT campaign_id, SUM(amount) AS total FROM spend_ledger GROUP BY campaign_id) l
+WHERE l.campaign_id = c.campaign_id;
+
+DROP TABLE spend_snapshots;
+DROP TABLE spend_ledger;
+DROP FUNCTION spend_ledger_append_only();
@@ -0,0 +1,36 @@
+-- Spend changes of the budget service, in the campaign currency (see spend.Ledger)
+CREATE TABLE spend_ledger (
+    entry_id        BIGSERIAL      PRIMARY KEY,
+    campaign_id     INT            NOT NULL REFERENCES campaigns(campaign_id),
+    amount          DECIMAL(12, 2) NOT NULL CHECK (amount <> 0),
+    source          VARCHAR(50)    NOT NULL,
+    idempotency_key VARCHAR(255)   NOT NULL,
+    actor           VARCHAR(255)   NOT NULL,
+    created_at      TIMESTAMP      NOT NULL,
+    UNIQUE (campaign_id, idempotency_key)
+);
+CREATE INDEX spend_ledger_campaign_entry ON spend_ledger (campaign_id, entry_id);
+
+CREATE FUNCTION spend_ledger_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'spend_ledger is append-only, add a correcting entry instead';
+END
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER spend_ledger_append_only BEFORE UPDATE OR DELETE ON spend_ledger
+    FOR EACH ROW EXECUTE FUNCTION spend_ledger_append_only();
+
+-- Spend of a campaign up to and including last_entry_id
+CREATE TABLE spend_snapshots (
+    campaign_id   INT            PRIMARY KEY REFERENCES campaigns(campaign_id),
+    total         DECIMAL(14, 2) NOT NULL,
+    last_entry_id BIGINT         NOT NULL,
+    taken_at      TIMESTAMP      NOT NULL
+);
+
+-- The spend accumulated so far opens each campaign's ledger
+INSERT INTO spend_ledger (campaign_id, amount, source, idempotency_key, actor, created_at)
+SELECT campaign_id, spend, 'migration', 'opening-balance', 'migration', NOW() AT TIME ZONE 'UTC'
+FROM campaigns
+WHERE spend <> 0;
+
+ALTER TABLE campaigns DROP COLUMN spend;
@@ -0,0 +1,5 @@
+-- Fails on events with a non-numeric ID
+ALTER TABLE events ALTER COLUMN event_id TYPE INT USING event_id::INT;
+CREATE SEQUENCE events_event_id_seq OWNED BY events.event_id;
+SELECT setval('events_event_id_seq', COALESCE((SELECT MAX(event_id) FROM events), 0) + 1, false);
+ALTER TABLE events ALTER COLUMN event_id SET DEFAULT nextval('events_event_id_seq');
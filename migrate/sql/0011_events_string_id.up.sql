@@ -0,0 +1,5 @@
+-- Events keep the client event ID, or one derived from their Kafka position
+-- (see events.Consumer), so a redelivered event is stored once
+ALTER TABLE events ALTER COLUMN event_id DROP DEFAULT;
+ALTER TABLE events ALTER COLUMN event_id TYPE VARCHAR(255) USING event_id::TEXT;
+DROP SEQUENCE events_event_id_seq;
@@ -0,0 +1,2 @@
+DELETE FROM event_archives WHERE completed_at IS NULL;
+ALTER TABLE event_archives DROP COLUMN completed_at;
@@ -0,0 +1,5 @@
+-- An archive is recorded before its upload and completed in the transaction
+-- deleting its events, so that a failed run leaves a pending row pointing to
+-- the file to clean up rather than an unknown file
+ALTER TABLE event_archives ADD COLUMN completed_at TIMESTAMP;
+UPDATE event_archives SET completed_at = created_at;
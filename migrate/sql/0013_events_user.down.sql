@@ -0,0 +1,2 @@
+DROP INDEX events_conversion_user;
+DROP INDEX events_user;
@@ -0,0 +1,4 @@
+-- Keyset pages of conversion journeys, ordered by user then time (see
+-- events.Store.IterateJourneys), and the converting users they start from
+CREATE INDEX events_user ON events (user_id, event_timestamp, event_id);
+CREATE INDEX events_conversion_user ON events (user_id, event_timestamp) WHERE event_type = 'conversion';
@@ -0,0 +1 @@
+DROP TABLE anomaly_series;
@@ -0,0 +1,9 @@
+-- Baselines and open hours of anomaly.Detector, kept over restarts (see
+-- anomaly.StateStore)
+CREATE TABLE anomaly_series (
+    campaign_id VARCHAR(255) NOT NULL,
+    platform    VARCHAR(50)  NOT NULL,
+    state       JSONB        NOT NULL,
+    updated_at  TIMESTAMP    NOT NULL,
+    PRIMARY KEY (campaign_id, platform)
+);
@@ -1,6 +1,10 @@
 package models
 
-import "github.com/goravel/framework/database/db"
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
 
 type CampaignData struct {
 	Impressions int
@@ -8,34 +12,31 @@ type CampaignData struct {
 	Conversions int
 	Cost        float64
 	Revenue     float64
+	Currency    string // ISO 4217 code of Cost and Revenue
+	Reach       int    // approximate unique users, 0 when unknown
 }
 
-func GetCampaignData(campaignID, platform, startDate, endDate string) (CampaignData, error) {
-
-	db := db.New()
-	// Example query to fetch campaign data
-	//modify this query to fetch data in chunks using offset and append for single file
+// CampaignRepository reads the stored campaign metrics
+type CampaignRepository interface {
+	// GetCampaignData sums the metrics of a campaign on dates in
+	// [startDate, endDate] (YYYY-MM-DD), one total per currency. An empty
+	// platform matches every platform. No rows yield no totals.
+	GetCampaignData(ctx context.Context, campaignID, platform, startDate, endDate string) ([]CampaignData, error)
+}
 
-	query := "SELECT impressions, clicks, conversions, cost, revenue FROM campaigns WHERE id = ? AND platform = ? AND date BETWEEN ? AND ?"
-	rows, err := db.Query(query, campaignID, platform, startDate, endDate)
-	if err != nil {
-		return CampaignData{}, err
+// Add returns the sum of d and o. Metrics in different currencies cannot be
+// summed, an empty currency taking the other's.
+func (d CampaignData) Add(o CampaignData) (CampaignData, error) {
+	if d.Currency != "" && o.Currency != "" && d.Currency != o.Currency {
+		return CampaignData{}, errors.Errorf("cannot sum %s and %s metrics", d.Currency, o.Currency)
 	}
-	defer rows.Close()
-	var impressions, clicks, conversions int
-	var cost, revenue float64
-	for rows.Next() {
-		err := rows.Scan(&impressions, &clicks, &conversions, &cost, &revenue)
-		if err != nil {
-			return CampaignData{}, err
-		}
+	if d.Currency == "" {
+		d.Currency = o.Currency
 	}
-
-	return CampaignData{
-		Impressions: 1000,
-		Clicks:      100,
-		Conversions: 10,
-		Cost:        500,
-		Revenue:     1500,
-	}, nil
+	d.Impressions += o.Impressions
+	d.Clicks += o.Clicks
+	d.Conversions += o.Conversions
+	d.Cost += o.Cost
+	d.Revenue += o.Revenue
+	return d, nil
 }
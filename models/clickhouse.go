@@ -0,0 +1,140 @@
+package models
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ClickHouseConfig locates a ClickHouse server's HTTP interface
+type ClickHouseConfig struct {
+	URL      string // e.g. http://localhost:8123
+	Database string // server default when empty
+	User     string
+	Password string
+	Table    string // campaign_metrics when empty
+}
+
+// ClickHouseCampaignRepository reads campaign metrics over the ClickHouse
+// HTTP interface from a table shaped like the Postgres one:
+//
+//	CREATE TABLE campaign_metrics (
+//	    campaign_id String,
+//	    platform    LowCardinality(String),
+//	    date        Date,
+//	    impressions UInt64,
+//	    clicks      UInt64,
+//	    conversions UInt64,
+//	    cost        Float64,
+//	    revenue     Float64,
+//	    currency    LowCardinality(String)
+//	) ENGINE = SummingMergeTree
+//	ORDER BY (campaign_id, platform, date, currency);
+type ClickHouseCampaignRepository struct {
+	cfg    ClickHouseConfig
+	client *http.Client
+}
+
+// NewClickHouseCampaignRepository creates a repository querying cfg.URL
+// through client, http.DefaultClient with a timeout when nil
+func NewClickHouseCampaignRepository(cfg ClickHouseConfig, client *http.Client) *ClickHouseCampaignRepository {
+	if cfg.Table == "" {
+		cfg.Table = "campaign_metrics"
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &ClickHouseCampaignRepository{cfg: cfg, client: client}
+}
+
+// clickHouseRow is a JSONEachRow line of the campaign data query
+type clickHouseRow struct {
+	Impressions int     `json:"impressions"`
+	Clicks      int     `json:"clicks"`
+	Conversions int     `json:"conversions"`
+	Cost        float64 `json:"cost"`
+	Revenue     float64 `json:"revenue"`
+	Currency    string  `json:"currency"`
+}
+
+func (r *ClickHouseCampaignRepository) GetCampaignData(ctx context.Context, campaignID, platform, startDate, endDate string) ([]CampaignData, error) {
+	// Values are bound as query parameters, the server substitutes them typed
+	query := `
+SELECT sum(impressions) AS impressions, sum(clicks) AS clicks, sum(conversions) AS conversions,
+       sum(cost) AS cost, sum(revenue) AS revenue, currency
+FROM ` + r.cfg.Table + `
+WHERE campaign_id = {campaign_id:String}
+  AND ({platform:String} = '' OR platform = {platform:String})
+  AND date BETWEEN {start_date:Date} AND {end_date:Date}
+GROUP BY currency
+FORMAT JSONEachRow`
+	params := url.Values{
+		"param_campaign_id": {campaignID},
+		"param_platform":    {platform},
+		"param_start_date":  {startDate},
+		"param_end_date":    {endDate},
+		// UInt64 sums are quoted in JSON otherwise
+		"output_format_json_quote_64bit_integers": {"0"},
+	}
+	if r.cfg.Database != "" {
+		params.Set("database", r.cfg.Database)
+	}
+
+	body, err := r.post(ctx, params, query)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var totals []CampaignData
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var row clickHouseRow
+		if err := json.Unmarshal(line, &row); err != nil {
+			return nil, errors.Wrap(err, "decode ClickHouse row")
+		}
+		totals = append(totals, CampaignData{
+			Impressions: row.Impressions,
+			Clicks:      row.Clicks,
+			Conversions: row.Conversions,
+			Cost:        row.Cost,
+			Revenue:     row.Revenue,
+			Currency:    row.Currency,
+		})
+	}
+	return totals, errors.Wrap(scanner.Err(), "read ClickHouse response")
+}
+
+// post sends query and returns the response body, failing on a non-200 status
+// with the server's error message
+func (r *ClickHouseCampaignRepository) post(ctx context.Context, params url.Values, query string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(r.cfg.URL, "/")+"/?"+params.Encode(), strings.NewReader(query))
+	if err != nil {
+		return nil, errors.Wrap(err, "build ClickHouse request")
+	}
+	if r.cfg.User != "" {
+		req.Header.Set("X-ClickHouse-User", r.cfg.User)
+		req.Header.Set("X-ClickHouse-Key", r.cfg.Password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "query ClickHouse")
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, errors.Errorf("ClickHouse returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClickHouseGetCampaignData(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		for name, want := range map[string]string{
+			"param_campaign_id": "c1",
+			"param_platform":    "meta",
+			"param_start_date":  "2024-03-01",
+			"param_end_date":    "2024-03-31",
+			"database":          "analytics",
+			"output_format_json_quote_64bit_integers": "0",
+		} {
+			if got := q.Get(name); got != want {
+				t.Errorf("%s = %q, want %q", name, got, want)
+			}
+		}
+		if r.Method != http.MethodPost {
+			t.Errorf("method %s, want POST", r.Method)
+		}
+		if u, k := r.Header.Get("X-ClickHouse-User"), r.Header.Get("X-ClickHouse-Key"); u != "reader" || k != "secret" {
+			t.Errorf("credentials %q/%q", u, k)
+		}
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), "FROM campaign_metrics") || !strings.Contains(string(body), "FORMAT JSONEachRow") {
+			t.Errorf("unexpected query %s", body)
+		}
+		io.WriteString(w, `{"impressions":1000,"clicks":50,"conversions":5,"cost":120.5,"revenue":300,"currency":"USD"}
+{"impressions":400,"clicks":10,"conversions":1,"cost":80,"revenue":0,"currency":"EUR"}
+
+`)
+	}))
+	defer srv.Close()
+
+	repo := NewClickHouseCampaignRepository(ClickHouseConfig{
+		URL:      srv.URL + "/",
+		Database: "analytics",
+		User:     "reader",
+		Password: "secret",
+	}, srv.Client())
+	got, err := repo.GetCampaignData(context.Background(), "c1", "meta", "2024-03-01", "2024-03-31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CampaignData{
+		{Impressions: 1000, Clicks: 50, Conversions: 5, Cost: 120.5, Revenue: 300, Currency: "USD"},
+		{Impressions: 400, Clicks: 10, Conversions: 1, Cost: 80, Currency: "EUR"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestClickHouseError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Code: 60. DB::Exception: Table analytics.campaign_metrics does not exist", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	repo := NewClickHouseCampaignRepository(ClickHouseConfig{URL: srv.URL}, srv.Client())
+	_, err := repo.GetCampaignData(context.Background(), "c1", "", "2024-03-01", "2024-03-31")
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("got %v, want the server's error", err)
+	}
+}
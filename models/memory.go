@@ -0,0 +1,58 @@
+package models
+
+import (
+	"context"
+	"sync"
+)
+
+// CampaignRow is the metrics of a campaign on one platform and day
+type CampaignRow struct {
+	CampaignID string
+	Platform   string
+	Date       string // YYYY-MM-DD
+	CampaignData
+}
+
+// MemoryCampaignRepository keeps rows in memory, for tests and local development
+type MemoryCampaignRepository struct {
+	mu   sync.RWMutex
+	rows []CampaignRow
+}
+
+func NewMemoryCampaignRepository() *MemoryCampaignRepository {
+	return &MemoryCampaignRepository{}
+}
+
+// Add stores rows
+func (r *MemoryCampaignRepository) Add(rows ...CampaignRow) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rows = append(r.rows, rows...)
+}
+
+func (r *MemoryCampaignRepository) GetCampaignData(_ context.Context, campaignID, platform, startDate, endDate string) ([]CampaignData, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var totals []CampaignData
+	byCurrency := make(map[string]int) // currency => index in totals
+	for _, row := range r.rows {
+		if row.CampaignID != campaignID || (platform != "" && row.Platform != platform) {
+			continue
+		}
+		// YYYY-MM-DD sorts as a date
+		if row.Date < startDate || row.Date > endDate {
+			continue
+		}
+		i, ok := byCurrency[row.Currency]
+		if !ok {
+			i = len(totals)
+			byCurrency[row.Currency] = i
+			totals = append(totals, CampaignData{Currency: row.Currency})
+		}
+		var err error
+		if totals[i], err = totals[i].Add(row.CampaignData); err != nil {
+			return nil, err
+		}
+	}
+	return totals, nil
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// PostgresCampaignRepository reads the daily metrics each platform reported
+// for a campaign from the campaign_metrics table:
+//
+//	CREATE TABLE campaign_metrics (
+//	    campaign_id VARCHAR(255) NOT NULL,
+//	    platform    VARCHAR(50)  NOT NULL,
+//	    date        DATE         NOT NULL,
+//	    impressions BIGINT NOT NULL DEFAULT 0,
+//	    clicks      BIGINT NOT NULL DEFAULT 0,
+//	    conversions BIGINT NOT NULL DEFAULT 0,
+//	    cost        DECIMAL(12, 2) NOT NULL DEFAULT 0,
+//	    revenue     DECIMAL(12, 2) NOT NULL DEFAULT 0,
+//	    currency    CHAR(3),
+//	    PRIMARY KEY (campaign_id, platform, date)
+//	);
+type PostgresCampaignRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresCampaignRepository(db *sql.DB) *PostgresCampaignRepository {
+	return &PostgresCampaignRepository{db: db}
+}
+
+func (r *PostgresCampaignRepository) GetCampaignData(ctx context.Context, campaignID, platform, startDate, endDate string) ([]CampaignData, error) {
+	rows, err := r.db.QueryContext(ctx, `
+SELECT SUM(impressions), SUM(clicks), SUM(conversions), SUM(cost), SUM(revenue), COALESCE(currency, '')
+FROM campaign_metrics
+WHERE campaign_id = $1 AND ($2 = '' OR platform = $2) AND date BETWEEN $3 AND $4
+GROUP BY COALESCE(currency, '')`, campaignID, platform, startDate, endDate)
+	if err != nil {
+		return nil, errors.Wrap(err, "query campaign data")
+	}
+	defer rows.Close()
+
+	var totals []CampaignData
+	for rows.Next() {
+		var d CampaignData
+		if err := rows.Scan(&d.Impressions, &d.Clicks, &d.Conversions, &d.Cost, &d.Revenue, &d.Currency); err != nil {
+			return nil, errors.Wrap(err, "scan campaign data")
+		}
+		totals = append(totals, d)
+	}
+	return totals, errors.Wrap(rows.Err(), "iterate campaign data")
+}
@@ -2,12 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"net/http" //# Used proper package
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"campaign-analytics/fx"
+	"campaign-analytics/spend"
+
 	"github.com/gin-gonic/gin"
 	"golang.org/x/time/rate"
 )
@@ -19,11 +28,17 @@ const (
 	dbTimeout       = 2 * time.Second
 	rateLimitPerSec = 5
 	rateLimitBurst  = 10
+
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+
+	// legacySpendSource is the source of entries posted as {"spend": x} alone
+	legacySpendSource = "api"
+	// actorKey is the gin context key of the authenticated caller
+	actorKey = "actor"
 )
 
 var db *sql.DB
-var campaignSpends = make(map[int]float64) // Changed to int for campaign ID; create index on this column; Better Readability and handling in code
-var mu sync.Mutex
 
 type Campaign struct {
 	ID     int     `json:"id"`
@@ -35,12 +50,19 @@ type Service struct {
 	mu      sync.Mutex
 	db      *sql.DB
 	limiter *rate.Limiter
+	spend   spend.Ledger // append-only spend entries, the source of campaign spend
+
+	rates             *fx.Store // daily FX rates, nil when no rates file is configured
+	reportingCurrency string    // organization reporting currency
 }
 
-func NewService(db *sql.DB) *Service {
+func NewService(db *sql.DB, ledger spend.Ledger, rates *fx.Store, reportingCurrency string) *Service {
 	return &Service{
-		db:      db,
-		limiter: rate.NewLimiter(rate.Limit(rateLimitPerSec), rateLimitBurst),
+		db:                db,
+		spend:             ledger,
+		limiter:           rate.NewLimiter(rate.Limit(rateLimitPerSec), rateLimitBurst),
+		rates:             rates,
+		reportingCurrency: reportingCurrency,
 	}
 }
 
@@ -80,76 +102,145 @@ func initDB() (*sql.DB, error) {
 	return db, nil
 }
 
-// API to update campaign spend
+// API to append a campaign spend entry. Retries carrying the same
+// idempotency key are answered with the entry already stored. The actor is
+// the authenticated caller. Clients posting only {"spend": x} keep working:
+// their entry gets the "api" source and a key of its own, so it is never
+// deduplicated, and they are answered 200 as before the ledger.
 func (s *Service) updateSpend(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), dbTimeout)
 	defer cancel()
 
-	campaignID := c.Param("campaign_id")
+	campaignID, err := parseCampaignID(c.Param("campaign_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	var request struct {
-		Spend float64 `json:"spend"`
+		Spend          float64 `json:"spend"`
+		Source         string  `json:"source"`
+		IdempotencyKey string  `json:"idempotency_key"`
 	}
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
+	if request.IdempotencyKey == "" {
+		request.IdempotencyKey = c.GetHeader("Idempotency-Key")
+	}
+	legacy := request.IdempotencyKey == ""
+	if legacy {
+		request.IdempotencyKey, err = newIdempotencyKey()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record spend"})
+			return
+		}
+	}
+	if request.Source == "" {
+		request.Source = legacySpendSource
+	}
+	entry := spend.Entry{
+		CampaignID:     campaignID,
+		Amount:         request.Spend,
+		Source:         request.Source,
+		IdempotencyKey: request.IdempotencyKey,
+		Actor:          c.GetString(actorKey),
+	}
+	if err := entry.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	campaignSpends[campaignID] += request.Spend
-	// Inefficient: No transactions, no concurrency safety
-	tx, err := s.db.BeginTx(ctx, nil)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to begin transaction"})
+	entry, created, err := s.spend.Append(ctx, entry)
+	switch {
+	case err == spend.ErrCampaignNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+		return
+	case err == spend.ErrIdempotencyConflict:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "entry": entry})
 		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record spend"})
+		return
+	}
+	status := http.StatusCreated
+	if !created || legacy {
+		status = http.StatusOK
 	}
-	defer tx.Rollback()
+	c.JSON(status, gin.H{"message": "Spend updated", "entry": entry})
+}
+
+// API to list the spend entries of a campaign, oldest first. Pages follow
+// each other through next_after_id.
+func (s *Service) getSpendHistory(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), dbTimeout)
+	defer cancel()
 
-	result, err := db.Exec("UPDATE campaigns SET spend = spend + $1 WHERE id = $2",
-		request.Spend, campaignID)
+	campaignID, err := parseCampaignID(c.Param("campaign_id"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database update failed"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	afterID, err := strconv.ParseInt(c.DefaultQuery("after_id", "0"), 10, 64)
+	if err != nil || afterID < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "after_id must be a non-negative integer"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultHistoryLimit)))
+	if err != nil || limit <= 0 || limit > maxHistoryLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit)})
+		return
+	}
 
+	var currency string
+	err = s.db.QueryRowContext(ctx, "SELECT currency FROM campaigns WHERE campaign_id = $1", campaignID).Scan(&currency)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
 		return
 	}
-	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get rows affected"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch campaign data"})
 		return
 	}
-	if rowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
+	entries, err := s.spend.History(ctx, campaignID, afterID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch spend history"})
 		return
 	}
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to commit transaction"})
+	total, err := s.spend.Total(ctx, campaignID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch spend"})
 		return
 	}
-
-	// Race condition here due to concurrent map writes
-	var mu sync.Mutex
-	mu.Lock()
-	// Update the in-memory map
-	campaignSpends[campaignID] += request.Spend
-
-	mu.Unlock()
-	c.JSON(http.StatusOK, gin.H{"message": "Spend updated"})
+	if entries == nil {
+		entries = []spend.Entry{}
+	}
+	resp := gin.H{
+		"campaign_id": campaignID,
+		"spend":       total,
+		"currency":    currency,
+		"entries":     entries,
+	}
+	if len(entries) == limit {
+		resp["next_after_id"] = entries[len(entries)-1].ID
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
 // API to get campaign budget status
 func (s *Service) getBudgetStatus(c *gin.Context) {
-
-	_, cancel := context.WithTimeout(c.Request.Context(), dbTimeout)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), dbTimeout)
 	defer cancel()
 
-	campaignID := c.Param("campaign_id")
-	// Validate campaignId
-	if err := validateCampaignID(campaignID); err != nil {
+	campaignID, err := parseCampaignID(c.Param("campaign_id"))
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Inefficient Query: Should only fetch required fields
-	var budget, spend float64
-	err := db.QueryRow("SELECT budget, spend FROM campaigns WHERE id = $1", campaignID).Scan(&budget, &spend)
+	var budget float64
+	var currency string
+	err = s.db.QueryRowContext(ctx, "SELECT COALESCE(budget, 0), currency FROM campaigns WHERE campaign_id = $1", campaignID).Scan(&budget, &currency)
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Campaign not found"})
 		return
@@ -158,30 +249,74 @@ func (s *Service) getBudgetStatus(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch campaign data"})
 		return
 	}
-	remaining := budget - spend
+	spent, err := s.spend.Total(ctx, campaignID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch spend"})
+		return
+	}
+	// Report in the requested currency, else in the organization's when rates
+	// are configured, else in the campaign's own
+	target := strings.ToUpper(c.Query("currency"))
+	if target == "" && s.rates != nil {
+		target = s.reportingCurrency
+	}
+	var rateDate string
+	if target != "" && target != currency {
+		if s.rates == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Currency conversion is not configured"})
+			return
+		}
+		// Budget and spend are running totals, converted at the latest rate
+		// the rates file has rather than today's, which it may not have yet
+		fxRate, day, err := s.rates.Latest(currency, target)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		budget, spent, currency = budget*fxRate, spent*fxRate, target
+		rateDate = day.Format("2006-01-02")
+	}
+	remaining := budget - spent
 	status := "Active"
 	if remaining <= 0 {
 		status = "Overspent"
 	}
-	c.JSON(http.StatusOK, gin.H{
+	resp := gin.H{
 		"campaign_id": campaignID,
 		"budget":      budget,
-		"spend":       spend,
+		"spend":       spent,
 		"remaining":   remaining,
+		"currency":    currency,
 		"status":      status,
-	})
+	}
+	if rateDate != "" {
+		resp["rate_date"] = rateDate
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
-func validateCampaignID(campaignID int) error {
-	if campaignID <= 0 {
-		return fmt.Errorf("Invalid campaign ID")
+func parseCampaignID(param string) (int64, error) {
+	campaignID, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || campaignID <= 0 {
+		return 0, fmt.Errorf("Invalid campaign ID")
 	}
-	mu.Lock()
-	defer mu.Unlock()
-	if _, exists := campaignSpends[campaignID]; !exists {
-		return fmt.Errorf("Campaign not found")
+	return campaignID, nil
+}
+
+// newIdempotencyKey returns a random key for entries posted without one
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	return nil
+	return "generated:" + hex.EncodeToString(b), nil
+}
+
+// callerOf identifies the caller of a token. Tokens are opaque here, so the
+// caller is a fingerprint of the token that does not reveal it.
+func callerOf(token string) string {
+	sum := sha256.Sum256([]byte(strings.TrimPrefix(token, "Bearer ")))
+	return "token:" + hex.EncodeToString(sum[:8])
 }
 
 func main() {
@@ -192,13 +327,26 @@ func main() {
 	}
 	defer db.Close()
 
+	var rates *fx.Store
+	if path := os.Getenv("FX_RATES_FILE"); path != "" {
+		rates, err = fx.LoadFile(path)
+		if err != nil {
+			panic(fmt.Errorf("Loading FX rates failed %v : ", err))
+		}
+	}
+	reportingCurrency := os.Getenv("REPORTING_CURRENCY")
+	if reportingCurrency == "" {
+		reportingCurrency = "USD"
+	}
+	s = NewService(db, spend.NewPostgresLedger(db, spend.DefaultSnapshotEvery), rates, reportingCurrency)
+
 	r := gin.Default()
 
 	// Middleware to handle CORS
 	r.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key")
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusNoContent)
 			return
@@ -221,11 +369,13 @@ func main() {
 			c.Abort()
 			return
 		}
+		c.Set(actorKey, callerOf(token))
 	})
 
 	campaigns := r.Group("/campaigns")
 	{
 		campaigns.POST("/:campaign_id/spend", s.updateSpend)
+		campaigns.GET("/:campaign_id/spend/history", s.getSpendHistory)
 		campaigns.GET("/:campaign_id/budget-status", s.getBudgetStatus)
 	}
 
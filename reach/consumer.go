@@ -0,0 +1,83 @@
+package reach
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"campaign-analytics/events"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// MessageReader is the part of *kafka.Reader the consumer needs
+type MessageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Consumer folds the users of impression events into daily sketches, merging
+// them into Store every FlushSize events or FlushInterval. Adding a user twice
+// leaves a sketch unchanged, so redelivered events need no ledger.
+type Consumer struct {
+	Reader        MessageReader
+	Store         Store
+	Precision     uint8
+	FlushSize     int
+	FlushInterval time.Duration
+}
+
+// Run consumes until ctx is done or a flush fails
+func (c *Consumer) Run(ctx context.Context) error {
+	pending := make(map[Key]*Sketch)
+	var uncommitted []kafka.Message
+	deadline := time.Now().Add(c.FlushInterval)
+	for {
+		fctx, cancel := context.WithDeadline(ctx, deadline)
+		msg, err := c.Reader.FetchMessage(fctx)
+		cancel()
+		switch {
+		case err == nil:
+			uncommitted = append(uncommitted, msg)
+			var ev events.Event
+			if err := json.Unmarshal(msg.Value, &ev); err != nil {
+				log.Printf("reach: skipping invalid message at %s/%d/%d: %v", msg.Topic, msg.Partition, msg.Offset, err)
+				break
+			}
+			if ev.EventType != events.Impression || ev.UserID == "" {
+				break
+			}
+			k := Key{CampaignID: ev.CampaignID, ChannelID: ev.ChannelID, Day: Day(ev.Time())}
+			sk := pending[k]
+			if sk == nil {
+				sk = NewSketch(c.Precision)
+				pending[k] = sk
+			}
+			sk.Add(ev.UserID)
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, context.DeadlineExceeded):
+		default:
+			return errors.Wrap(err, "fetch message")
+		}
+
+		if len(uncommitted) < c.FlushSize && time.Now().Before(deadline) {
+			continue
+		}
+		if len(pending) > 0 {
+			if err := c.Store.Merge(ctx, pending); err != nil {
+				return errors.Wrap(err, "merge sketches")
+			}
+			pending = make(map[Key]*Sketch)
+		}
+		if len(uncommitted) > 0 {
+			if err := c.Reader.CommitMessages(ctx, uncommitted...); err != nil {
+				return errors.Wrap(err, "commit offsets")
+			}
+			uncommitted = uncommitted[:0]
+		}
+		deadline = time.Now().Add(c.FlushInterval)
+	}
+}
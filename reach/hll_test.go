@@ -0,0 +1,134 @@
+package reach
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func sketchOf(precision uint8, from, to int) *Sketch {
+	s := NewSketch(precision)
+	for i := from; i < to; i++ {
+		s.Add(fmt.Sprint("user-", i))
+	}
+	return s
+}
+
+// withinError checks an estimate of n is within 3 standard errors of the
+// sketch's precision
+func withinError(t *testing.T, s *Sketch, n int) {
+	t.Helper()
+	bound := 3 * 1.04 / math.Sqrt(float64(len(s.registers)))
+	got := s.Estimate()
+	if n == 0 {
+		if got != 0 {
+			t.Fatalf("estimate %d of an empty sketch", got)
+		}
+		return
+	}
+	if rel := math.Abs(float64(got)/float64(n) - 1); rel > bound {
+		t.Fatalf("estimate %d of %d users, error %.2f%% over %.2f%%", got, n, 100*rel, 100*bound)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	for _, precision := range []uint8{10, DefaultPrecision} {
+		for _, n := range []int{0, 1, 10, 100, 1000, 10000, 100000, 500000} {
+			t.Run(fmt.Sprintf("p%d/%d", precision, n), func(t *testing.T) {
+				s := sketchOf(precision, 0, n)
+				withinError(t, s, n)
+				// Users added again are not counted again
+				before := s.Estimate()
+				for i := 0; i < n; i++ {
+					s.Add(fmt.Sprint("user-", i))
+				}
+				if s.Estimate() != before {
+					t.Fatalf("estimate %d after adding the users again, was %d", s.Estimate(), before)
+				}
+			})
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	// Overlapping days merge into their union
+	a, b := sketchOf(DefaultPrecision, 0, 60000), sketchOf(DefaultPrecision, 40000, 100000)
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	withinError(t, a, 100000)
+	if err := a.Merge(sketchOf(DefaultPrecision, 0, 100000)); err != nil {
+		t.Fatal(err)
+	}
+	withinError(t, a, 100000)
+
+	if err := a.Merge(NewSketch(10)); err == nil {
+		t.Fatal("merged sketches of different precisions")
+	}
+}
+
+// Stored sketches depend on hash64 and the encoding staying the same
+func TestHash64Stable(t *testing.T) {
+	for id, want := range map[string]uint64{
+		"":                                     0x045b5b928698bf92,
+		"u1":                                   0x3c1ce33a6e171238,
+		"user-42":                              0xf66f101875fe171a,
+		"0f8fad5b-d9cb-469f-a165-70867728950e": 0x255f3df097cfd11c,
+	} {
+		if got := hash64(id); got != want {
+			t.Errorf("hash64(%q) = %#016x, want %#016x", id, got, want)
+		}
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	s := NewSketch(4)
+	s.Add("u1")
+	s.Add("u2")
+	b, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{sketchVersion, 4, 0, 0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("encoded %v, want %v", b, want)
+	}
+
+	for _, precision := range []uint8{4, DefaultPrecision, 18} {
+		s := sketchOf(precision, 0, 5000)
+		b, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Sketch
+		if err := got.UnmarshalBinary(b); err != nil {
+			t.Fatal(err)
+		}
+		if got.p != s.p || !bytes.Equal(got.registers, s.registers) || got.Estimate() != s.Estimate() {
+			t.Fatalf("precision %d: round trip changed the sketch", precision)
+		}
+		// The decoded sketch does not share the encoded bytes
+		b[2]++
+		if got.registers[0] != s.registers[0] {
+			t.Fatal("decoded sketch aliases its encoding")
+		}
+	}
+}
+
+func TestUnmarshalBinaryCorrupt(t *testing.T) {
+	valid, _ := NewSketch(4).MarshalBinary()
+	for name, b := range map[string][]byte{
+		"empty":           nil,
+		"other version":   append([]byte{sketchVersion + 1}, valid[1:]...),
+		"precision low":   append([]byte{sketchVersion, 3}, valid[2:10]...),
+		"precision high":  {sketchVersion, 19},
+		"short registers": valid[:len(valid)-1],
+		"long registers":  append(append([]byte(nil), valid...), 0),
+	} {
+		var s Sketch
+		if err := s.UnmarshalBinary(b); err == nil {
+			t.Errorf("%s: decoded", name)
+		}
+	}
+}
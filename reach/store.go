@@ -0,0 +1,177 @@
+package reach
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Key identifies a daily sketch
+type Key struct {
+	CampaignID int64
+	ChannelID  int64
+	Day        time.Time // UTC midnight
+}
+
+// Day truncates t to its UTC day
+func Day(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// Query selects the daily sketches to merge. Zero ChannelID matches every channel.
+type Query struct {
+	CampaignIDs []int64
+	ChannelID   int64
+	From, To    time.Time // days in [From, To)
+}
+
+// Store keeps daily sketches
+type Store interface {
+	// Merge folds each sketch into the stored one for its key
+	Merge(ctx context.Context, sketches map[Key]*Sketch) error
+	// Reach returns the merge of the sketches matching q, empty when none match
+	Reach(ctx context.Context, q Query) (*Sketch, error)
+}
+
+// PostgresStore keeps sketches in the reach_sketches table:
+//
+//	CREATE TABLE reach_sketches (
+//	    campaign_id INT   NOT NULL,
+//	    channel_id  INT   NOT NULL,
+//	    day         DATE  NOT NULL,
+//	    sketch      BYTEA NOT NULL,
+//	    PRIMARY KEY (campaign_id, channel_id, day)
+//	);
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Merge(ctx context.Context, sketches map[Key]*Sketch) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+
+	for k, sk := range sketches {
+		var stored []byte
+		err := tx.QueryRowContext(ctx,
+			"SELECT sketch FROM reach_sketches WHERE campaign_id = $1 AND channel_id = $2 AND day = $3 FOR UPDATE",
+			k.CampaignID, k.ChannelID, k.Day).Scan(&stored)
+		merged := sk
+		switch {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return errors.Wrap(err, "select sketch")
+		default:
+			merged = &Sketch{}
+			if err := merged.UnmarshalBinary(stored); err != nil {
+				return errors.Wrapf(err, "decode sketch %d/%d/%s", k.CampaignID, k.ChannelID, k.Day.Format("2006-01-02"))
+			}
+			if err := merged.Merge(sk); err != nil {
+				return err
+			}
+		}
+		b, _ := merged.MarshalBinary()
+		_, err = tx.ExecContext(ctx, `
+INSERT INTO reach_sketches (campaign_id, channel_id, day, sketch) VALUES ($1, $2, $3, $4)
+ON CONFLICT (campaign_id, channel_id, day) DO UPDATE SET sketch = EXCLUDED.sketch`,
+			k.CampaignID, k.ChannelID, k.Day, b)
+		if err != nil {
+			return errors.Wrap(err, "upsert sketch")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "commit transaction")
+}
+
+func (s *PostgresStore) Reach(ctx context.Context, q Query) (*Sketch, error) {
+	rows, err := s.db.QueryContext(ctx, `
+SELECT sketch FROM reach_sketches
+WHERE campaign_id = ANY($1) AND ($2 = 0 OR channel_id = $2) AND day >= $3 AND day < $4`,
+		pq.Array(q.CampaignIDs), q.ChannelID, q.From, q.To)
+	if err != nil {
+		return nil, errors.Wrap(err, "query sketches")
+	}
+	defer rows.Close()
+
+	var out *Sketch
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, errors.Wrap(err, "scan sketch")
+		}
+		sk := &Sketch{}
+		if err := sk.UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+		if out == nil {
+			out = sk
+		} else if err := out.Merge(sk); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterate sketches")
+	}
+	if out == nil {
+		out = NewSketch(DefaultPrecision)
+	}
+	return out, nil
+}
+
+// MemoryStore keeps sketches in memory, for tests and local development
+type MemoryStore struct {
+	mu       sync.RWMutex
+	sketches map[Key]*Sketch
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sketches: make(map[Key]*Sketch)}
+}
+
+func (s *MemoryStore) Merge(_ context.Context, sketches map[Key]*Sketch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, sk := range sketches {
+		stored, ok := s.sketches[k]
+		if !ok {
+			stored = NewSketch(sk.p)
+			s.sketches[k] = stored
+		}
+		if err := stored.Merge(sk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Reach(_ context.Context, q Query) (*Sketch, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	campaigns := make(map[int64]bool, len(q.CampaignIDs))
+	for _, id := range q.CampaignIDs {
+		campaigns[id] = true
+	}
+	out := NewSketch(DefaultPrecision)
+	for k, sk := range s.sketches {
+		if !campaigns[k.CampaignID] || (q.ChannelID != 0 && k.ChannelID != q.ChannelID) {
+			continue
+		}
+		if k.Day.Before(q.From) || !k.Day.Before(q.To) {
+			continue
+		}
+		if err := out.Merge(sk); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,156 @@
+// Package retention bounds the raw events table. Once past its organization's
+// policy, a day of raw events is compacted into event_daily_rollups, archived
+// as a compressed file and deleted; Restore brings archived days back.
+package retention
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const dateLayout = "2006-01-02"
+
+// Policy is the retention of an organization's raw events
+type Policy struct {
+	OrganizationID int64     `json:"organization_id"`
+	RawDays        int       `json:"raw_days"` // days of raw events kept, today included
+	Archive        bool      `json:"archive"`  // archive raw events before deleting them
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+func (p Policy) Validate() error {
+	if p.OrganizationID <= 0 {
+		return errors.New("organization_id must be positive")
+	}
+	if p.RawDays <= 0 {
+		return errors.New("raw_days must be positive")
+	}
+	return nil
+}
+
+// Cutoff returns the start of the oldest day whose raw events are kept at now
+func (p Policy) Cutoff(now time.Time) time.Time {
+	return truncateDay(now).AddDate(0, 0, 1-p.RawDays)
+}
+
+func truncateDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// PolicyStore keeps retention policies. Organizations without one keep their
+// raw events forever.
+type PolicyStore interface {
+	// Get returns the policy of an organization, false when it has none
+	Get(ctx context.Context, organizationID int64) (Policy, bool, error)
+	// Put creates or replaces the policy of p.OrganizationID
+	Put(ctx context.Context, p Policy) error
+	// List returns every policy ordered by organization
+	List(ctx context.Context) ([]Policy, error)
+}
+
+// PostgresPolicyStore keeps policies in the retention_policies table:
+//
+//	CREATE TABLE retention_policies (
+//	    organization_id INT       PRIMARY KEY,
+//	    raw_days        INT       NOT NULL CHECK (raw_days > 0),
+//	    archive         BOOLEAN   NOT NULL DEFAULT TRUE,
+//	    updated_at      TIMESTAMP NOT NULL
+//	);
+type PostgresPolicyStore struct {
+	db *sql.DB
+}
+
+func NewPostgresPolicyStore(db *sql.DB) *PostgresPolicyStore {
+	return &PostgresPolicyStore{db: db}
+}
+
+func (s *PostgresPolicyStore) Get(ctx context.Context, organizationID int64) (Policy, bool, error) {
+	p := Policy{OrganizationID: organizationID}
+	err := s.db.QueryRowContext(ctx,
+		"SELECT raw_days, archive, updated_at FROM retention_policies WHERE organization_id = $1",
+		organizationID).Scan(&p.RawDays, &p.Archive, &p.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return Policy{}, false, nil
+	}
+	if err != nil {
+		return Policy{}, false, errors.Wrap(err, "query retention policy")
+	}
+	p.UpdatedAt = p.UpdatedAt.UTC()
+	return p, true, nil
+}
+
+func (s *PostgresPolicyStore) Put(ctx context.Context, p Policy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO retention_policies (organization_id, raw_days, archive, updated_at)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (organization_id) DO UPDATE
+SET raw_days = EXCLUDED.raw_days, archive = EXCLUDED.archive, updated_at = EXCLUDED.updated_at`,
+		p.OrganizationID, p.RawDays, p.Archive, p.UpdatedAt)
+	return errors.Wrap(err, "upsert retention policy")
+}
+
+func (s *PostgresPolicyStore) List(ctx context.Context) ([]Policy, error) {
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT organization_id, raw_days, archive, updated_at FROM retention_policies ORDER BY organization_id")
+	if err != nil {
+		return nil, errors.Wrap(err, "query retention policies")
+	}
+	defer rows.Close()
+	var out []Policy
+	for rows.Next() {
+		var p Policy
+		if err := rows.Scan(&p.OrganizationID, &p.RawDays, &p.Archive, &p.UpdatedAt); err != nil {
+			return nil, errors.Wrap(err, "scan retention policy")
+		}
+		p.UpdatedAt = p.UpdatedAt.UTC()
+		out = append(out, p)
+	}
+	return out, errors.Wrap(rows.Err(), "iterate retention policies")
+}
+
+// MemoryPolicyStore keeps policies in memory, for tests and local development
+type MemoryPolicyStore struct {
+	mu       sync.RWMutex
+	policies map[int64]Policy
+}
+
+func NewMemoryPolicyStore() *MemoryPolicyStore {
+	return &MemoryPolicyStore{policies: make(map[int64]Policy)}
+}
+
+func (s *MemoryPolicyStore) Get(_ context.Context, organizationID int64) (Policy, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.policies[organizationID]
+	return p, ok, nil
+}
+
+func (s *MemoryPolicyStore) Put(_ context.Context, p Policy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies[p.OrganizationID] = p
+	return nil
+}
+
+func (s *MemoryPolicyStore) List(_ context.Context) ([]Policy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]Policy, 0, len(s.policies))
+	for _, p := range s.policies {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].OrganizationID < out[j].OrganizationID })
+	return out, nil
+}
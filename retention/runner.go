@@ -0,0 +1,482 @@
+package retention
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"campaign-analytics/events"
+
+	"github.com/pkg/errors"
+)
+
+// Result describes a compacted or restored day of an organization
+type Result struct {
+	OrganizationID int64     `json:"organization_id"`
+	Day            time.Time `json:"day"`
+	Events         int       `json:"events"`
+	FileName       string    `json:"file_name,omitempty"` // empty when not archived
+	URL            string    `json:"url,omitempty"`
+}
+
+// Runner applies retention policies to the events table. Compacted counts go
+// to event_daily_rollups and archives are recorded in event_archives:
+//
+//	CREATE TABLE event_daily_rollups (
+//	    campaign_id INT         NOT NULL,
+//	    channel_id  INT         NOT NULL, -- 0 when the events had none
+//	    audience_id INT         NOT NULL DEFAULT 0,
+//	    day         DATE        NOT NULL,
+//	    event_type  VARCHAR(50) NOT NULL,
+//	    events      BIGINT      NOT NULL,
+//	    revenue     DECIMAL(14, 2) NOT NULL DEFAULT 0,
+//	    PRIMARY KEY (campaign_id, day, channel_id, audience_id, event_type)
+//	);
+//	CREATE TABLE event_archives (
+//	    archive_id      SERIAL       PRIMARY KEY,
+//	    organization_id INT          NOT NULL,
+//	    day             DATE         NOT NULL,
+//	    file_name       VARCHAR(512) NOT NULL,
+//	    url             TEXT         NOT NULL,
+//	    events          INT          NOT NULL,
+//	    created_at      TIMESTAMP    NOT NULL,
+//	    completed_at    TIMESTAMP,   -- NULL while pending
+//	    restored_at     TIMESTAMP
+//	);
+//
+// Organizations own campaigns through campaigns.organization_id.
+type Runner struct {
+	db       *sql.DB
+	policies PolicyStore
+	uploader Uploader
+}
+
+func NewRunner(db *sql.DB, policies PolicyStore, uploader Uploader) *Runner {
+	return &Runner{db: db, policies: policies, uploader: uploader}
+}
+
+// pendingArchiveTTL is how old a pending archive must be for Apply to clean it
+// up, so that a run still uploading it is left alone
+const pendingArchiveTTL = 24 * time.Hour
+
+// Run applies every policy at now. An organization failing does not stop the
+// others; the error then lists every failed organization.
+func (r *Runner) Run(ctx context.Context, now time.Time) ([]Result, error) {
+	policies, err := r.policies.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		out    []Result
+		failed []string
+	)
+	for _, p := range policies {
+		res, err := r.Apply(ctx, p, now)
+		out = append(out, res...)
+		if err != nil {
+			if ctx.Err() != nil {
+				return out, errors.Wrapf(err, "organization %d", p.OrganizationID)
+			}
+			failed = append(failed, fmt.Sprintf("organization %d: %v", p.OrganizationID, err))
+		}
+	}
+	if len(failed) > 0 {
+		return out, errors.Errorf("%d of %d organizations failed: %s", len(failed), len(policies), strings.Join(failed, "; "))
+	}
+	return out, nil
+}
+
+// Apply compacts, archives when the policy asks to, and deletes the raw events
+// of p's organization older than p.Cutoff(now), one day at a time
+func (r *Runner) Apply(ctx context.Context, p Policy, now time.Time) ([]Result, error) {
+	if err := r.cleanPending(ctx, p.OrganizationID, now.Add(-pendingArchiveTTL)); err != nil {
+		return nil, err
+	}
+	days, err := r.expiredDays(ctx, p.OrganizationID, p.Cutoff(now))
+	if err != nil {
+		return nil, err
+	}
+	var out []Result
+	for _, day := range days {
+		res, err := r.compactDay(ctx, p, day)
+		if err != nil {
+			return out, errors.Wrapf(err, "compact %s", day.Format(dateLayout))
+		}
+		if res.Events > 0 {
+			out = append(out, res)
+		}
+	}
+	return out, nil
+}
+
+func (r *Runner) expiredDays(ctx context.Context, organizationID int64, cutoff time.Time) ([]time.Time, error) {
+	rows, err := r.db.QueryContext(ctx, `
+SELECT DISTINCT date_trunc('day', e.event_timestamp)
+FROM events e
+JOIN campaigns c ON c.campaign_id = e.campaign_id
+WHERE c.organization_id = $1 AND e.event_timestamp < $2
+ORDER BY 1`, organizationID, cutoff)
+	if err != nil {
+		return nil, errors.Wrap(err, "query expired days")
+	}
+	defer rows.Close()
+	var out []time.Time
+	for rows.Next() {
+		var day time.Time
+		if err := rows.Scan(&day); err != nil {
+			return nil, errors.Wrap(err, "scan expired day")
+		}
+		out = append(out, day.UTC())
+	}
+	return out, errors.Wrap(rows.Err(), "iterate expired days")
+}
+
+// dayCount is a row of event_daily_rollups
+type dayCount struct {
+	campaignID, channelID, audienceID int64
+	eventType                         string
+}
+
+type dayTotal struct {
+	events  int64
+	revenue float64
+}
+
+// compactDay deletes a day of raw events and, in the same transaction, adds
+// their counts to the rollups and completes their archive. The events deleted
+// are exactly the ones counted and archived; a failed upload keeps them all.
+// The archive is recorded as pending before its upload, and its file deleted
+// when the transaction fails, so no file is left unaccounted for.
+func (r *Runner) compactDay(ctx context.Context, p Policy, day time.Time) (res Result, err error) {
+	res = Result{OrganizationID: p.OrganizationID, Day: day}
+	now := time.Now().UTC()
+	var archiveID int64
+	if p.Archive {
+		res.FileName = fmt.Sprintf("archive/org_%d/events_%s_%d.jsonl.gz", p.OrganizationID, day.Format(dateLayout), now.Unix())
+		err = r.db.QueryRowContext(ctx, `
+INSERT INTO event_archives (organization_id, day, file_name, url, events, created_at)
+VALUES ($1, $2, $3, $4, 0, $5)
+RETURNING archive_id`, p.OrganizationID, day, res.FileName, r.uploader.URL(res.FileName), now).Scan(&archiveID)
+		if err != nil {
+			return res, errors.Wrap(err, "record pending archive")
+		}
+		defer func() {
+			if err != nil || res.Events == 0 {
+				if derr := r.discardArchive(context.WithoutCancel(ctx), archiveID, res.FileName); derr != nil && err == nil {
+					err = derr
+				}
+			}
+		}()
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return res, errors.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+
+	totals := make(map[dayCount]*dayTotal)
+	deleteDay := func(emit func(ev events.Event) error) error {
+		rows, err := tx.QueryContext(ctx, `
+DELETE FROM events e
+USING campaigns c
+WHERE c.campaign_id = e.campaign_id AND c.organization_id = $1
+  AND e.event_timestamp >= $2 AND e.event_timestamp < $3
+RETURNING e.event_id, e.campaign_id, e.channel_id, e.audience_id, e.event_type, e.event_timestamp, e.user_id, e.revenue`,
+			p.OrganizationID, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			return errors.Wrap(err, "delete raw events")
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				ev       events.Event
+				channel  sql.NullInt64
+				audience sql.NullInt64
+				userID   sql.NullString
+				revenue  sql.NullFloat64
+				ts       time.Time
+			)
+			err := rows.Scan(&ev.EventID, &ev.CampaignID, &channel, &audience, &ev.EventType, &ts, &userID, &revenue)
+			if err != nil {
+				return errors.Wrap(err, "scan raw event")
+			}
+			ev.ChannelID = channel.Int64
+			ev.AudienceID = audience.Int64
+			ev.UserID = userID.String
+			ev.Revenue = revenue.Float64
+			ev.EventTimestamp = ts.Unix()
+
+			k := dayCount{ev.CampaignID, ev.ChannelID, ev.AudienceID, ev.EventType}
+			t := totals[k]
+			if t == nil {
+				t = &dayTotal{}
+				totals[k] = t
+			}
+			t.events++
+			t.revenue += ev.Revenue
+			res.Events++
+			if err := emit(ev); err != nil {
+				return err
+			}
+		}
+		return errors.Wrap(rows.Err(), "iterate raw events")
+	}
+
+	if p.Archive {
+		res.URL, err = r.uploader.StreamFile(ctx, res.FileName, func(w io.Writer) error {
+			aw := newArchiveWriter(w)
+			if err := deleteDay(aw.Write); err != nil {
+				return err
+			}
+			return aw.Close()
+		})
+	} else {
+		err = deleteDay(func(events.Event) error { return nil })
+	}
+	if err != nil {
+		return res, err
+	}
+	if res.Events == 0 {
+		return res, nil
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `
+INSERT INTO event_daily_rollups AS r (campaign_id, channel_id, audience_id, day, event_type, events, revenue)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (campaign_id, day, channel_id, audience_id, event_type) DO UPDATE
+SET events = r.events + EXCLUDED.events, revenue = r.revenue + EXCLUDED.revenue`)
+	if err != nil {
+		return res, errors.Wrap(err, "prepare rollup upsert")
+	}
+	defer stmt.Close()
+	for k, t := range totals {
+		_, err = stmt.ExecContext(ctx, k.campaignID, k.channelID, k.audienceID, day, k.eventType, t.events, t.revenue)
+		if err != nil {
+			return res, errors.Wrap(err, "upsert daily rollup")
+		}
+	}
+	if p.Archive {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE event_archives SET url = $1, events = $2, completed_at = $3 WHERE archive_id = $4",
+			res.URL, res.Events, time.Now().UTC(), archiveID)
+		if err != nil {
+			return res, errors.Wrap(err, "complete archive")
+		}
+	}
+	err = errors.Wrap(tx.Commit(), "commit transaction")
+	return res, err
+}
+
+// discardArchive deletes the file and row of an archive still pending. An
+// archive found completed, by a commit reported as failed, is kept.
+func (r *Runner) discardArchive(ctx context.Context, archiveID int64, fileName string) error {
+	var completed sql.NullTime
+	err := r.db.QueryRowContext(ctx, "SELECT completed_at FROM event_archives WHERE archive_id = $1", archiveID).Scan(&completed)
+	if err == sql.ErrNoRows || completed.Valid {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "query pending archive")
+	}
+	// The file goes first: a failure leaves the row to retry the cleanup with
+	if err := r.uploader.DeleteFile(ctx, fileName); err != nil {
+		return errors.Wrapf(err, "delete %s", fileName)
+	}
+	_, err = r.db.ExecContext(ctx, "DELETE FROM event_archives WHERE archive_id = $1 AND completed_at IS NULL", archiveID)
+	return errors.Wrap(err, "delete pending archive")
+}
+
+// cleanPending discards the archives of an organization left pending before
+// `before` by runs that could not clean up after themselves. Archives stored
+// by another uploader are left to the runners using it.
+func (r *Runner) cleanPending(ctx context.Context, organizationID int64, before time.Time) error {
+	rows, err := r.db.QueryContext(ctx, `
+SELECT archive_id, file_name, url
+FROM event_archives
+WHERE organization_id = $1 AND completed_at IS NULL AND created_at < $2`, organizationID, before)
+	if err != nil {
+		return errors.Wrap(err, "query pending archives")
+	}
+	var pending []archiveRow
+	for rows.Next() {
+		var a archiveRow
+		if err := rows.Scan(&a.id, &a.fileName, &a.url); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "scan pending archive")
+		}
+		if r.owns(a) {
+			pending = append(pending, a)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "iterate pending archives")
+	}
+	for _, a := range pending {
+		if err := r.discardArchive(ctx, a.id, a.fileName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore rehydrates the archived raw events of an organization's days in
+// [from, to], for reprocessing. Their counts leave the rollups, as their raw
+// events are back; the next Run compacts the day again if it is still past the
+// policy. Events compacted without archive stay counted in the rollups only.
+func (r *Runner) Restore(ctx context.Context, organizationID int64, from, to time.Time) ([]Result, error) {
+	rows, err := r.db.QueryContext(ctx, `
+SELECT archive_id, day, file_name, url
+FROM event_archives
+WHERE organization_id = $1 AND day >= $2 AND day <= $3
+  AND completed_at IS NOT NULL AND restored_at IS NULL
+ORDER BY day, archive_id`, organizationID, truncateDay(from), truncateDay(to))
+	if err != nil {
+		return nil, errors.Wrap(err, "query archives")
+	}
+	var archives []archiveRow
+	for rows.Next() {
+		var a archiveRow
+		if err := rows.Scan(&a.id, &a.day, &a.fileName, &a.url); err != nil {
+			rows.Close()
+			return nil, errors.Wrap(err, "scan archive")
+		}
+		a.day = a.day.UTC()
+		archives = append(archives, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterate archives")
+	}
+
+	for _, a := range archives {
+		if !r.owns(a) {
+			return nil, errors.Errorf("archive %s is stored at %s, not by this runner's uploader", a.fileName, a.url)
+		}
+	}
+
+	var out []Result
+	for len(archives) > 0 {
+		n := 1
+		for n < len(archives) && archives[n].day.Equal(archives[0].day) {
+			n++
+		}
+		res, err := r.restoreDay(ctx, organizationID, archives[:n])
+		if err != nil {
+			return out, errors.Wrapf(err, "restore %s", archives[0].day.Format(dateLayout))
+		}
+		out = append(out, res...)
+		archives = archives[n:]
+	}
+	return out, nil
+}
+
+type archiveRow struct {
+	id            int64
+	day           time.Time
+	fileName, url string
+}
+
+// owns tells whether the runner's uploader stores the file of a
+func (r *Runner) owns(a archiveRow) bool {
+	return a.url == r.uploader.URL(a.fileName)
+}
+
+// restoreDay reinserts the events of a day's archives in one transaction and
+// takes them out of the day's rollups, which keep the counts compacted
+// without archive or into other archives. Events keep their IDs, so one
+// restored twice is inserted once.
+func (r *Runner) restoreDay(ctx context.Context, organizationID int64, archives []archiveRow) ([]Result, error) {
+	day := archives[0].day
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+INSERT INTO events (event_id, campaign_id, channel_id, audience_id, event_type, event_timestamp, user_id, revenue)
+VALUES ($1, $2, NULLIF($3, 0), NULLIF($4, 0), $5, $6, NULLIF($7, ''), NULLIF($8, 0))
+ON CONFLICT (event_id) DO NOTHING`)
+	if err != nil {
+		return nil, errors.Wrap(err, "prepare event insert")
+	}
+	defer stmt.Close()
+
+	restoredAt := time.Now().UTC()
+	totals := make(map[dayCount]*dayTotal)
+	var out []Result
+	for _, a := range archives {
+		res := Result{OrganizationID: organizationID, Day: day, FileName: a.fileName, URL: a.url}
+		f, err := r.uploader.OpenFile(ctx, a.fileName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "open %s", a.fileName)
+		}
+		err = readArchive(f, func(ev events.Event) error {
+			if ev.EventID == "" {
+				return errors.New("archived event without an ID")
+			}
+			_, err := stmt.ExecContext(ctx, ev.EventID, ev.CampaignID, ev.ChannelID, ev.AudienceID, ev.EventType,
+				ev.Time(), ev.UserID, ev.Revenue)
+			if err != nil {
+				return errors.Wrap(err, "insert event")
+			}
+			k := dayCount{ev.CampaignID, ev.ChannelID, ev.AudienceID, ev.EventType}
+			t := totals[k]
+			if t == nil {
+				t = &dayTotal{}
+				totals[k] = t
+			}
+			t.events++
+			t.revenue += ev.Revenue
+			res.Events++
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %s", a.fileName)
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE event_archives SET restored_at = $1 WHERE archive_id = $2", restoredAt, a.id)
+		if err != nil {
+			return nil, errors.Wrap(err, "mark archive restored")
+		}
+		out = append(out, res)
+	}
+
+	sub, err := tx.PrepareContext(ctx, `
+UPDATE event_daily_rollups
+SET events = events - $6, revenue = revenue - $7
+WHERE campaign_id = $1 AND channel_id = $2 AND audience_id = $3 AND day = $4 AND event_type = $5
+  AND events >= $6`)
+	if err != nil {
+		return nil, errors.Wrap(err, "prepare rollup update")
+	}
+	defer sub.Close()
+	for k, t := range totals {
+		res, err := sub.ExecContext(ctx, k.campaignID, k.channelID, k.audienceID, day, k.eventType, t.events, t.revenue)
+		if err != nil {
+			return nil, errors.Wrap(err, "update daily rollup")
+		}
+		// The archive's events were added to the rollup when it was written
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, errors.Wrap(err, "update daily rollup")
+		}
+		if n != 1 {
+			return nil, errors.Errorf("daily rollup of campaign %d channel %d audience %d %s holds fewer events than its archives",
+				k.campaignID, k.channelID, k.audienceID, k.eventType)
+		}
+	}
+	_, err = tx.ExecContext(ctx, `
+DELETE FROM event_daily_rollups r
+USING campaigns c
+WHERE c.campaign_id = r.campaign_id AND c.organization_id = $1 AND r.day = $2 AND r.events = 0`, organizationID, day)
+	if err != nil {
+		return nil, errors.Wrap(err, "delete empty daily rollups")
+	}
+	return out, errors.Wrap(tx.Commit(), "commit transaction")
+}
@@ -0,0 +1,244 @@
+package retention_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"campaign-analytics/events"
+	"campaign-analytics/migrate/migratetest"
+	"campaign-analytics/retention"
+
+	"github.com/pkg/errors"
+)
+
+const org = 1
+
+var day1 = time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+
+// fixture is an organization with a campaign and channel, its events saved
+// through save
+type fixture struct {
+	db                    *sql.DB
+	campaignID, channelID int64
+	uploader              retention.LocalUploader
+	// now is past the retention of day1 and the next day for 2 days of raw events
+	now time.Time
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	f := &fixture{db: migratetest.DB(t), uploader: retention.LocalUploader{Dir: t.TempDir()}, now: day1.AddDate(0, 0, 5)}
+	err := f.db.QueryRow(`
+INSERT INTO campaigns (name, start_date, organization_id) VALUES ('spring', '2024-03-01', $1)
+RETURNING campaign_id`, org).Scan(&f.campaignID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.db.QueryRow("INSERT INTO channels (name) VALUES ('meta') RETURNING channel_id").Scan(&f.channelID); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// save stores events of the fixture's campaign at hours after day1, the hour
+// naming the event and its user and valuing conversions
+func (f *fixture) save(t *testing.T, eventType string, hours ...int) {
+	t.Helper()
+	var evs []events.Event
+	for _, h := range hours {
+		ev := events.Event{
+			EventID:        fmt.Sprintf("%s-%d", eventType, h),
+			CampaignID:     f.campaignID,
+			ChannelID:      f.channelID,
+			EventType:      eventType,
+			EventTimestamp: day1.Add(time.Duration(h) * time.Hour).Unix(),
+			UserID:         fmt.Sprint("u", h),
+		}
+		if eventType == events.Conversion {
+			ev.Revenue = float64(h)
+		}
+		evs = append(evs, ev)
+	}
+	if _, err := events.NewPostgresStore(f.db).Save(context.Background(), evs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (f *fixture) runner(u retention.Uploader) *retention.Runner {
+	return retention.NewRunner(f.db, retention.NewMemoryPolicyStore(), u)
+}
+
+func (f *fixture) count(t *testing.T, query string, args ...interface{}) int64 {
+	t.Helper()
+	var n int64
+	if err := f.db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+func (f *fixture) rawEvents(t *testing.T) int64 {
+	return f.count(t, "SELECT COUNT(*) FROM events")
+}
+
+// rolledUp returns the compacted events of a day
+func (f *fixture) rolledUp(t *testing.T, day time.Time) int64 {
+	return f.count(t, "SELECT COALESCE(SUM(events), 0) FROM event_daily_rollups WHERE day = $1", day)
+}
+
+func (f *fixture) revenue(t *testing.T) int64 {
+	return f.count(t, "SELECT COALESCE(SUM(revenue), 0)::BIGINT FROM event_daily_rollups")
+}
+
+func (f *fixture) archives(t *testing.T) int64 {
+	return f.count(t, "SELECT COUNT(*) FROM event_archives")
+}
+
+func TestCompactArchiveRestore(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	runner := f.runner(f.uploader)
+	day2 := day1.AddDate(0, 0, 1)
+
+	// An impression compacted without archive, then two more events of day1
+	// and one of day2 compacted with archives
+	f.save(t, events.Impression, 1)
+	res, err := runner.Apply(ctx, retention.Policy{OrganizationID: org, RawDays: 2}, f.now)
+	if err != nil || len(res) != 1 || res[0].Events != 1 || res[0].FileName != "" {
+		t.Fatalf("unarchived compaction %+v (%v)", res, err)
+	}
+	f.save(t, events.Impression, 2)
+	f.save(t, events.Conversion, 3, 24)
+	policy := retention.Policy{OrganizationID: org, RawDays: 2, Archive: true}
+	res, err = runner.Apply(ctx, policy, f.now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].Events != 2 || res[1].Events != 1 {
+		t.Fatalf("archived compaction %+v, want 2 events of day1 and 1 of day2", res)
+	}
+	for _, r := range res {
+		if r.URL != f.uploader.URL(r.FileName) {
+			t.Fatalf("archive url %s, want %s", r.URL, f.uploader.URL(r.FileName))
+		}
+	}
+	if n := f.rawEvents(t); n != 0 {
+		t.Fatalf("%d raw events left", n)
+	}
+	if n := f.rolledUp(t, day1); n != 3 {
+		t.Fatalf("day1 rollups hold %d events, want 3", n)
+	}
+	if n := f.revenue(t); n != 27 {
+		t.Fatalf("rollup revenue %d, want 27", n)
+	}
+	if n := f.count(t, "SELECT COUNT(*) FROM event_archives WHERE completed_at IS NOT NULL"); n != 2 {
+		t.Fatalf("%d completed archives, want 2", n)
+	}
+
+	restored, err := runner.Restore(ctx, org, day1, day2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 2 {
+		t.Fatalf("restored %+v, want both archives", restored)
+	}
+	if n := f.rawEvents(t); n != 3 {
+		t.Fatalf("%d raw events restored, want 3", n)
+	}
+	// The impression compacted without archive is still counted
+	if n := f.rolledUp(t, day1); n != 1 {
+		t.Fatalf("day1 rollups hold %d events after restore, want 1", n)
+	}
+	if n := f.rolledUp(t, day2); n != 0 {
+		t.Fatalf("day2 rollups hold %d events after restore, want 0", n)
+	}
+	if n := f.revenue(t); n != 0 {
+		t.Fatalf("rollup revenue %d after restore, want 0", n)
+	}
+
+	// Compacting the restored days again archives them anew, and those
+	// archives restore too
+	if res, err = runner.Apply(ctx, policy, f.now); err != nil || len(res) != 2 {
+		t.Fatalf("recompaction %+v (%v)", res, err)
+	}
+	if n := f.rolledUp(t, day1); n != 3 {
+		t.Fatalf("day1 rollups hold %d events after recompaction, want 3", n)
+	}
+	if restored, err = runner.Restore(ctx, org, day1, day1); err != nil || len(restored) != 1 || restored[0].Events != 2 {
+		t.Fatalf("second restore %+v (%v)", restored, err)
+	}
+
+	// A runner storing elsewhere neither restores nor cleans these archives
+	other := f.runner(retention.LocalUploader{Dir: t.TempDir()})
+	if _, err := other.Restore(ctx, org, day2, day2); err == nil {
+		t.Fatal("restored an archive of another uploader")
+	}
+}
+
+// failingUploader stores files through LocalUploader, then fails as if the
+// upload's response was lost
+type failingUploader struct {
+	retention.LocalUploader
+}
+
+func (u failingUploader) StreamFile(ctx context.Context, fileName string, write func(w io.Writer) error) (string, error) {
+	if _, err := u.LocalUploader.StreamFile(ctx, fileName, write); err != nil {
+		return "", err
+	}
+	return "", errors.New("upload response lost")
+}
+
+func TestCompactFailedUpload(t *testing.T) {
+	f := newFixture(t)
+	f.save(t, events.Impression, 1, 2)
+	_, err := f.runner(failingUploader{f.uploader}).Apply(context.Background(), retention.Policy{OrganizationID: org, RawDays: 2, Archive: true}, f.now)
+	if err == nil {
+		t.Fatal("compaction succeeded without its archive")
+	}
+	assertUntouched(t, f, 2)
+}
+
+func TestCompactFailedCommit(t *testing.T) {
+	f := newFixture(t)
+	f.save(t, events.Impression, 1, 2)
+	// A deferred constraint fails the transaction at commit only
+	_, err := f.db.Exec(`
+CREATE FUNCTION fail_commit() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'commit failed';
+END
+$$ LANGUAGE plpgsql;
+CREATE CONSTRAINT TRIGGER fail_commit AFTER INSERT ON event_daily_rollups
+    DEFERRABLE INITIALLY DEFERRED FOR EACH ROW EXECUTE FUNCTION fail_commit();`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.runner(f.uploader).Apply(context.Background(), retention.Policy{OrganizationID: org, RawDays: 2, Archive: true}, f.now)
+	if err == nil || !strings.Contains(err.Error(), "commit failed") {
+		t.Fatalf("got %v, want the commit failure", err)
+	}
+	assertUntouched(t, f, 2)
+}
+
+// assertUntouched checks that a failed compaction kept the raw events and
+// left neither an archive row nor a file behind
+func assertUntouched(t *testing.T, f *fixture, rawEvents int64) {
+	t.Helper()
+	if n := f.rawEvents(t); n != rawEvents {
+		t.Fatalf("%d raw events, want %d", n, rawEvents)
+	}
+	if n := f.rolledUp(t, day1); n != 0 {
+		t.Fatalf("rollups hold %d events", n)
+	}
+	if n := f.archives(t); n != 0 {
+		t.Fatalf("%d archives left, pending ones included", n)
+	}
+	if names := files(t, f.uploader.Dir); len(names) != 0 {
+		t.Fatalf("files left %v", names)
+	}
+}
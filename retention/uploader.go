@@ -0,0 +1,170 @@
+package retention
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+
+	"campaign-analytics/events"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+)
+
+// Uploader stores archive files. GCSUploader keeps them in a bucket, as the
+// export service and the retention command do in production; LocalUploader
+// keeps them in a directory, for tests and local runs.
+type Uploader interface {
+	// URL returns the URL of fileName once stored. Archives are recorded with
+	// it, so a runner only touches the files of its own uploader.
+	URL(fileName string) string
+	// StreamFile stores what write produces as fileName and returns its URL
+	StreamFile(ctx context.Context, fileName string, write func(w io.Writer) error) (string, error)
+	// OpenFile reads a file stored by StreamFile
+	OpenFile(ctx context.Context, fileName string) (io.ReadCloser, error)
+	// DeleteFile removes a file stored by StreamFile, if it exists
+	DeleteFile(ctx context.Context, fileName string) error
+}
+
+// LocalUploader keeps files under Dir
+type LocalUploader struct {
+	Dir string
+}
+
+func (u LocalUploader) URL(fileName string) string {
+	path := filepath.Join(u.Dir, filepath.FromSlash(fileName))
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return "file://" + filepath.ToSlash(path)
+}
+
+func (u LocalUploader) StreamFile(_ context.Context, fileName string, write func(w io.Writer) error) (string, error) {
+	path := filepath.Join(u.Dir, filepath.FromSlash(fileName))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", errors.Wrap(err, "create archive directory")
+	}
+	// Written aside then renamed, so a failed write leaves no partial file
+	f, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return "", errors.Wrap(err, "create file")
+	}
+	defer os.Remove(f.Name())
+	if err := write(f); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", errors.Wrap(err, "close file")
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", errors.Wrap(err, "rename file")
+	}
+	return u.URL(fileName), nil
+}
+
+func (u LocalUploader) OpenFile(_ context.Context, fileName string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(u.Dir, filepath.FromSlash(fileName)))
+	return f, errors.Wrap(err, "open file")
+}
+
+func (u LocalUploader) DeleteFile(_ context.Context, fileName string) error {
+	err := os.Remove(filepath.Join(u.Dir, filepath.FromSlash(fileName)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return errors.Wrap(err, "delete file")
+}
+
+// GCSUploader keeps files in a GCS bucket under Prefix
+type GCSUploader struct {
+	Client *storage.Client
+	Bucket string
+	Prefix string // e.g. upload/
+}
+
+func (u GCSUploader) URL(fileName string) string {
+	return "https://" + u.Bucket + "/" + u.Prefix + fileName
+}
+
+func (u GCSUploader) object(fileName string) *storage.ObjectHandle {
+	return u.Client.Bucket(u.Bucket).Object(u.Prefix + fileName)
+}
+
+func (u GCSUploader) StreamFile(ctx context.Context, fileName string, write func(w io.Writer) error) (string, error) {
+	// Cancelling the writer's context aborts the upload, leaving no object
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wc := u.object(fileName).NewWriter(wctx)
+	if err := write(wc); err != nil {
+		cancel()
+		wc.Close()
+		return "", err
+	}
+	if err := wc.Close(); err != nil {
+		return "", errors.Wrap(err, "write close")
+	}
+	return u.URL(fileName), nil
+}
+
+func (u GCSUploader) OpenFile(ctx context.Context, fileName string) (io.ReadCloser, error) {
+	r, err := u.object(fileName).NewReader(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "open storage object")
+	}
+	return r, nil
+}
+
+func (u GCSUploader) DeleteFile(ctx context.Context, fileName string) error {
+	err := u.object(fileName).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	return errors.Wrap(err, "delete storage object")
+}
+
+// Archive files are gzipped JSON lines of events.Event
+
+type archiveWriter struct {
+	gz  *gzip.Writer
+	enc *json.Encoder
+}
+
+func newArchiveWriter(w io.Writer) *archiveWriter {
+	gz := gzip.NewWriter(w)
+	return &archiveWriter{gz: gz, enc: json.NewEncoder(gz)}
+}
+
+func (w *archiveWriter) Write(ev events.Event) error {
+	return errors.Wrap(w.enc.Encode(ev), "write archived event")
+}
+
+func (w *archiveWriter) Close() error {
+	return errors.Wrap(w.gz.Close(), "close archive")
+}
+
+// readArchive calls fn with every event of an archive file
+func readArchive(r io.Reader, fn func(ev events.Event) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "open archive")
+	}
+	defer gz.Close()
+	dec := json.NewDecoder(gz)
+	for {
+		var ev events.Event
+		err := dec.Decode(&ev)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "read archived event")
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package retention_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"campaign-analytics/retention"
+
+	"github.com/pkg/errors"
+)
+
+func TestLocalUploader(t *testing.T) {
+	ctx := context.Background()
+	u := retention.LocalUploader{Dir: t.TempDir()}
+
+	got, err := u.StreamFile(ctx, "org_1/a.txt", func(w io.Writer) error {
+		_, err := io.WriteString(w, "archived")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != u.URL("org_1/a.txt") {
+		t.Fatalf("url %s, want %s", got, u.URL("org_1/a.txt"))
+	}
+	f, err := u.OpenFile(ctx, "org_1/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(f)
+	f.Close()
+	if string(b) != "archived" {
+		t.Fatalf("read %q", b)
+	}
+
+	// A failed write leaves no file, not even a partial one
+	_, err = u.StreamFile(ctx, "org_1/b.txt", func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return errors.New("source failed")
+	})
+	if err == nil {
+		t.Fatal("failed write stored")
+	}
+	if names := files(t, u.Dir); !reflect.DeepEqual(names, []string{"org_1/a.txt"}) {
+		t.Fatalf("files %v, want org_1/a.txt alone", names)
+	}
+
+	if err := u.DeleteFile(ctx, "org_1/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.DeleteFile(ctx, "org_1/a.txt"); err != nil {
+		t.Fatalf("deleting a missing file: %v", err)
+	}
+}
+
+// files lists the files under dir, relative and slash separated
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+	var out []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		out = append(out, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,71 @@
+// Package retry delays failed messages through tiered retry topics instead of
+// sleeping in the consumer. A failed message is written to the tier matching
+// its backoff with a not-before header; a Scheduler per tier holds it until it
+// is due and puts it back on the main topic.
+package retry
+
+import (
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Policy is an exponential backoff with jitter
+type Policy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	Jitter       float64 // fraction of the delay randomly added or removed, 0..1
+	MaxAttempts  int     // retries before a message is dead-lettered
+}
+
+// DefaultPolicy retries 3 times, after about 5s, 10s and 20s
+var DefaultPolicy = Policy{
+	InitialDelay: 5 * time.Second,
+	MaxDelay:     10 * time.Minute,
+	Multiplier:   2,
+	Jitter:       0.2,
+	MaxAttempts:  3,
+}
+
+// LoadPolicy returns DefaultPolicy overridden by RETRY_INITIAL_DELAY,
+// RETRY_MAX_DELAY, RETRY_MULTIPLIER, RETRY_JITTER and RETRY_MAX_ATTEMPTS.
+// Invalid values are ignored.
+func LoadPolicy() Policy {
+	p := DefaultPolicy
+	if d, err := time.ParseDuration(os.Getenv("RETRY_INITIAL_DELAY")); err == nil && d > 0 {
+		p.InitialDelay = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("RETRY_MAX_DELAY")); err == nil && d > 0 {
+		p.MaxDelay = d
+	}
+	if f, err := strconv.ParseFloat(os.Getenv("RETRY_MULTIPLIER"), 64); err == nil && f >= 1 {
+		p.Multiplier = f
+	}
+	if f, err := strconv.ParseFloat(os.Getenv("RETRY_JITTER"), 64); err == nil && f >= 0 && f <= 1 {
+		p.Jitter = f
+	}
+	if n, err := strconv.Atoi(os.Getenv("RETRY_MAX_ATTEMPTS")); err == nil && n >= 0 {
+		p.MaxAttempts = n
+	}
+	return p
+}
+
+// Delay returns the backoff before retry number attempt (1-based)
+func (p Policy) Delay(attempt int) time.Duration {
+	d := float64(p.InitialDelay)
+	for i := 1; i < attempt; i++ {
+		d *= p.Multiplier
+		if p.MaxDelay > 0 && d >= float64(p.MaxDelay) {
+			break
+		}
+	}
+	if max := float64(p.MaxDelay); p.MaxDelay > 0 && d > max {
+		d = max
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
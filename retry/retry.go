@@ -0,0 +1,134 @@
+package retry
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"campaign-analytics/sink"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// Headers set on messages routed through the retry topics
+const (
+	HeaderNotBefore   = "retry_not_before"   // unix milliseconds before which the message must not be retried
+	HeaderAttempt     = "retry_attempt"      // number of retries so far
+	HeaderOriginTopic = "retry_origin_topic" // topic the message failed on
+	HeaderError       = "retry_error"        // error of the last attempt
+)
+
+// ErrExhausted is returned by Schedule once a message used up its attempts
+var ErrExhausted = errors.New("retry attempts exhausted")
+
+// Tier is a retry topic for delays up to Delay
+type Tier struct {
+	Topic string
+	Delay time.Duration
+}
+
+// Tiers returns the 5s, 1m and 10m retry topics of topic
+func Tiers(topic string) []Tier {
+	return []Tier{
+		{Topic: topic + ".retry-5s", Delay: 5 * time.Second},
+		{Topic: topic + ".retry-1m", Delay: time.Minute},
+		{Topic: topic + ".retry-10m", Delay: 10 * time.Minute},
+	}
+}
+
+// tierFor picks the shortest tier covering delay, or the longest one
+func tierFor(tiers []Tier, delay time.Duration) Tier {
+	for _, t := range tiers {
+		if delay <= t.Delay {
+			return t
+		}
+	}
+	return tiers[len(tiers)-1]
+}
+
+// Retrier routes failed messages to the retry tiers
+type Retrier struct {
+	policy Policy
+	tiers  []Tier
+	sinks  map[string]sink.EventSink
+	now    func() time.Time
+}
+
+// NewRetrier creates a Retrier writing to the tier topics through the sinks
+// returned by open. tiers must be sorted by Delay.
+func NewRetrier(policy Policy, tiers []Tier, open func(topic string) sink.EventSink) *Retrier {
+	r := &Retrier{policy: policy, tiers: tiers, sinks: make(map[string]sink.EventSink), now: time.Now}
+	for _, t := range tiers {
+		r.sinks[t.Topic] = open(t.Topic)
+	}
+	return r
+}
+
+// Attempt returns the number of retries msg already went through
+func Attempt(msg kafka.Message) int {
+	n, _ := strconv.Atoi(header(msg, HeaderAttempt))
+	return n
+}
+
+// NotBefore returns when msg becomes due, zero if it carries no header
+func NotBefore(msg kafka.Message) time.Time {
+	ms, err := strconv.ParseInt(header(msg, HeaderNotBefore), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// Schedule writes msg, which failed with cause, to the retry tier matching its
+// next backoff. It returns ErrExhausted once the policy's attempts are used up.
+func (r *Retrier) Schedule(ctx context.Context, msg kafka.Message, cause error) error {
+	attempt := Attempt(msg) + 1
+	if attempt > r.policy.MaxAttempts {
+		return ErrExhausted
+	}
+	delay := r.policy.Delay(attempt)
+	tier := tierFor(r.tiers, delay)
+
+	out := kafka.Message{Key: msg.Key, Value: msg.Value}
+	for _, h := range msg.Headers {
+		switch h.Key {
+		case HeaderNotBefore, HeaderAttempt, HeaderOriginTopic, HeaderError:
+		default:
+			out.Headers = append(out.Headers, h)
+		}
+	}
+	origin := header(msg, HeaderOriginTopic)
+	if origin == "" {
+		origin = msg.Topic
+	}
+	out.Headers = append(out.Headers,
+		kafka.Header{Key: HeaderNotBefore, Value: []byte(strconv.FormatInt(r.now().Add(delay).UnixMilli(), 10))},
+		kafka.Header{Key: HeaderAttempt, Value: []byte(strconv.Itoa(attempt))},
+		kafka.Header{Key: HeaderOriginTopic, Value: []byte(origin)},
+	)
+	if cause != nil {
+		out.Headers = append(out.Headers, kafka.Header{Key: HeaderError, Value: []byte(cause.Error())})
+	}
+	return errors.Wrapf(r.sinks[tier.Topic].Write(ctx, out), "write to %s", tier.Topic)
+}
+
+// Close closes the tier sinks
+func (r *Retrier) Close() error {
+	var err error
+	for _, s := range r.sinks {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func header(msg kafka.Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
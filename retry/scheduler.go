@@ -0,0 +1,56 @@
+package retry
+
+import (
+	"context"
+	"time"
+
+	"campaign-analytics/sink"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// MessageReader is the part of *kafka.Reader the scheduler needs
+type MessageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Scheduler consumes one retry tier and puts each message back on the main
+// topic once its not-before time has passed. Messages of a tier share roughly
+// the same delay, so holding the head of a partition delays the rest by at
+// most the tier delay.
+type Scheduler struct {
+	Reader MessageReader
+	Dest   sink.EventSink // the main topic
+}
+
+// Run forwards due messages until ctx is done or a write fails
+func (s *Scheduler) Run(ctx context.Context) error {
+	for {
+		msg, err := s.Reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Wrap(err, "fetch message")
+		}
+		if wait := time.Until(NotBefore(msg)); wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-t.C:
+			}
+		}
+		// Retry headers stay so the consumer keeps counting attempts
+		out := kafka.Message{Key: msg.Key, Value: msg.Value, Headers: msg.Headers}
+		if err := s.Dest.Write(ctx, out); err != nil {
+			return errors.Wrap(err, "write to main topic")
+		}
+		if err := s.Reader.CommitMessages(ctx, msg); err != nil {
+			return errors.Wrap(err, "commit offset")
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package rollup
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"campaign-analytics/fx"
+	"campaign-analytics/schema"
+	"campaign-analytics/sink"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// Aggregator buffers records until Flush applies them to the repository.
+// Records for buckets that were already written (late data) are added on top,
+// bumping the bucket revision, and re-emitted.
+type Aggregator struct {
+	repo    Repository
+	emit    sink.EventSink // optional, receives every updated bucket
+	pending []Record
+
+	// Buckets sum cost and revenue in currency, converted at rates
+	rates    *fx.Store
+	currency string
+}
+
+// NewAggregator creates an aggregator writing to repo, summing cost and
+// revenue in currency. Records in another currency are converted at rates,
+// which may be nil when every record is in currency. emit may be nil.
+func NewAggregator(repo Repository, emit sink.EventSink, rates *fx.Store, currency string) *Aggregator {
+	return &Aggregator{repo: repo, emit: emit, rates: rates, currency: currency}
+}
+
+// Add buffers a record read under message ID id, converting it to the
+// aggregator currency at the rate of its day. Records without a currency are
+// taken to be in it already.
+func (a *Aggregator) Add(id string, d schema.CampaignData) error {
+	if d.Currency != "" && d.Currency != a.currency {
+		if a.rates == nil {
+			return errors.Errorf("record in %s, no FX rates to convert it to %s", d.Currency, a.currency)
+		}
+		day := time.Unix(d.Timestamp, 0).UTC()
+		if d.IsDayTotal() {
+			day, _ = time.Parse(schema.DateLayout, d.ReportDate)
+		}
+		rate, err := a.rates.Rate(day, d.Currency, a.currency)
+		if err != nil {
+			return errors.Wrap(err, "convert record")
+		}
+		d.Cost *= rate
+		d.Revenue *= rate
+	}
+	d.Currency = a.currency
+	a.pending = append(a.pending, Record{ID: id, Data: d})
+	return nil
+}
+
+// Len returns the number of records buffered since the last flush
+func (a *Aggregator) Len() int {
+	return len(a.pending)
+}
+
+// Flush applies the buffered records and emits the updated buckets. Emitting
+// happens after the repository commit: a crash in between skips the emit until
+// the bucket changes again, and a retried emit may repeat a bucket, so
+// consumers of the rollups topic keep the highest Revision per Key.
+func (a *Aggregator) Flush(ctx context.Context) error {
+	if len(a.pending) == 0 {
+		return nil
+	}
+	buckets, err := a.repo.Apply(ctx, a.pending)
+	if err != nil {
+		return errors.Wrap(err, "apply rollups")
+	}
+	a.reset()
+	return a.publish(ctx, buckets)
+}
+
+func (a *Aggregator) reset() {
+	a.pending = nil
+}
+
+// publish emits updated buckets, keyed by campaign so that revisions of a
+// bucket stay ordered
+func (a *Aggregator) publish(ctx context.Context, buckets []Bucket) error {
+	if a.emit == nil || len(buckets) == 0 {
+		return nil
+	}
+	msgs := make([]kafka.Message, 0, len(buckets))
+	for _, b := range buckets {
+		v, err := json.Marshal(b)
+		if err != nil {
+			return errors.Wrap(err, "encode bucket")
+		}
+		msgs = append(msgs, kafka.Message{Key: []byte(b.CampaignID), Value: v})
+	}
+	return errors.Wrap(a.emit.Write(ctx, msgs...), "emit rollups")
+}
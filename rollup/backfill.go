@@ -0,0 +1,179 @@
+package rollup
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"campaign-analytics/codec"
+	"campaign-analytics/ledger"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// Backfill re-reads a topic into an Aggregator, partition by partition, up to
+// the end offsets seen when it starts. Progress is committed as the offsets of
+// GroupID, a group of its own, so the live consumer is unaffected and an
+// interrupted or repeated run resumes where the previous one stopped.
+type Backfill struct {
+	Client     *kafka.Client
+	Brokers    []string
+	Topic      string
+	GroupID    string
+	Aggregator *Aggregator
+	FlushSize  int
+
+	Since       time.Time       // start of partitions without explicit or committed offsets, zero for the first offset
+	Offsets     map[int]int64   // explicit start offsets per partition
+	Restart     bool            // ignore offsets committed by an earlier run
+	CampaignIDs map[string]bool // only these campaigns, all when empty
+
+	// OnLowerBound, when set, is called before the first message of a
+	// partition that starts past the beginning of the topic without Since,
+	// with the first bucket time complete from then on. Buckets before it
+	// may miss records published before the start offset.
+	OnLowerBound func(ctx context.Context, bound time.Time) error
+}
+
+// Run reads every partition to its end offset
+func (b *Backfill) Run(ctx context.Context) error {
+	if b.FlushSize <= 0 {
+		return errors.Errorf("flush size must be positive, got %d", b.FlushSize)
+	}
+	meta, err := b.Client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{b.Topic}})
+	if err != nil {
+		return errors.Wrap(err, "metadata")
+	}
+	if len(meta.Topics) != 1 || meta.Topics[0].Error != nil {
+		return errors.Errorf("topic %s not found", b.Topic)
+	}
+	var partitions []int
+	var offsetReqs []kafka.OffsetRequest
+	for _, p := range meta.Topics[0].Partitions {
+		partitions = append(partitions, p.ID)
+		offsetReqs = append(offsetReqs, kafka.FirstOffsetOf(p.ID), kafka.LastOffsetOf(p.ID))
+	}
+
+	listed, err := b.Client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: map[string][]kafka.OffsetRequest{b.Topic: offsetReqs}})
+	if err != nil {
+		return errors.Wrap(err, "list offsets")
+	}
+	bounds := make(map[int]kafka.PartitionOffsets)
+	for _, po := range listed.Topics[b.Topic] {
+		if po.Error != nil {
+			return errors.Wrapf(po.Error, "list offsets of partition %d", po.Partition)
+		}
+		bounds[po.Partition] = po
+	}
+
+	committed := make(map[int]int64)
+	if !b.Restart {
+		fetched, err := b.Client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: b.GroupID, Topics: map[string][]int{b.Topic: partitions}})
+		if err != nil {
+			return errors.Wrap(err, "fetch committed offsets")
+		}
+		for _, p := range fetched.Topics[b.Topic] {
+			if p.Error == nil && p.CommittedOffset >= 0 {
+				committed[p.Partition] = p.CommittedOffset
+			}
+		}
+	}
+
+	for _, p := range partitions {
+		start, ok := committed[p]
+		if !ok {
+			start, ok = b.Offsets[p]
+		}
+		if !ok {
+			start = bounds[p].FirstOffset
+		}
+		_, resumed := committed[p]
+		useSince := !ok && !b.Since.IsZero()
+		// A run resumed from committed offsets recorded its bound when it started
+		bounded := !resumed && !useSince && start > 0
+		if err := b.runPartition(ctx, p, start, useSince, bounded, bounds[p].LastOffset); err != nil {
+			return errors.Wrapf(err, "partition %d", p)
+		}
+	}
+	return nil
+}
+
+func (b *Backfill) runPartition(ctx context.Context, partition int, start int64, useSince, bounded bool, end int64) error {
+	r := kafka.NewReader(kafka.ReaderConfig{Brokers: b.Brokers, Topic: b.Topic, Partition: partition})
+	defer r.Close()
+	var err error
+	if useSince {
+		err = r.SetOffsetAt(ctx, b.Since)
+	} else {
+		err = r.SetOffset(start)
+	}
+	if err != nil {
+		return errors.Wrap(err, "seek")
+	}
+	if r.Offset() >= end {
+		return nil
+	}
+	log.Printf("backfill: partition %d from offset %d to %d", partition, r.Offset(), end)
+
+	read := 0
+	for {
+		msg, err := r.ReadMessage(ctx)
+		if err != nil {
+			return errors.Wrap(err, "read message")
+		}
+		if read == 0 && bounded && b.OnLowerBound != nil {
+			if err := b.OnLowerBound(ctx, lowerBound(msg.Time)); err != nil {
+				return errors.Wrap(err, "record lower bound")
+			}
+		}
+		if data, err := codec.DecodeCampaignData(msg); err != nil {
+			log.Printf("backfill: skipping invalid message at %d/%d: %v", msg.Partition, msg.Offset, err)
+		} else if len(b.CampaignIDs) == 0 || b.CampaignIDs[data.CampaignID] {
+			if err := b.Aggregator.Add(ledger.MessageID(msg), data); err != nil {
+				log.Printf("backfill: skipping message at %d/%d: %v", msg.Partition, msg.Offset, err)
+			}
+		}
+		read++
+		done := msg.Offset+1 >= end
+		if read%b.FlushSize == 0 || done {
+			if err := b.Aggregator.Flush(ctx); err != nil {
+				return err
+			}
+			if err := b.commit(ctx, partition, msg.Offset+1); err != nil {
+				return err
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// commit records progress; the group has no members so a simple commit is accepted
+func (b *Backfill) commit(ctx context.Context, partition int, next int64) error {
+	resp, err := b.Client.OffsetCommit(ctx, &kafka.OffsetCommitRequest{
+		GroupID:      b.GroupID,
+		GenerationID: -1,
+		Topics:       map[string][]kafka.OffsetCommit{b.Topic: {{Partition: partition, Offset: next}}},
+	})
+	if err != nil {
+		return errors.Wrap(err, "commit offset")
+	}
+	for _, p := range resp.Topics[b.Topic] {
+		if p.Error != nil {
+			return errors.Wrap(p.Error, "commit offset")
+		}
+	}
+	return nil
+}
+
+// lowerBound returns the first day whose records were all published at or
+// after first, records being published no earlier than their timestamp
+func lowerBound(first time.Time) time.Time {
+	day := Daily.Truncate(first)
+	if day.Before(first) {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day
+}
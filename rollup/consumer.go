@@ -0,0 +1,72 @@
+package rollup
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"campaign-analytics/codec"
+	"campaign-analytics/ledger"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// MessageReader is the part of *kafka.Reader the consumer needs
+type MessageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Consumer reads campaign-data messages into an Aggregator, flushing every
+// FlushSize records or FlushInterval, and commits offsets only after a flush.
+// Messages redelivered after a crash between flush and commit are skipped by
+// the repository ledger, which makes the rollups effectively exactly-once.
+type Consumer struct {
+	Reader        MessageReader
+	Aggregator    *Aggregator
+	FlushSize     int
+	FlushInterval time.Duration
+}
+
+// Run consumes until ctx is done or a flush fails
+func (c *Consumer) Run(ctx context.Context) error {
+	var uncommitted []kafka.Message
+	deadline := time.Now().Add(c.FlushInterval)
+	for {
+		fctx, cancel := context.WithDeadline(ctx, deadline)
+		msg, err := c.Reader.FetchMessage(fctx)
+		cancel()
+		switch {
+		case err == nil:
+			uncommitted = append(uncommitted, msg)
+			data, err := codec.DecodeCampaignData(msg)
+			if err != nil {
+				log.Printf("rollup: skipping invalid message at %s/%d/%d: %v", msg.Topic, msg.Partition, msg.Offset, err)
+				break
+			}
+			if err := c.Aggregator.Add(ledger.MessageID(msg), data); err != nil {
+				log.Printf("rollup: skipping message at %s/%d/%d: %v", msg.Topic, msg.Partition, msg.Offset, err)
+			}
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, context.DeadlineExceeded):
+		default:
+			return errors.Wrap(err, "fetch message")
+		}
+
+		if c.Aggregator.Len() < c.FlushSize && time.Now().Before(deadline) {
+			continue
+		}
+		if err := c.Aggregator.Flush(ctx); err != nil {
+			return err
+		}
+		if len(uncommitted) > 0 {
+			if err := c.Reader.CommitMessages(ctx, uncommitted...); err != nil {
+				return errors.Wrap(err, "commit offsets")
+			}
+			uncommitted = uncommitted[:0]
+		}
+		deadline = time.Now().Add(c.FlushInterval)
+	}
+}
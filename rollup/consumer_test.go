@@ -0,0 +1,234 @@
+package rollup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"campaign-analytics/codec"
+	"campaign-analytics/migrate/migratetest"
+	"campaign-analytics/schema"
+
+	"github.com/segmentio/kafka-go"
+)
+
+var errKilled = errors.New("consumer killed")
+
+// partition is a single Kafka partition with a committed offset, read by
+// successive consumer runs like a consumer group member restarting
+type partition struct {
+	mu        sync.Mutex
+	msgs      []kafka.Message
+	committed int
+}
+
+// reader reads p from its committed offset. It kills the run by failing the
+// fetch after killAfterFetch messages or the first commit when killOnCommit,
+// and cancels the run once every message is committed.
+type reader struct {
+	p              *partition
+	pos            int
+	fetched        int
+	killAfterFetch int
+	killOnCommit   bool
+	done           context.CancelFunc
+}
+
+func (p *partition) reader(done context.CancelFunc) *reader {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &reader{p: p, pos: p.committed, done: done}
+}
+
+func (r *reader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	if r.killAfterFetch > 0 && r.fetched == r.killAfterFetch {
+		return kafka.Message{}, errKilled
+	}
+	if r.pos == len(r.p.msgs) {
+		<-ctx.Done()
+		return kafka.Message{}, ctx.Err()
+	}
+	msg := r.p.msgs[r.pos]
+	r.pos++
+	r.fetched++
+	return msg, nil
+}
+
+func (r *reader) CommitMessages(_ context.Context, msgs ...kafka.Message) error {
+	if r.killOnCommit {
+		return errKilled
+	}
+	r.p.mu.Lock()
+	defer r.p.mu.Unlock()
+	r.p.committed = int(msgs[len(msgs)-1].Offset) + 1
+	if r.p.committed == len(r.p.msgs) {
+		r.done()
+	}
+	return nil
+}
+
+func newPartition(t *testing.T, n int) *partition {
+	t.Helper()
+	hour := time.Now().UTC().Truncate(time.Hour).Add(-2 * time.Hour)
+	p := &partition{}
+	for i := 0; i < n; i++ {
+		v, err := codec.EncodeCampaignData(schema.CampaignData{
+			CampaignID:  "c1",
+			Platform:    "meta",
+			Timestamp:   hour.Add(time.Duration(i) * time.Second).Unix(),
+			Impressions: 100,
+			Clicks:      10,
+			Cost:        1.5,
+			Currency:    "USD",
+		}, codec.JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.msgs = append(p.msgs, kafka.Message{
+			Topic:   "campaign-data",
+			Offset:  int64(i),
+			Value:   v,
+			Headers: []kafka.Header{codec.Header(codec.JSON)},
+		})
+	}
+	return p
+}
+
+// run consumes p with a fresh consumer until it is killed or caught up
+func run(t *testing.T, p *partition, repo Repository, kill func(r *reader)) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	r := p.reader(cancel)
+	if kill != nil {
+		kill(r)
+	}
+	c := &Consumer{
+		Reader:        r,
+		Aggregator:    NewAggregator(repo, nil, nil, "USD"),
+		FlushSize:     10,
+		FlushInterval: 50 * time.Millisecond,
+	}
+	err := c.Run(ctx)
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+func totals(t *testing.T, repo Repository) Metrics {
+	t.Helper()
+	return campaignTotals(t, repo, "c1")
+}
+
+func campaignTotals(t *testing.T, repo Repository, campaignID string) Metrics {
+	t.Helper()
+	var m Metrics
+	it := repo.Iterate(campaignID, "", Daily, time.Now().AddDate(0, 0, -2), time.Now().AddDate(0, 0, 1), 0)
+	for {
+		page, err := it.Next(context.Background())
+		if err == io.EOF {
+			return m
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range page {
+			m = m.Add(b.Metrics)
+		}
+	}
+}
+
+// repositories are the backends the consumer is tested against, Postgres
+// when TEST_DATABASE_URL is set
+var repositories = []struct {
+	name string
+	new  func(t *testing.T) Repository
+}{
+	{"memory", func(*testing.T) Repository { return NewMemoryRepository() }},
+	{"postgres", func(t *testing.T) Repository { return NewPostgresRepository(migratetest.DB(t)) }},
+}
+
+func TestConsumerKilledMidBatch(t *testing.T) {
+	const n = 35
+	want := Metrics{Impressions: 100 * n, Clicks: 10 * n, Cost: 1.5 * n}
+
+	for _, repo := range repositories {
+		for _, tc := range []struct {
+			name string
+			kill func(r *reader)
+		}{
+			// Killed with records aggregated but not flushed
+			{"before flush", func(r *reader) { r.killAfterFetch = 25 }},
+			// Killed after a flush applied records whose offsets were not committed
+			{"after flush before commit", func(r *reader) { r.killOnCommit = true }},
+		} {
+			t.Run(repo.name+"/"+tc.name, func(t *testing.T) {
+				p := newPartition(t, n)
+				repo := repo.new(t)
+				if err := run(t, p, repo, tc.kill); !errors.Is(err, errKilled) {
+					t.Fatalf("killed run: got %v, want %v", err, errKilled)
+				}
+				if err := run(t, p, repo, nil); err != nil {
+					t.Fatalf("restarted run: %v", err)
+				}
+				if got := totals(t, repo); got != want {
+					t.Fatalf("totals after restart %+v, want %+v", got, want)
+				}
+
+				// Redelivering everything, as after a reset of the group offsets,
+				// changes nothing either
+				p.committed = 0
+				if err := run(t, p, repo, nil); err != nil {
+					t.Fatalf("replayed run: %v", err)
+				}
+				if got := totals(t, repo); got != want {
+					t.Fatalf("totals after replay %+v, want %+v", got, want)
+				}
+			})
+		}
+	}
+}
+
+// Messages produced twice upstream carry the same event_id at other offsets
+// and count once, unless the event_id is another campaign's
+func TestConsumerEventIDs(t *testing.T) {
+	for _, repo := range repositories {
+		t.Run(repo.name, func(t *testing.T) {
+			p := newPartition(t, 4)
+			for i := range p.msgs {
+				p.msgs[i].Key = []byte("c1")
+				p.msgs[i].Headers = append(p.msgs[i].Headers, kafka.Header{Key: "event_id", Value: []byte(fmt.Sprint("e", i%2))})
+			}
+			other := newPartition(t, 1).msgs[0]
+			v, err := codec.EncodeCampaignData(schema.CampaignData{
+				CampaignID:  "c2",
+				Platform:    "meta",
+				Timestamp:   time.Now().UTC().Add(-time.Hour).Unix(),
+				Impressions: 100,
+				Currency:    "USD",
+			}, codec.JSON)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other.Key, other.Value, other.Offset = []byte("c2"), v, 4
+			other.Headers = append(other.Headers, kafka.Header{Key: "event_id", Value: []byte("e0")})
+			p.msgs = append(p.msgs, other)
+
+			repo := repo.new(t)
+			if err := run(t, p, repo, nil); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := totals(t, repo), (Metrics{Impressions: 200, Clicks: 20, Cost: 3}); got != want {
+				t.Fatalf("totals %+v, want %+v", got, want)
+			}
+			if got := campaignTotals(t, repo, "c2"); got.Impressions != 100 {
+				t.Fatalf("other campaign's impressions %d, want 100", got.Impressions)
+			}
+		})
+	}
+}
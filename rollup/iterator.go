@@ -0,0 +1,104 @@
+package rollup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultBatchSize is the page size used when an iterator is given none
+const DefaultBatchSize = 1000
+
+// Iterator pages through buckets with constant memory. Next returns io.EOF
+// once every bucket has been returned.
+type Iterator interface {
+	Next(ctx context.Context) ([]Bucket, error)
+}
+
+// pgIterator pages with a keyset on (bucket_start, platform), which follows
+// the primary key so every page is an index range scan
+type pgIterator struct {
+	db    *sql.DB
+	table string
+	args  []interface{}
+	size  int
+	last  *Key
+	done  bool
+}
+
+func (it *pgIterator) Next(ctx context.Context) ([]Bucket, error) {
+	if it.done {
+		return nil, io.EOF
+	}
+	if it.size <= 0 {
+		it.size = DefaultBatchSize
+	}
+	cond, args := "", it.args
+	if it.last != nil {
+		n := len(args)
+		cond = fmt.Sprintf("\n  AND (bucket_start, platform) > ($%d, $%d)", n+1, n+2)
+		args = append(args[:n:n], it.last.Start, it.last.Platform)
+	}
+	rows, err := it.db.QueryContext(ctx, `
+SELECT campaign_id, platform, granularity, bucket_start, impressions, clicks, conversions, cost, revenue, revision, updated_at
+FROM `+it.table+`
+WHERE campaign_id = $1 AND ($2 = '' OR platform = $2) AND granularity = $3
+  AND bucket_start >= $4 AND bucket_start < $5`+cond+`
+ORDER BY bucket_start, platform
+LIMIT `+fmt.Sprint(it.size), args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query rollups")
+	}
+	defer rows.Close()
+
+	var out []Bucket
+	for rows.Next() {
+		var b Bucket
+		var gran string
+		err := rows.Scan(&b.CampaignID, &b.Platform, &gran, &b.Start, &b.Impressions, &b.Clicks,
+			&b.Conversions, &b.Cost, &b.Revenue, &b.Revision, &b.UpdatedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan rollup")
+		}
+		b.Granularity = Granularity(gran)
+		b.Start = b.Start.UTC()
+		out = append(out, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "iterate rollups")
+	}
+	if len(out) < it.size {
+		it.done = true
+	}
+	if len(out) == 0 {
+		return nil, io.EOF
+	}
+	last := out[len(out)-1].Key
+	it.last = &last
+	return out, nil
+}
+
+// sliceIterator pages through buckets already in memory
+type sliceIterator struct {
+	buckets []Bucket
+	size    int
+}
+
+func (it *sliceIterator) Next(context.Context) ([]Bucket, error) {
+	if len(it.buckets) == 0 {
+		return nil, io.EOF
+	}
+	if it.size <= 0 {
+		it.size = DefaultBatchSize
+	}
+	n := it.size
+	if n > len(it.buckets) {
+		n = len(it.buckets)
+	}
+	page := it.buckets[:n:n]
+	it.buckets = it.buckets[n:]
+	return page, nil
+}
@@ -0,0 +1,125 @@
+package rollup
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"campaign-analytics/ledger"
+)
+
+// MemoryRepository keeps buckets in memory, for tests and local development
+type MemoryRepository struct {
+	mu      sync.RWMutex
+	buckets map[Key]Bucket
+	totals  map[DayKey]DayTotal
+	history []Restatement
+	ledger  *ledger.Memory
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		buckets: make(map[Key]Bucket),
+		totals:  make(map[DayKey]DayTotal),
+		ledger:  ledger.NewMemory(),
+	}
+}
+
+func (r *MemoryRepository) Apply(_ context.Context, recs []Record) ([]Bucket, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fresh := filterFresh(recs, r.ledger.MarkNew(recordIDs(recs)))
+	deltas := Deltas(fresh)
+	totals, history, _ := foldDayTotals(fresh, deltas, func(k DayKey) (*DayTotal, error) {
+		if t, ok := r.totals[k]; ok {
+			return &t, nil
+		}
+		return nil, nil
+	})
+	for _, t := range totals {
+		r.totals[t.DayKey] = t
+	}
+	r.history = append(r.history, history...)
+
+	now := time.Now().UTC()
+	out := make([]Bucket, 0, len(deltas))
+	for k, d := range deltas {
+		b, ok := r.buckets[k]
+		if !ok {
+			b = Bucket{Key: k}
+		}
+		b.Metrics = b.Metrics.Add(d)
+		b.Revision++
+		b.UpdatedAt = now
+		r.buckets[k] = b
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+func (r *MemoryRepository) Iterate(campaignID, platform string, g Granularity, from, to time.Time, batchSize int) Iterator {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var out []Bucket
+	for k, b := range r.buckets {
+		if k.CampaignID != campaignID || k.Granularity != g || (platform != "" && k.Platform != platform) {
+			continue
+		}
+		if k.Start.Before(from) || !k.Start.Before(to) {
+			continue
+		}
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Start.Equal(out[j].Start) {
+			return out[i].Start.Before(out[j].Start)
+		}
+		return out[i].Platform < out[j].Platform
+	})
+	return &sliceIterator{buckets: out, size: batchSize}
+}
+
+func (r *MemoryRepository) Restatements(_ context.Context, campaignID, platform string, from, to time.Time) ([]Restatement, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var out []Restatement
+	for _, rs := range r.history {
+		if rs.CampaignID != campaignID || (platform != "" && rs.Platform != platform) {
+			continue
+		}
+		if rs.Date.Before(from) || !rs.Date.Before(to) {
+			continue
+		}
+		out = append(out, rs)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].FetchedAt.Before(out[j].FetchedAt) })
+	return out, nil
+}
+
+func recordIDs(recs []Record) []string {
+	ids := make([]string, 0, len(recs))
+	for _, r := range recs {
+		if r.ID != "" {
+			ids = append(ids, r.ID)
+		}
+	}
+	return ids
+}
+
+// filterFresh keeps the records without an ID and those whose ID is in fresh,
+// consuming fresh so that an ID repeated within recs is applied once
+func filterFresh(recs []Record, fresh map[string]bool) []Record {
+	out := recs[:0:0]
+	for _, r := range recs {
+		if r.ID == "" {
+			out = append(out, r)
+			continue
+		}
+		if fresh[r.ID] {
+			delete(fresh, r.ID)
+			out = append(out, r)
+		}
+	}
+	return out
+}
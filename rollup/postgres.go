@@ -0,0 +1,270 @@
+package rollup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"campaign-analytics/ledger"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	liveTable      = "campaign_rollups"
+	dayTotalsTable = "campaign_day_totals"
+	historyTable   = "campaign_restatements"
+	// ledgerName namespaces the live rollup message IDs in processed_messages
+	ledgerName = "campaign-rollups"
+)
+
+// PostgresRepository stores buckets in the campaign_rollups table:
+//
+//	CREATE TABLE campaign_rollups (
+//	    campaign_id  VARCHAR(255) NOT NULL,
+//	    platform     VARCHAR(50)  NOT NULL,
+//	    granularity  VARCHAR(10)  NOT NULL,
+//	    bucket_start TIMESTAMP    NOT NULL,
+//	    impressions  BIGINT NOT NULL DEFAULT 0,
+//	    clicks       BIGINT NOT NULL DEFAULT 0,
+//	    conversions  BIGINT NOT NULL DEFAULT 0,
+//	    cost         DOUBLE PRECISION NOT NULL DEFAULT 0,
+//	    revenue      DOUBLE PRECISION NOT NULL DEFAULT 0,
+//	    revision     BIGINT NOT NULL DEFAULT 0,
+//	    updated_at   TIMESTAMP NOT NULL,
+//	    PRIMARY KEY (campaign_id, platform, granularity, bucket_start)
+//	);
+//
+// The latest fetch of every day total is kept in campaign_day_totals and each
+// fetch that changed one is recorded in campaign_restatements:
+//
+//	CREATE TABLE campaign_day_totals (
+//	    campaign_id VARCHAR(255) NOT NULL,
+//	    platform    VARCHAR(50)  NOT NULL,
+//	    report_date DATE         NOT NULL,
+//	    level       VARCHAR(20)  NOT NULL,
+//	    impressions BIGINT NOT NULL,
+//	    clicks      BIGINT NOT NULL,
+//	    conversions BIGINT NOT NULL,
+//	    cost        DOUBLE PRECISION NOT NULL,
+//	    revenue     DOUBLE PRECISION NOT NULL,
+//	    fetched_at  TIMESTAMP NOT NULL,
+//	    PRIMARY KEY (campaign_id, platform, report_date, level)
+//	);
+//
+//	CREATE TABLE campaign_restatements (
+//	    id                   BIGSERIAL PRIMARY KEY,
+//	    campaign_id          VARCHAR(255) NOT NULL,
+//	    platform             VARCHAR(50)  NOT NULL,
+//	    report_date          DATE         NOT NULL,
+//	    level                VARCHAR(20)  NOT NULL,
+//	    prev_impressions     BIGINT NOT NULL,
+//	    prev_clicks          BIGINT NOT NULL,
+//	    prev_conversions     BIGINT NOT NULL,
+//	    prev_cost            DOUBLE PRECISION NOT NULL,
+//	    prev_revenue         DOUBLE PRECISION NOT NULL,
+//	    impressions          BIGINT NOT NULL,
+//	    clicks               BIGINT NOT NULL,
+//	    conversions          BIGINT NOT NULL,
+//	    cost                 DOUBLE PRECISION NOT NULL,
+//	    revenue              DOUBLE PRECISION NOT NULL,
+//	    previous_fetched_at  TIMESTAMP NOT NULL,
+//	    fetched_at           TIMESTAMP NOT NULL
+//	);
+//	CREATE INDEX ON campaign_restatements (campaign_id, report_date);
+//
+// Applied message IDs are recorded in processed_messages (see ledger.SQL) in
+// the same transaction as the bucket upserts.
+type PostgresRepository struct {
+	db        *sql.DB
+	table     string
+	dayTotals string
+	history   string // empty to not record restatements
+	ledger    *ledger.SQL
+}
+
+func NewPostgresRepository(db *sql.DB) *PostgresRepository {
+	return &PostgresRepository{
+		db:        db,
+		table:     liveTable,
+		dayTotals: dayTotalsTable,
+		history:   historyTable,
+		ledger:    ledger.NewSQL(db, ledgerName),
+	}
+}
+
+// upsertBucket is formatted with the table name
+const upsertBucket = `
+INSERT INTO %[1]s
+    (campaign_id, platform, granularity, bucket_start, impressions, clicks, conversions, cost, revenue, revision, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, 1, $10)
+ON CONFLICT (campaign_id, platform, granularity, bucket_start) DO UPDATE SET
+    impressions = %[1]s.impressions + EXCLUDED.impressions,
+    clicks      = %[1]s.clicks + EXCLUDED.clicks,
+    conversions = %[1]s.conversions + EXCLUDED.conversions,
+    cost        = %[1]s.cost + EXCLUDED.cost,
+    revenue     = %[1]s.revenue + EXCLUDED.revenue,
+    revision    = %[1]s.revision + 1,
+    updated_at  = EXCLUDED.updated_at
+RETURNING impressions, clicks, conversions, cost, revenue, revision, updated_at`
+
+func (r *PostgresRepository) Apply(ctx context.Context, recs []Record) ([]Bucket, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+
+	fresh, err := r.ledger.MarkTx(ctx, tx, recordIDs(recs))
+	if err != nil {
+		return nil, err
+	}
+	recs = filterFresh(recs, fresh)
+	deltas := Deltas(recs)
+	if err := r.restateTx(ctx, tx, recs, deltas); err != nil {
+		return nil, err
+	}
+	out, err := applyTx(ctx, tx, r.table, deltas)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "commit transaction")
+	}
+	return out, nil
+}
+
+// applyTx upserts deltas into table inside an existing transaction
+func applyTx(ctx context.Context, tx *sql.Tx, table string, deltas map[Key]Metrics) ([]Bucket, error) {
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(upsertBucket, table))
+	if err != nil {
+		return nil, errors.Wrap(err, "prepare upsert")
+	}
+	defer stmt.Close()
+
+	now := time.Now().UTC()
+	out := make([]Bucket, 0, len(deltas))
+	for k, d := range deltas {
+		b := Bucket{Key: k}
+		err := stmt.QueryRowContext(ctx, k.CampaignID, k.Platform, string(k.Granularity), k.Start,
+			d.Impressions, d.Clicks, d.Conversions, d.Cost, d.Revenue, now,
+		).Scan(&b.Impressions, &b.Clicks, &b.Conversions, &b.Cost, &b.Revenue, &b.Revision, &b.UpdatedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "upsert bucket")
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+// restateTx replaces the stored day totals with the newer ones in recs, adding
+// the bucket moves to deltas and recording the restatements. Stored totals are
+// locked until the transaction ends.
+func (r *PostgresRepository) restateTx(ctx context.Context, tx *sql.Tx, recs []Record, deltas map[Key]Metrics) error {
+	totals, history, err := foldDayTotals(recs, deltas, func(k DayKey) (*DayTotal, error) {
+		t := DayTotal{DayKey: k}
+		err := tx.QueryRowContext(ctx, `
+SELECT impressions, clicks, conversions, cost, revenue, fetched_at FROM `+r.dayTotals+`
+WHERE campaign_id = $1 AND platform = $2 AND report_date = $3 AND level = $4
+FOR UPDATE`, k.CampaignID, k.Platform, k.Date, k.Level).
+			Scan(&t.Impressions, &t.Clicks, &t.Conversions, &t.Cost, &t.Revenue, &t.FetchedAt)
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read day total")
+		}
+		t.FetchedAt = t.FetchedAt.UTC()
+		return &t, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, t := range totals {
+		_, err := tx.ExecContext(ctx, `
+INSERT INTO `+r.dayTotals+` AS t
+    (campaign_id, platform, report_date, level, impressions, clicks, conversions, cost, revenue, fetched_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+ON CONFLICT (campaign_id, platform, report_date, level) DO UPDATE SET
+    impressions = EXCLUDED.impressions,
+    clicks      = EXCLUDED.clicks,
+    conversions = EXCLUDED.conversions,
+    cost        = EXCLUDED.cost,
+    revenue     = EXCLUDED.revenue,
+    fetched_at  = EXCLUDED.fetched_at
+WHERE EXCLUDED.fetched_at > t.fetched_at`, t.CampaignID, t.Platform, t.Date, t.Level,
+			t.Impressions, t.Clicks, t.Conversions, t.Cost, t.Revenue, t.FetchedAt)
+		if err != nil {
+			return errors.Wrap(err, "upsert day total")
+		}
+	}
+
+	if r.history == "" {
+		return nil
+	}
+	for _, rs := range history {
+		p, c := rs.Previous, rs.Current
+		_, err := tx.ExecContext(ctx, `
+INSERT INTO `+r.history+`
+    (campaign_id, platform, report_date, level,
+     prev_impressions, prev_clicks, prev_conversions, prev_cost, prev_revenue,
+     impressions, clicks, conversions, cost, revenue, previous_fetched_at, fetched_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`,
+			rs.CampaignID, rs.Platform, rs.Date, rs.Level,
+			p.Impressions, p.Clicks, p.Conversions, p.Cost, p.Revenue,
+			c.Impressions, c.Clicks, c.Conversions, c.Cost, c.Revenue, rs.PreviousFetchedAt, rs.FetchedAt)
+		if err != nil {
+			return errors.Wrap(err, "record restatement")
+		}
+	}
+	return nil
+}
+
+func (r *PostgresRepository) Iterate(campaignID, platform string, g Granularity, from, to time.Time, batchSize int) Iterator {
+	return &pgIterator{
+		db:    r.db,
+		table: r.table,
+		args:  []interface{}{campaignID, platform, string(g), from, to},
+		size:  batchSize,
+	}
+}
+
+func (r *PostgresRepository) Restatements(ctx context.Context, campaignID, platform string, from, to time.Time) ([]Restatement, error) {
+	if r.history == "" {
+		return nil, nil
+	}
+	rows, err := r.db.QueryContext(ctx, `
+SELECT campaign_id, platform, report_date, level,
+       prev_impressions, prev_clicks, prev_conversions, prev_cost, prev_revenue,
+       impressions, clicks, conversions, cost, revenue, previous_fetched_at, fetched_at
+FROM `+r.history+`
+WHERE campaign_id = $1 AND ($2 = '' OR platform = $2) AND report_date >= $3 AND report_date < $4
+ORDER BY fetched_at, id`, campaignID, platform, from, to)
+	if err != nil {
+		return nil, errors.Wrap(err, "query restatements")
+	}
+	defer rows.Close()
+
+	var out []Restatement
+	for rows.Next() {
+		var rs Restatement
+		p, c := &rs.Previous, &rs.Current
+		err := rows.Scan(&rs.CampaignID, &rs.Platform, &rs.Date, &rs.Level,
+			&p.Impressions, &p.Clicks, &p.Conversions, &p.Cost, &p.Revenue,
+			&c.Impressions, &c.Clicks, &c.Conversions, &c.Cost, &c.Revenue, &rs.PreviousFetchedAt, &rs.FetchedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan restatement")
+		}
+		rs.Date = rs.Date.UTC()
+		rs.Change = rs.Current.Sub(rs.Previous)
+		out = append(out, rs)
+	}
+	return out, errors.Wrap(rows.Err(), "iterate restatements")
+}
+
+// PruneLedger forgets applied message IDs older than cutoff
+func (r *PostgresRepository) PruneLedger(ctx context.Context, cutoff time.Time) (int64, error) {
+	return r.ledger.Prune(ctx, cutoff)
+}
@@ -0,0 +1,124 @@
+package rollup
+
+import (
+	"sort"
+	"time"
+
+	"campaign-analytics/schema"
+)
+
+// DayKey identifies a platform-reported day total
+type DayKey struct {
+	CampaignID string    `json:"campaign_id"`
+	Platform   string    `json:"platform"`
+	Date       time.Time `json:"date"`
+	Level      string    `json:"level"`
+}
+
+// bucket returns the daily bucket a day total is folded into. Only campaign
+// level totals are, finer levels break down the same numbers.
+func (k DayKey) bucket() (Key, bool) {
+	if k.Level != schema.LevelCampaign {
+		return Key{}, false
+	}
+	return Key{CampaignID: k.CampaignID, Platform: k.Platform, Granularity: Daily, Start: k.Date}, true
+}
+
+// DayTotal is the latest fetch of a day total. Platforms restate the last
+// days as conversions are attributed and invalid clicks removed, so a newer
+// fetch replaces the stored total and the daily bucket moves by the difference.
+// Day totals carry no hour and are not folded into hourly buckets.
+type DayTotal struct {
+	DayKey
+	Metrics
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// Restatement records a fetch that changed a stored day total
+type Restatement struct {
+	DayKey
+	Previous          Metrics   `json:"previous"`
+	Current           Metrics   `json:"current"`
+	Change            Metrics   `json:"change"`
+	PreviousFetchedAt time.Time `json:"previous_fetched_at"`
+	FetchedAt         time.Time `json:"fetched_at"`
+}
+
+func dayTotalOf(d schema.CampaignData) DayTotal {
+	date, _ := time.Parse(schema.DateLayout, d.ReportDate)
+	level := d.Level
+	if level == "" {
+		level = schema.LevelCampaign
+	}
+	return DayTotal{
+		DayKey:    DayKey{CampaignID: d.CampaignID, Platform: d.Platform, Date: date, Level: level},
+		Metrics:   MetricsOf(d),
+		FetchedAt: time.Unix(d.Timestamp, 0).UTC(),
+	}
+}
+
+// foldDayTotals replaces the stored day totals, read through load (nil when
+// none), with the newer ones in recs and adds the resulting bucket moves to
+// deltas. Fetches not newer than the stored total are ignored so that late
+// redelivery cannot roll a day back. It returns the totals to store and the
+// restatements to record.
+func foldDayTotals(recs []Record, deltas map[Key]Metrics, load func(DayKey) (*DayTotal, error)) ([]DayTotal, []Restatement, error) {
+	var totals []DayTotal
+	for _, r := range recs {
+		if r.Data.IsDayTotal() {
+			totals = append(totals, dayTotalOf(r.Data))
+		}
+	}
+	sort.SliceStable(totals, func(i, j int) bool { return totals[i].FetchedAt.Before(totals[j].FetchedAt) })
+
+	current := make(map[DayKey]*DayTotal)
+	dirty := make(map[DayKey]bool)
+	var (
+		changed []DayKey
+		history []Restatement
+	)
+	for i := range totals {
+		t := &totals[i]
+		prev, ok := current[t.DayKey]
+		if !ok {
+			var err error
+			if prev, err = load(t.DayKey); err != nil {
+				return nil, nil, err
+			}
+		}
+		current[t.DayKey] = prev
+		if prev != nil && !t.FetchedAt.After(prev.FetchedAt) {
+			continue
+		}
+		if !dirty[t.DayKey] {
+			dirty[t.DayKey] = true
+			changed = append(changed, t.DayKey)
+		}
+		current[t.DayKey] = t
+
+		var base Metrics
+		if prev != nil {
+			if prev.Metrics == t.Metrics {
+				continue
+			}
+			base = prev.Metrics
+			history = append(history, Restatement{
+				DayKey:            t.DayKey,
+				Previous:          prev.Metrics,
+				Current:           t.Metrics,
+				Change:            t.Metrics.Sub(prev.Metrics),
+				PreviousFetchedAt: prev.FetchedAt,
+				FetchedAt:         t.FetchedAt,
+			})
+		}
+		if k, ok := t.bucket(); ok {
+			deltas[k] = deltas[k].Add(t.Metrics.Sub(base))
+		}
+	}
+
+	out := make([]DayTotal, 0, len(changed))
+	for _, k := range changed {
+		out = append(out, *current[k])
+	}
+	return out, history, nil
+}
@@ -0,0 +1,130 @@
+// Package rollup folds campaign-data records into hourly and daily buckets per
+// campaign and platform so reads do not have to aggregate raw records.
+package rollup
+
+import (
+	"context"
+	"time"
+
+	"campaign-analytics/schema"
+)
+
+// Granularity is the width of a bucket
+type Granularity string
+
+const (
+	Hourly Granularity = "hour"
+	Daily  Granularity = "day"
+)
+
+// Granularities lists the buckets every record is folded into
+var Granularities = []Granularity{Hourly, Daily}
+
+// Truncate returns the start of the bucket holding t, in UTC
+func (g Granularity) Truncate(t time.Time) time.Time {
+	t = t.UTC()
+	if g == Daily {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+// Key identifies a bucket
+type Key struct {
+	CampaignID  string      `json:"campaign_id"`
+	Platform    string      `json:"platform"`
+	Granularity Granularity `json:"granularity"`
+	Start       time.Time   `json:"start"`
+}
+
+// Metrics are the additive counters kept per bucket. Cost and revenue are in
+// the reporting currency of the Aggregator that folded them.
+type Metrics struct {
+	Impressions int64   `json:"impressions"`
+	Clicks      int64   `json:"clicks"`
+	Conversions int64   `json:"conversions"`
+	Cost        float64 `json:"cost"`
+	Revenue     float64 `json:"revenue"`
+}
+
+// Add returns the sum of m and o
+func (m Metrics) Add(o Metrics) Metrics {
+	return Metrics{
+		Impressions: m.Impressions + o.Impressions,
+		Clicks:      m.Clicks + o.Clicks,
+		Conversions: m.Conversions + o.Conversions,
+		Cost:        m.Cost + o.Cost,
+		Revenue:     m.Revenue + o.Revenue,
+	}
+}
+
+// Sub returns m minus o
+func (m Metrics) Sub(o Metrics) Metrics {
+	return Metrics{
+		Impressions: m.Impressions - o.Impressions,
+		Clicks:      m.Clicks - o.Clicks,
+		Conversions: m.Conversions - o.Conversions,
+		Cost:        m.Cost - o.Cost,
+		Revenue:     m.Revenue - o.Revenue,
+	}
+}
+
+// MetricsOf returns the counters carried by a record
+func MetricsOf(d schema.CampaignData) Metrics {
+	return Metrics{
+		Impressions: int64(d.Impressions),
+		Clicks:      int64(d.Clicks),
+		Conversions: int64(d.Conversions),
+		Cost:        d.Cost,
+		Revenue:     d.Revenue,
+	}
+}
+
+// Bucket is a stored rollup. Revision increases every time late data changes
+// a bucket, so readers can tell a corrected bucket from the one first emitted.
+type Bucket struct {
+	Key
+	Metrics
+	Revision  int64     `json:"revision"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Record is a consumed record together with the message ID it was read under
+type Record struct {
+	ID   string // ledger ID, see ledger.MessageID; empty records are always applied
+	Data schema.CampaignData
+}
+
+// Deltas folds additive records into their hourly and daily buckets. Day
+// totals are skipped, they depend on the stored total they replace (see
+// foldDayTotals).
+func Deltas(recs []Record) map[Key]Metrics {
+	deltas := make(map[Key]Metrics)
+	for _, r := range recs {
+		if r.Data.IsDayTotal() {
+			continue
+		}
+		ts := time.Unix(r.Data.Timestamp, 0)
+		m := MetricsOf(r.Data)
+		for _, g := range Granularities {
+			k := Key{CampaignID: r.Data.CampaignID, Platform: r.Data.Platform, Granularity: g, Start: g.Truncate(ts)}
+			deltas[k] = deltas[k].Add(m)
+		}
+	}
+	return deltas
+}
+
+// Repository stores rollup buckets
+type Repository interface {
+	// Apply folds the records whose ID is not in the repository's ledger into
+	// their buckets and records their IDs, atomically, so a redelivered record
+	// is never counted twice. It returns the updated buckets.
+	Apply(ctx context.Context, recs []Record) ([]Bucket, error)
+	// Iterate pages, ordered by Start then platform, through the buckets of a
+	// campaign with Start in [from, to), batchSize at a time
+	// (DefaultBatchSize when 0). An empty platform matches every platform.
+	Iterate(campaignID, platform string, g Granularity, from, to time.Time, batchSize int) Iterator
+	// Restatements returns the recorded changes to the day totals of a
+	// campaign for days in [from, to), oldest fetch first
+	Restatements(ctx context.Context, campaignID, platform string, from, to time.Time) ([]Restatement, error)
+}
@@ -0,0 +1,265 @@
+package rollup
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"sort"
+	"time"
+
+	"campaign-analytics/ledger"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// Version statuses
+const (
+	VersionBuilding = "building"
+	VersionReady    = "ready"
+	VersionPromoted = "promoted"
+)
+
+var versionName = regexp.MustCompile(`^[a-z0-9_]{1,40}$`)
+
+// Version describes a recomputed copy of the rollups, written to its own
+// campaign_rollups_<name> table by a backfill and tracked in rollup_versions:
+//
+//	CREATE TABLE rollup_versions (
+//	    name         VARCHAR(40) PRIMARY KEY,
+//	    created_at   TIMESTAMP   NOT NULL,
+//	    source_since TIMESTAMP,
+//	    source_until TIMESTAMP,
+//	    campaign_ids TEXT[]      NOT NULL DEFAULT '{}',
+//	    status       VARCHAR(20) NOT NULL,
+//	    promoted_at  TIMESTAMP
+//	);
+type Version struct {
+	Name        string     `json:"name"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Since       *time.Time `json:"since,omitempty"`
+	Until       *time.Time `json:"until,omitempty"` // end of the input read by the last completed run
+	CampaignIDs []string   `json:"campaign_ids,omitempty"`
+	Status      string     `json:"status"`
+	PromotedAt  *time.Time `json:"promoted_at,omitempty"`
+}
+
+func versionTable(name string) string {
+	return liveTable + "_" + name
+}
+
+func versionDayTotals(name string) string {
+	return dayTotalsTable + "_" + name
+}
+
+// CreateVersion registers a version and creates its tables, shaped like the
+// live ones. Creating an existing version is a no-op so a backfill can resume.
+func CreateVersion(ctx context.Context, db *sql.DB, v Version) error {
+	if !versionName.MatchString(v.Name) {
+		return errors.Errorf("invalid version name %q, want [a-z0-9_]{1,40}", v.Name)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `
+INSERT INTO rollup_versions (name, created_at, source_since, campaign_ids, status)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (name) DO NOTHING`, v.Name, time.Now().UTC(), v.Since, pq.Array(v.CampaignIDs), VersionBuilding)
+	if err != nil {
+		return errors.Wrap(err, "register version")
+	}
+	_, err = tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+versionTable(v.Name)+" (LIKE "+liveTable+" INCLUDING ALL)")
+	if err != nil {
+		return errors.Wrap(err, "create version table")
+	}
+	_, err = tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+versionDayTotals(v.Name)+" (LIKE "+dayTotalsTable+" INCLUDING ALL)")
+	if err != nil {
+		return errors.Wrap(err, "create version day totals")
+	}
+	return errors.Wrap(tx.Commit(), "commit transaction")
+}
+
+// RaiseVersionSince moves the lower bound of a version's complete buckets up
+// to since, if it is below
+func RaiseVersionSince(ctx context.Context, db *sql.DB, name string, since time.Time) error {
+	_, err := db.ExecContext(ctx, `
+UPDATE rollup_versions SET source_since = $1
+WHERE name = $2 AND (source_since IS NULL OR source_since < $1)`, since.UTC(), name)
+	return errors.Wrap(err, "raise version since")
+}
+
+// GetVersion reads a registered version
+func GetVersion(ctx context.Context, db *sql.DB, name string) (*Version, error) {
+	v := &Version{Name: name}
+	err := db.QueryRowContext(ctx, `
+SELECT created_at, source_since, source_until, campaign_ids, status, promoted_at FROM rollup_versions WHERE name = $1`, name).
+		Scan(&v.CreatedAt, &v.Since, &v.Until, pq.Array(&v.CampaignIDs), &v.Status, &v.PromotedAt)
+	if err == sql.ErrNoRows {
+		return nil, errors.Errorf("unknown rollup version %q", name)
+	}
+	return v, errors.Wrap(err, "query version")
+}
+
+// CompleteVersion marks a backfill run as done, having read the input up to
+// what was published at until
+func CompleteVersion(ctx context.Context, db *sql.DB, name string, until time.Time) error {
+	_, err := db.ExecContext(ctx, `
+UPDATE rollup_versions SET status = $1, source_until = $2 WHERE name = $3 AND status <> $4`,
+		VersionReady, until.UTC(), name, VersionPromoted)
+	return errors.Wrap(err, "complete version")
+}
+
+// NewVersionRepository returns a repository writing to a version's tables,
+// with its own ledger so the backfill re-applies messages the live rollups
+// saw. Restatements are not recorded again, the live history already has them.
+func NewVersionRepository(db *sql.DB, name string) (*PostgresRepository, error) {
+	if !versionName.MatchString(name) {
+		return nil, errors.Errorf("invalid version name %q", name)
+	}
+	table := versionTable(name)
+	return &PostgresRepository{db: db, table: table, dayTotals: versionDayTotals(name), ledger: ledger.NewSQL(db, table)}, nil
+}
+
+// Diff compares live and version totals of one campaign and platform
+type Diff struct {
+	CampaignID string  `json:"campaign_id"`
+	Platform   string  `json:"platform"`
+	Live       Metrics `json:"live"`
+	Version    Metrics `json:"version"`
+}
+
+// DiffVersion compares, per campaign and platform, the daily totals of a
+// version with the live ones over the days the version covers
+func DiffVersion(ctx context.Context, db *sql.DB, name string) ([]Diff, error) {
+	if _, err := GetVersion(ctx, db, name); err != nil {
+		return nil, err
+	}
+	table := versionTable(name)
+	var from, to sql.NullTime
+	err := db.QueryRowContext(ctx, "SELECT MIN(bucket_start), MAX(bucket_start) FROM "+table+" WHERE granularity = $1", string(Daily)).
+		Scan(&from, &to)
+	if err != nil {
+		return nil, errors.Wrap(err, "version range")
+	}
+	if !from.Valid {
+		return nil, nil
+	}
+
+	diffs := make(map[[2]string]*Diff)
+	for _, src := range []string{liveTable, table} {
+		rows, err := db.QueryContext(ctx, `
+SELECT campaign_id, platform, SUM(impressions), SUM(clicks), SUM(conversions), SUM(cost), SUM(revenue)
+FROM `+src+`
+WHERE granularity = $1 AND bucket_start >= $2 AND bucket_start <= $3
+  AND campaign_id IN (SELECT DISTINCT campaign_id FROM `+table+`)
+GROUP BY campaign_id, platform`, string(Daily), from.Time, to.Time)
+		if err != nil {
+			return nil, errors.Wrap(err, "query totals")
+		}
+		for rows.Next() {
+			var k [2]string
+			var m Metrics
+			if err := rows.Scan(&k[0], &k[1], &m.Impressions, &m.Clicks, &m.Conversions, &m.Cost, &m.Revenue); err != nil {
+				rows.Close()
+				return nil, errors.Wrap(err, "scan totals")
+			}
+			d := diffs[k]
+			if d == nil {
+				d = &Diff{CampaignID: k[0], Platform: k[1]}
+				diffs[k] = d
+			}
+			if src == liveTable {
+				d.Live = m
+			} else {
+				d.Version = m
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, errors.Wrap(err, "iterate totals")
+		}
+	}
+
+	out := make([]Diff, 0, len(diffs))
+	for _, d := range diffs {
+		out = append(out, *d)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].CampaignID != out[j].CampaignID {
+			return out[i].CampaignID < out[j].CampaignID
+		}
+		return out[i].Platform < out[j].Platform
+	})
+	return out, nil
+}
+
+// PromoteVersion replaces the live buckets with those of a ready version, in
+// one transaction. Only buckets that ended before the version's Until are
+// replaced, later ones still receiving live data, and that start at or after
+// its Since, earlier ones missing the records published before the backfill
+// start; live buckets the version has no row for are left alone. Day totals of the replaced days are copied
+// too, so later restatements move the buckets from the promoted numbers. The
+// revision of every replaced bucket is bumped so consumers see the change.
+// Records published between Until and the promotion are lost for the replaced
+// buckets, so re-run the backfill, which resumes where it stopped, right
+// before promoting.
+func PromoteVersion(ctx context.Context, db *sql.DB, name string) (int64, error) {
+	v, err := GetVersion(ctx, db, name)
+	if err != nil {
+		return 0, err
+	}
+	if v.Status != VersionReady || v.Until == nil {
+		return 0, errors.Errorf("version %q is %s, only ready versions can be promoted", name, v.Status)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+INSERT INTO `+liveTable+` AS l
+    (campaign_id, platform, granularity, bucket_start, impressions, clicks, conversions, cost, revenue, revision, updated_at)
+SELECT campaign_id, platform, granularity, bucket_start, impressions, clicks, conversions, cost, revenue, 1, $1
+FROM `+versionTable(name)+`
+WHERE ((granularity = $2 AND bucket_start + INTERVAL '1 hour' <= $4)
+    OR (granularity = $3 AND bucket_start + INTERVAL '1 day' <= $4))
+  AND ($5::TIMESTAMP IS NULL OR bucket_start >= $5)
+ON CONFLICT (campaign_id, platform, granularity, bucket_start) DO UPDATE SET
+    impressions = EXCLUDED.impressions,
+    clicks      = EXCLUDED.clicks,
+    conversions = EXCLUDED.conversions,
+    cost        = EXCLUDED.cost,
+    revenue     = EXCLUDED.revenue,
+    revision    = l.revision + 1,
+    updated_at  = EXCLUDED.updated_at`, time.Now().UTC(), string(Hourly), string(Daily), *v.Until, v.Since)
+	if err != nil {
+		return 0, errors.Wrap(err, "replace live buckets")
+	}
+	n, _ := res.RowsAffected()
+	_, err = tx.ExecContext(ctx, `
+INSERT INTO `+dayTotalsTable+`
+    (campaign_id, platform, report_date, level, impressions, clicks, conversions, cost, revenue, fetched_at)
+SELECT campaign_id, platform, report_date, level, impressions, clicks, conversions, cost, revenue, fetched_at
+FROM `+versionDayTotals(name)+`
+WHERE report_date + INTERVAL '1 day' <= $1
+  AND ($2::TIMESTAMP IS NULL OR report_date >= $2)
+ON CONFLICT (campaign_id, platform, report_date, level) DO UPDATE SET
+    impressions = EXCLUDED.impressions,
+    clicks      = EXCLUDED.clicks,
+    conversions = EXCLUDED.conversions,
+    cost        = EXCLUDED.cost,
+    revenue     = EXCLUDED.revenue,
+    fetched_at  = EXCLUDED.fetched_at`, *v.Until, v.Since)
+	if err != nil {
+		return 0, errors.Wrap(err, "replace live day totals")
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE rollup_versions SET status = $1, promoted_at = $2 WHERE name = $3",
+		VersionPromoted, time.Now().UTC(), name)
+	if err != nil {
+		return 0, errors.Wrap(err, "mark promoted")
+	}
+	return n, errors.Wrap(tx.Commit(), "commit transaction")
+}
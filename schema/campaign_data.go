@@ -0,0 +1,63 @@
+// Package schema holds the versioned wire format of campaign data and the
+// validation rules shared by the ingest server and the Kafka consumers.
+package schema
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// CurrentVersion is the schema version assumed when a record does not carry one
+const CurrentVersion = 1
+
+// CampaignData represents the structure of the incoming campaign data
+type CampaignData struct {
+	SchemaVersion int     `json:"schema_version,omitempty"`
+	CampaignID    string  `json:"campaign_id"`
+	Platform      string  `json:"platform"`
+	Timestamp     int64   `json:"timestamp"`
+	Impressions   int     `json:"impressions"`
+	Clicks        int     `json:"clicks"`
+	Conversions   int     `json:"conversions"`
+	Cost          float64 `json:"cost"`
+	Revenue       float64 `json:"revenue"`
+	Currency      string  `json:"currency,omitempty"` // ISO 4217 code of Cost and Revenue, account currency when empty
+	EventID       string  `json:"event_id,omitempty"` // optional client-supplied ID used for deduplication
+
+	// ReportDate (YYYY-MM-DD, UTC) marks a platform-reported day total fetched
+	// at Timestamp. A later fetch of the same day and Level replaces it instead
+	// of adding to it.
+	ReportDate string `json:"report_date,omitempty"`
+	Level      string `json:"level,omitempty"` // reporting level of a day total, LevelCampaign when empty
+}
+
+// DateLayout is the layout of ReportDate
+const DateLayout = "2006-01-02"
+
+// Reporting levels of a day total
+const (
+	LevelCampaign = "campaign"
+	LevelAdSet    = "adset"
+	LevelAd       = "ad"
+)
+
+// Levels lists the accepted reporting levels
+var Levels = map[string]bool{LevelCampaign: true, LevelAdSet: true, LevelAd: true}
+
+// IsDayTotal reports whether d restates a whole day rather than adding to it
+func (d CampaignData) IsDayTotal() bool {
+	return d.ReportDate != ""
+}
+
+// Decode unmarshals a campaign-data message and re-validates it against its schema version
+func Decode(b []byte) (CampaignData, error) {
+	var data CampaignData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return CampaignData{}, errors.Wrap(err, "JSON unmarshal")
+	}
+	if err := Validate(&data); err != nil {
+		return CampaignData{}, err
+	}
+	return data, nil
+}
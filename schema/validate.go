@@ -0,0 +1,131 @@
+package schema
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxClockSkew is how far in the future a timestamp may be before it is rejected
+const maxClockSkew = 5 * time.Minute
+
+// Platforms lists the ad platforms and offline channels accepted on ingest
+var Platforms = map[string]bool{
+	"meta":     true,
+	"google":   true,
+	"linkedin": true,
+	"tiktok":   true,
+
+	// Channels without an API, uploaded as CSV
+	"offline":    true,
+	"print":      true,
+	"influencer": true,
+}
+
+// FieldError names an offending field and why it was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned by Validate and lists every offending field
+type ValidationError struct {
+	SchemaVersion int          `json:"schema_version"`
+	Fields        []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + " " + f.Message
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+// Rule is a single declarative check on a field. Rules for the same field are
+// evaluated in order and only the first failure is reported.
+type Rule struct {
+	Field   string
+	Message string
+	Valid   func(d *CampaignData, now time.Time) bool
+}
+
+// rules holds the rule set of every supported schema version
+var rules = map[int][]Rule{
+	1: {
+		{"campaign_id", "is required", func(d *CampaignData, _ time.Time) bool { return d.CampaignID != "" }},
+		{"platform", "is required", func(d *CampaignData, _ time.Time) bool { return d.Platform != "" }},
+		{"platform", "is not a supported platform", func(d *CampaignData, _ time.Time) bool { return Platforms[d.Platform] }},
+		{"timestamp", "is required", func(d *CampaignData, _ time.Time) bool { return d.Timestamp != 0 }},
+		{"timestamp", "must not be negative", func(d *CampaignData, _ time.Time) bool { return d.Timestamp > 0 }},
+		{"timestamp", "must not be in the future", func(d *CampaignData, now time.Time) bool {
+			return time.Unix(d.Timestamp, 0).Before(now.Add(maxClockSkew))
+		}},
+		{"impressions", "must not be negative", func(d *CampaignData, _ time.Time) bool { return d.Impressions >= 0 }},
+		{"clicks", "must not be negative", func(d *CampaignData, _ time.Time) bool { return d.Clicks >= 0 }},
+		{"clicks", "must not exceed impressions", func(d *CampaignData, _ time.Time) bool { return d.Clicks <= d.Impressions }},
+		{"conversions", "must not be negative", func(d *CampaignData, _ time.Time) bool { return d.Conversions >= 0 }},
+		{"cost", "must not be negative", func(d *CampaignData, _ time.Time) bool { return d.Cost >= 0 }},
+		{"revenue", "must not be negative", func(d *CampaignData, _ time.Time) bool { return d.Revenue >= 0 }},
+		{"currency", "must be a 3-letter ISO 4217 code", func(d *CampaignData, _ time.Time) bool {
+			return d.Currency == "" || isCurrencyCode(d.Currency)
+		}},
+		{"report_date", "must be a YYYY-MM-DD date", func(d *CampaignData, _ time.Time) bool {
+			_, err := time.Parse(DateLayout, d.ReportDate)
+			return d.ReportDate == "" || err == nil
+		}},
+		{"report_date", "must not be after the fetch timestamp", func(d *CampaignData, _ time.Time) bool {
+			day, _ := time.Parse(DateLayout, d.ReportDate)
+			return d.ReportDate == "" || day.Before(time.Unix(d.Timestamp, 0).Add(maxClockSkew))
+		}},
+		{"level", "is not a supported reporting level", func(d *CampaignData, _ time.Time) bool { return d.Level == "" || Levels[d.Level] }},
+		{"level", "requires report_date", func(d *CampaignData, _ time.Time) bool { return d.Level == "" || d.ReportDate != "" }},
+	},
+}
+
+// Validate checks d against the rules of its schema version, defaulting a
+// missing version to CurrentVersion. It returns a *ValidationError on failure.
+func Validate(d *CampaignData) error {
+	return validateAt(d, time.Now())
+}
+
+func validateAt(d *CampaignData, now time.Time) error {
+	if d.SchemaVersion == 0 {
+		d.SchemaVersion = CurrentVersion
+	}
+	set, ok := rules[d.SchemaVersion]
+	if !ok {
+		return &ValidationError{
+			SchemaVersion: d.SchemaVersion,
+			Fields:        []FieldError{{Field: "schema_version", Message: fmt.Sprintf("unsupported version %d", d.SchemaVersion)}},
+		}
+	}
+
+	var fields []FieldError
+	failed := make(map[string]bool)
+	for _, r := range set {
+		if failed[r.Field] {
+			continue
+		}
+		if !r.Valid(d, now) {
+			failed[r.Field] = true
+			fields = append(fields, FieldError{Field: r.Field, Message: r.Message})
+		}
+	}
+	if len(fields) > 0 {
+		return &ValidationError{SchemaVersion: d.SchemaVersion, Fields: fields}
+	}
+	return nil
+}
+
+func isCurrencyCode(c string) bool {
+	if len(c) != 3 {
+		return false
+	}
+	for _, r := range c {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
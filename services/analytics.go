@@ -1,26 +1,80 @@
 package services
 
 import (
-	"campaign-analytics/factory"
+	"campaign-analytics/fx"
+	"campaign-analytics/models"
 	"campaign-analytics/utils"
+	"context"
 	"errors"
+	"time"
 )
 
-func FetchInsights(campaignID, platform, startDate, endDate string) (map[string]float64, error) {
-	dataFetcher, err := factory.GetCampaignDataFetcher(platform)
+// Campaigns is the backend campaign metrics are read from, set at startup
+var Campaigns models.CampaignRepository = models.NewMemoryCampaignRepository()
+
+// ErrNoImpressions is returned for a campaign without impressions in the range
+var ErrNoImpressions = errors.New("no impressions data available")
+
+// Rates and ReportingCurrency convert the metrics of campaigns spending in
+// several currencies, set at startup
+var (
+	Rates             *fx.Store
+	ReportingCurrency string
+)
+
+// FetchInsights computes the metrics of a campaign. Spend and CPA are in the
+// campaign's currency, or in ReportingCurrency when it spent in several.
+func FetchInsights(ctx context.Context, campaignID, platform, startDate, endDate string) (map[string]float64, string, error) {
+	totals, err := fetchCampaignData(ctx, campaignID, platform, startDate, endDate)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
+	if len(totals) == 1 {
+		return utils.ComputeMetrics(totals[0]), totals[0].Currency, nil
+	}
+	if ReportingCurrency == "" {
+		return nil, "", errors.New("campaign spent in several currencies and no reporting currency is set")
+	}
+	metrics, err := FetchInsightsIn(ctx, campaignID, platform, startDate, endDate, ReportingCurrency, Rates)
+	return metrics, ReportingCurrency, err
+}
 
-	data, err := dataFetcher.FetchData(campaignID, startDate, endDate)
+// FetchInsightsIn is FetchInsights with Spend and CPA in the given reporting
+// currency, each currency converted at the rates of endDate
+func FetchInsightsIn(ctx context.Context, campaignID, platform, startDate, endDate, currency string, rates *fx.Store) (map[string]float64, error) {
+	date, err := time.Parse("2006-01-02", endDate)
 	if err != nil {
 		return nil, err
 	}
+	totals, err := fetchCampaignData(ctx, campaignID, platform, startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+	sum := models.CampaignData{Currency: currency}
+	for _, data := range totals {
+		if data, err = utils.ConvertCampaignData(data, rates, currency, date); err != nil {
+			return nil, err
+		}
+		if sum, err = sum.Add(data); err != nil {
+			return nil, err
+		}
+	}
+	return utils.ComputeMetrics(sum), nil
+}
 
-	if data.Impressions == 0 {
-		return nil, errors.New("no impressions data available")
+// fetchCampaignData returns the totals of a campaign per currency
+func fetchCampaignData(ctx context.Context, campaignID, platform, startDate, endDate string) ([]models.CampaignData, error) {
+	totals, err := Campaigns.GetCampaignData(ctx, campaignID, platform, startDate, endDate)
+	if err != nil {
+		return nil, err
 	}
 
-	metrics := utils.ComputeMetrics(data)
-	return metrics, nil
+	impressions := 0
+	for _, data := range totals {
+		impressions += data.Impressions
+	}
+	if impressions == 0 {
+		return nil, ErrNoImpressions
+	}
+	return totals, nil
 }
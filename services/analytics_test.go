@@ -0,0 +1,58 @@
+package services
+
+import (
+	"campaign-analytics/fx"
+	"campaign-analytics/models"
+	"context"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestFetchInsightsConvertsCurrencies(t *testing.T) {
+	repo := models.NewMemoryCampaignRepository()
+	repo.Add(
+		models.CampaignRow{CampaignID: "c1", Platform: "meta", Date: "2024-03-01",
+			CampaignData: models.CampaignData{Impressions: 1000, Clicks: 50, Conversions: 2, Cost: 100, Revenue: 300, Currency: "USD"}},
+		models.CampaignRow{CampaignID: "c1", Platform: "google", Date: "2024-03-02",
+			CampaignData: models.CampaignData{Impressions: 1000, Clicks: 50, Conversions: 2, Cost: 100, Revenue: 100, Currency: "EUR"}},
+		// Out of range
+		models.CampaignRow{CampaignID: "c1", Platform: "meta", Date: "2024-04-01",
+			CampaignData: models.CampaignData{Impressions: 1000, Cost: 1000, Currency: "USD"}},
+	)
+	rates := fx.NewStore()
+	if err := rates.Add(fx.Rate{Date: "2024-03-31", Base: "EUR", Quote: "USD", Rate: 1.1}); err != nil {
+		t.Fatal(err)
+	}
+	Campaigns, Rates, ReportingCurrency = repo, rates, "USD"
+	defer func() { Campaigns, Rates, ReportingCurrency = models.NewMemoryCampaignRepository(), nil, "" }()
+
+	metrics, currency, err := FetchInsights(context.Background(), "c1", "", "2024-03-01", "2024-03-31")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if currency != "USD" {
+		t.Fatalf("currency %s, want USD", currency)
+	}
+	for name, want := range map[string]float64{"Spend": 210, "CTR": 0.05, "CPA": 52.5, "ROAS": 410.0 / 210} {
+		if got := metrics[name]; math.Abs(got-want) > 1e-9 {
+			t.Errorf("%s = %v, want %v", name, got, want)
+		}
+	}
+
+	// A single currency is reported as is
+	metrics, currency, err = FetchInsights(context.Background(), "c1", "google", "2024-03-01", "2024-03-31")
+	if err != nil || currency != "EUR" || metrics["Spend"] != 100 {
+		t.Fatalf("got %v %s %v, want Spend 100 EUR", metrics, currency, err)
+	}
+
+	// Without a rate the request fails rather than summing currencies
+	Rates = fx.NewStore()
+	if _, _, err := FetchInsights(context.Background(), "c1", "", "2024-03-01", "2024-03-31"); err == nil {
+		t.Fatal("summed currencies without a rate")
+	}
+
+	if _, _, err := FetchInsights(context.Background(), "c2", "", "2024-03-01", "2024-03-31"); !errors.Is(err, ErrNoImpressions) {
+		t.Fatalf("got %v, want %v", err, ErrNoImpressions)
+	}
+}
@@ -0,0 +1,38 @@
+package services
+
+import (
+	"campaign-analytics/attribution"
+	"campaign-analytics/events"
+	"context"
+	"io"
+	"time"
+)
+
+// FetchAttribution attributes the conversions in [from, to) with cfg. With a
+// campaignID only that campaign's credits are kept; the conversion totals
+// still cover every campaign so shares can be compared against them.
+func FetchAttribution(ctx context.Context, store events.Store, campaignID int64, from, to time.Time, cfg attribution.Config) (*attribution.Report, error) {
+	journeys := events.ByUser(store.IterateJourneys(from, to, cfg.Lookback, 0))
+	a := attribution.NewAttributor(from, to, cfg)
+	for {
+		journey, err := journeys.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		a.Add(journey)
+	}
+	rep := a.Report()
+	if campaignID != 0 {
+		credits := rep.Credits[:0]
+		for _, c := range rep.Credits {
+			if c.CampaignID == campaignID {
+				credits = append(credits, c)
+			}
+		}
+		rep.Credits = credits
+	}
+	return &rep, nil
+}
@@ -0,0 +1,41 @@
+package services
+
+import (
+	"campaign-analytics/events"
+	"campaign-analytics/funnel"
+	"context"
+	"io"
+	"time"
+)
+
+// FetchFunnel builds the funnel of a campaign for users entering in [from, to).
+// Events are read up to the conversion window past to so late steps count,
+// and streamed one user at a time.
+func FetchFunnel(ctx context.Context, store events.Store, campaignID int64, from, to time.Time, cfg funnel.Config) (*funnel.Report, error) {
+	users := events.ByUser(store.IterateCampaignEvents(campaignID, from, to.Add(cfg.ClickWindow+cfg.ConversionWindow), 0))
+	b := funnel.NewBuilder(cfg)
+	for {
+		evs, err := users.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Users whose first impression falls after to are not part of this funnel
+		if enteredBefore(evs, to) {
+			b.Add(evs)
+		}
+	}
+	rep := b.Report(campaignID, from, to)
+	return &rep, nil
+}
+
+func enteredBefore(evs []events.Event, to time.Time) bool {
+	for _, ev := range evs {
+		if ev.EventType == events.Impression && ev.Time().Before(to) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package services
+
+import (
+	"campaign-analytics/events"
+	"campaign-analytics/funnel"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFetchFunnel(t *testing.T) {
+	from := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 1)
+	store := events.NewMemoryStore()
+	add := func(user, eventType string, at time.Time) {
+		store.Add(events.Event{CampaignID: 1, ChannelID: 1, EventType: eventType, EventTimestamp: at.Unix(), UserID: user})
+	}
+	// Enters on the last hour and converts the next day
+	add("u1", events.Impression, to.Add(-time.Hour))
+	add("u1", events.Click, to.Add(time.Hour))
+	add("u1", events.Conversion, to.Add(2*time.Hour))
+	add("u2", events.Impression, from)
+	// Enters after the range
+	add("u3", events.Impression, to.Add(time.Hour))
+	add("u3", events.Click, to.Add(2*time.Hour))
+	// Anonymous events of different people, which would otherwise make up a
+	// user going through every step
+	add("", events.Impression, from)
+	add("", events.Click, from.Add(time.Minute))
+	add("", events.Conversion, from.Add(2*time.Minute))
+	// Another campaign
+	store.Add(events.Event{CampaignID: 2, ChannelID: 1, EventType: events.Impression, EventTimestamp: from.Unix(), UserID: "u4"})
+
+	rep, err := FetchFunnel(context.Background(), store, 1, from, to, funnel.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for _, s := range rep.Steps {
+		got = append(got, s.Users)
+	}
+	if len(got) != 3 || got[0] != 2 || got[1] != 1 || got[2] != 1 {
+		t.Fatalf("users per step %v, want [2 1 1]", got)
+	}
+}
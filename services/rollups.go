@@ -0,0 +1,104 @@
+package services
+
+import (
+	"campaign-analytics/events"
+	"campaign-analytics/models"
+	"campaign-analytics/reach"
+	"campaign-analytics/rollup"
+	"campaign-analytics/schema"
+	"campaign-analytics/utils"
+	"context"
+	"io"
+	"time"
+)
+
+// RollupInsights is the pre-aggregated view of a campaign over a time range.
+// Its buckets are streamed rather than held, see FetchRollupInsights.
+type RollupInsights struct {
+	Totals  rollup.Metrics     `json:"totals"`
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+}
+
+// FetchRollupInsights pages through the rollup buckets in [from, to), passing
+// each to emit, and computes metrics on their totals. Rollups are keyed by the
+// platform campaign ID while reach sketches are keyed by the campaigns table
+// ID, so reach and Frequency are only served by FetchReach.
+func FetchRollupInsights(ctx context.Context, repo rollup.Repository, campaignID, platform string, g rollup.Granularity, from, to time.Time, emit func(rollup.Bucket) error) (*RollupInsights, error) {
+	res := &RollupInsights{}
+	it := repo.Iterate(campaignID, platform, g, from, to, 0)
+	for {
+		page, err := it.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range page {
+			res.Totals = res.Totals.Add(b.Metrics)
+			if err := emit(b); err != nil {
+				return nil, err
+			}
+		}
+	}
+	res.Metrics = utils.ComputeMetrics(models.CampaignData{
+		Impressions: int(res.Totals.Impressions),
+		Clicks:      int(res.Totals.Clicks),
+		Conversions: int(res.Totals.Conversions),
+		Cost:        res.Totals.Cost,
+		Revenue:     res.Totals.Revenue,
+	})
+	return res, nil
+}
+
+// RestatementHistory lists how platforms changed the reported day totals of a
+// campaign after the fact
+type RestatementHistory struct {
+	NetChange    rollup.Metrics       `json:"net_change"`
+	Restatements []rollup.Restatement `json:"restatements"`
+}
+
+// FetchRestatements reads the restatements of days in [from, to). NetChange
+// only sums campaign level totals, which are the ones folded into rollups.
+func FetchRestatements(ctx context.Context, repo rollup.Repository, campaignID, platform string, from, to time.Time) (*RestatementHistory, error) {
+	rs, err := repo.Restatements(ctx, campaignID, platform, from, to)
+	if err != nil {
+		return nil, err
+	}
+	res := &RestatementHistory{Restatements: rs}
+	for _, r := range rs {
+		if r.Level == schema.LevelCampaign {
+			res.NetChange = res.NetChange.Add(r.Change)
+		}
+	}
+	return res, nil
+}
+
+// ReachInsights is the reach of a group of campaigns and the impressions
+// behind it
+type ReachInsights struct {
+	Reach       uint64             `json:"reach"`
+	Impressions int64              `json:"impressions"`
+	Metrics     map[string]float64 `json:"metrics,omitempty"`
+}
+
+// FetchReach estimates the unique users of the sketches matching q and
+// computes Frequency on the impressions of evs under the same keys
+func FetchReach(ctx context.Context, store reach.Store, evs events.Store, q reach.Query) (*ReachInsights, error) {
+	sk, err := store.Reach(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	res := &ReachInsights{Reach: sk.Estimate()}
+	res.Impressions, err = evs.CountImpressions(ctx, q.CampaignIDs, q.ChannelID, q.From, q.To)
+	if err != nil {
+		return nil, err
+	}
+	res.Metrics = utils.ComputeMetrics(models.CampaignData{
+		Impressions: int(res.Impressions),
+		Reach:       int(res.Reach),
+	})
+	// There is no spend behind reach
+	delete(res.Metrics, "Spend")
+	return res, nil
+}
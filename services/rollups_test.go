@@ -0,0 +1,70 @@
+package services
+
+import (
+	"campaign-analytics/events"
+	"campaign-analytics/reach"
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFetchReachFrequency(t *testing.T) {
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	evs := events.NewMemoryStore()
+	sketches := map[reach.Key]*reach.Sketch{}
+	// 100 users see campaign 1 on channel 1 three times, 50 of them campaign 2 once
+	for u := 0; u < 100; u++ {
+		for i := 0; i < 3; i++ {
+			evs.Add(events.Event{CampaignID: 1, ChannelID: 1, EventType: events.Impression, EventTimestamp: day.Add(time.Duration(i) * time.Hour).Unix(), UserID: fmt.Sprint("u", u)})
+		}
+		if u < 50 {
+			evs.Add(events.Event{CampaignID: 2, ChannelID: 2, EventType: events.Impression, EventTimestamp: day.Unix(), UserID: fmt.Sprint("u", u)})
+		}
+	}
+	// Clicks and other days are not impressions of the range
+	evs.Add(events.Event{CampaignID: 1, ChannelID: 1, EventType: events.Click, EventTimestamp: day.Unix(), UserID: "u0"})
+	evs.Add(events.Event{CampaignID: 1, ChannelID: 1, EventType: events.Impression, EventTimestamp: day.AddDate(0, 0, 1).Unix(), UserID: "u0"})
+	for _, k := range []reach.Key{{CampaignID: 1, ChannelID: 1, Day: day}, {CampaignID: 2, ChannelID: 2, Day: day}} {
+		sk := reach.NewSketch(reach.DefaultPrecision)
+		n := 100
+		if k.CampaignID == 2 {
+			n = 50
+		}
+		for u := 0; u < n; u++ {
+			sk.Add(fmt.Sprint("u", u))
+		}
+		sketches[k] = sk
+	}
+	store := reach.NewMemoryStore()
+	if err := store.Merge(context.Background(), sketches); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		q           reach.Query
+		impressions int64
+		frequency   float64
+	}{
+		{reach.Query{CampaignIDs: []int64{1}}, 300, 3},
+		{reach.Query{CampaignIDs: []int64{1, 2}}, 350, 3.5},
+		{reach.Query{CampaignIDs: []int64{1, 2}, ChannelID: 2}, 50, 1},
+	} {
+		tc.q.From, tc.q.To = day, day.AddDate(0, 0, 1)
+		res, err := FetchReach(context.Background(), store, evs, tc.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Impressions != tc.impressions {
+			t.Errorf("%+v: impressions %d, want %d", tc.q, res.Impressions, tc.impressions)
+		}
+		// Reach is exact at this cardinality
+		if f := res.Metrics["Frequency"]; math.Abs(f-tc.frequency) > 1e-9 {
+			t.Errorf("%+v: frequency %v (reach %d), want %v", tc.q, f, res.Reach, tc.frequency)
+		}
+		if _, ok := res.Metrics["Spend"]; ok {
+			t.Errorf("%+v: reach metrics have a Spend", tc.q)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package sink
+
+import (
+	"context"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// ChannelSink is an in-memory sink that delivers messages on a channel.
+// It is meant for tests and local development.
+type ChannelSink struct {
+	mu     sync.RWMutex
+	ch     chan kafka.Message
+	closed bool
+	// done is closed first by Close, so writers blocked on a full channel
+	// release mu before ch is closed
+	done      chan struct{}
+	closeDone sync.Once
+}
+
+func NewChannelSink(buffer int) *ChannelSink {
+	return &ChannelSink{ch: make(chan kafka.Message, buffer), done: make(chan struct{})}
+}
+
+// C returns the channel messages are delivered on. It is closed by Close.
+func (s *ChannelSink) C() <-chan kafka.Message {
+	return s.ch
+}
+
+func (s *ChannelSink) Write(ctx context.Context, msgs ...kafka.Message) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	for _, msg := range msgs {
+		select {
+		case s.ch <- msg:
+		case <-s.done:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *ChannelSink) Close() error {
+	s.closeDone.Do(func() { close(s.done) })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+	return nil
+}
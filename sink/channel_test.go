@@ -0,0 +1,37 @@
+package sink
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Close does not wait on a writer blocked on a full channel, which fails
+func TestChannelSinkCloseBlockedWrite(t *testing.T) {
+	s := NewChannelSink(1)
+	written := make(chan error)
+	go func() {
+		written <- s.Write(context.Background(), kafka.Message{Value: []byte("a")}, kafka.Message{Value: []byte("b")})
+	}()
+	// a fills the channel, b blocks
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan error)
+	go func() { closed <- s.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked by a pending write")
+	}
+	if err := <-written; err != ErrClosed {
+		t.Fatalf("got %v, want ErrClosed", err)
+	}
+	if err := s.Write(context.Background(), kafka.Message{}); err != ErrClosed {
+		t.Fatalf("write after close: got %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,100 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+// FileRecord is the line format written by FileSink
+type FileRecord struct {
+	Time    time.Time         `json:"time"`
+	Key     string            `json:"key,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Value   []byte            `json:"value"`
+}
+
+// FileSink appends messages as JSON lines to a local file
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open sink file")
+	}
+	return &FileSink{file: f}, nil
+}
+
+func (s *FileSink) Write(ctx context.Context, msgs ...kafka.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Encode the whole batch first so a failure does not leave a partial batch behind
+	buf := make([]byte, 0, 512*len(msgs))
+	now := time.Now().UTC()
+	for _, msg := range msgs {
+		rec := FileRecord{Time: now, Key: string(msg.Key), Value: msg.Value}
+		if len(msg.Headers) > 0 {
+			rec.Headers = make(map[string]string, len(msg.Headers))
+			for _, h := range msg.Headers {
+				rec.Headers[h.Key] = string(h.Value)
+			}
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return errors.Wrap(err, "encode record")
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return ErrClosed
+	}
+	if _, err := s.file.Write(buf); err != nil {
+		return errors.Wrap(err, "write sink file")
+	}
+	return nil
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// ReadFile returns every record written to a FileSink file
+func ReadFile(path string) ([]FileRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open sink file")
+	}
+	defer f.Close()
+
+	var recs []FileRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var rec FileRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, errors.Wrap(err, "decode record")
+		}
+		recs = append(recs, rec)
+	}
+	return recs, errors.Wrap(scanner.Err(), "scan sink file")
+}
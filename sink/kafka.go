@@ -0,0 +1,30 @@
+package sink
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaSink writes messages to a Kafka topic
+type KafkaSink struct {
+	writer *kafka.Writer
+}
+
+func NewKafkaSink(brokers []string, topic string) *KafkaSink {
+	return &KafkaSink{
+		writer: &kafka.Writer{
+			Addr:     kafka.TCP(brokers...),
+			Topic:    topic,
+			Balancer: &kafka.LeastBytes{},
+		},
+	}
+}
+
+func (s *KafkaSink) Write(ctx context.Context, msgs ...kafka.Message) error {
+	return s.writer.WriteMessages(ctx, msgs...)
+}
+
+func (s *KafkaSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,21 @@
+// Package sink abstracts where ingested campaign data is written to so the
+// ingest path can run against Kafka, memory or a local file.
+package sink
+
+import (
+	"context"
+	"errors"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// ErrClosed is returned when writing to a sink that has been closed
+var ErrClosed = errors.New("sink closed")
+
+// EventSink is the destination for ingested messages
+type EventSink interface {
+	// Write delivers msgs. A kafka.WriteErrors error holds the outcome of each
+	// message; any other error means none of them is to be taken as delivered.
+	Write(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
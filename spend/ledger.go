@@ -0,0 +1,169 @@
+// Package spend keeps campaign spend as an append-only ledger of entries.
+// The current spend of a campaign is the sum of its entries, read from the
+// latest snapshot plus the entries appended after it.
+package spend
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultSnapshotEvery is the number of entries between two snapshots
+const DefaultSnapshotEvery = 100
+
+var (
+	// ErrCampaignNotFound is returned when appending to an unknown campaign
+	ErrCampaignNotFound = errors.New("campaign not found")
+	// ErrIdempotencyConflict is returned when an idempotency key is reused
+	// for a different entry
+	ErrIdempotencyConflict = errors.New("idempotency key already used for a different entry")
+)
+
+// Entry is a spend change of a campaign, in the campaign currency. Corrections
+// are entries with a negative amount.
+type Entry struct {
+	ID             int64     `json:"id"`
+	CampaignID     int64     `json:"campaign_id"`
+	Amount         float64   `json:"amount"`
+	Source         string    `json:"source"` // e.g. manual, meta_sync
+	IdempotencyKey string    `json:"idempotency_key"`
+	Actor          string    `json:"actor"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func (e Entry) Validate() error {
+	switch {
+	case e.CampaignID <= 0:
+		return errors.New("campaign_id must be positive")
+	case e.Amount == 0:
+		return errors.New("amount must not be zero")
+	case e.Source == "":
+		return errors.New("source is required")
+	case e.IdempotencyKey == "":
+		return errors.New("idempotency_key is required")
+	case e.Actor == "":
+		return errors.New("actor is required")
+	}
+	return nil
+}
+
+// same tells whether o records the same change as e, ignoring what Append sets
+func (e Entry) same(o Entry) bool {
+	return e.CampaignID == o.CampaignID && e.Amount == o.Amount && e.Source == o.Source && e.Actor == o.Actor
+}
+
+// roundCents rounds an amount to the cents stored by spend_ledger, so that a
+// retried entry compares equal to the stored one
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// Snapshot is the spend of a campaign up to and including entry LastEntryID
+type Snapshot struct {
+	CampaignID  int64     `json:"campaign_id"`
+	Total       float64   `json:"total"`
+	LastEntryID int64     `json:"last_entry_id"`
+	TakenAt     time.Time `json:"taken_at"`
+}
+
+// Ledger stores spend entries
+type Ledger interface {
+	// Append stores e, setting its ID and CreatedAt. An entry with the same
+	// campaign and idempotency key is not stored twice: Append returns the
+	// stored one and false, or ErrIdempotencyConflict when it differs.
+	Append(ctx context.Context, e Entry) (Entry, bool, error)
+	// Total returns the current spend of a campaign
+	Total(ctx context.Context, campaignID int64) (float64, error)
+	// History returns up to limit entries of a campaign with an ID above
+	// afterID, oldest first
+	History(ctx context.Context, campaignID, afterID int64, limit int) ([]Entry, error)
+}
+
+// MemoryLedger keeps entries in memory, for tests and local development. Any
+// campaign ID is accepted.
+type MemoryLedger struct {
+	mu        sync.RWMutex
+	every     int
+	entries   map[int64][]Entry
+	snapshots map[int64]Snapshot
+	lastID    int64
+}
+
+// NewMemoryLedger snapshots a campaign every `every` entries,
+// DefaultSnapshotEvery when 0
+func NewMemoryLedger(every int) *MemoryLedger {
+	if every <= 0 {
+		every = DefaultSnapshotEvery
+	}
+	return &MemoryLedger{every: every, entries: make(map[int64][]Entry), snapshots: make(map[int64]Snapshot)}
+}
+
+func (l *MemoryLedger) Append(_ context.Context, e Entry) (Entry, bool, error) {
+	e.Amount = roundCents(e.Amount)
+	if err := e.Validate(); err != nil {
+		return Entry{}, false, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := l.entries[e.CampaignID]
+	for _, old := range entries {
+		if old.IdempotencyKey == e.IdempotencyKey {
+			if !old.same(e) {
+				return old, false, ErrIdempotencyConflict
+			}
+			return old, false, nil
+		}
+	}
+	l.lastID++
+	e.ID = l.lastID
+	e.CreatedAt = time.Now().UTC()
+	entries = append(entries, e)
+	l.entries[e.CampaignID] = entries
+
+	snap := l.snapshots[e.CampaignID]
+	if since := entriesAfter(entries, snap.LastEntryID); len(since) >= l.every {
+		l.snapshots[e.CampaignID] = Snapshot{
+			CampaignID:  e.CampaignID,
+			Total:       roundCents(snap.Total + sum(since)),
+			LastEntryID: e.ID,
+			TakenAt:     e.CreatedAt,
+		}
+	}
+	return e, true, nil
+}
+
+func (l *MemoryLedger) Total(_ context.Context, campaignID int64) (float64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	snap := l.snapshots[campaignID]
+	return roundCents(snap.Total + sum(entriesAfter(l.entries[campaignID], snap.LastEntryID))), nil
+}
+
+func (l *MemoryLedger) History(_ context.Context, campaignID, afterID int64, limit int) ([]Entry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	out := append([]Entry(nil), entriesAfter(l.entries[campaignID], afterID)...)
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// entriesAfter returns the entries with an ID above id; entries are in ID order
+func entriesAfter(entries []Entry, id int64) []Entry {
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].ID > id })
+	return entries[i:]
+}
+
+func sum(entries []Entry) float64 {
+	var total float64
+	for _, e := range entries {
+		total += e.Amount
+	}
+	return total
+}
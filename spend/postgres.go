@@ -0,0 +1,177 @@
+package spend
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PostgresLedger keeps entries in the spend_ledger table, which rejects
+// updates and deletes, and snapshots in spend_snapshots:
+//
+//	CREATE TABLE spend_ledger (
+//	    entry_id        BIGSERIAL      PRIMARY KEY,
+//	    campaign_id     INT            NOT NULL REFERENCES campaigns(campaign_id),
+//	    amount          DECIMAL(12, 2) NOT NULL CHECK (amount <> 0),
+//	    source          VARCHAR(50)    NOT NULL,
+//	    idempotency_key VARCHAR(255)   NOT NULL,
+//	    actor           VARCHAR(255)   NOT NULL,
+//	    created_at      TIMESTAMP      NOT NULL,
+//	    UNIQUE (campaign_id, idempotency_key)
+//	);
+//	CREATE INDEX spend_ledger_campaign_entry ON spend_ledger (campaign_id, entry_id);
+//	CREATE TABLE spend_snapshots (
+//	    campaign_id   INT            PRIMARY KEY REFERENCES campaigns(campaign_id),
+//	    total         DECIMAL(14, 2) NOT NULL,
+//	    last_entry_id BIGINT         NOT NULL,
+//	    taken_at      TIMESTAMP      NOT NULL
+//	);
+//
+// Appends lock the campaign row, so a campaign's entry IDs are committed in
+// order and a snapshot never misses an entry below its last_entry_id.
+type PostgresLedger struct {
+	db    *sql.DB
+	every int
+}
+
+// NewPostgresLedger snapshots a campaign every `every` entries,
+// DefaultSnapshotEvery when 0
+func NewPostgresLedger(db *sql.DB, every int) *PostgresLedger {
+	if every <= 0 {
+		every = DefaultSnapshotEvery
+	}
+	return &PostgresLedger{db: db, every: every}
+}
+
+const entryColumns = "entry_id, campaign_id, amount, source, idempotency_key, actor, created_at"
+
+func (l *PostgresLedger) Append(ctx context.Context, e Entry) (Entry, bool, error) {
+	e.Amount = roundCents(e.Amount)
+	if err := e.Validate(); err != nil {
+		return Entry{}, false, err
+	}
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Entry{}, false, errors.Wrap(err, "begin transaction")
+	}
+	defer tx.Rollback()
+
+	var one int
+	err = tx.QueryRowContext(ctx, "SELECT 1 FROM campaigns WHERE campaign_id = $1 FOR UPDATE", e.CampaignID).Scan(&one)
+	if err == sql.ErrNoRows {
+		return Entry{}, false, ErrCampaignNotFound
+	}
+	if err != nil {
+		return Entry{}, false, errors.Wrap(err, "lock campaign")
+	}
+
+	e.CreatedAt = time.Now().UTC()
+	err = tx.QueryRowContext(ctx, `
+INSERT INTO spend_ledger (campaign_id, amount, source, idempotency_key, actor, created_at)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (campaign_id, idempotency_key) DO NOTHING
+RETURNING entry_id`, e.CampaignID, e.Amount, e.Source, e.IdempotencyKey, e.Actor, e.CreatedAt).Scan(&e.ID)
+	if err == sql.ErrNoRows {
+		old, err := scanEntry(tx.QueryRowContext(ctx,
+			"SELECT "+entryColumns+" FROM spend_ledger WHERE campaign_id = $1 AND idempotency_key = $2",
+			e.CampaignID, e.IdempotencyKey))
+		if err != nil {
+			return Entry{}, false, err
+		}
+		if !old.same(e) {
+			return old, false, ErrIdempotencyConflict
+		}
+		return old, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, errors.Wrap(err, "insert spend entry")
+	}
+
+	if err := l.snapshot(ctx, tx, e); err != nil {
+		return Entry{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Entry{}, false, errors.Wrap(err, "commit transaction")
+	}
+	return e, true, nil
+}
+
+// snapshot moves the campaign snapshot to e once `every` entries followed it
+func (l *PostgresLedger) snapshot(ctx context.Context, tx *sql.Tx, e Entry) error {
+	var total float64
+	var lastID int64
+	err := tx.QueryRowContext(ctx,
+		"SELECT total, last_entry_id FROM spend_snapshots WHERE campaign_id = $1", e.CampaignID).Scan(&total, &lastID)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrap(err, "query spend snapshot")
+	}
+	var count int
+	var since float64
+	err = tx.QueryRowContext(ctx, `
+SELECT COUNT(*), COALESCE(SUM(amount), 0)
+FROM spend_ledger
+WHERE campaign_id = $1 AND entry_id > $2 AND entry_id <= $3`, e.CampaignID, lastID, e.ID).Scan(&count, &since)
+	if err != nil {
+		return errors.Wrap(err, "sum spend entries")
+	}
+	if count < l.every {
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, `
+INSERT INTO spend_snapshots (campaign_id, total, last_entry_id, taken_at)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (campaign_id) DO UPDATE
+SET total = EXCLUDED.total, last_entry_id = EXCLUDED.last_entry_id, taken_at = EXCLUDED.taken_at`,
+		e.CampaignID, total+since, e.ID, e.CreatedAt)
+	return errors.Wrap(err, "upsert spend snapshot")
+}
+
+func (l *PostgresLedger) Total(ctx context.Context, campaignID int64) (float64, error) {
+	var total float64
+	err := l.db.QueryRowContext(ctx, `
+SELECT COALESCE(MAX(s.total), 0) + COALESCE(SUM(l.amount), 0)
+FROM (SELECT $1::INT AS campaign_id) c
+LEFT JOIN spend_snapshots s ON s.campaign_id = c.campaign_id
+LEFT JOIN spend_ledger l ON l.campaign_id = c.campaign_id AND l.entry_id > COALESCE(s.last_entry_id, 0)`,
+		campaignID).Scan(&total)
+	return total, errors.Wrap(err, "query spend total")
+}
+
+func (l *PostgresLedger) History(ctx context.Context, campaignID, afterID int64, limit int) ([]Entry, error) {
+	query := "SELECT " + entryColumns + " FROM spend_ledger WHERE campaign_id = $1 AND entry_id > $2 ORDER BY entry_id"
+	args := []interface{}{campaignID, afterID}
+	if limit > 0 {
+		query += " LIMIT $3"
+		args = append(args, limit)
+	}
+	rows, err := l.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query spend history")
+	}
+	defer rows.Close()
+	var out []Entry
+	for rows.Next() {
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, errors.Wrap(rows.Err(), "iterate spend history")
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEntry(row scanner) (Entry, error) {
+	var e Entry
+	err := row.Scan(&e.ID, &e.CampaignID, &e.Amount, &e.Source, &e.IdempotencyKey, &e.Actor, &e.CreatedAt)
+	if err != nil {
+		return Entry{}, errors.Wrap(err, "scan spend entry")
+	}
+	e.CreatedAt = e.CreatedAt.UTC()
+	return e, nil
+}
@@ -0,0 +1,168 @@
+package spool
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"campaign-analytics/sink"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	forwardBatchSize  = 500
+	forwardMinBackoff = time.Second
+	forwardMaxBackoff = 30 * time.Second
+	forwardPoll       = 5 * time.Second
+	// forwardMaxAttempts is the number of writes of a batch before its
+	// messages are tried one at a time, see Forward
+	forwardMaxAttempts = 10
+
+	// DeadLetterFile is the file of the spool directory receiving, as JSON
+	// lines, the messages the primary sink would not take
+	DeadLetterFile = "dead-letter.ndjson"
+)
+
+// forwardWriteTimeout bounds each write of the one-at-a-time fallback, so a
+// sink hanging on a message fails it instead of stalling the spool
+var forwardWriteTimeout = 10 * time.Second
+
+// deadLetter is a line of DeadLetterFile
+type deadLetter struct {
+	record
+	Error  string    `json:"error"`
+	DeadAt time.Time `json:"dead_at"`
+}
+
+// Forward drains the spool into dst in order until ctx is done. Delivery is
+// at-least-once: a crash between the write and the cursor commit re-sends the batch.
+//
+// A batch failing forwardMaxAttempts times in a row is written one message at
+// a time. Messages the sink rejects for good go to DeadLetterFile; the first
+// message failing otherwise, as in an outage, stops the pass and stays in the
+// spool with the ones after it, so temporary failures never dead-letter.
+func (s *Spool) Forward(ctx context.Context, dst sink.EventSink) {
+	backoff := forwardMinBackoff
+	attempts := 0
+	for {
+		recs, ends, err := s.peek(forwardBatchSize)
+		if err != nil {
+			log.Printf("spool: read: %v", err)
+		}
+		if len(recs) == 0 || err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.notify:
+			case <-time.After(forwardPoll):
+			}
+			continue
+		}
+
+		msgs := make([]kafka.Message, len(recs))
+		for i, rec := range recs {
+			msgs[i] = kafka.Message{Key: rec.Key, Value: rec.Value, Headers: rec.Headers}
+		}
+		err = dst.Write(ctx, msgs...)
+		if err != nil {
+			attempts++
+		}
+		if err != nil && attempts >= forwardMaxAttempts && ctx.Err() == nil {
+			var n int
+			n, err = s.forwardEach(ctx, dst, recs, msgs)
+			if err != nil && n > 0 {
+				// Keep the progress, the next pass starts at the failed message
+				if err := s.commit(ends[n-1], n); err != nil {
+					log.Printf("spool: commit: %v", err)
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("spool: forward %d messages: %v (attempt %d, retrying in %s)", len(msgs), err, attempts, backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > forwardMaxBackoff {
+				backoff = forwardMaxBackoff
+			}
+			continue
+		}
+		backoff = forwardMinBackoff
+		attempts = 0
+
+		if err := s.commit(ends[len(ends)-1], len(recs)); err != nil {
+			log.Printf("spool: commit: %v", err)
+		}
+	}
+}
+
+// forwardEach writes msgs one at a time, each within forwardWriteTimeout, and
+// dead-letters those failing with a permanent error. It stops at the first
+// message failing with another error and returns it with the number of
+// messages before it, delivered or dead-lettered.
+func (s *Spool) forwardEach(ctx context.Context, dst sink.EventSink, recs []record, msgs []kafka.Message) (int, error) {
+	var (
+		dead []deadLetter
+		n    int
+		err  error
+	)
+	for ; n < len(msgs); n++ {
+		wctx, cancel := context.WithTimeout(ctx, forwardWriteTimeout)
+		werr := dst.Write(wctx, msgs[n])
+		cancel()
+		if werr == nil {
+			continue
+		}
+		if !isPermanent(werr) {
+			err = werr
+			break
+		}
+		dead = append(dead, deadLetter{record: recs[n], Error: werr.Error(), DeadAt: time.Now().UTC()})
+	}
+	if derr := s.deadLetter(dead); derr != nil {
+		return 0, derr
+	}
+	if len(dead) > 0 {
+		log.Printf("spool: moved %d of %d messages to %s", len(dead), len(msgs), DeadLetterFile)
+	}
+	return n, err
+}
+
+// isPermanent reports whether the sink rejected a message for good, such as
+// one too large for the topic
+func isPermanent(err error) bool {
+	var kerr kafka.Error
+	return errors.As(err, &kerr) && !kerr.Temporary()
+}
+
+// deadLetter appends records to the dead-letter file, synced before the
+// cursor moves past them
+func (s *Spool) deadLetter(dead []deadLetter) error {
+	if len(dead) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, DeadLetterFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "open dead-letter file")
+	}
+	enc := json.NewEncoder(f)
+	for _, d := range dead {
+		if err := enc.Encode(d); err != nil {
+			f.Close()
+			return errors.Wrap(err, "write dead-letter file")
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "sync dead-letter file")
+	}
+	return errors.Wrap(f.Close(), "close dead-letter file")
+}
@@ -0,0 +1,46 @@
+package spool
+
+import (
+	"context"
+	"time"
+
+	"campaign-analytics/sink"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Sink writes to a primary sink and falls back to the spool when the primary
+// fails or does not answer within the timeout. While the spool holds messages
+// new writes go straight to it so ordering is preserved. A write that timed out
+// may still have reached the primary, so spooled messages can be delivered
+// twice; consumers dedupe on the event_id header.
+type Sink struct {
+	primary sink.EventSink
+	spool   *Spool
+	timeout time.Duration
+}
+
+func NewSink(primary sink.EventSink, sp *Spool, timeout time.Duration) *Sink {
+	return &Sink{primary: primary, spool: sp, timeout: timeout}
+}
+
+func (s *Sink) Write(ctx context.Context, msgs ...kafka.Message) error {
+	if s.spool.Depth() == 0 {
+		wctx, cancel := context.WithTimeout(ctx, s.timeout)
+		err := s.primary.Write(wctx, msgs...)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return s.spool.Append(msgs...)
+}
+
+// Close closes the spool. The forwarder must be stopped first and the primary
+// sink is left to its owner.
+func (s *Sink) Close() error {
+	return s.spool.Close()
+}
@@ -0,0 +1,376 @@
+// Package spool implements a disk-backed write-ahead spool that buffers
+// messages while the primary sink (Kafka) is unavailable and forwards them
+// in order once it is back.
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	segmentExt          = ".seg"
+	cursorFile          = "cursor"
+	frameHeaderSize     = 8 // uint32 length + uint32 crc32
+	DefaultSegmentBytes = 64 << 20
+)
+
+// ErrFull is returned by Append once the spool reached its size cap
+var ErrFull = errors.New("spool is full")
+
+type record struct {
+	Time    time.Time      `json:"time"`
+	Key     []byte         `json:"key,omitempty"`
+	Value   []byte         `json:"value"`
+	Headers []kafka.Header `json:"headers,omitempty"`
+}
+
+// position points at a frame inside a segment
+type position struct {
+	segment int64
+	offset  int64
+}
+
+// Spool stores messages in numbered append-only segment files. Messages are
+// read back in the order they were appended, starting at a persisted cursor.
+type Spool struct {
+	mu           sync.Mutex
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+
+	segments []int64 // ids of segments still on disk, oldest first; the last one is active
+	active   *os.File
+	activeSz int64
+	cursor   position
+	depth    int64 // unforwarded messages
+	size     int64 // bytes on disk
+	notify   chan struct{}
+}
+
+// Open opens (or creates) a spool in dir. maxBytes caps the bytes kept on disk.
+func Open(dir string, maxBytes, segmentBytes int64) (*Spool, error) {
+	if segmentBytes <= 0 {
+		segmentBytes = DefaultSegmentBytes
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrap(err, "create spool dir")
+	}
+	s := &Spool{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		notify:       make(chan struct{}, 1),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load discovers existing segments, restores the cursor and counts pending messages
+func (s *Spool) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return errors.Wrap(err, "read spool dir")
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, id)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	if b, err := os.ReadFile(filepath.Join(s.dir, cursorFile)); err == nil {
+		fmt.Sscanf(string(b), "%d %d", &s.cursor.segment, &s.cursor.offset)
+	}
+	if len(s.segments) > 0 && s.cursor.segment < s.segments[0] {
+		s.cursor = position{segment: s.segments[0]}
+	}
+
+	// Drop segments the cursor already moved past
+	for len(s.segments) > 0 && s.segments[0] < s.cursor.segment {
+		os.Remove(s.segmentPath(s.segments[0]))
+		s.segments = s.segments[1:]
+	}
+
+	for _, id := range s.segments {
+		start := int64(0)
+		if id == s.cursor.segment {
+			start = s.cursor.offset
+		}
+		n, end, err := s.scanSegment(id, start)
+		if err != nil {
+			return err
+		}
+		s.depth += n
+		s.size += end
+	}
+	return nil
+}
+
+// scanSegment counts valid frames from offset and truncates a torn tail
+func (s *Spool) scanSegment(id, offset int64) (int64, int64, error) {
+	f, err := os.OpenFile(s.segmentPath(id), os.O_RDWR, 0o644)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "open segment")
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, 0, errors.Wrap(err, "seek segment")
+	}
+	r := bufio.NewReader(f)
+	var n int64
+	for {
+		_, sz, err := readFrame(r)
+		if err != nil {
+			break
+		}
+		n++
+		offset += sz
+	}
+	if err := f.Truncate(offset); err != nil {
+		return 0, 0, errors.Wrap(err, "truncate segment")
+	}
+	return n, offset, nil
+}
+
+func (s *Spool) segmentPath(id int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// rotate closes the active segment and starts a new one
+func (s *Spool) rotate() error {
+	if s.active != nil {
+		if err := s.active.Close(); err != nil {
+			return errors.Wrap(err, "close segment")
+		}
+	}
+	id := int64(1)
+	if len(s.segments) > 0 {
+		id = s.segments[len(s.segments)-1] + 1
+	}
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "create segment")
+	}
+	s.segments = append(s.segments, id)
+	s.active = f
+	s.activeSz = 0
+	if len(s.segments) == 1 {
+		s.cursor = position{segment: id}
+	}
+	return nil
+}
+
+// Append durably writes msgs to the spool as a unit
+func (s *Spool) Append(msgs ...kafka.Message) error {
+	var buf []byte
+	now := time.Now().UTC()
+	for _, msg := range msgs {
+		payload, err := json.Marshal(record{Time: now, Key: msg.Key, Value: msg.Value, Headers: msg.Headers})
+		if err != nil {
+			return errors.Wrap(err, "encode record")
+		}
+		var hdr [frameHeaderSize]byte
+		binary.BigEndian.PutUint32(hdr[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(hdr[4:8], crc32.ChecksumIEEE(payload))
+		buf = append(append(buf, hdr[:]...), payload...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active == nil {
+		return errors.New("spool closed")
+	}
+	if s.maxBytes > 0 && s.size+int64(len(buf)) > s.maxBytes {
+		return ErrFull
+	}
+	if s.activeSz > 0 && s.activeSz+int64(len(buf)) > s.segmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.active.Write(buf); err != nil {
+		return errors.Wrap(err, "write segment")
+	}
+	if err := s.active.Sync(); err != nil {
+		return errors.Wrap(err, "sync segment")
+	}
+	s.activeSz += int64(len(buf))
+	s.size += int64(len(buf))
+	s.depth += int64(len(msgs))
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Depth returns the number of messages waiting to be forwarded
+func (s *Spool) Depth() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.depth
+}
+
+// peek reads up to max records from the cursor without consuming them. ends
+// holds the position following each record, to commit up to it.
+func (s *Spool) peek(max int) (recs []record, ends []position, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pos := s.cursor
+	for len(recs) < max && s.depth > int64(len(recs)) {
+		f, err := os.Open(s.segmentPath(pos.segment))
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "open segment")
+		}
+		if _, err := f.Seek(pos.offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, nil, errors.Wrap(err, "seek segment")
+		}
+		r := bufio.NewReader(f)
+		for len(recs) < max {
+			rec, sz, err := readFrame(r)
+			if err != nil {
+				break
+			}
+			recs = append(recs, rec)
+			pos.offset += sz
+			ends = append(ends, pos)
+		}
+		f.Close()
+
+		if len(recs) < max && pos.segment != s.segments[len(s.segments)-1] {
+			// End of a sealed segment, continue with the next one
+			pos = position{segment: s.nextSegment(pos.segment)}
+			continue
+		}
+		break
+	}
+	return recs, ends, nil
+}
+
+func (s *Spool) nextSegment(id int64) int64 {
+	for _, seg := range s.segments {
+		if seg > id {
+			return seg
+		}
+	}
+	return id
+}
+
+// commit advances the cursor past n forwarded records and deletes drained segments
+func (s *Spool) commit(pos position, n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp := filepath.Join(s.dir, cursorFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d", pos.segment, pos.offset)), 0o644); err != nil {
+		return errors.Wrap(err, "write cursor")
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, cursorFile)); err != nil {
+		return errors.Wrap(err, "rename cursor")
+	}
+	s.cursor = pos
+	s.depth -= int64(n)
+
+	for len(s.segments) > 1 && s.segments[0] < pos.segment {
+		path := s.segmentPath(s.segments[0])
+		if fi, err := os.Stat(path); err == nil {
+			s.size -= fi.Size()
+		}
+		os.Remove(path)
+		s.segments = s.segments[1:]
+	}
+	// Start a fresh active segment once everything in it was forwarded
+	if s.depth == 0 && s.activeSz > 0 && pos.segment == s.segments[len(s.segments)-1] {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		os.Remove(s.segmentPath(s.segments[0]))
+		s.segments = s.segments[1:]
+		s.size = 0
+		s.cursor = position{segment: s.segments[0]}
+	}
+	return nil
+}
+
+// Stats reports spool depth and the age of the oldest pending message
+type Stats struct {
+	DepthMessages    int64   `json:"depth_messages"`
+	DepthBytes       int64   `json:"depth_bytes"`
+	MaxBytes         int64   `json:"max_bytes"`
+	OldestAgeSeconds float64 `json:"oldest_age_seconds"`
+}
+
+func (s *Spool) Stats() Stats {
+	st := Stats{MaxBytes: s.maxBytes}
+	recs, _, _ := s.peek(1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st.DepthMessages = s.depth
+	st.DepthBytes = s.size
+	if len(recs) > 0 {
+		st.OldestAgeSeconds = time.Since(recs[0].Time).Seconds()
+	}
+	return st
+}
+
+// Close closes the active segment
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.active = nil
+	return err
+}
+
+// readFrame reads a single frame, returning the decoded record and its size on disk
+func readFrame(r io.Reader) (record, int64, error) {
+	var hdr [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return record{}, 0, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(hdr[0:4]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return record{}, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return record{}, 0, errors.New("corrupt frame")
+	}
+	var rec record
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return record{}, 0, errors.Wrap(err, "decode record")
+	}
+	return rec, int64(frameHeaderSize + len(payload)), nil
+}
@@ -0,0 +1,264 @@
+package spool
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func messages(values ...string) []kafka.Message {
+	msgs := make([]kafka.Message, len(values))
+	for i, v := range values {
+		msgs[i] = kafka.Message{Key: []byte("c1"), Value: []byte(v)}
+	}
+	return msgs
+}
+
+func values(recs []record) []string {
+	var out []string
+	for _, rec := range recs {
+		out = append(out, string(rec.Value))
+	}
+	return out
+}
+
+func open(t *testing.T, dir string, maxBytes int64) *Spool {
+	t.Helper()
+	s, err := Open(dir, maxBytes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func pending(t *testing.T, s *Spool) []string {
+	t.Helper()
+	recs, _, err := s.peek(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values(recs)
+}
+
+// A frame failing its CRC, as after a torn write, is cut off with the frames
+// after it when the spool is opened again
+func TestCorruptFrame(t *testing.T) {
+	dir := t.TempDir()
+	s := open(t, dir, 0)
+	if err := s.Append(messages("a", "b", "c")...); err != nil {
+		t.Fatal(err)
+	}
+	_, ends, err := s.peek(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Flip the last payload byte of b
+	path := s.segmentPath(ends[1].segment)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[ends[1].offset-1] ^= 0xff
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s = open(t, dir, 0)
+	if got := pending(t, s); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("pending %v, want [a]", got)
+	}
+	if s.Depth() != 1 {
+		t.Fatalf("depth %d, want 1", s.Depth())
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != ends[0].offset {
+		t.Fatalf("segment not truncated after a (%v)", err)
+	}
+
+	// The spool goes on appending after the valid frames
+	if err := s.Append(messages("d")...); err != nil {
+		t.Fatal(err)
+	}
+	if got := pending(t, s); !reflect.DeepEqual(got, []string{"a", "d"}) {
+		t.Fatalf("pending %v, want [a d]", got)
+	}
+}
+
+func TestFull(t *testing.T) {
+	s := open(t, t.TempDir(), 0)
+	if err := s.Append(messages("a")...); err != nil {
+		t.Fatal(err)
+	}
+	frame := s.Stats().DepthBytes
+
+	// Room for two frames, whose timestamps may be a few bytes longer
+	s = open(t, t.TempDir(), 2*frame+16)
+	if err := s.Append(messages("a", "b")...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(messages("c")...); err != ErrFull {
+		t.Fatalf("got %v, want ErrFull", err)
+	}
+	if got := pending(t, s); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("pending %v, want [a b]", got)
+	}
+
+	// Forwarding frees the space
+	_, ends, _ := s.peek(2)
+	if err := s.commit(ends[1], 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(messages("c")...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testSink records delivered messages and fails those whose value is in fail
+type testSink struct {
+	mu        sync.Mutex
+	delivered []string
+	fail      map[string]error
+}
+
+func (s *testSink) Write(ctx context.Context, msgs ...kafka.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range msgs {
+		err := s.fail[string(msg.Value)]
+		if err == errHang {
+			<-ctx.Done()
+			err = ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, msg := range msgs {
+		s.delivered = append(s.delivered, string(msg.Value))
+	}
+	return nil
+}
+
+func (s *testSink) Close() error { return nil }
+
+// errHang makes testSink block until the write's context is done
+var errHang = errors.New("hang")
+
+func TestForward(t *testing.T) {
+	s := open(t, t.TempDir(), 0)
+	if err := s.Append(messages("a", "b", "c")...); err != nil {
+		t.Fatal(err)
+	}
+	dst := &testSink{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Forward(ctx, dst)
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); s.Depth() > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	if !reflect.DeepEqual(dst.delivered, []string{"a", "b", "c"}) || s.Depth() != 0 {
+		t.Fatalf("delivered %v, depth %d", dst.delivered, s.Depth())
+	}
+}
+
+func deadLetters(t *testing.T, dir string) []string {
+	t.Helper()
+	f, err := os.Open(filepath.Join(dir, DeadLetterFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var d deadLetter
+		if err := json.Unmarshal(sc.Bytes(), &d); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, fmt.Sprintf("%s: %s", d.Value, d.Error))
+	}
+	return out
+}
+
+// The one-at-a-time fallback dead-letters messages rejected for good and
+// stops at a temporary failure, the rest staying in the spool
+func TestForwardEach(t *testing.T) {
+	defer func(d time.Duration) { forwardWriteTimeout = d }(forwardWriteTimeout)
+	forwardWriteTimeout = 50 * time.Millisecond
+
+	tooLarge := fmt.Sprintf("b: %v", kafka.MessageSizeTooLarge)
+	for _, tc := range []struct {
+		name      string
+		fail      map[string]error
+		n         int
+		err       error
+		delivered []string
+		dead      []string
+		pending   []string
+	}{
+		{"delivered", nil, 4, nil, []string{"a", "b", "c", "d"}, nil, nil},
+		{"rejected", map[string]error{"b": kafka.MessageSizeTooLarge}, 4, nil,
+			[]string{"a", "c", "d"}, []string{tooLarge}, nil},
+		{"unavailable", map[string]error{"a": kafka.LeaderNotAvailable}, 0, kafka.LeaderNotAvailable,
+			nil, nil, []string{"a", "b", "c", "d"}},
+		{"rejected then unavailable", map[string]error{"b": kafka.MessageSizeTooLarge, "c": kafka.NotEnoughReplicas}, 2, kafka.NotEnoughReplicas,
+			[]string{"a"}, []string{tooLarge}, []string{"c", "d"}},
+		{"hanging", map[string]error{"c": errHang}, 2, context.DeadlineExceeded,
+			[]string{"a", "b"}, nil, []string{"c", "d"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := open(t, dir, 0)
+			if err := s.Append(messages("a", "b", "c", "d")...); err != nil {
+				t.Fatal(err)
+			}
+			recs, ends, err := s.peek(forwardBatchSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs := messages(values(recs)...)
+			dst := &testSink{fail: tc.fail}
+
+			// As Forward does after a batch failed forwardMaxAttempts times
+			n, err := s.forwardEach(context.Background(), dst, recs, msgs)
+			if n != tc.n || !errors.Is(err, tc.err) {
+				t.Fatalf("got %d, %v, want %d, %v", n, err, tc.n, tc.err)
+			}
+			if n > 0 {
+				if err := s.commit(ends[n-1], n); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !reflect.DeepEqual(dst.delivered, tc.delivered) {
+				t.Errorf("delivered %v, want %v", dst.delivered, tc.delivered)
+			}
+			if got := deadLetters(t, dir); !reflect.DeepEqual(got, tc.dead) {
+				t.Errorf("dead letters %v, want %v", got, tc.dead)
+			}
+			if got := pending(t, s); !reflect.DeepEqual(got, tc.pending) {
+				t.Errorf("pending %v, want %v", got, tc.pending)
+			}
+		})
+	}
+}
@@ -1,20 +1,63 @@
 package utils
 
-import "campaign-analytics/models"
+import (
+	"campaign-analytics/fx"
+	"campaign-analytics/models"
+	"fmt"
+	"time"
+)
 
+// ComputeMetrics leaves out the ratios whose denominator is zero, which would
+// be NaN or Inf and cannot be encoded as JSON
 func ComputeMetrics(data models.CampaignData) map[string]float64 {
-	ctr := float64(data.Clicks) / float64(data.Impressions)
-	cpa := data.Cost / float64(data.Conversions)
-	roas := data.Revenue / data.Cost
-
-	return map[string]float64{
-		"CTR":   ctr,
-		"CPA":   cpa,
-		"ROAS":  roas,
+	metrics := map[string]float64{
 		"Spend": data.Cost,
 	}
+	if data.Impressions > 0 {
+		metrics["CTR"] = float64(data.Clicks) / float64(data.Impressions)
+	}
+	if data.Conversions > 0 {
+		metrics["CPA"] = data.Cost / float64(data.Conversions)
+	}
+	if data.Cost > 0 {
+		metrics["ROAS"] = data.Revenue / data.Cost
+	}
+	if data.Reach > 0 {
+		metrics["Reach"] = float64(data.Reach)
+		metrics["Frequency"] = float64(data.Impressions) / float64(data.Reach)
+	}
+	return metrics
 }
 
 func ValidateToken(token string) bool {
 	return token == "valid_token"
 }
+
+// ConvertCampaignData converts Cost and Revenue into the given currency at the
+// rates of date. Data without a currency is assumed to already be in it.
+func ConvertCampaignData(data models.CampaignData, rates *fx.Store, currency string, date time.Time) (models.CampaignData, error) {
+	if data.Currency == "" || data.Currency == currency {
+		data.Currency = currency
+		return data, nil
+	}
+	if rates == nil {
+		return models.CampaignData{}, fmt.Errorf("no FX rates to convert %s to %s", data.Currency, currency)
+	}
+	rate, err := rates.Rate(date, data.Currency, currency)
+	if err != nil {
+		return models.CampaignData{}, err
+	}
+	data.Cost *= rate
+	data.Revenue *= rate
+	data.Currency = currency
+	return data, nil
+}
+
+// ComputeMetricsIn computes metrics with monetary values in the reporting currency
+func ComputeMetricsIn(data models.CampaignData, rates *fx.Store, currency string, date time.Time) (map[string]float64, error) {
+	data, err := ConvertCampaignData(data, rates, currency, date)
+	if err != nil {
+		return nil, err
+	}
+	return ComputeMetrics(data), nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"campaign-analytics/schema"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	maxWebhookBodyBytes = 1 << 20 // 1 MB
+	// webhookMaxSkew bounds the age of a signed TikTok timestamp to limit replays
+	webhookMaxSkew = 5 * time.Minute
+)
+
+var errBadSignature = errors.New("invalid signature")
+
+// webhookSecret holds the per-platform credentials of a webhook subscription
+type webhookSecret struct {
+	Secret      string // HMAC key used to sign request bodies
+	VerifyToken string // token echoed back during the subscription handshake
+}
+
+// webhookPlatform describes how a platform signs, verifies and shapes its pushes
+type webhookPlatform struct {
+	// verify checks the request signature over the raw body
+	verify func(r *http.Request, body []byte, secret []byte) error
+	// translate turns a verified payload into campaign data records
+	translate func(body []byte) ([]schema.CampaignData, error)
+}
+
+var webhookPlatforms = map[string]webhookPlatform{
+	"meta":   {verify: verifyMetaSignature, translate: translateMetaPayload},
+	"tiktok": {verify: verifyTikTokSignature, translate: translateTikTokPayload},
+}
+
+// loadWebhookSecrets reads <PLATFORM>_WEBHOOK_SECRET and <PLATFORM>_WEBHOOK_VERIFY_TOKEN.
+// Platforms without a secret get no webhook endpoint.
+func loadWebhookSecrets() map[string]webhookSecret {
+	secrets := make(map[string]webhookSecret)
+	for name := range webhookPlatforms {
+		prefix := strings.ToUpper(name) + "_WEBHOOK_"
+		if secret := os.Getenv(prefix + "SECRET"); secret != "" {
+			secrets[name] = webhookSecret{Secret: secret, VerifyToken: os.Getenv(prefix + "VERIFY_TOKEN")}
+		}
+	}
+	return secrets
+}
+
+// webhookHandler serves /webhooks/<platform>: GET answers the subscription
+// handshake, POST verifies the signature and forwards the translated records.
+func (s *ingestServer) webhookHandler(name string, secret webhookSecret) http.HandlerFunc {
+	platform := webhookPlatforms[name]
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			webhookChallenge(w, r, secret.VerifyToken)
+			return
+		case http.MethodPost:
+		default:
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if err := platform.verify(r, body, []byte(secret.Secret)); err != nil {
+			log.Printf("webhook %s: %v", name, err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		records, err := platform.translate(body)
+		if err != nil {
+			http.Error(w, "Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var (
+			msgs []kafka.Message
+			keys []string
+		)
+		release := func(err error) {
+			for _, key := range keys {
+				if err != nil {
+					s.dedup.Abort(r.Context(), key)
+				} else {
+					s.dedup.Complete(r.Context(), key, DedupResult{StatusCode: http.StatusAccepted, Body: []byte("Data ingested successfully")})
+				}
+			}
+		}
+		for _, data := range records {
+			if err := schema.Validate(&data); err != nil {
+				// A single bad entry should not make the platform retry the whole push
+				log.Printf("webhook %s: dropping record for campaign %q: %v", name, data.CampaignID, err)
+				continue
+			}
+			if data.EventID != "" {
+				prev, err := s.dedup.Begin(r.Context(), data.EventID)
+				if err != nil {
+					// Another delivery of the record is still in progress, or the
+					// store is down: the platform redelivers the push later
+					log.Printf("webhook %s: dedup %q: %v", name, data.EventID, err)
+					release(err)
+					http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				if prev != nil {
+					continue // already ingested
+				}
+				keys = append(keys, data.EventID)
+			}
+			msg, err := newCampaignMessage(data, s.encoding)
+			if err != nil {
+				release(err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			msgs = append(msgs, msg)
+		}
+
+		if len(msgs) > 0 {
+			err = s.sink.Write(r.Context(), msgs...)
+		}
+		release(err)
+		if err != nil {
+			// Non-2xx makes the platform redeliver later
+			http.Error(w, "Failed to write to sink", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// webhookChallenge answers the subscription handshake. Meta sends
+// hub.mode/hub.verify_token/hub.challenge, TikTok verify_token/challenge.
+func webhookChallenge(w http.ResponseWriter, r *http.Request, verifyToken string) {
+	q := r.URL.Query()
+	token, challenge := q.Get("hub.verify_token"), q.Get("hub.challenge")
+	if mode := q.Get("hub.mode"); mode == "" {
+		token, challenge = q.Get("verify_token"), q.Get("challenge")
+	} else if mode != "subscribe" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if verifyToken == "" || !hmac.Equal([]byte(token), []byte(verifyToken)) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(challenge))
+}
+
+// verifyMetaSignature checks X-Hub-Signature-256: sha256=<hex hmac of body>
+func verifyMetaSignature(r *http.Request, body []byte, secret []byte) error {
+	sig, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	if !ok {
+		return errBadSignature
+	}
+	return checkHMAC(secret, body, sig)
+}
+
+// verifyTikTokSignature checks TikTok-Signature: t=<unix>,s=<hex hmac of "t.body">
+func verifyTikTokSignature(r *http.Request, body []byte, secret []byte) error {
+	var ts, sig string
+	for _, part := range strings.Split(r.Header.Get("TikTok-Signature"), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "s":
+			sig = v
+		}
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return errBadSignature
+	}
+	if d := time.Since(time.Unix(sec, 0)); d > webhookMaxSkew || d < -webhookMaxSkew {
+		return fmt.Errorf("signature timestamp %s outside tolerance", ts)
+	}
+	return checkHMAC(secret, append([]byte(ts+"."), body...), sig)
+}
+
+func checkHMAC(secret, payload []byte, hexSig string) error {
+	got, err := hex.DecodeString(hexSig)
+	if err != nil {
+		return errBadSignature
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// metaPayload is the subset of a Meta ad account insights push we consume.
+// Meta sends metric values as strings.
+type metaPayload struct {
+	Object string `json:"object"`
+	Entry  []struct {
+		ID      string `json:"id"`
+		Time    int64  `json:"time"`
+		Changes []struct {
+			Field string `json:"field"`
+			Value struct {
+				CampaignID      string `json:"campaign_id"`
+				Impressions     string `json:"impressions"`
+				Clicks          string `json:"clicks"`
+				Conversions     string `json:"conversions"`
+				Spend           string `json:"spend"`
+				ConversionValue string `json:"conversion_value"`
+				AccountCurrency string `json:"account_currency"`
+				DateStart       string `json:"date_start"` // day the totals cover
+			} `json:"value"`
+		} `json:"changes"`
+	} `json:"entry"`
+}
+
+func translateMetaPayload(body []byte) ([]schema.CampaignData, error) {
+	var p metaPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	var out []schema.CampaignData
+	for _, e := range p.Entry {
+		for _, c := range e.Changes {
+			if c.Field != "insights" {
+				continue
+			}
+			v := c.Value
+			data := schema.CampaignData{
+				CampaignID: v.CampaignID,
+				Platform:   "meta",
+				Timestamp:  e.Time,
+				Currency:   v.AccountCurrency,
+			}
+			// A malformed metric rejects the push rather than being ingested as 0
+			var err error
+			if data.Impressions, err = atoi("impressions", v.Impressions); err != nil {
+				return nil, err
+			}
+			if data.Clicks, err = atoi("clicks", v.Clicks); err != nil {
+				return nil, err
+			}
+			if data.Conversions, err = atoi("conversions", v.Conversions); err != nil {
+				return nil, err
+			}
+			if data.Cost, err = atof("spend", v.Spend); err != nil {
+				return nil, err
+			}
+			if data.Revenue, err = atof("conversion_value", v.ConversionValue); err != nil {
+				return nil, err
+			}
+			// Insights are the day's totals so far: a later push restates the day
+			if v.DateStart != "" {
+				if _, err := time.Parse(schema.DateLayout, v.DateStart); err != nil {
+					return nil, fmt.Errorf("invalid date_start %q for campaign %q", v.DateStart, v.CampaignID)
+				}
+				data.ReportDate = v.DateStart
+				data.Level = schema.LevelCampaign
+			}
+			// Meta redelivers the same entry on failure; id+time+campaign identifies it
+			data.EventID = fmt.Sprintf("meta:%s:%d:%s", e.ID, e.Time, v.CampaignID)
+			out = append(out, data)
+		}
+	}
+	return out, nil
+}
+
+// tiktokPayload is the subset of a TikTok campaign metrics push we consume
+type tiktokPayload struct {
+	EventID   string `json:"event_id"`
+	Event     string `json:"event"`
+	Timestamp int64  `json:"timestamp"`
+	Content   []struct {
+		CampaignID string `json:"campaign_id"`
+		Metrics    struct {
+			Impressions int     `json:"impressions"`
+			Clicks      int     `json:"clicks"`
+			Conversion  int     `json:"conversion"`
+			Spend       float64 `json:"spend"`
+			Revenue     float64 `json:"total_purchase_value"`
+			Currency    string  `json:"currency"`
+		} `json:"metrics"`
+	} `json:"content"`
+}
+
+func translateTikTokPayload(body []byte) ([]schema.CampaignData, error) {
+	var p tiktokPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	out := make([]schema.CampaignData, 0, len(p.Content))
+	for _, c := range p.Content {
+		data := schema.CampaignData{
+			CampaignID:  c.CampaignID,
+			Platform:    "tiktok",
+			Timestamp:   p.Timestamp,
+			Impressions: c.Metrics.Impressions,
+			Clicks:      c.Metrics.Clicks,
+			Conversions: c.Metrics.Conversion,
+			Cost:        c.Metrics.Spend,
+			Revenue:     c.Metrics.Revenue,
+			Currency:    c.Metrics.Currency,
+		}
+		if p.EventID != "" {
+			data.EventID = "tiktok:" + p.EventID + ":" + c.CampaignID
+		}
+		out = append(out, data)
+	}
+	return out, nil
+}
+
+// atoi parses a Meta metric; Meta leaves out metrics that are zero
+func atoi(field, s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", field, s)
+	}
+	return n, nil
+}
+
+func atof(field, s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", field, s)
+	}
+	return f, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"campaign-analytics/codec"
+	"campaign-analytics/schema"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// testSink records the messages written to it, failing with err when set
+type testSink struct {
+	mu   sync.Mutex
+	msgs []kafka.Message
+	err  error
+}
+
+func (s *testSink) Write(_ context.Context, msgs ...kafka.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.msgs = append(s.msgs, msgs...)
+	return nil
+}
+
+func (s *testSink) Close() error { return nil }
+
+func (s *testSink) records(t *testing.T) []schema.CampaignData {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []schema.CampaignData
+	for _, msg := range s.msgs {
+		d, err := codec.DecodeCampaignData(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+const testSecret = "s3cret"
+
+func hexHMAC(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func metaSignature(secret string, body []byte) string {
+	return "sha256=" + hexHMAC(secret, body)
+}
+
+func tiktokSignature(secret string, ts time.Time, body []byte) string {
+	t := fmt.Sprint(ts.Unix())
+	return "t=" + t + ",s=" + hexHMAC(secret, append([]byte(t+"."), body...))
+}
+
+func TestWebhookSignatures(t *testing.T) {
+	body := []byte(`{"entry":[]}`)
+	now := time.Now()
+	for _, tc := range []struct {
+		name   string
+		verify func(r *http.Request, body []byte, secret []byte) error
+		header string
+		value  string
+		ok     bool
+	}{
+		{"meta", verifyMetaSignature, "X-Hub-Signature-256", metaSignature(testSecret, body), true},
+		{"meta other secret", verifyMetaSignature, "X-Hub-Signature-256", metaSignature("other", body), false},
+		{"meta other body", verifyMetaSignature, "X-Hub-Signature-256", metaSignature(testSecret, []byte("{}")), false},
+		{"meta without prefix", verifyMetaSignature, "X-Hub-Signature-256", hexHMAC(testSecret, body), false},
+		{"meta missing", verifyMetaSignature, "", "", false},
+		{"tiktok", verifyTikTokSignature, "TikTok-Signature", tiktokSignature(testSecret, now, body), true},
+		{"tiktok skewed", verifyTikTokSignature, "TikTok-Signature", tiktokSignature(testSecret, now.Add(-4*time.Minute), body), true},
+		{"tiktok other secret", verifyTikTokSignature, "TikTok-Signature", tiktokSignature("other", now, body), false},
+		{"tiktok stale", verifyTikTokSignature, "TikTok-Signature", tiktokSignature(testSecret, now.Add(-10*time.Minute), body), false},
+		{"tiktok future", verifyTikTokSignature, "TikTok-Signature", tiktokSignature(testSecret, now.Add(10*time.Minute), body), false},
+		{"tiktok without timestamp", verifyTikTokSignature, "TikTok-Signature", "s=" + hexHMAC(testSecret, body), false},
+		{"tiktok missing", verifyTikTokSignature, "", "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tc.header != "" {
+				r.Header.Set(tc.header, tc.value)
+			}
+			if err := tc.verify(r, body, []byte(testSecret)); (err == nil) != tc.ok {
+				t.Fatalf("got %v, want ok %v", err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestWebhookChallenge(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		query string
+		token string
+		code  int
+	}{
+		{"meta", "hub.mode=subscribe&hub.verify_token=tok&hub.challenge=abc", "tok", http.StatusOK},
+		{"meta wrong token", "hub.mode=subscribe&hub.verify_token=bad&hub.challenge=abc", "tok", http.StatusForbidden},
+		{"meta other mode", "hub.mode=unsubscribe&hub.verify_token=tok&hub.challenge=abc", "tok", http.StatusBadRequest},
+		{"tiktok", "verify_token=tok&challenge=abc", "tok", http.StatusOK},
+		{"tiktok wrong token", "verify_token=bad&challenge=abc", "tok", http.StatusForbidden},
+		{"no token configured", "verify_token=&challenge=abc", "", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			webhookChallenge(w, httptest.NewRequest(http.MethodGet, "/?"+tc.query, nil), tc.token)
+			if w.Code != tc.code {
+				t.Fatalf("status %d, want %d", w.Code, tc.code)
+			}
+			if tc.code == http.StatusOK && w.Body.String() != "abc" {
+				t.Fatalf("body %q, want the challenge", w.Body.String())
+			}
+		})
+	}
+}
+
+func metaPush(ts int64, day string) []byte {
+	return []byte(fmt.Sprintf(`{"object":"ad_account","entry":[{"id":"act_1","time":%d,"changes":[
+{"field":"insights","value":{"campaign_id":"c1","impressions":"100","clicks":"10","spend":"1.50","conversion_value":"","account_currency":"EUR","date_start":%q}},
+{"field":"ads","value":{"campaign_id":"c2","impressions":"5"}}]}]}`, ts, day))
+}
+
+func TestTranslateMetaPayload(t *testing.T) {
+	got, err := translateMetaPayload(metaPush(1700000000, "2023-11-14"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []schema.CampaignData{{
+		CampaignID:  "c1",
+		Platform:    "meta",
+		Timestamp:   1700000000,
+		Impressions: 100,
+		Clicks:      10,
+		Cost:        1.5,
+		Currency:    "EUR",
+		ReportDate:  "2023-11-14",
+		Level:       schema.LevelCampaign,
+		EventID:     "meta:act_1:1700000000:c1",
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	for name, body := range map[string]string{
+		"malformed metric": `{"entry":[{"changes":[{"field":"insights","value":{"campaign_id":"c1","clicks":"1,000"}}]}]}`,
+		"malformed day":    `{"entry":[{"changes":[{"field":"insights","value":{"campaign_id":"c1","date_start":"14/11/2023"}}]}]}`,
+		"malformed JSON":   `{"entry":`,
+	} {
+		if _, err := translateMetaPayload([]byte(body)); err == nil {
+			t.Errorf("%s: translated", name)
+		}
+	}
+}
+
+func TestTranslateTikTokPayload(t *testing.T) {
+	got, err := translateTikTokPayload([]byte(`{"event_id":"ev1","event":"campaign.metrics","timestamp":1700000000,"content":[
+{"campaign_id":"c1","metrics":{"impressions":100,"clicks":10,"conversion":2,"spend":3.5,"total_purchase_value":20,"currency":"USD"}},
+{"campaign_id":"c2","metrics":{"impressions":7}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []schema.CampaignData{
+		{CampaignID: "c1", Platform: "tiktok", Timestamp: 1700000000, Impressions: 100, Clicks: 10, Conversions: 2, Cost: 3.5, Revenue: 20, Currency: "USD", EventID: "tiktok:ev1:c1"},
+		{CampaignID: "c2", Platform: "tiktok", Timestamp: 1700000000, Impressions: 7, EventID: "tiktok:ev1:c2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	// Without an event_id the records are not deduplicated
+	got, err = translateTikTokPayload([]byte(`{"timestamp":1700000000,"content":[{"campaign_id":"c1"}]}`))
+	if err != nil || len(got) != 1 || got[0].EventID != "" {
+		t.Fatalf("got %+v (%v), want a record without event ID", got, err)
+	}
+}
+
+// failingDedup fails every Begin with err
+type failingDedup struct {
+	DedupStore
+	err error
+}
+
+func (d failingDedup) Begin(context.Context, string) (*DedupResult, error) {
+	return nil, d.err
+}
+
+func TestWebhookHandler(t *testing.T) {
+	now := time.Now().UTC()
+	body := metaPush(now.Add(-time.Minute).Unix(), now.Format(schema.DateLayout))
+	eventID := fmt.Sprintf("meta:act_1:%d:c1", now.Add(-time.Minute).Unix())
+	post := func(h http.Handler, sig string) int {
+		r := httptest.NewRequest(http.MethodPost, "/webhooks/meta", strings.NewReader(string(body)))
+		r.Header.Set("X-Hub-Signature-256", sig)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	hooks := map[string]webhookSecret{"meta": {Secret: testSecret, VerifyToken: "tok"}}
+	signed := metaSignature(testSecret, body)
+
+	t.Run("delivered once", func(t *testing.T) {
+		data := &testSink{}
+		h := newIngestHandler(data, &testSink{}, NewMemoryDedupStore(time.Hour, 100), codec.JSON, hooks)
+		if code := post(h, metaSignature("other", body)); code != http.StatusUnauthorized {
+			t.Fatalf("unsigned push: status %d", code)
+		}
+		for i := 0; i < 2; i++ {
+			if code := post(h, signed); code != http.StatusOK {
+				t.Fatalf("push %d: status %d", i, code)
+			}
+		}
+		recs := data.records(t)
+		if len(recs) != 1 || recs[0].CampaignID != "c1" || recs[0].EventID != eventID {
+			t.Fatalf("ingested %+v, want c1 once", recs)
+		}
+	})
+
+	t.Run("in flight", func(t *testing.T) {
+		data := &testSink{}
+		dedup := NewMemoryDedupStore(time.Hour, 100)
+		dedup.Begin(context.Background(), eventID)
+		h := newIngestHandler(data, &testSink{}, dedup, codec.JSON, hooks)
+		if code := post(h, signed); code != http.StatusServiceUnavailable {
+			t.Fatalf("status %d, want 503", code)
+		}
+		// Once the other delivery gave up, the redelivery goes through
+		dedup.Abort(context.Background(), eventID)
+		if code := post(h, signed); code != http.StatusOK || len(data.records(t)) != 1 {
+			t.Fatalf("redelivery: status %d, %d records", code, len(data.records(t)))
+		}
+	})
+
+	t.Run("store down", func(t *testing.T) {
+		data := &testSink{}
+		h := newIngestHandler(data, &testSink{}, failingDedup{err: errors.New("connection refused")}, codec.JSON, hooks)
+		if code := post(h, signed); code != http.StatusServiceUnavailable || len(data.msgs) != 0 {
+			t.Fatalf("status %d, %d messages, want 503 and none", code, len(data.msgs))
+		}
+	})
+
+	t.Run("sink down", func(t *testing.T) {
+		data := &testSink{err: errors.New("broker unavailable")}
+		h := newIngestHandler(data, &testSink{}, NewMemoryDedupStore(time.Hour, 100), codec.JSON, hooks)
+		if code := post(h, signed); code != http.StatusServiceUnavailable {
+			t.Fatalf("status %d, want 503", code)
+		}
+		// The reservation was released for the redelivery
+		data.err = nil
+		if code := post(h, signed); code != http.StatusOK || len(data.records(t)) != 1 {
+			t.Fatalf("redelivery: status %d, %d records", code, len(data.records(t)))
+		}
+	})
+}